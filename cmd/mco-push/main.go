@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/component-base/cli"
+
+	versioncmd "github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/version"
+)
+
+var (
+	rootCmd = &cobra.Command{
+		Use:   "mco-push",
+		Short: "Replaces, reverts, or restarts the MCO image on a running OpenShift cluster",
+		Long:  "",
+	}
+)
+
+func init() {
+	rootCmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+	rootCmd.AddCommand(versioncmd.Command())
+}
+
+func main() {
+	os.Exit(cli.Run(rootCmd))
+}
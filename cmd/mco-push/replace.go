@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type replaceOpts struct {
+	forceRestart      bool
+	overwriteSnapshot bool
+	rolloutTimeout    time.Duration
+	skipPrechecks     bool
+	snapshotPath      string
+}
+
+func init() {
+	opts := replaceOpts{}
+
+	replaceCmd := &cobra.Command{
+		Use:   "replace <pullspec>",
+		Short: "Replaces the MCO image, rolling back if anything fails",
+		Long:  "",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return replace(args[0], opts)
+		},
+	}
+
+	replaceCmd.PersistentFlags().BoolVar(&opts.skipPrechecks, "skip-prechecks", false, "Skips the cluster health prechecks (e.g., degraded ClusterOperators or pools, nodes which are not Ready) which otherwise stop the replacement.")
+	replaceCmd.PersistentFlags().BoolVar(&opts.forceRestart, "force-restart", false, "Deletes the MCO pods after updating each component.")
+	replaceCmd.PersistentFlags().DurationVar(&opts.rolloutTimeout, "rollout-timeout", 0, "How long to wait for the new image to roll out before rolling back. Requires a digested pullspec. Zero means do not wait.")
+	replaceCmd.PersistentFlags().StringVar(&opts.snapshotPath, "snapshot-file", "", "Where to write the pre-replacement snapshot for a later revert. Defaults to the user cache dir.")
+	replaceCmd.PersistentFlags().BoolVar(&opts.overwriteSnapshot, "overwrite-snapshot", false, "Overwrites the snapshot left by a previous replace which has not been reverted. The overwritten snapshot cannot be restored afterward.")
+
+	rootCmd.AddCommand(replaceCmd)
+}
+
+func replace(pullspec string, opts replaceOpts) error {
+	snapshotPath, err := getSnapshotPath(opts.snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureSnapshotCanBeWritten(snapshotPath, opts.overwriteSnapshot); err != nil {
+		return err
+	}
+
+	cs := framework.NewClientSet("")
+
+	err = rollout.ReplaceMCOImageWithOpts(cs, rollout.ReplaceOpts{
+		Pullspec:       pullspec,
+		ForceRestart:   opts.forceRestart,
+		SnapshotPath:   snapshotPath,
+		RolloutTimeout: opts.rolloutTimeout,
+		SkipPrechecks:  opts.skipPrechecks,
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not replace MCO image with %s: %w", pullspec, err)
+	}
+
+	klog.Infof("Replaced MCO image with %s; run \"mco-push revert --from-snapshot\" to undo", pullspec)
+	return nil
+}
+
+func getSnapshotPath(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	return rollout.DefaultMCOImageSnapshotPath()
+}
+
+// Determines whether the snapshot can be written to the given path. A
+// snapshot left behind by a previous replace records the cluster state from
+// before that replace, so overwriting it would lose the original MCO images
+// and CVO replica count.
+func ensureSnapshotCanBeWritten(path string, overwrite bool) error {
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not check for existing snapshot %s: %w", path, err)
+	}
+
+	if overwrite {
+		klog.Warningf("Overwriting existing snapshot %s", path)
+		return nil
+	}
+
+	return fmt.Errorf("snapshot %s from a previous replace already exists; run \"mco-push revert --from-snapshot\" first or use --overwrite-snapshot to replace it", path)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type restartOpts struct {
+	components   []string
+	forceRestart bool
+	timeout      time.Duration
+}
+
+func (r *restartOpts) validate() error {
+	if r.forceRestart && len(r.components) != 0 {
+		return fmt.Errorf("--force and --component are mutually exclusive")
+	}
+
+	if r.timeout <= 0 {
+		return fmt.Errorf("--timeout must be positive")
+	}
+
+	return nil
+}
+
+func init() {
+	opts := restartOpts{}
+
+	restartCmd := &cobra.Command{
+		Use:   "restart",
+		Short: "Restarts the MCO components",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return restart(opts)
+		},
+	}
+
+	restartCmd.PersistentFlags().StringSliceVar(&opts.components, "component", []string{}, fmt.Sprintf("The MCO component(s) to restart. Defaults to all of them. One of: %s", strings.Join(rollout.GetMCOComponentNames(), ", ")))
+	restartCmd.PersistentFlags().BoolVar(&opts.forceRestart, "force", false, "Deletes the MCO pods instead of updating the deployments and daemonsets.")
+	restartCmd.PersistentFlags().DurationVar(&opts.timeout, "timeout", 10*time.Minute, "How long to wait for the restarted components to become ready.")
+
+	rootCmd.AddCommand(restartCmd)
+}
+
+func restart(opts restartOpts) error {
+	cs := framework.NewClientSet("")
+
+	if opts.forceRestart {
+		return rollout.RestartMCO(cs, true)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	if err := rollout.RestartMCOComponents(ctx, cs, rollout.RestartOpts{Components: opts.components}); err != nil {
+		return fmt.Errorf("could not restart MCO components: %w", err)
+	}
+
+	klog.Infof("Restarted MCO components")
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+)
+
+type revertOpts struct {
+	forceRestart  bool
+	fromSnapshot  bool
+	skipPrechecks bool
+	snapshotPath  string
+}
+
+func init() {
+	opts := revertOpts{}
+
+	revertCmd := &cobra.Command{
+		Use:   "revert",
+		Short: "Reverts the MCO image to the one in the cluster release or to a previously taken snapshot",
+		Long:  "",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return revert(opts)
+		},
+	}
+
+	revertCmd.PersistentFlags().BoolVar(&opts.skipPrechecks, "skip-prechecks", false, "Skips the cluster health prechecks. Failed prechecks never stop a revert; they are only reported.")
+	revertCmd.PersistentFlags().BoolVar(&opts.forceRestart, "force-restart", false, "Deletes the MCO pods after updating each component.")
+	revertCmd.PersistentFlags().BoolVar(&opts.fromSnapshot, "from-snapshot", false, "Restores the snapshot written by a previous replace instead of the image from the cluster release.")
+	revertCmd.PersistentFlags().StringVar(&opts.snapshotPath, "snapshot-file", "", "The snapshot to restore when --from-snapshot is used. Defaults to the user cache dir.")
+
+	rootCmd.AddCommand(revertCmd)
+}
+
+func revert(opts revertOpts) error {
+	revertOpts := rollout.RevertOpts{
+		ForceRestart:  opts.forceRestart,
+		SkipPrechecks: opts.skipPrechecks,
+	}
+
+	if opts.fromSnapshot {
+		snapshotPath, err := getSnapshotPath(opts.snapshotPath)
+		if err != nil {
+			return err
+		}
+
+		revertOpts.SnapshotPath = snapshotPath
+	}
+
+	return rollout.RevertMCOImageWithOpts(framework.NewClientSet(""), revertOpts)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/spf13/cobra"
+)
+
+type diffOpts struct {
+	exitCode bool
+}
+
+func init() {
+	opts := diffOpts{}
+
+	diffCmd := &cobra.Command{
+		Use:   "diff <before-dir> <after-dir>",
+		Short: "Shows what changed between two cluster snapshots",
+		Long:  "",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return diff(args[0], args[1], opts)
+		},
+	}
+
+	diffCmd.PersistentFlags().BoolVar(&opts.exitCode, "exit-code", false, "Exits non-zero if the snapshots differ.")
+
+	rootCmd.AddCommand(diffCmd)
+}
+
+func diff(beforeDir, afterDir string, opts diffOpts) error {
+	before, err := rollout.LoadClusterSnapshot(beforeDir)
+	if err != nil {
+		return err
+	}
+
+	after, err := rollout.LoadClusterSnapshot(afterDir)
+	if err != nil {
+		return err
+	}
+
+	result := rollout.DiffClusterSnapshots(before, after)
+
+	fmt.Print(result)
+
+	if opts.exitCode && !result.IsEmpty() {
+		return fmt.Errorf("snapshots %s and %s differ", beforeDir, afterDir)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type takeOpts struct {
+	timeout time.Duration
+}
+
+func init() {
+	opts := takeOpts{}
+
+	takeCmd := &cobra.Command{
+		Use:   "take <dir>",
+		Short: "Snapshots the MCO-related cluster state to a directory",
+		Long:  "",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return take(args[0], opts)
+		},
+	}
+
+	takeCmd.PersistentFlags().DurationVar(&opts.timeout, "timeout", 2*time.Minute, "How long to wait for the snapshot to be taken.")
+
+	rootCmd.AddCommand(takeCmd)
+}
+
+func take(dir string, opts takeOpts) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	snapshot, err := rollout.TakeClusterSnapshot(ctx, framework.NewClientSet(""))
+	if err != nil {
+		return fmt.Errorf("could not take cluster snapshot: %w", err)
+	}
+
+	if err := snapshot.WriteToDir(dir); err != nil {
+		return fmt.Errorf("could not write cluster snapshot: %w", err)
+	}
+
+	klog.Infof("Wrote cluster snapshot to %s", dir)
+	return nil
+}
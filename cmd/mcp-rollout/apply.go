@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type applyOpts struct {
+	deleteOnFailure    bool
+	files              []string
+	json               bool
+	revertTimeout      time.Duration
+	skipPrechecks      bool
+	stuckNodeThreshold time.Duration
+	timeout            time.Duration
+}
+
+func (a *applyOpts) validate() error {
+	if len(a.files) == 0 {
+		return fmt.Errorf("at least one --file must be provided")
+	}
+
+	if a.stuckNodeThreshold < 0 {
+		return fmt.Errorf("--stuck-node-threshold must not be negative")
+	}
+
+	return nil
+}
+
+func (a *applyOpts) toRolloutApplyOpts() rollout.ApplyOpts {
+	opts := rollout.ApplyOpts{
+		WaitOpts: rollout.WaitOpts{
+			StuckNodeThreshold: a.stuckNodeThreshold,
+		},
+		DeleteOnFailure: a.deleteOnFailure,
+		RevertTimeout:   a.revertTimeout,
+	}
+
+	if a.json {
+		opts.ProgressHandler = rollout.NewJSONLinesProgressHandler(os.Stdout)
+	}
+
+	return opts
+}
+
+func init() {
+	opts := applyOpts{}
+
+	applyCmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Applies MachineConfigs and waits for the pools they target to roll them out",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return applyMachineConfigs(opts)
+		},
+	}
+
+	applyCmd.PersistentFlags().BoolVar(&opts.deleteOnFailure, "delete-on-failure", false, "If the rollout fails, deletes the applied MachineConfigs (or restores their previous versions) and waits for the pools to roll back.")
+	applyCmd.PersistentFlags().StringSliceVarP(&opts.files, "file", "f", []string{}, "Path to a YAML or JSON file containing one or more MachineConfigs. May be given multiple times.")
+	applyCmd.PersistentFlags().BoolVar(&opts.json, "json", false, "Writes progress events to stdout as JSON lines.")
+	applyCmd.PersistentFlags().DurationVar(&opts.revertTimeout, "revert-timeout", 30*time.Minute, "How long to wait for the pools to roll back when --delete-on-failure is used.")
+	applyCmd.PersistentFlags().BoolVar(&opts.skipPrechecks, "skip-prechecks", false, "Skips the cluster health prechecks (e.g., degraded ClusterOperators or pools, nodes which are not Ready) which otherwise stop the command.")
+	applyCmd.PersistentFlags().DurationVar(&opts.stuckNodeThreshold, "stuck-node-threshold", 20*time.Minute, "Warns when a node stays in a single phase (e.g., Draining, Rebooting) for longer than this. Set to 0 to disable.")
+	applyCmd.PersistentFlags().DurationVar(&opts.timeout, "timeout", time.Hour, "How long to wait for the pools to finish updating.")
+
+	rootCmd.AddCommand(applyCmd)
+}
+
+func applyMachineConfigs(opts applyOpts) error {
+	mcs, err := rollout.LoadMachineConfigsFromFiles(opts.files)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	cs := framework.NewClientSet("")
+
+	if err := rollout.EnforcePrechecks(ctx, cs, opts.skipPrechecks); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	klog.Infof("Applying %d MachineConfig(s) and waiting up to %s for them to roll out", len(mcs), opts.timeout)
+
+	if err := rollout.ApplyMachineConfigsAndWait(ctx, cs, mcs, opts.toRolloutApplyOpts()); err != nil {
+		return err
+	}
+
+	klog.Infof("MachineConfig(s) rolled out after %s", time.Since(start))
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/errors"
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type canaryOpts struct {
+	batchSize          int
+	canaryNodes        []string
+	healthCheck        string
+	healthCheckTimeout time.Duration
+	json               bool
+	pool               string
+	skipPrechecks      bool
+	stuckNodeThreshold time.Duration
+	timeout            time.Duration
+}
+
+func (c *canaryOpts) validate() error {
+	if c.batchSize < 1 {
+		return fmt.Errorf("--batch-size must be at least 1")
+	}
+
+	if c.stuckNodeThreshold < 0 {
+		return fmt.Errorf("--stuck-node-threshold must not be negative")
+	}
+
+	return nil
+}
+
+func (c *canaryOpts) toRolloutCanaryOpts() rollout.CanaryOpts {
+	opts := rollout.CanaryOpts{
+		WaitOpts: rollout.WaitOpts{
+			StuckNodeThreshold: c.stuckNodeThreshold,
+		},
+		CanaryNodes: c.canaryNodes,
+		BatchSize:   c.batchSize,
+	}
+
+	if c.json {
+		opts.ProgressHandler = rollout.NewJSONLinesProgressHandler(os.Stdout)
+	}
+
+	if c.healthCheck != "" {
+		opts.HealthCheck = c.runHealthCheck
+	}
+
+	return opts
+}
+
+// Runs the health check command in a shell. The names of the nodes in the
+// batch are passed via the CANARY_NODES env var as a comma-separated list.
+func (c *canaryOpts) runHealthCheck(ctx context.Context, nodes []string) error {
+	if c.healthCheckTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.healthCheckTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c.healthCheck)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("CANARY_NODES=%s", strings.Join(nodes, ",")))
+
+	klog.Infof("Running %s", cmd)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.NewExecError(cmd, out, err)
+	}
+
+	klog.Infof("Health check output:\n%s", strings.TrimSpace(string(out)))
+	return nil
+}
+
+func init() {
+	opts := canaryOpts{}
+
+	canaryCmd := &cobra.Command{
+		Use:   "canary",
+		Short: "Rolls out a pool's pending config in batches, starting with canary nodes",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runCanaryRollout(opts)
+		},
+	}
+
+	canaryCmd.PersistentFlags().IntVar(&opts.batchSize, "batch-size", 1, "How many nodes to update in each batch after the canary batch.")
+	canaryCmd.PersistentFlags().StringSliceVar(&opts.canaryNodes, "canary-node", []string{}, "The node(s) to update in the first batch. Defaults to the first --batch-size nodes which need to be updated.")
+	canaryCmd.PersistentFlags().StringVar(&opts.healthCheck, "health-check", "", "A shell command to run after each batch finishes updating. The node names are passed via the CANARY_NODES env var. A non-zero exit aborts the rollout.")
+	canaryCmd.PersistentFlags().DurationVar(&opts.healthCheckTimeout, "health-check-timeout", 10*time.Minute, "How long each health check may run for. Set to 0 to disable.")
+	canaryCmd.PersistentFlags().BoolVar(&opts.json, "json", false, "Writes progress events to stdout as JSON lines.")
+	canaryCmd.PersistentFlags().StringVar(&opts.pool, "pool", "worker", "The MachineConfigPool to roll out. Only the worker pool is currently supported.")
+	canaryCmd.PersistentFlags().BoolVar(&opts.skipPrechecks, "skip-prechecks", false, "Skips the cluster health prechecks (e.g., degraded ClusterOperators or pools, nodes which are not Ready) which otherwise stop the command.")
+	canaryCmd.PersistentFlags().DurationVar(&opts.stuckNodeThreshold, "stuck-node-threshold", 20*time.Minute, "Warns when a node stays in a single phase (e.g., Draining, Rebooting) for longer than this. Set to 0 to disable.")
+	canaryCmd.PersistentFlags().DurationVar(&opts.timeout, "timeout", 3*time.Hour, "How long to wait for every batch to finish updating.")
+
+	rootCmd.AddCommand(canaryCmd)
+}
+
+func runCanaryRollout(opts canaryOpts) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	cs := framework.NewClientSet("")
+
+	if err := rollout.EnforcePrechecks(ctx, cs, opts.skipPrechecks); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	klog.Infof("Rolling out MachineConfigPool %s in batches of %d, waiting up to %s", opts.pool, opts.batchSize, opts.timeout)
+
+	if err := rollout.RolloutInBatches(ctx, cs, opts.pool, opts.toRolloutCanaryOpts()); err != nil {
+		return err
+	}
+
+	klog.Infof("MachineConfigPool %s rolled out after %s", opts.pool, time.Since(start))
+	return nil
+}
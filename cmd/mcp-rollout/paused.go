@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type unpauseOpts struct {
+	dryRun    bool
+	olderThan time.Duration
+	pools     []string
+}
+
+func (u *unpauseOpts) validate() error {
+	if u.olderThan < 0 {
+		return fmt.Errorf("--older-than must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	pausedCmd := &cobra.Command{
+		Use:   "paused",
+		Short: "Finds and unpauses MachineConfigPools left paused by these helpers",
+		Long:  "",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the MachineConfigPools paused by these helpers",
+		Long:  "",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return listPausedPools()
+		},
+	}
+
+	opts := unpauseOpts{}
+
+	unpauseCmd := &cobra.Command{
+		Use:   "unpause",
+		Short: "Unpauses the MachineConfigPools paused by these helpers",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return unpausePools(opts)
+		},
+	}
+
+	unpauseCmd.PersistentFlags().BoolVar(&opts.dryRun, "dry-run", false, "Lists the MachineConfigPools that would be unpaused without unpausing them.")
+	unpauseCmd.PersistentFlags().DurationVar(&opts.olderThan, "older-than", 0, "Only unpauses MachineConfigPools which were paused at least this long ago.")
+	unpauseCmd.PersistentFlags().StringSliceVar(&opts.pools, "pool", []string{}, "The MachineConfigPool(s) to unpause. Defaults to all pools paused by these helpers.")
+
+	pausedCmd.AddCommand(listCmd)
+	pausedCmd.AddCommand(unpauseCmd)
+
+	rootCmd.AddCommand(pausedCmd)
+}
+
+func listPausedPools() error {
+	records, err := utils.ListMachineConfigPoolsPausedByUs(context.Background(), framework.NewClientSet(""))
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		klog.Infof("No MachineConfigPools paused by these helpers")
+		return nil
+	}
+
+	for _, record := range records {
+		fmt.Fprintln(os.Stdout, record.String())
+	}
+
+	return nil
+}
+
+func unpausePools(opts unpauseOpts) error {
+	bulkOpts := utils.BulkUnpauseOpts{
+		PoolNames: opts.pools,
+		OlderThan: opts.olderThan,
+		DryRun:    opts.dryRun,
+	}
+
+	unpaused, err := utils.UnpauseMachineConfigPoolsPausedByUs(context.Background(), framework.NewClientSet(""), bulkOpts)
+
+	verb := "Unpaused"
+	if opts.dryRun {
+		verb = "Would unpause"
+	}
+
+	for _, record := range unpaused {
+		fmt.Fprintf(os.Stdout, "%s %s\n", verb, record)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(unpaused) == 0 {
+		klog.Infof("No MachineConfigPools to unpause")
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type waitOpts struct {
+	imageDigest        string
+	json               bool
+	machineConfig      string
+	pools              []string
+	renderedConfig     string
+	skipPrechecks      bool
+	stuckNodeThreshold time.Duration
+	timeout            time.Duration
+	waitForBuild       bool
+	waitForUpdate      bool
+}
+
+func (w *waitOpts) validate() error {
+	// Each of these flags selects a different kind of wait which only applies
+	// to a single pool.
+	singlePoolFlags := map[string]bool{
+		"--image-digest":    w.imageDigest != "",
+		"--machine-config":  w.machineConfig != "",
+		"--rendered-config": w.renderedConfig != "",
+		"--wait-for-build":  w.waitForBuild,
+		"--wait-for-update": w.waitForUpdate,
+	}
+
+	set := []string{}
+	for flag, isSet := range singlePoolFlags {
+		if isSet {
+			set = append(set, flag)
+		}
+	}
+
+	sort.Strings(set)
+
+	if len(set) > 1 {
+		return fmt.Errorf("%s are mutually exclusive", strings.Join(set, ", "))
+	}
+
+	if len(set) == 1 && len(w.pools) != 1 {
+		return fmt.Errorf("%s requires exactly one --pool", set[0])
+	}
+
+	if w.stuckNodeThreshold < 0 {
+		return fmt.Errorf("--stuck-node-threshold must not be negative")
+	}
+
+	return nil
+}
+
+func (w *waitOpts) toRolloutWaitOpts() rollout.WaitOpts {
+	opts := rollout.WaitOpts{
+		StuckNodeThreshold: w.stuckNodeThreshold,
+	}
+
+	if w.json {
+		opts.ProgressHandler = rollout.NewJSONLinesProgressHandler(os.Stdout)
+	}
+
+	return opts
+}
+
+func init() {
+	opts := waitOpts{}
+
+	waitCmd := &cobra.Command{
+		Use:   "wait",
+		Short: "Waits for MachineConfigPools and their nodes to finish updating",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return waitForPools(opts)
+		},
+	}
+
+	waitCmd.PersistentFlags().StringVar(&opts.imageDigest, "image-digest", "", "Waits until every node in the pool is running an OS image with this digest. Accepts a bare digest or a digested pullspec.")
+	waitCmd.PersistentFlags().BoolVar(&opts.json, "json", false, "Writes progress events to stdout as JSON lines.")
+	waitCmd.PersistentFlags().StringVar(&opts.machineConfig, "machine-config", "", "Waits until the pool's rendered config includes this MachineConfig and every node in the pool is running it.")
+	waitCmd.PersistentFlags().StringSliceVar(&opts.pools, "pool", []string{}, "The MachineConfigPool(s) to wait on. Defaults to all pools.")
+	waitCmd.PersistentFlags().StringVar(&opts.renderedConfig, "rendered-config", "", "Waits until every node in the pool is running this rendered MachineConfig.")
+	waitCmd.PersistentFlags().BoolVar(&opts.skipPrechecks, "skip-prechecks", false, "Skips the cluster health prechecks (e.g., degraded ClusterOperators or pools, nodes which are not Ready) which otherwise stop the command.")
+	waitCmd.PersistentFlags().DurationVar(&opts.stuckNodeThreshold, "stuck-node-threshold", 20*time.Minute, "Warns when a node stays in a single phase (e.g., Draining, Rebooting) for longer than this. Set to 0 to disable.")
+	waitCmd.PersistentFlags().DurationVar(&opts.timeout, "timeout", time.Hour, "How long to wait for the pools to finish updating.")
+	waitCmd.PersistentFlags().BoolVar(&opts.waitForBuild, "wait-for-build", false, "For layered pools, waits for the MachineOSBuild to finish before waiting for the nodes to be running the built image.")
+	waitCmd.PersistentFlags().BoolVar(&opts.waitForUpdate, "wait-for-update", false, "Waits for the pool to begin updating before waiting for it to finish.")
+
+	rootCmd.AddCommand(waitCmd)
+}
+
+func waitForPools(opts waitOpts) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	cs := framework.NewClientSet("")
+
+	if err := rollout.EnforcePrechecks(ctx, cs, opts.skipPrechecks); err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	klog.Infof("Waiting up to %s for MachineConfigPool(s) to finish updating", opts.timeout)
+
+	var err error
+	switch {
+	case opts.renderedConfig != "":
+		err = rollout.WaitForPoolToReachRenderedConfig(ctx, cs, opts.pools[0], opts.renderedConfig, opts.toRolloutWaitOpts())
+	case opts.imageDigest != "":
+		err = rollout.WaitForPoolToReachImageDigest(ctx, cs, opts.pools[0], opts.imageDigest, opts.toRolloutWaitOpts())
+	case opts.machineConfig != "":
+		err = rollout.WaitForPoolToIncludeMachineConfig(ctx, cs, opts.pools[0], opts.machineConfig, opts.toRolloutWaitOpts())
+	case opts.waitForBuild:
+		err = rollout.WaitForMachineOSBuildAndRolloutWithOpts(ctx, cs, opts.pools[0], opts.toRolloutWaitOpts())
+	case opts.waitForUpdate:
+		err = rollout.WaitForMachineConfigPoolUpdateToCompleteWithOpts(ctx, cs, opts.pools[0], opts.toRolloutWaitOpts())
+	default:
+		err = rollout.WaitForMachineConfigPoolsToCompleteWithOpts(ctx, cs, opts.pools, opts.toRolloutWaitOpts())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("MachineConfigPool(s) finished updating after %s", time.Since(start))
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+func init() {
+	namespace := ""
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the ImageStreams and tags in a namespace",
+		Long:  "",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return listImageStreamTags(namespace)
+		},
+	}
+
+	listCmd.PersistentFlags().StringVar(&namespace, "namespace", ctrlcommon.MCONamespace, "The namespace whose ImageStreams should be listed.")
+
+	rootCmd.AddCommand(listCmd)
+}
+
+func listImageStreamTags(namespace string) error {
+	ctx := context.Background()
+
+	cs := framework.NewClientSet("")
+
+	q, err := utils.NewImageStreamQuery(cs)
+	if err != nil {
+		return err
+	}
+
+	tags, err := q.ListTags(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		klog.Infof("No tagged images found in namespace %q", namespace)
+		return nil
+	}
+
+	builds := getMachineOSBuildsByDigest(ctx, cs)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGESTREAMTAG\tDIGEST\tCREATED\tMACHINEOSBUILD")
+
+	for _, tag := range tags {
+		build := builds[tag.Digest]
+		if build == "" {
+			build = "-"
+		}
+
+		fmt.Fprintf(w, "%s:%s\t%s\t%s\t%s\n", tag.ImageStream, tag.Tag, tag.Digest, tag.Created.Format(time.RFC3339), build)
+	}
+
+	return w.Flush()
+}
+
+// Maps the digest of each image built by a MachineOSBuild to the name of the
+// MachineOSBuild which built it. Errors are logged rather than returned since
+// this is only informational.
+func getMachineOSBuildsByDigest(ctx context.Context, cs *framework.ClientSet) map[string]string {
+	out := map[string]string{}
+
+	mosbList, err := cs.MachineconfigurationV1Interface.MachineOSBuilds().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Could not list MachineOSBuilds: %s", err)
+		return out
+	}
+
+	for _, mosb := range mosbList.Items {
+		_, digest, ok := strings.Cut(string(mosb.Status.DigestedImagePushSpec), "@")
+		if ok {
+			out[digest] = mosb.Name
+		}
+	}
+
+	return out
+}
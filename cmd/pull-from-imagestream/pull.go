@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+func init() {
+	opts := registryOpts{}
+	dest := ""
+
+	pullCmd := &cobra.Command{
+		Use:   "pull <pullspec | namespace/imagestream:tag | istag/imagestream:tag>",
+		Short: "Pulls an image from an ImageStream",
+		Long:  "",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if err := opts.validate(); err != nil {
+				return err
+			}
+
+			if dest == "" || isContainersStorage(dest) {
+				return reexecIfNecessaryForStorage()
+			}
+
+			return nil
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			return withRegistry(opts, args[0], true, func(ctx context.Context, r *registrySession) error {
+				if dest == "" {
+					dest = containersStoragePrefix + r.taggedPullspec
+				}
+
+				klog.Infof("Attempting to pull image %q to %q", r.pullspec, dest)
+				return r.copyTo(ctx, dest)
+			})
+		},
+	}
+
+	opts.addFlags(pullCmd)
+	pullCmd.PersistentFlags().StringVar(&dest, "dest", "", "Where to write the image, e.g., oci:/path/to/layout:tag, docker-archive:/path/to/image.tar, dir:/path, containers-storage:localhost/image:tag, or docker://registry/image:tag. Defaults to local container storage.")
+
+	rootCmd.AddCommand(pullCmd)
+}
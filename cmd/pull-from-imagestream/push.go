@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+func init() {
+	opts := registryOpts{}
+
+	pushCmd := &cobra.Command{
+		Use:   "push <source-image> <pullspec | namespace/imagestream:tag | istag/imagestream:tag>",
+		Short: "Pushes an image into an ImageStream",
+		Long:  "The source image may be given with a transport (oci:, docker-archive:, dir:, or docker://). Otherwise, it is read from local container storage.",
+		Args:  cobra.ExactArgs(2),
+		PreRunE: func(_ *cobra.Command, args []string) error {
+			if err := opts.validate(); err != nil {
+				return err
+			}
+
+			if isContainersStorage(args[0]) {
+				return reexecIfNecessaryForStorage()
+			}
+
+			return nil
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			src := args[0]
+
+			return withRegistry(opts, args[1], false, func(ctx context.Context, r *registrySession) error {
+				klog.Infof("Attempting to push image %q to %q", src, r.pullspec)
+				return r.copyFrom(ctx, src)
+			})
+		},
+	}
+
+	opts.addFlags(pushCmd)
+
+	rootCmd.AddCommand(pushCmd)
+}
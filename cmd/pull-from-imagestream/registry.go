@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/containers"
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	"github.com/containers/image/v5/types"
+	"github.com/distribution/reference"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+const (
+	internalRegistryHostname string = "image-registry.openshift-image-registry.svc:5000"
+
+	// How long to wait for the registry Route to start serving requests.
+	registryTimeout time.Duration = time.Minute
+)
+
+type registryOpts struct {
+	namespace      string
+	serviceAccount string
+	authfile       string
+	mergeAuthfile  string
+	tlsVerify      bool
+	unexpose       bool
+}
+
+func (r *registryOpts) validate() error {
+	if r.authfile != "" {
+		if _, err := os.Stat(filepath.Dir(r.authfile)); err != nil {
+			return fmt.Errorf("could not use --authfile %s: %w", r.authfile, err)
+		}
+	}
+
+	if r.mergeAuthfile != "" {
+		if _, err := os.Stat(r.mergeAuthfile); err != nil {
+			return fmt.Errorf("could not use --merge-authfile %s: %w", r.mergeAuthfile, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *registryOpts) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&r.namespace, "namespace", "", "The namespace for istag/ references and whose service account pull secrets should be used. Defaults to the namespace in the pullspec.")
+	cmd.PersistentFlags().StringVar(&r.serviceAccount, "service-account", "", "The service account whose image pull secrets should be used. Defaults to builder, falling back to default if the namespace has no builder service account.")
+	cmd.PersistentFlags().StringVar(&r.authfile, "authfile", "", "Writes the pull secret to this path and keeps it afterward. Defaults to a temporary file which is removed on exit.")
+	cmd.PersistentFlags().StringVar(&r.mergeAuthfile, "merge-authfile", "", "Merges the credentials from this existing authfile into the pull secret. Credentials for the cluster image registry take precedence.")
+	cmd.PersistentFlags().BoolVar(&r.tlsVerify, "tls-verify", false, "Verifies the TLS certificate presented by the cluster image registry Route.")
+	cmd.PersistentFlags().BoolVar(&r.unexpose, "unexpose", true, "Unexposes the cluster image registry on exit.")
+}
+
+// Holds everything needed to talk to the exposed cluster image registry.
+type registrySession struct {
+	registryOpts
+	// The pullspec, rewritten to use the external registry hostname.
+	pullspec string
+	// The tagged pullspec the user referred to, e.g., before an ImageStreamTag
+	// was resolved to a digest. Used for naming local images.
+	taggedPullspec string
+	// The image reference for pullspec.
+	ref types.ImageReference
+	// The SystemContext for talking to the registry.
+	sysCtx *types.SystemContext
+	// Cleans up any temporary files created during the session.
+	cleaner *cleaner
+}
+
+// Runs the given cleanup functions in reverse order. Each function is only
+// run once, regardless of how many times run() is called.
+type cleaner struct {
+	funcs []func() error
+}
+
+func (c *cleaner) add(f func() error) {
+	c.funcs = append(c.funcs, makeIdempotent(f))
+}
+
+func (c *cleaner) run() error {
+	errs := []error{}
+
+	for i := len(c.funcs) - 1; i >= 0; i-- {
+		errs = append(errs, c.funcs[i]())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Exposes the cluster image registry Route, writes the builder pull secret,
+// waits for the registry to respond to requests, then calls the given
+// function. The registry is unexposed and the temporary pull secret is removed
+// on every exit path, including when interrupted.
+func withRegistry(opts registryOpts, pullspec string, resolveDigest bool, f func(context.Context, *registrySession) error) (err error) {
+	cs := framework.NewClientSet("")
+
+	pullspec, taggedPullspec, err := resolveImageStreamTag(cs, opts, pullspec, resolveDigest)
+	if err != nil {
+		return err
+	}
+
+	named, err := reference.ParseNamed(pullspec)
+	if err != nil {
+		return fmt.Errorf("could not parse pullspec %q: %w", pullspec, err)
+	}
+
+	if opts.namespace == "" {
+		opts.namespace = strings.Split(reference.Path(named), "/")[0]
+	}
+
+	// Cancel the context on SIGINT / SIGTERM so that any running copy is
+	// stopped and the cleanup below runs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := &cleaner{}
+	defer func() {
+		if cleanupErr := c.run(); cleanupErr != nil {
+			err = errors.Join(err, fmt.Errorf("could not clean up: %w", cleanupErr))
+		}
+	}()
+
+	// Only the Route is needed since the service account pull secret
+	// authenticates us. Anonymous pulls are never granted.
+	extHostname, err := rollout.ExposeClusterImageRegistryRoute(ctx, cs)
+	if opts.unexpose {
+		// Unexpose even when exposing failed partway through. The context may
+		// have been canceled by an interrupt, so it must not be used here.
+		c.add(func() error {
+			klog.Infof("Unexposing the cluster image registry")
+			return rollout.UnexposeClusterImageRegistryRoute(context.WithoutCancel(ctx), cs)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	authfilePath, err := writePullSecret(ctx, cs, c, opts, extHostname)
+	if err != nil {
+		return err
+	}
+
+	if reference.Domain(named) == internalRegistryHostname {
+		pullspec = strings.ReplaceAll(pullspec, internalRegistryHostname, extHostname)
+		taggedPullspec = strings.ReplaceAll(taggedPullspec, internalRegistryHostname, extHostname)
+	}
+
+	ref, err := containers.ParseImageName("docker://" + pullspec)
+	if err != nil {
+		return err
+	}
+
+	r := &registrySession{
+		registryOpts:   opts,
+		pullspec:       pullspec,
+		taggedPullspec: taggedPullspec,
+		ref:            ref,
+		sysCtx:         containers.NewSystemContext(authfilePath, opts.tlsVerify),
+		cleaner:        c,
+	}
+
+	if err := containers.WaitForRegistry(ctx, r.ref, r.sysCtx, registryTimeout); err != nil {
+		return err
+	}
+
+	return f(ctx, r)
+}
+
+// Converts ImageStreamTag references (e.g., "namespace/imagestream:tag" or
+// "istag/imagestream:tag") into pullspecs for the cluster image registry.
+// Returns the pullspec to use and the tagged pullspec for the ImageStreamTag.
+// If resolveDigest is true, the pullspec to use refers to the digest of the
+// image the tag currently points to. Otherwise, it refers to the tag (e.g.,
+// for pushing). Other pullspecs are returned as-is.
+func resolveImageStreamTag(cs *framework.ClientSet, opts registryOpts, pullspec string, resolveDigest bool) (string, string, error) {
+	ref, ok, err := utils.ParseImageStreamTagRef(pullspec, opts.namespace)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !ok {
+		return pullspec, pullspec, nil
+	}
+
+	tagged := fmt.Sprintf("%s/%s/%s:%s", internalRegistryHostname, ref.Namespace, ref.ImageStream, ref.Tag)
+
+	if !resolveDigest {
+		return tagged, tagged, nil
+	}
+
+	q, err := utils.NewImageStreamQuery(cs)
+	if err != nil {
+		return "", "", err
+	}
+
+	info, err := q.Resolve(context.Background(), ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	klog.Infof("Resolved ImageStreamTag %s to %s", ref, info.Pullspec)
+
+	return info.Pullspec, tagged, nil
+}
+
+func makeIdempotent(f func() error) func() error {
+	hasRun := false
+	var result error
+
+	return func() error {
+		if hasRun {
+			return result
+		}
+
+		result = f()
+		hasRun = true
+		return result
+	}
+}
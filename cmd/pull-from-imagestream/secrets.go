@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openshift/machine-config-operator/test/framework"
+	"k8s.io/klog"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The service accounts whose image pull secrets are used when
+// --service-account is not given, in order of preference. Every namespace has
+// a default service account, but only namespaces with the build capability
+// have a builder service account.
+var defaultServiceAccounts = []string{"builder", "default"}
+
+// Writes the image pull secrets for the service account in the given
+// namespace, merged with the authfile to merge from the options (if any), to
+// the authfile path from the options or, if not set, to a temporary directory
+// which is removed by the cleaner. Returns the path the secret was written to.
+func writePullSecret(ctx context.Context, cs *framework.ClientSet, c *cleaner, opts registryOpts, hostname string) (string, error) {
+	merged, err := getMergedPullSecret(ctx, cs, opts, hostname)
+	if err != nil {
+		return "", err
+	}
+
+	// The temp dir is only created once there is something to write to it so
+	// that it cannot be leaked by an earlier error.
+	secretPath := opts.authfile
+	if secretPath == "" {
+		tmpDir, err := os.MkdirTemp("", "")
+		if err != nil {
+			return "", err
+		}
+
+		c.add(func() error {
+			klog.Infof("Removing %s", tmpDir)
+			return os.RemoveAll(tmpDir)
+		})
+
+		secretPath = filepath.Join(tmpDir, "config.json")
+	}
+
+	if err := os.WriteFile(secretPath, merged, 0o600); err != nil {
+		return "", fmt.Errorf("could not write pull secret to %s: %w", secretPath, err)
+	}
+
+	klog.Infof("Pull secret has been written to %s", secretPath)
+
+	return secretPath, nil
+}
+
+// Gets the image pull secrets for the service account, canonicalized and
+// merged with the authfile to merge from the options (if any).
+func getMergedPullSecret(ctx context.Context, cs *framework.ClientSet, opts registryOpts, hostname string) ([]byte, error) {
+	merged := map[string]json.RawMessage{}
+
+	if opts.mergeAuthfile != "" {
+		existing, err := os.ReadFile(opts.mergeAuthfile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read authfile to merge: %w", err)
+		}
+
+		auths, _, err := decodePullSecretAuths(existing)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode authfile %s: %w", opts.mergeAuthfile, err)
+		}
+
+		mergePullSecretAuths(merged, auths)
+	}
+
+	secrets, err := getServiceAccountPullSecrets(ctx, cs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secrets {
+		secretBytes, err := getPullSecretBytes(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		canonicalized, _, err := canonicalizePullSecretBytes(secretBytes, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("could not canonicalize secret %q: %w", secret.Name, err)
+		}
+
+		auths, _, err := decodePullSecretAuths(canonicalized)
+		if err != nil {
+			return nil, err
+		}
+
+		mergePullSecretAuths(merged, auths)
+	}
+
+	if _, ok := merged[hostname]; !ok {
+		return nil, fmt.Errorf("none of the image pull secrets for namespace %q have credentials for the cluster image registry", opts.namespace)
+	}
+
+	return json.Marshal(map[string]interface{}{"auths": merged})
+}
+
+// Gets the image pull secrets referenced by the service account from the
+// options or, if not set, the first of the default service accounts which
+// exists in the namespace.
+func getServiceAccountPullSecrets(ctx context.Context, cs *framework.ClientSet, opts registryOpts) ([]*corev1.Secret, error) {
+	saNames := defaultServiceAccounts
+	if opts.serviceAccount != "" {
+		saNames = []string{opts.serviceAccount}
+	}
+
+	var sa *corev1.ServiceAccount
+
+	for _, saName := range saNames {
+		found, err := cs.ServiceAccounts(opts.namespace).Get(ctx, saName, metav1.GetOptions{})
+		if err == nil {
+			sa = found
+			break
+		}
+
+		if !apierrs.IsNotFound(err) {
+			return nil, fmt.Errorf("could not get service account %s/%s: %w", opts.namespace, saName, err)
+		}
+
+		klog.V(2).Infof("Service account %s/%s not found", opts.namespace, saName)
+	}
+
+	if sa == nil {
+		return nil, fmt.Errorf("none of the service account(s) %v exist in namespace %q", saNames, opts.namespace)
+	}
+
+	if len(sa.ImagePullSecrets) == 0 {
+		return nil, fmt.Errorf("service account %s/%s has no image pull secrets", sa.Namespace, sa.Name)
+	}
+
+	out := []*corev1.Secret{}
+	names := []string{}
+
+	for _, ref := range sa.ImagePullSecrets {
+		secret, err := cs.Secrets(sa.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			// The token controller may not have created the secret yet.
+			klog.Warningf("Image pull secret %q for service account %s/%s not found, skipping", ref.Name, sa.Namespace, sa.Name)
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not get image pull secret %q: %w", ref.Name, err)
+		}
+
+		out = append(out, secret)
+		names = append(names, secret.Name)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("none of the image pull secrets for service account %s/%s exist", sa.Namespace, sa.Name)
+	}
+
+	klog.Infof("Using image pull secret(s) %s from service account %s/%s", strings.Join(names, ", "), sa.Namespace, sa.Name)
+
+	return out, nil
+}
+
+// Gets the pull secret bytes from either a legacy .dockercfg or a
+// .dockerconfigjson secret.
+func getPullSecretBytes(secret *corev1.Secret) ([]byte, error) {
+	key := ""
+
+	switch secret.Type {
+	case corev1.SecretTypeDockercfg:
+		key = corev1.DockerConfigKey
+	case corev1.SecretTypeDockerConfigJson:
+		key = corev1.DockerConfigJsonKey
+	default:
+		return nil, fmt.Errorf("secret %q has unsupported type %q, expected %q or %q", secret.Name, secret.Type, corev1.SecretTypeDockercfg, corev1.SecretTypeDockerConfigJson)
+	}
+
+	secretBytes, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %q is missing key %q", secret.Name, key)
+	}
+
+	return secretBytes, nil
+}
+
+// Decodes the per-registry credentials from either a legacy-style
+// ({"registry.hostname.com": {...}}) or new-style ({"auths":
+// {"registry.hostname.com": {...}}}) pull secret. Returns the credentials and
+// whether the pull secret was legacy-style.
+func decodePullSecretAuths(secretBytes []byte) (map[string]json.RawMessage, bool, error) {
+	decoded := map[string]json.RawMessage{}
+	if err := json.Unmarshal(secretBytes, &decoded); err != nil {
+		return nil, false, fmt.Errorf("could not decode pull secret: %w", err)
+	}
+
+	rawAuths, ok := decoded["auths"]
+	if !ok {
+		return decoded, true, nil
+	}
+
+	auths := map[string]json.RawMessage{}
+	if err := json.Unmarshal(rawAuths, &auths); err != nil {
+		return nil, false, fmt.Errorf("could not decode new-style pull secret: %w", err)
+	}
+
+	return auths, false, nil
+}
+
+// Adds every credential from src to dst, replacing any which are already
+// present.
+func mergePullSecretAuths(dst, src map[string]json.RawMessage) {
+	for hostname, auth := range src {
+		dst[hostname] = auth
+	}
+}
+
+// Converts a legacy Docker pull secret into a more modern representation.
+// Essentially, it converts {"registry.hostname.com": {"username": "user"...}}
+// into {"auths": {"registry.hostname.com": {"username": "user"...}}}. Pull
+// secrets already in the new-style representation keep their credentials
+// as-is. Returns the new-style representation, a boolean to indicate whether
+// it was converted from the legacy-style, and any errors resulting from the
+// conversion process. Additionally, this function will add an additional
+// entry for the external cluster image registry hostname if the pull secret
+// has credentials for the internal one.
+func canonicalizePullSecretBytes(secretBytes []byte, extHostname string) ([]byte, bool, error) {
+	auths, converted, err := decodePullSecretAuths(secretBytes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if auth, ok := getInternalRegistryAuth(auths); ok {
+		if _, exists := auths[extHostname]; !exists {
+			auths[extHostname] = auth
+		}
+	}
+
+	out, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return nil, false, fmt.Errorf("could not encode pull secret: %w", err)
+	}
+
+	return out, converted, nil
+}
+
+// Gets the credentials for the internal cluster image registry. The secrets
+// created for service accounts have entries for several hostnames which all
+// refer to it (e.g., with and without the cluster domain or by Service IP),
+// so the canonical hostname is preferred.
+func getInternalRegistryAuth(auths map[string]json.RawMessage) (json.RawMessage, bool) {
+	if auth, ok := auths[internalRegistryHostname]; ok {
+		return auth, true
+	}
+
+	internalHost := strings.Split(internalRegistryHostname, ":")[0]
+
+	hostnames := []string{}
+	for hostname := range auths {
+		hostnames = append(hostnames, hostname)
+	}
+
+	sort.Strings(hostnames)
+
+	for _, hostname := range hostnames {
+		if strings.HasPrefix(hostname, internalHost) {
+			return auths[hostname], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testExtHostname string = "default-route-openshift-image-registry.apps.example.com"
+	testAuth        string = `{"auth":"c2VydmljZWFjY291bnQ6dG9rZW4="}`
+	userAuth        string = `{"auth":"dXNlcjpwYXNzd29yZA=="}`
+)
+
+func TestCanonicalizePullSecretBytes(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		input             string
+		expected          string
+		convertedExpected bool
+		errExpected       bool
+	}{
+		{
+			name:              "Legacy .dockercfg",
+			input:             `{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `}`,
+			expected:          `{"auths":{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `,"` + testExtHostname + `":` + testAuth + `}}`,
+			convertedExpected: true,
+		},
+		{
+			name:              "Legacy .dockercfg with every internal hostname",
+			input:             `{"172.30.1.1:5000":` + testAuth + `,"image-registry.openshift-image-registry.svc.cluster.local:5000":` + testAuth + `,"image-registry.openshift-image-registry.svc:5000":` + testAuth + `}`,
+			expected:          `{"auths":{"172.30.1.1:5000":` + testAuth + `,"image-registry.openshift-image-registry.svc.cluster.local:5000":` + testAuth + `,"image-registry.openshift-image-registry.svc:5000":` + testAuth + `,"` + testExtHostname + `":` + testAuth + `}}`,
+			convertedExpected: true,
+		},
+		{
+			name:              "Legacy .dockercfg with only the cluster domain hostname",
+			input:             `{"image-registry.openshift-image-registry.svc.cluster.local:5000":` + testAuth + `}`,
+			expected:          `{"auths":{"image-registry.openshift-image-registry.svc.cluster.local:5000":` + testAuth + `,"` + testExtHostname + `":` + testAuth + `}}`,
+			convertedExpected: true,
+		},
+		{
+			name:     ".dockerconfigjson",
+			input:    `{"auths":{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `}}`,
+			expected: `{"auths":{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `,"` + testExtHostname + `":` + testAuth + `}}`,
+		},
+		{
+			name:     ".dockerconfigjson with existing external hostname entry",
+			input:    `{"auths":{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `,"` + testExtHostname + `":` + userAuth + `}}`,
+			expected: `{"auths":{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `,"` + testExtHostname + `":` + userAuth + `}}`,
+		},
+		{
+			name:     ".dockerconfigjson for another registry",
+			input:    `{"auths":{"quay.io":` + userAuth + `}}`,
+			expected: `{"auths":{"quay.io":` + userAuth + `}}`,
+		},
+		{
+			name:     "Empty .dockerconfigjson",
+			input:    `{"auths":{}}`,
+			expected: `{"auths":{}}`,
+		},
+		{
+			name:        "Invalid JSON",
+			input:       `{"auths":`,
+			errExpected: true,
+		},
+		{
+			name:        "Invalid auths",
+			input:       `{"auths":[]}`,
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			out, converted, err := canonicalizePullSecretBytes([]byte(testCase.input), testExtHostname)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.convertedExpected, converted)
+			assert.JSONEq(t, testCase.expected, string(out))
+		})
+	}
+}
+
+func TestGetMergedPullSecret(t *testing.T) {
+	t.Parallel()
+
+	dockercfgSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "builder-dockercfg-abcde", Namespace: "test-ns"},
+		Type:       corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{
+			corev1.DockerConfigKey: []byte(`{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `}`),
+		},
+	}
+
+	dockerconfigjsonSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "default-dockercfg-fghij", Namespace: "test-ns"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `}}`),
+		},
+	}
+
+	quaySecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "quay", Namespace: "test-ns"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"quay.io":` + testAuth + `}}`),
+		},
+	}
+
+	opaqueSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "opaque", Namespace: "test-ns"},
+		Type:       corev1.SecretTypeOpaque,
+	}
+
+	newSA := func(name string, secrets ...string) *corev1.ServiceAccount {
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-ns"}}
+		for _, secret := range secrets {
+			sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{Name: secret})
+		}
+		return sa
+	}
+
+	testCases := []struct {
+		name           string
+		objects        []runtime.Object
+		serviceAccount string
+		mergeAuthfile  string
+		expectedHosts  []string
+		errExpected    bool
+	}{
+		{
+			name:          "Builder service account with legacy secret",
+			objects:       []runtime.Object{newSA("builder", dockercfgSecret.Name), dockercfgSecret},
+			expectedHosts: []string{internalRegistryHostname, testExtHostname},
+		},
+		{
+			name:          "Falls back to default service account",
+			objects:       []runtime.Object{newSA("default", dockerconfigjsonSecret.Name), dockerconfigjsonSecret},
+			expectedHosts: []string{internalRegistryHostname, testExtHostname},
+		},
+		{
+			name:           "Explicit service account",
+			objects:        []runtime.Object{newSA("builder", dockercfgSecret.Name), newSA("puller", dockerconfigjsonSecret.Name, quaySecret.Name), dockercfgSecret, dockerconfigjsonSecret, quaySecret},
+			serviceAccount: "puller",
+			expectedHosts:  []string{internalRegistryHostname, testExtHostname, "quay.io"},
+		},
+		{
+			name:          "Missing secrets are skipped",
+			objects:       []runtime.Object{newSA("builder", "missing", dockercfgSecret.Name), dockercfgSecret},
+			expectedHosts: []string{internalRegistryHostname, testExtHostname},
+		},
+		{
+			name:          "Merges existing authfile",
+			objects:       []runtime.Object{newSA("builder", dockercfgSecret.Name), dockercfgSecret},
+			mergeAuthfile: `{"auths":{"registry.example.com":` + userAuth + `,"` + testExtHostname + `":` + userAuth + `}}`,
+			expectedHosts: []string{internalRegistryHostname, testExtHostname, "registry.example.com"},
+		},
+		{
+			name:          "Merges existing legacy authfile",
+			objects:       []runtime.Object{newSA("builder", dockercfgSecret.Name), dockercfgSecret},
+			mergeAuthfile: `{"registry.example.com":` + userAuth + `}`,
+			expectedHosts: []string{internalRegistryHostname, testExtHostname, "registry.example.com"},
+		},
+		{
+			name:        "No service account",
+			errExpected: true,
+		},
+		{
+			name:           "Explicit service account does not fall back",
+			objects:        []runtime.Object{newSA("builder", dockercfgSecret.Name), dockercfgSecret},
+			serviceAccount: "missing",
+			errExpected:    true,
+		},
+		{
+			name:        "No image pull secrets",
+			objects:     []runtime.Object{newSA("builder")},
+			errExpected: true,
+		},
+		{
+			name:        "Unsupported secret type",
+			objects:     []runtime.Object{newSA("builder", opaqueSecret.Name), opaqueSecret},
+			errExpected: true,
+		},
+		{
+			name:        "No credentials for the cluster image registry",
+			objects:     []runtime.Object{newSA("builder", quaySecret.Name), quaySecret},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			cs := &framework.ClientSet{
+				CoreV1Interface: fakekube.NewSimpleClientset(testCase.objects...).CoreV1(),
+			}
+
+			opts := registryOpts{
+				namespace:      "test-ns",
+				serviceAccount: testCase.serviceAccount,
+			}
+
+			if testCase.mergeAuthfile != "" {
+				opts.mergeAuthfile = filepath.Join(t.TempDir(), "auth.json")
+				require.NoError(t, os.WriteFile(opts.mergeAuthfile, []byte(testCase.mergeAuthfile), 0o600))
+			}
+
+			out, err := getMergedPullSecret(context.Background(), cs, opts, testExtHostname)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			decoded := struct {
+				Auths map[string]json.RawMessage `json:"auths"`
+			}{}
+			require.NoError(t, json.Unmarshal(out, &decoded))
+
+			hosts := []string{}
+			for host := range decoded.Auths {
+				hosts = append(hosts, host)
+			}
+
+			assert.ElementsMatch(t, testCase.expectedHosts, hosts)
+
+			// Credentials for the cluster image registry take precedence over
+			// those in the merged authfile.
+			assert.JSONEq(t, testAuth, string(decoded.Auths[testExtHostname]))
+		})
+	}
+}
+
+func TestWritePullSecret(t *testing.T) {
+	t.Parallel()
+
+	cs := &framework.ClientSet{
+		CoreV1Interface: fakekube.NewSimpleClientset().CoreV1(),
+	}
+
+	// Nothing is left on disk when the pull secret cannot be found.
+	c := &cleaner{}
+	_, err := writePullSecret(context.Background(), cs, c, registryOpts{namespace: "test-ns"}, testExtHostname)
+	assert.Error(t, err)
+	assert.Empty(t, c.funcs)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "builder-dockercfg-abcde", Namespace: "test-ns"},
+		Type:       corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{
+			corev1.DockerConfigKey: []byte(`{"image-registry.openshift-image-registry.svc:5000":` + testAuth + `}`),
+		},
+	}
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Name: "builder", Namespace: "test-ns"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: secret.Name}},
+	}
+
+	cs = &framework.ClientSet{
+		CoreV1Interface: fakekube.NewSimpleClientset(sa, secret).CoreV1(),
+	}
+
+	// The temporary pull secret is removed by the cleaner.
+	c = &cleaner{}
+	secretPath, err := writePullSecret(context.Background(), cs, c, registryOpts{namespace: "test-ns"}, testExtHostname)
+	require.NoError(t, err)
+	assert.FileExists(t, secretPath)
+
+	require.NoError(t, c.run())
+	assert.NoDirExists(t, filepath.Dir(secretPath))
+
+	// A pull secret written to --authfile is kept.
+	authfile := filepath.Join(t.TempDir(), "auth.json")
+
+	c = &cleaner{}
+	secretPath, err = writePullSecret(context.Background(), cs, c, registryOpts{namespace: "test-ns", authfile: authfile}, testExtHostname)
+	require.NoError(t, err)
+	assert.Equal(t, authfile, secretPath)
+
+	require.NoError(t, c.run())
+	assert.FileExists(t, authfile)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/containers"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"k8s.io/klog"
+)
+
+const (
+	containersStoragePrefix string = "containers-storage:"
+)
+
+// Determines whether the given image name refers to local container storage.
+// Image names without a supported transport (e.g., "localhost/my-image:latest")
+// are assumed to be in local container storage.
+func isContainersStorage(name string) bool {
+	return strings.HasPrefix(name, containersStoragePrefix) || !containers.HasSupportedTransport(name)
+}
+
+// Parses the given image name, assuming that names without a supported
+// transport are in local container storage.
+func parseImageName(name string) (types.ImageReference, error) {
+	if !containers.HasSupportedTransport(name) {
+		name = containersStoragePrefix + name
+	}
+
+	return containers.ParseImageName(name)
+}
+
+// Copies the image from the registry to the given destination.
+func (r *registrySession) copyTo(ctx context.Context, dest string) error {
+	destRef, err := parseImageName(dest)
+	if err != nil {
+		return err
+	}
+
+	return r.copy(ctx, destRef, r.ref)
+}
+
+// Copies the image from the given source to the registry.
+func (r *registrySession) copyFrom(ctx context.Context, src string) error {
+	srcRef, err := parseImageName(src)
+	if err != nil {
+		return err
+	}
+
+	return r.copy(ctx, r.ref, srcRef)
+}
+
+// Copies the image using the session SystemContext, which authenticates with
+// the exposed registry.
+func (r *registrySession) copy(ctx context.Context, destRef, srcRef types.ImageReference) error {
+	klog.Infof("Copying %s to %s", transports.ImageName(srcRef), transports.ImageName(destRef))
+
+	d, err := containers.CopyImage(ctx, destRef, srcRef, containers.CopyOpts{
+		SourceCtx:      r.sysCtx,
+		DestinationCtx: r.sysCtx,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Copied image with manifest digest %s", d)
+	return nil
+}
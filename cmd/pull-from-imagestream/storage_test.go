@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImageName(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		imageName         string
+		expectedTransport string
+		isStorage         bool
+	}{
+		{
+			name:              "No transport",
+			imageName:         "localhost/my-image:latest",
+			expectedTransport: "containers-storage",
+			isStorage:         true,
+		},
+		{
+			name:              "Local container storage",
+			imageName:         "containers-storage:localhost/my-image:latest",
+			expectedTransport: "containers-storage",
+			isStorage:         true,
+		},
+		{
+			name:              "OCI layout",
+			imageName:         "oci:/tmp/layout:latest",
+			expectedTransport: "oci",
+		},
+		{
+			name:              "Registry",
+			imageName:         "docker://quay.io/example/image:latest",
+			expectedTransport: "docker",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, testCase.isStorage, isContainersStorage(testCase.imageName))
+
+			ref, err := parseImageName(testCase.imageName)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedTransport, ref.Transport().Name())
+		})
+	}
+}
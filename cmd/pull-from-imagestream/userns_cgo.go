@@ -0,0 +1,16 @@
+//go:build linux && cgo
+
+package main
+
+import (
+	"github.com/containers/storage/pkg/unshare"
+)
+
+// Re-executes this process in a user namespace when running as a non-root
+// user, the same way podman and skopeo do, so that image layers can be written
+// to local container storage with their original owners. The re-executed
+// process runs the same command and this process exits with its exit code.
+func reexecIfNecessaryForStorage() error {
+	unshare.MaybeReexecUsingUserNamespace(false)
+	return nil
+}
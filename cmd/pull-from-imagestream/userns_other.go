@@ -0,0 +1,18 @@
+//go:build !linux || !cgo
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Entering a user namespace requires cgo, so local container storage can only
+// be used as root (including within "podman unshare").
+func reexecIfNecessaryForStorage() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("using local container storage as a non-root user requires a build with cgo, run this with \"podman unshare\" or use another transport instead")
+	}
+
+	return nil
+}
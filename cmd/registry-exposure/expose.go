@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type exposeOpts struct {
+	authfile  string
+	lifetime  time.Duration
+	namespace string
+	scoped    bool
+}
+
+func (e *exposeOpts) validate() error {
+	if e.scoped {
+		if e.lifetime <= 0 {
+			return fmt.Errorf("--lifetime must be positive")
+		}
+
+		return nil
+	}
+
+	if e.authfile != "" {
+		return fmt.Errorf("--authfile requires --scoped")
+	}
+
+	if e.namespace != ctrlcommon.MCONamespace {
+		return fmt.Errorf("--namespace requires --scoped")
+	}
+
+	return nil
+}
+
+func init() {
+	opts := exposeOpts{}
+
+	exposeCmd := &cobra.Command{
+		Use:   "expose",
+		Short: "Exposes the cluster image registry via a Route",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runExpose(opts)
+		},
+	}
+
+	exposeCmd.PersistentFlags().StringVar(&opts.authfile, "authfile", "", "Writes the scoped pull secret to this path. Requires --scoped.")
+	exposeCmd.PersistentFlags().DurationVar(&opts.lifetime, "lifetime", time.Hour, "How long the scoped token and exposure should last.")
+	exposeCmd.PersistentFlags().StringVar(&opts.namespace, "namespace", ctrlcommon.MCONamespace, "The namespace whose images the scoped token may pull.")
+	exposeCmd.PersistentFlags().BoolVar(&opts.scoped, "scoped", false, "Authenticates with a short-lived service account token instead of granting anonymous access.")
+
+	rootCmd.AddCommand(exposeCmd)
+}
+
+func runExpose(opts exposeOpts) error {
+	cs := framework.NewClientSet("")
+
+	if !opts.scoped {
+		hostname, err := rollout.ExposeClusterImageRegistry(cs)
+		if err != nil {
+			return err
+		}
+
+		klog.Warningf("Anonymous users may now pull images from the MCO namespace; run \"registry-exposure unexpose\" when done")
+		fmt.Println(hostname)
+		return nil
+	}
+
+	exposure, err := rollout.ExposeClusterImageRegistryWithToken(context.Background(), cs, rollout.ScopedExposureOpts{
+		Namespace: opts.namespace,
+		Lifetime:  opts.lifetime,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Pull secret %s/%s expires at %s", exposure.Namespace, exposure.SecretName, exposure.Expires.Format(time.RFC3339))
+
+	if opts.authfile != "" {
+		if err := os.WriteFile(opts.authfile, exposure.PullSecret, 0o600); err != nil {
+			return fmt.Errorf("could not write authfile %s: %w", opts.authfile, err)
+		}
+
+		klog.Infof("Wrote pull secret to %s", opts.authfile)
+	}
+
+	fmt.Println(exposure.Hostname)
+	return nil
+}
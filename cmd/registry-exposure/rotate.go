@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type rotateOpts struct {
+	namespace   string
+	renewWithin time.Duration
+	interval    time.Duration
+	dryRun      bool
+}
+
+func (r *rotateOpts) validate() error {
+	if r.renewWithin < 0 {
+		return fmt.Errorf("--renew-within must not be negative")
+	}
+
+	if r.interval < 0 {
+		return fmt.Errorf("--interval must not be negative")
+	}
+
+	return nil
+}
+
+func init() {
+	opts := rotateOpts{}
+
+	rotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Renews long-lived pull secrets which are about to expire",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runRotate(opts)
+		},
+	}
+
+	rotateCmd.PersistentFlags().StringVar(&opts.namespace, "namespace", "", "Only rotates pull secrets in this namespace. Defaults to all namespaces.")
+	rotateCmd.PersistentFlags().DurationVar(&opts.renewWithin, "renew-within", time.Hour, "Rotates pull secrets whose tokens expire within this window.")
+	rotateCmd.PersistentFlags().DurationVar(&opts.interval, "interval", 0, "Checks for pull secrets to rotate at this interval until interrupted. Defaults to checking once, which is suitable for cron.")
+	rotateCmd.PersistentFlags().BoolVar(&opts.dryRun, "dry-run", false, "Lists the pull secrets that would be rotated without rotating them.")
+
+	rootCmd.AddCommand(rotateCmd)
+}
+
+func runRotate(opts rotateOpts) error {
+	cs := framework.NewClientSet("")
+
+	if opts.interval == 0 {
+		return rotateOnce(context.Background(), cs, opts)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+
+	for {
+		// Errors are logged rather than returned so that a transient failure
+		// does not stop the loop.
+		if err := rotateOnce(ctx, cs, opts); err != nil {
+			klog.Errorf("Could not rotate pull secrets: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			klog.Infof("Interrupted, stopping")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func rotateOnce(ctx context.Context, cs *framework.ClientSet, opts rotateOpts) error {
+	rotateOpts := utils.RotateLongLivedPullSecretOpts{
+		Namespace:   opts.namespace,
+		RenewWithin: opts.renewWithin,
+		DryRun:      opts.dryRun,
+	}
+
+	rotated, err := utils.RotateLongLivedPullSecrets(ctx, cs, rotateOpts)
+
+	verb := "Rotated"
+	if opts.dryRun {
+		verb = "Would rotate"
+	}
+
+	for _, item := range rotated {
+		fmt.Fprintf(os.Stdout, "%s %s\n", verb, item)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(rotated) == 0 {
+		klog.Infof("No pull secrets expire within %s", opts.renewWithin)
+	}
+
+	return nil
+}
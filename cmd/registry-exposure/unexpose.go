@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/rollout"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/spf13/cobra"
+	"k8s.io/klog"
+)
+
+type unexposeOpts struct {
+	namespace string
+	scoped    bool
+}
+
+func (u *unexposeOpts) validate() error {
+	if !u.scoped && u.namespace != ctrlcommon.MCONamespace {
+		return fmt.Errorf("--namespace requires --scoped")
+	}
+
+	return nil
+}
+
+type cleanupOpts struct {
+	all bool
+}
+
+func init() {
+	opts := unexposeOpts{}
+
+	unexposeCmd := &cobra.Command{
+		Use:   "unexpose",
+		Short: "Removes an exposure created by the expose command",
+		Long:  "",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runUnexpose(opts)
+		},
+	}
+
+	unexposeCmd.PersistentFlags().StringVar(&opts.namespace, "namespace", ctrlcommon.MCONamespace, "The namespace the scoped exposure was created for.")
+	unexposeCmd.PersistentFlags().BoolVar(&opts.scoped, "scoped", false, "Removes a scoped exposure instead of the anonymous one.")
+
+	cOpts := cleanupOpts{}
+
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Removes expired exposures which were never unexposed",
+		Long:  "",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runCleanup(cOpts)
+		},
+	}
+
+	cleanupCmd.PersistentFlags().BoolVar(&cOpts.all, "all", false, "Removes every exposure, including those which have not yet expired.")
+
+	rootCmd.AddCommand(unexposeCmd)
+	rootCmd.AddCommand(cleanupCmd)
+}
+
+func runUnexpose(opts unexposeOpts) error {
+	cs := framework.NewClientSet("")
+
+	if !opts.scoped {
+		return rollout.UnexposeClusterImageRegistry(cs)
+	}
+
+	return rollout.UnexposeScopedClusterImageRegistry(context.Background(), cs, opts.namespace)
+}
+
+func runCleanup(opts cleanupOpts) error {
+	cs := framework.NewClientSet("")
+
+	removed, err := rollout.CleanupStaleRegistryExposures(context.Background(), cs, rollout.CleanupRegistryExposureOpts{All: opts.all})
+
+	for _, item := range removed {
+		klog.Infof("Removed %s", item)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(removed) == 0 {
+		klog.Infof("No stale registry exposures found")
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"k8s.io/klog"
+
+	// Registers the transports which ParseImageName supports.
+	_ "github.com/containers/image/v5/directory"
+	_ "github.com/containers/image/v5/docker/archive"
+	_ "github.com/containers/image/v5/oci/layout"
+	_ "github.com/containers/image/v5/storage"
+)
+
+// The transports which ParseImageName supports.
+var supportedTransports = []string{"docker", "docker-archive", "oci", "dir", "containers-storage"}
+
+// Determines whether the image name begins with a transport which
+// ParseImageName supports.
+func HasSupportedTransport(name string) bool {
+	transportName, _, ok := strings.Cut(name, ":")
+	return ok && slices.Contains(supportedTransports, transportName)
+}
+
+// Parses an image name in the "transport:reference" form used by skopeo, e.g.,
+// "docker://quay.io/org/image:latest", "oci:/path/to/layout:tag",
+// "docker-archive:/path/to/archive.tar", or
+// "containers-storage:localhost/image:latest".
+func ParseImageName(name string) (types.ImageReference, error) {
+	transportName, ref, ok := strings.Cut(name, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid image name %q, expected transport:reference", name)
+	}
+
+	if !slices.Contains(supportedTransports, transportName) {
+		return nil, fmt.Errorf("unsupported transport %q in image name %q, supported transports: %v", transportName, name, supportedTransports)
+	}
+
+	transport := transports.Get(transportName)
+	if transport == nil {
+		return nil, fmt.Errorf("transport %q is not registered", transportName)
+	}
+
+	parsed, err := transport.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse image name %q: %w", name, err)
+	}
+
+	return parsed, nil
+}
+
+// Gets a SystemContext which authenticates with the given authfile and
+// optionally skips TLS verification for registries.
+func NewSystemContext(authfilePath string, tlsVerify bool) *types.SystemContext {
+	return &types.SystemContext{
+		AuthFilePath:                authfilePath,
+		DockerInsecureSkipTLSVerify: types.NewOptionalBool(!tlsVerify),
+		OCIInsecureSkipTLSVerify:    !tlsVerify,
+	}
+}
+
+// Options for copying an image.
+type CopyOpts struct {
+	// The SystemContext used for the source image.
+	SourceCtx *types.SystemContext
+	// The SystemContext used for the destination image.
+	DestinationCtx *types.SystemContext
+}
+
+// Copies a single image from the source to the destination, converting the
+// manifest to a type the destination supports if needed. If the source is a
+// manifest list, only the instance for the current platform is copied. Returns
+// the digest of the manifest written to the destination.
+//
+// This does not use copy.Image from containers/image because the copy package
+// depends on the signature package, which links against gpgme via cgo (unless
+// built with the containers_image_openpgp tag) and pulls in sigstore. Neither
+// is part of this module. As a result, signatures are not copied or verified,
+// and layers are copied as-is without being recompressed.
+func CopyImage(ctx context.Context, dst, src types.ImageReference, opts CopyOpts) (digest.Digest, error) {
+	imgSrc, err := src.NewImageSource(ctx, opts.SourceCtx)
+	if err != nil {
+		return "", fmt.Errorf("could not open source image %s: %w", transports.ImageName(src), err)
+	}
+
+	defer imgSrc.Close()
+
+	instanceDigest, err := chooseInstance(ctx, imgSrc, opts.SourceCtx)
+	if err != nil {
+		return "", err
+	}
+
+	unparsed := image.UnparsedInstance(imgSrc, instanceDigest)
+
+	img, err := image.FromUnparsedImage(ctx, opts.SourceCtx, unparsed)
+	if err != nil {
+		return "", fmt.Errorf("could not read source image %s: %w", transports.ImageName(src), err)
+	}
+
+	img, layers, err := getLayersForCopy(ctx, imgSrc, img, instanceDigest)
+	if err != nil {
+		return "", err
+	}
+
+	imgDest, err := dst.NewImageDestination(ctx, opts.DestinationCtx)
+	if err != nil {
+		return "", fmt.Errorf("could not open destination image %s: %w", transports.ImageName(dst), err)
+	}
+
+	defer imgDest.Close()
+
+	blobs := append([]types.BlobInfo{img.ConfigInfo()}, layers...)
+	for i, blob := range blobs {
+		if err := copyBlob(ctx, imgSrc, imgDest, blob, i == 0); err != nil {
+			return "", err
+		}
+	}
+
+	manifestBytes, err := getManifestForDestination(ctx, img, imgDest)
+	if err != nil {
+		return "", err
+	}
+
+	if err := imgDest.PutManifest(ctx, manifestBytes, nil); err != nil {
+		return "", fmt.Errorf("could not write manifest to %s: %w", transports.ImageName(dst), err)
+	}
+
+	if err := imgDest.Commit(ctx, unparsed); err != nil {
+		return "", fmt.Errorf("could not commit image to %s: %w", transports.ImageName(dst), err)
+	}
+
+	return manifest.Digest(manifestBytes)
+}
+
+// Chooses the instance for the current platform if the source is a manifest
+// list. Returns nil if the source is a single image.
+func chooseInstance(ctx context.Context, imgSrc types.ImageSource, sysCtx *types.SystemContext) (*digest.Digest, error) {
+	manifestBytes, mimeType, err := imgSrc.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not get manifest: %w", err)
+	}
+
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil, nil
+	}
+
+	list, err := manifest.ListFromBlob(manifestBytes, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest list: %w", err)
+	}
+
+	instance, err := list.ChooseInstance(sysCtx)
+	if err != nil {
+		return nil, fmt.Errorf("could not choose image from manifest list: %w", err)
+	}
+
+	klog.V(4).Infof("Chose image %s from manifest list", instance)
+
+	return &instance, nil
+}
+
+// Gets the layers to copy from the source. Some sources (e.g., local container
+// storage) store the layers differently than the manifest describes them, so
+// the image is updated to describe the layers which are actually copied.
+// Since layers are not recompressed, uncompressed layers are described as
+// such.
+func getLayersForCopy(ctx context.Context, imgSrc types.ImageSource, img types.Image, instanceDigest *digest.Digest) (types.Image, []types.BlobInfo, error) {
+	layers, err := imgSrc.LayerInfosForCopy(ctx, instanceDigest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get layers to copy: %w", err)
+	}
+
+	if layers == nil {
+		return img, img.LayerInfos(), nil
+	}
+
+	for i := range layers {
+		if layers[i].MediaType == imgspecv1.MediaTypeImageLayer || layers[i].MediaType == manifest.DockerV2SchemaLayerMediaTypeUncompressed {
+			layers[i].CompressionOperation = types.Decompress
+		}
+	}
+
+	updated, err := img.UpdatedImage(ctx, types.ManifestUpdateOptions{LayerInfos: layers})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not update manifest with layers to copy: %w", err)
+	}
+
+	return updated, layers, nil
+}
+
+// Copies a single blob from the source to the destination.
+func copyBlob(ctx context.Context, imgSrc types.ImageSource, imgDest types.ImageDestination, blob types.BlobInfo, isConfig bool) error {
+	stream, size, err := imgSrc.GetBlob(ctx, blob, none.NoCache)
+	if err != nil {
+		return fmt.Errorf("could not get blob %s: %w", blob.Digest, err)
+	}
+
+	defer stream.Close()
+
+	if blob.Size == -1 {
+		blob.Size = size
+	}
+
+	klog.V(4).Infof("Copying blob %s (%d bytes)", blob.Digest, blob.Size)
+
+	if _, err := imgDest.PutBlob(ctx, stream, blob, none.NoCache, isConfig); err != nil {
+		return fmt.Errorf("could not write blob %s: %w", blob.Digest, err)
+	}
+
+	return nil
+}
+
+// Gets the manifest for the image in a format the destination supports.
+func getManifestForDestination(ctx context.Context, img types.Image, imgDest types.ImageDestination) ([]byte, error) {
+	manifestBytes, mimeType, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get manifest: %w", err)
+	}
+
+	supported := imgDest.SupportedManifestMIMETypes()
+	if len(supported) == 0 || slices.Contains(supported, mimeType) {
+		return manifestBytes, nil
+	}
+
+	errs := []error{}
+
+	for _, candidate := range supported {
+		updated, err := img.UpdatedImage(ctx, types.ManifestUpdateOptions{
+			ManifestMIMEType: candidate,
+			InformationOnly: types.ManifestUpdateInformation{
+				Destination: imgDest,
+			},
+		})
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		converted, _, err := updated.Manifest(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		klog.V(4).Infof("Converted manifest from %s to %s", mimeType, candidate)
+
+		return converted, nil
+	}
+
+	return nil, fmt.Errorf("could not convert manifest from %s to any of %v: %w", mimeType, supported, errors.Join(errs...))
+}
+
+// Waits for the registry serving the given image reference to respond to
+// registry API requests. Any response from the registry itself, including
+// that the image does not exist (e.g., before a push), means that it is
+// available. Network errors, server errors, and responses which did not come
+// from a registry (e.g., from a Route which is not admitted yet) are retried
+// until the context is cancelled or the timeout elapses.
+func WaitForRegistry(ctx context.Context, ref types.ImageReference, sysCtx *types.SystemContext, timeout time.Duration) error {
+	if ref.Transport().Name() != docker.Transport.Name() {
+		return fmt.Errorf("image %s is not in a registry", transports.ImageName(ref))
+	}
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+
+	for attempt := 1; ; attempt++ {
+		err := probeRegistry(ctx, ref, sysCtx)
+		if err == nil || isRegistryResponse(err) {
+			klog.Infof("Registry became available after %d attempt(s) in %s", attempt, time.Since(start))
+			return nil
+		}
+
+		lastErr = err
+		klog.V(2).Infof("Attempt #%d: registry is not yet available: %s", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("registry did not become available after %d attempt(s) in %s: %w", attempt, time.Since(start), lastErr)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Fetches the manifest for the given image reference.
+func probeRegistry(ctx context.Context, ref types.ImageReference, sysCtx *types.SystemContext) error {
+	src, err := ref.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	_, _, err = src.GetManifest(ctx, nil)
+	return err
+}
+
+// Determines whether the given error was returned by a registry, as opposed
+// to by the network or by something in front of the registry.
+func isRegistryResponse(err error) bool {
+	var errs errcode.Errors
+	if errors.As(err, &errs) {
+		return true
+	}
+
+	var codeErr errcode.Error
+	if errors.As(err, &codeErr) {
+		return true
+	}
+
+	var unauthorized docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauthorized) {
+		return true
+	}
+
+	var statusErr docker.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode < 500
+	}
+
+	return false
+}
@@ -0,0 +1,339 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// containers/storage re-executes the test binary to apply layers.
+	if reexec.Init() {
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestParseImageName(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		imageName         string
+		expectedTransport string
+		errExpected       bool
+	}{
+		{
+			name:              "Registry",
+			imageName:         "docker://quay.io/example/image:latest",
+			expectedTransport: "docker",
+		},
+		{
+			name:              "OCI layout",
+			imageName:         "oci:/tmp/layout:latest",
+			expectedTransport: "oci",
+		},
+		{
+			name:              "Docker archive",
+			imageName:         "docker-archive:/tmp/image.tar",
+			expectedTransport: "docker-archive",
+		},
+		{
+			name:              "Directory",
+			imageName:         "dir:/tmp/image",
+			expectedTransport: "dir",
+		},
+		{
+			name:              "Local container storage",
+			imageName:         "containers-storage:quay.io/example/image:latest",
+			expectedTransport: "containers-storage",
+		},
+		{
+			name:        "Unsupported transport",
+			imageName:   "docker-daemon:quay.io/example/image:latest",
+			errExpected: true,
+		},
+		{
+			name:        "No transport",
+			imageName:   "image",
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, !testCase.errExpected, HasSupportedTransport(testCase.imageName))
+
+			ref, err := ParseImageName(testCase.imageName)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedTransport, ref.Transport().Name())
+		})
+	}
+}
+
+func TestWaitForRegistry(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		tag               string
+		unavailableStatus int
+		unavailableFor    int
+		timeout           time.Duration
+		errExpected       bool
+	}{
+		{
+			name: "Image exists",
+			tag:  "latest",
+		},
+		{
+			name: "Image does not exist yet",
+			tag:  "missing",
+		},
+		{
+			name:              "Route not ready",
+			tag:               "latest",
+			unavailableStatus: http.StatusServiceUnavailable,
+			unavailableFor:    2,
+		},
+		{
+			name:              "Non-registry response",
+			tag:               "latest",
+			unavailableStatus: http.StatusBadRequest,
+			unavailableFor:    1,
+		},
+		{
+			name:              "Never ready",
+			tag:               "latest",
+			unavailableStatus: http.StatusServiceUnavailable,
+			unavailableFor:    1000,
+			timeout:           1500 * time.Millisecond,
+			errExpected:       true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry, host := newTestRegistry(t)
+			seedTestImage(t, registry, "ns/image", "latest")
+
+			registry.unavailableStatus = testCase.unavailableStatus
+			registry.unavailableFor = testCase.unavailableFor
+
+			timeout := testCase.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+
+			ref, err := ParseImageName("docker://" + host + "/ns/image:" + testCase.tag)
+			require.NoError(t, err)
+
+			err = WaitForRegistry(context.Background(), ref, NewSystemContext("", false), timeout)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCopyImage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	sysCtx := NewSystemContext("", false)
+	opts := CopyOpts{SourceCtx: sysCtx, DestinationCtx: sysCtx}
+
+	registry, host := newTestRegistry(t)
+	layerDigest := seedTestImage(t, registry, "ns/image", "latest")
+
+	tmpDir := t.TempDir()
+
+	// Copies the image and reads it back to make sure it is complete.
+	// Transports which synthesize a manifest when reading (e.g.,
+	// docker-archive) do not return the digest which was written.
+	copyAndCheck := func(dst, src string, digestPreserved bool) digest.Digest {
+		t.Helper()
+
+		srcRef, err := ParseImageName(src)
+		require.NoError(t, err)
+
+		dstRef, err := ParseImageName(dst)
+		require.NoError(t, err)
+
+		d, err := CopyImage(ctx, dstRef, srcRef, opts)
+		require.NoError(t, err)
+
+		imgSrc, err := dstRef.NewImageSource(ctx, sysCtx)
+		require.NoError(t, err)
+		defer imgSrc.Close()
+
+		manifestBytes, _, err := imgSrc.GetManifest(ctx, nil)
+		require.NoError(t, err)
+
+		if digestPreserved {
+			actual, err := manifest.Digest(manifestBytes)
+			require.NoError(t, err)
+			assert.Equal(t, d, actual)
+		}
+
+		return d
+	}
+
+	// Registry to OCI layout requires converting the manifest.
+	ociLayout := "oci:" + filepath.Join(tmpDir, "layout") + ":latest"
+	copyAndCheck(ociLayout, "docker://"+host+"/ns/image:latest", true)
+
+	ociRef, err := ParseImageName(ociLayout)
+	require.NoError(t, err)
+
+	ociSrc, err := ociRef.NewImageSource(ctx, sysCtx)
+	require.NoError(t, err)
+	_, mimeType, err := ociSrc.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mimeType)
+	require.NoError(t, ociSrc.Close())
+
+	// OCI layout to another repository in the registry.
+	pushed := copyAndCheck("docker://"+host+"/other/image:pushed", ociLayout, true)
+	_, ok := registry.getManifest("other/image", pushed.String())
+	assert.True(t, ok)
+	assert.True(t, registry.hasBlob(layerDigest))
+
+	// Registry to a docker-archive and a directory.
+	copyAndCheck("docker-archive:"+filepath.Join(tmpDir, "image.tar")+":example.com/ns/image:latest", "docker://"+host+"/ns/image:latest", false)
+	copyAndCheck("dir:"+filepath.Join(tmpDir, "dir"), "docker://"+host+"/ns/image:latest", true)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "dir", "manifest.json"))
+	assert.NoError(t, err)
+
+	// Missing source images are reported.
+	missing, err := ParseImageName("docker://" + host + "/ns/image:missing")
+	require.NoError(t, err)
+
+	dst, err := ParseImageName("dir:" + filepath.Join(tmpDir, "missing"))
+	require.NoError(t, err)
+
+	_, err = CopyImage(ctx, dst, missing, opts)
+	assert.Error(t, err)
+}
+
+func TestCopyImageContainersStorage(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() != 0 {
+		t.Skip("writing to container storage requires root")
+	}
+
+	ctx := context.Background()
+	sysCtx := NewSystemContext("", false)
+	opts := CopyOpts{SourceCtx: sysCtx, DestinationCtx: sysCtx}
+
+	registry, host := newTestRegistry(t)
+	seedTestImage(t, registry, "ns/image", "latest")
+
+	tmpDir := t.TempDir()
+
+	// Use a store in the temp dir instead of the default store.
+	storageName := fmt.Sprintf("containers-storage:[vfs@%s+%s]localhost/ns/image:latest", filepath.Join(tmpDir, "root"), filepath.Join(tmpDir, "runroot"))
+
+	storageRef, err := ParseImageName(storageName)
+	require.NoError(t, err)
+
+	srcRef, err := ParseImageName("docker://" + host + "/ns/image:latest")
+	require.NoError(t, err)
+
+	_, err = CopyImage(ctx, storageRef, srcRef, opts)
+	require.NoError(t, err)
+
+	// Push the image from container storage back to the registry.
+	dstRef, err := ParseImageName("docker://" + host + "/other/image:pushed")
+	require.NoError(t, err)
+
+	pushed, err := CopyImage(ctx, dstRef, storageRef, opts)
+	require.NoError(t, err)
+
+	// Layers are stored uncompressed, so the pushed manifest describes the
+	// uncompressed layer which was uploaded.
+	pushedManifest, ok := registry.getManifest("other/image", pushed.String())
+	require.True(t, ok)
+
+	m, err := manifest.Schema2FromManifest(pushedManifest.content)
+	require.NoError(t, err)
+	require.Len(t, m.LayersDescriptors, 1)
+	assert.Equal(t, manifest.DockerV2SchemaLayerMediaTypeUncompressed, m.LayersDescriptors[0].MediaType)
+	assert.True(t, registry.hasBlob(m.LayersDescriptors[0].Digest))
+}
+
+// Adds a single-layer image to the registry. Returns the digest of the layer.
+func seedTestImage(t *testing.T, registry *testRegistry, repo, tag string) digest.Digest {
+	t.Helper()
+
+	uncompressed := &bytes.Buffer{}
+	tw := tar.NewWriter(uncompressed)
+	content := []byte("hello world\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	_, err = gw.Write(uncompressed.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	layerDigest := registry.addBlob(compressed.Bytes())
+
+	config, err := json.Marshal(imgspecv1.Image{
+		Platform: imgspecv1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS: imgspecv1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromBytes(uncompressed.Bytes())},
+		},
+	})
+	require.NoError(t, err)
+
+	configDigest := registry.addBlob(config)
+
+	m := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Size: int64(len(config)), Digest: configDigest},
+		[]manifest.Schema2Descriptor{{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: int64(compressed.Len()), Digest: layerDigest}},
+	)
+
+	manifestBytes, err := m.Serialize()
+	require.NoError(t, err)
+
+	registry.addManifest(repo, tag, manifest.DockerV2Schema2MediaType, manifestBytes)
+
+	return layerDigest
+}
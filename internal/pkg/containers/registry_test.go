@@ -0,0 +1,216 @@
+package containers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// A minimal in-process implementation of the registry API, just enough for
+// containers/image to ping, pull, and push single images.
+type testRegistry struct {
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string]testManifest
+	uploads   map[string][]byte
+	// Responds with this status to this many requests before serving them.
+	unavailableStatus int
+	unavailableFor    int
+	requests          int
+}
+
+type testManifest struct {
+	mimeType string
+	content  []byte
+}
+
+// Starts a TLS server backed by a testRegistry which is stopped when the test
+// ends. Returns the registry and its host:port.
+func newTestRegistry(t *testing.T) (*testRegistry, string) {
+	t.Helper()
+
+	r := &testRegistry{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string]testManifest{},
+		uploads:   map[string][]byte{},
+	}
+
+	server := httptest.NewUnstartedServer(r)
+	// Silence the TLS handshake errors logged when containers/image falls
+	// back to plain HTTP.
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return r, strings.TrimPrefix(server.URL, "https://")
+}
+
+func (r *testRegistry) addBlob(content []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := digest.FromBytes(content)
+	r.blobs[d] = content
+	return d
+}
+
+func (r *testRegistry) addManifest(repo, tag, mimeType string, content []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := digest.FromBytes(content)
+	m := testManifest{mimeType: mimeType, content: content}
+	r.manifests[repo+":"+tag] = m
+	r.manifests[repo+"@"+d.String()] = m
+	return d
+}
+
+func (r *testRegistry) getManifest(repo, ref string) (testManifest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sep := ":"
+	if strings.HasPrefix(ref, "sha256:") {
+		sep = "@"
+	}
+
+	m, ok := r.manifests[repo+sep+ref]
+	return m, ok
+}
+
+func (r *testRegistry) hasBlob(d digest.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.blobs[d]
+	return ok
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests++
+	unavailable := r.requests <= r.unavailableFor
+	r.mu.Unlock()
+
+	if unavailable {
+		w.WriteHeader(r.unavailableStatus)
+		fmt.Fprint(w, "<html><body>Application is not available</body></html>")
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/manifests/"):
+		repo, ref, _ := strings.Cut(path, "/manifests/")
+		r.serveManifest(w, req, repo, ref)
+	case strings.Contains(path, "/blobs/uploads/"):
+		repo, id, _ := strings.Cut(path, "/blobs/uploads/")
+		r.serveUpload(w, req, repo, id)
+	case strings.Contains(path, "/blobs/"):
+		_, d, _ := strings.Cut(path, "/blobs/")
+		r.serveBlob(w, req, digest.Digest(d))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.getManifest(repo, ref)
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+
+		w.Header().Set("Content-Type", m.mimeType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.content).String())
+		w.Header().Set("Content-Length", fmt.Sprint(len(m.content)))
+		w.WriteHeader(http.StatusOK)
+
+		if req.Method == http.MethodGet {
+			w.Write(m.content)
+		}
+	case http.MethodPut:
+		content, _ := io.ReadAll(req.Body)
+		d := r.addManifest(repo, ref, req.Header.Get("Content-Type"), content)
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *testRegistry) serveBlob(w http.ResponseWriter, req *http.Request, d digest.Digest) {
+	r.mu.Lock()
+	content, ok := r.blobs[d]
+	r.mu.Unlock()
+
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch req.Method {
+	case http.MethodPost:
+		id = fmt.Sprintf("upload-%d", len(r.uploads))
+		r.uploads[id] = body
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		r.uploads[id] = append(r.uploads[id], body...)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(r.uploads[id])-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		content := append(r.uploads[id], body...)
+		delete(r.uploads, id)
+
+		d := digest.FromBytes(content)
+		if expected := req.URL.Query().Get("digest"); expected != d.String() {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+
+		r.blobs[d] = content
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, d))
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": strings.ToLower(code)}},
+	})
+}
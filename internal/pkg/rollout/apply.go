@@ -0,0 +1,497 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog"
+)
+
+// The label that MachineConfigPools use to select MachineConfigs.
+const machineConfigRoleLabel string = "machineconfiguration.openshift.io/role"
+
+// How long to wait for the pools to roll back if the caller did not specify.
+const defaultRevertTimeout time.Duration = 30 * time.Minute
+
+// Options for applying MachineConfigs and waiting for them to roll out.
+type ApplyOpts struct {
+	WaitOpts
+	// If the rollout fails, delete the MachineConfigs that were created,
+	// restore the MachineConfigs that were updated to their previous state, and
+	// wait for the affected pools to roll back to their original rendered
+	// configs.
+	DeleteOnFailure bool
+	// How long to wait for the affected pools to roll back. Defaults to 30
+	// minutes.
+	RevertTimeout time.Duration
+}
+
+// Records a MachineConfig that was applied so that it can be reverted.
+type appliedMachineConfig struct {
+	name string
+	// The MachineConfig as it was before we updated it. Nil if we created it.
+	previous *mcfgv1.MachineConfig
+	// Whether the MachineConfig was created or its contents changed.
+	changed bool
+}
+
+// Records the state of a pool before the MachineConfigs were applied.
+type appliedPool struct {
+	name             string
+	originalConfig   string
+	machineConfigs   []string
+	hasChangedConfig bool
+}
+
+// Reads MachineConfigs from the given YAML or JSON files. Each file may
+// contain multiple documents.
+func LoadMachineConfigsFromFiles(paths []string) ([]*mcfgv1.MachineConfig, error) {
+	out := []*mcfgv1.MachineConfig{}
+
+	for _, path := range paths {
+		mcs, err := loadMachineConfigsFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, mcs...)
+	}
+
+	return out, nil
+}
+
+func loadMachineConfigsFromFile(path string) ([]*mcfgv1.MachineConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+
+	defer f.Close()
+
+	decoder := kubeyaml.NewYAMLOrJSONDecoder(f, 4096)
+
+	out := []*mcfgv1.MachineConfig{}
+
+	for {
+		mc := &mcfgv1.MachineConfig{}
+
+		err := decoder.Decode(mc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not decode %s: %w", path, err)
+		}
+
+		// Skip empty documents.
+		if mc.Kind == "" && mc.Name == "" {
+			continue
+		}
+
+		if mc.Kind != "MachineConfig" {
+			return nil, fmt.Errorf("%s contains a %q, expected a MachineConfig", path, mc.Kind)
+		}
+
+		if mc.Name == "" {
+			return nil, fmt.Errorf("%s contains a MachineConfig without a name", path)
+		}
+
+		out = append(out, mc)
+	}
+
+	return out, nil
+}
+
+// Applies the given MachineConfigs and waits for exactly the pools that they
+// target to render and roll out a config containing them. The target pools are
+// paused while the MachineConfigs are applied so that all of them roll out
+// together in a single update.
+func ApplyMachineConfigsAndWait(ctx context.Context, cs *framework.ClientSet, mcs []*mcfgv1.MachineConfig, opts ApplyOpts) (err error) {
+	if len(mcs) == 0 {
+		return fmt.Errorf("no MachineConfigs given")
+	}
+
+	// The informers must outlive the given context so that we can still wait
+	// for the pools to revert if it expires.
+	trackerCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	w, err := newPoolWaiter(trackerCtx, cs, opts.WaitOpts)
+	if err != nil {
+		return err
+	}
+
+	return w.applyMachineConfigsAndWait(ctx, mcs, opts)
+}
+
+func (w *poolWaiter) applyMachineConfigsAndWait(ctx context.Context, mcs []*mcfgv1.MachineConfig, opts ApplyOpts) (err error) {
+	pools, err := w.tracker.listMachineConfigPools()
+	if err != nil {
+		return fmt.Errorf("could not list MachineConfigPools: %w", err)
+	}
+
+	poolsForMCs, err := getPoolsForMachineConfigs(pools, mcs)
+	if err != nil {
+		return err
+	}
+
+	poolNames := []string{}
+	for poolName := range poolsForMCs {
+		poolNames = append(poolNames, poolName)
+	}
+
+	sort.Strings(poolNames)
+
+	klog.Infof("MachineConfig(s) target MachineConfigPool(s): %v", poolNames)
+
+	defer func() {
+		w.reporter.summary(poolNames, err)
+	}()
+
+	applied := []*appliedPool{}
+
+	for _, poolName := range poolNames {
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
+		if err != nil {
+			return err
+		}
+
+		if mcp.Spec.Paused {
+			return fmt.Errorf("MachineConfigPool %s is paused, MachineConfigs would not roll out", poolName)
+		}
+
+		applied = append(applied, &appliedPool{
+			name:           poolName,
+			originalConfig: mcp.Spec.Configuration.Name,
+			machineConfigs: poolsForMCs[poolName],
+		})
+	}
+
+	appliedMCs, err := w.applyMachineConfigsToPausedPools(ctx, applied, mcs)
+	if err == nil {
+		err = w.waitForAppliedMachineConfigs(ctx, applied)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if !opts.DeleteOnFailure || len(appliedMCs) == 0 {
+		return err
+	}
+
+	klog.Errorf("Rollout failed, reverting MachineConfig(s): %s", err)
+
+	if revertErr := w.revertAppliedMachineConfigs(ctx, opts, applied, appliedMCs); revertErr != nil {
+		return fmt.Errorf("%w; revert also failed: %w", err, revertErr)
+	}
+
+	return fmt.Errorf("rollout failed and was reverted: %w", err)
+}
+
+// Pauses the given pools, applies the MachineConfigs, waits for each pool to
+// render a config containing them, and unpauses the pools again. Pausing
+// ensures that the nodes only roll out the final rendered config rather than
+// any intermediate ones. The pools are unpaused regardless of whether this
+// succeeded. Returns the MachineConfigs that were applied, even if an error
+// occurred.
+func (w *poolWaiter) applyMachineConfigsToPausedPools(ctx context.Context, pools []*appliedPool, mcs []*mcfgv1.MachineConfig) (applied []*appliedMachineConfig, err error) {
+	poolNames := getAppliedPoolNames(pools)
+
+	defer func() {
+		// The given context may have expired, but the pools must not be left
+		// paused.
+		unpauseErr := unpauseMachineConfigPools(context.WithoutCancel(ctx), w.cs, poolNames)
+		if unpauseErr != nil {
+			err = errors.Join(err, unpauseErr)
+		}
+	}()
+
+	for _, poolName := range poolNames {
+		if err := utils.PauseMachineConfigPoolWithReason(ctx, w.cs, poolName, "applying MachineConfigs"); err != nil {
+			return nil, fmt.Errorf("could not pause MachineConfigPool %s: %w", poolName, err)
+		}
+	}
+
+	applied, err = applyMachineConfigs(ctx, w.cs, mcs)
+	if err != nil {
+		return applied, err
+	}
+
+	changed := map[string]bool{}
+	for _, mc := range applied {
+		changed[mc.name] = mc.changed
+	}
+
+	eg := errgroup.Group{}
+
+	for _, pool := range pools {
+		pool := pool
+
+		for _, mcName := range pool.machineConfigs {
+			if changed[mcName] {
+				pool.hasChangedConfig = true
+			}
+		}
+
+		if !pool.hasChangedConfig {
+			klog.Infof("MachineConfig(s) for pool %s are unchanged, will wait for nodes to be running %s", pool.name, pool.originalConfig)
+		}
+
+		eg.Go(func() error {
+			return w.waitForPoolToTarget(ctx, pool.name, newAppliedMachineConfigsTarget(pool))
+		})
+	}
+
+	return applied, eg.Wait()
+}
+
+func unpauseMachineConfigPools(ctx context.Context, cs *framework.ClientSet, poolNames []string) error {
+	errs := []error{}
+
+	for _, poolName := range poolNames {
+		if err := utils.UnpauseMachineConfigPoolOnlyIfWePausedIt(ctx, cs, poolName); err != nil {
+			errs = append(errs, fmt.Errorf("could not unpause MachineConfigPool %s: %w", poolName, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Waits for all of the nodes in each pool to be running the rendered config
+// containing its MachineConfigs.
+func (w *poolWaiter) waitForAppliedMachineConfigs(ctx context.Context, pools []*appliedPool) error {
+	eg := errgroup.Group{}
+
+	for _, pool := range pools {
+		pool := pool
+
+		eg.Go(func() error {
+			return w.waitForPoolTarget(ctx, pool.name, newAppliedMachineConfigsTarget(pool))
+		})
+	}
+
+	return eg.Wait()
+}
+
+func getAppliedPoolNames(pools []*appliedPool) []string {
+	out := []string{}
+	for _, pool := range pools {
+		out = append(out, pool.name)
+	}
+
+	return out
+}
+
+// Deletes or restores the applied MachineConfigs and waits for the pools to
+// roll back to their original configs. A fresh context is used since the
+// original one may have already expired.
+func (w *poolWaiter) revertAppliedMachineConfigs(ctx context.Context, opts ApplyOpts, pools []*appliedPool, appliedMCs []*appliedMachineConfig) error {
+	timeout := opts.RevertTimeout
+	if timeout == 0 {
+		timeout = defaultRevertTimeout
+	}
+
+	revertCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	if err := revertMachineConfigs(revertCtx, w.cs, appliedMCs); err != nil {
+		return err
+	}
+
+	// Ensure that the pools are not left paused so that they can roll back.
+	if err := unpauseMachineConfigPools(revertCtx, w.cs, getAppliedPoolNames(pools)); err != nil {
+		return err
+	}
+
+	eg := errgroup.Group{}
+
+	for _, pool := range pools {
+		pool := pool
+
+		eg.Go(func() error {
+			klog.Infof("Waiting up to %s for pool %s to revert to %s", timeout, pool.name, pool.originalConfig)
+			return w.waitForPoolTarget(revertCtx, pool.name, newRenderedConfigTarget(pool.originalConfig))
+		})
+	}
+
+	return eg.Wait()
+}
+
+// Creates each MachineConfig, or updates it if it already exists. Returns the
+// MachineConfigs that were applied, even if an error occurred, so that they
+// may be reverted.
+func applyMachineConfigs(ctx context.Context, cs *framework.ClientSet, mcs []*mcfgv1.MachineConfig) ([]*appliedMachineConfig, error) {
+	applied := []*appliedMachineConfig{}
+
+	for _, mc := range mcs {
+		result, err := applyMachineConfig(ctx, cs, mc)
+		if err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, result)
+	}
+
+	return applied, nil
+}
+
+func applyMachineConfig(ctx context.Context, cs *framework.ClientSet, mc *mcfgv1.MachineConfig) (*appliedMachineConfig, error) {
+	toApply := mc.DeepCopy()
+	toApply.ResourceVersion = ""
+	toApply.UID = ""
+
+	_, err := cs.MachineConfigs().Create(ctx, toApply, metav1.CreateOptions{})
+	if err == nil {
+		klog.Infof("Created MachineConfig %s", mc.Name)
+		return &appliedMachineConfig{name: mc.Name, changed: true}, nil
+	}
+
+	if !apierrs.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("could not create MachineConfig %s: %w", mc.Name, err)
+	}
+
+	existing, err := cs.MachineConfigs().Get(ctx, mc.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get MachineConfig %s: %w", mc.Name, err)
+	}
+
+	result := &appliedMachineConfig{
+		name:     mc.Name,
+		previous: existing.DeepCopy(),
+		changed:  !equality.Semantic.DeepEqual(existing.Spec, toApply.Spec) || !equality.Semantic.DeepEqual(existing.Labels, toApply.Labels),
+	}
+
+	if !result.changed {
+		klog.Infof("MachineConfig %s is unchanged", mc.Name)
+		return result, nil
+	}
+
+	updated := existing.DeepCopy()
+	updated.Labels = toApply.Labels
+	updated.Annotations = toApply.Annotations
+	updated.Spec = toApply.Spec
+
+	if _, err := cs.MachineConfigs().Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("could not update MachineConfig %s: %w", mc.Name, err)
+	}
+
+	klog.Infof("Updated MachineConfig %s", mc.Name)
+
+	return result, nil
+}
+
+// Deletes the MachineConfigs that were created and restores the ones that
+// were updated.
+func revertMachineConfigs(ctx context.Context, cs *framework.ClientSet, applied []*appliedMachineConfig) error {
+	errs := []error{}
+
+	for _, mc := range applied {
+		if !mc.changed {
+			continue
+		}
+
+		if mc.previous == nil {
+			err := cs.MachineConfigs().Delete(ctx, mc.name, metav1.DeleteOptions{})
+			if err != nil && !apierrs.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("could not delete MachineConfig %s: %w", mc.name, err))
+				continue
+			}
+
+			klog.Infof("Deleted MachineConfig %s", mc.name)
+			continue
+		}
+
+		current, err := cs.MachineConfigs().Get(ctx, mc.name, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get MachineConfig %s: %w", mc.name, err))
+			continue
+		}
+
+		current.Labels = mc.previous.Labels
+		current.Annotations = mc.previous.Annotations
+		current.Spec = mc.previous.Spec
+
+		if _, err := cs.MachineConfigs().Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore MachineConfig %s: %w", mc.name, err))
+			continue
+		}
+
+		klog.Infof("Restored MachineConfig %s", mc.name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Determines which pools each MachineConfig targets. Each MachineConfig must
+// have a role label and must be selected by at least one pool. Returns a map
+// of pool name to the names of the MachineConfigs targeting it.
+func getPoolsForMachineConfigs(pools []*mcfgv1.MachineConfigPool, mcs []*mcfgv1.MachineConfig) (map[string][]string, error) {
+	out := map[string][]string{}
+
+	for _, mc := range mcs {
+		if _, ok := mc.Labels[machineConfigRoleLabel]; !ok {
+			return nil, fmt.Errorf("MachineConfig %s is missing the %q label", mc.Name, machineConfigRoleLabel)
+		}
+
+		found := false
+
+		for _, pool := range pools {
+			selector, err := metav1.LabelSelectorAsSelector(pool.Spec.MachineConfigSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MachineConfig selector for MachineConfigPool %s: %w", pool.Name, err)
+			}
+
+			if selector.Empty() || !selector.Matches(labels.Set(mc.Labels)) {
+				continue
+			}
+
+			out[pool.Name] = append(out[pool.Name], mc.Name)
+			found = true
+		}
+
+		if !found {
+			return nil, fmt.Errorf("MachineConfig %s with role %q is not selected by any MachineConfigPool", mc.Name, mc.Labels[machineConfigRoleLabel])
+		}
+	}
+
+	return out, nil
+}
+
+// Targets a rendered config containing all of the given MachineConfigs. If
+// any of them changed, the rendered config must also differ from the one the
+// pool had before they were applied since a MachineConfig which already
+// existed will already be in the original rendered config.
+func newAppliedMachineConfigsTarget(pool *appliedPool) *poolTarget {
+	return &poolTarget{
+		description: fmt.Sprintf("a rendered config containing MachineConfig(s) %v", pool.machineConfigs),
+		isPoolTargeting: func(mcp *mcfgv1.MachineConfigPool) bool {
+			for _, mcName := range pool.machineConfigs {
+				if !doesPoolConfigIncludeMachineConfig(mcp, mcName) {
+					return false
+				}
+			}
+
+			return !pool.hasChangedConfig || mcp.Spec.Configuration.Name != pool.originalConfig
+		},
+		isNodeDone: func(mcp *mcfgv1.MachineConfigPool, node *corev1.Node) bool {
+			return isNodeDoneAtRenderedConfig(node, mcp.Spec.Configuration.Name)
+		},
+	}
+}
@@ -0,0 +1,301 @@
+package rollout
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	fakemcfg "github.com/openshift/client-go/machineconfiguration/clientset/versioned/fake"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLoadMachineConfigsFromFiles(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+
+	multiDoc := `---
+apiVersion: machineconfiguration.openshift.io/v1
+kind: MachineConfig
+metadata:
+  name: 99-worker-a
+  labels:
+    machineconfiguration.openshift.io/role: worker
+---
+apiVersion: machineconfiguration.openshift.io/v1
+kind: MachineConfig
+metadata:
+  name: 99-worker-b
+  labels:
+    machineconfiguration.openshift.io/role: worker
+`
+
+	notMC := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-a-machineconfig
+`
+
+	multiDocPath := filepath.Join(tmpDir, "multi.yaml")
+	require.NoError(t, os.WriteFile(multiDocPath, []byte(multiDoc), 0o644))
+
+	notMCPath := filepath.Join(tmpDir, "configmap.yaml")
+	require.NoError(t, os.WriteFile(notMCPath, []byte(notMC), 0o644))
+
+	mcs, err := LoadMachineConfigsFromFiles([]string{multiDocPath})
+	require.NoError(t, err)
+	require.Len(t, mcs, 2)
+	assert.Equal(t, "99-worker-a", mcs[0].Name)
+	assert.Equal(t, "99-worker-b", mcs[1].Name)
+
+	_, err = LoadMachineConfigsFromFiles([]string{multiDocPath, notMCPath})
+	assert.ErrorContains(t, err, "expected a MachineConfig")
+
+	_, err = LoadMachineConfigsFromFiles([]string{filepath.Join(tmpDir, "missing.yaml")})
+	assert.Error(t, err)
+}
+
+func TestGetPoolsForMachineConfigs(t *testing.T) {
+	t.Parallel()
+
+	worker := newMachineConfigPoolWithMCSelector("worker", "rendered-worker-1")
+	master := newMachineConfigPoolWithMCSelector("master", "rendered-master-1")
+
+	// Custom pools typically select both worker MachineConfigs and their own.
+	infra := newMachineConfigPoolWithMCSelector("infra", "rendered-infra-1")
+	infra.Spec.MachineConfigSelector = &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      machineConfigRoleLabel,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   []string{"worker", "infra"},
+			},
+		},
+	}
+
+	pools := []*mcfgv1.MachineConfigPool{worker, master, infra}
+
+	testCases := []struct {
+		name        string
+		mcs         []*mcfgv1.MachineConfig
+		expected    map[string][]string
+		errExpected bool
+	}{
+		{
+			name: "Master MachineConfig",
+			mcs:  []*mcfgv1.MachineConfig{newMachineConfig("99-master-a", "master")},
+			expected: map[string][]string{
+				"master": {"99-master-a"},
+			},
+		},
+		{
+			name: "Worker MachineConfig is also selected by custom pool",
+			mcs:  []*mcfgv1.MachineConfig{newMachineConfig("99-worker-a", "worker")},
+			expected: map[string][]string{
+				"worker": {"99-worker-a"},
+				"infra":  {"99-worker-a"},
+			},
+		},
+		{
+			name: "Multiple MachineConfigs",
+			mcs: []*mcfgv1.MachineConfig{
+				newMachineConfig("99-infra-a", "infra"),
+				newMachineConfig("99-master-a", "master"),
+			},
+			expected: map[string][]string{
+				"infra":  {"99-infra-a"},
+				"master": {"99-master-a"},
+			},
+		},
+		{
+			name:        "Missing role label",
+			mcs:         []*mcfgv1.MachineConfig{newMachineConfig("99-none", "")},
+			errExpected: true,
+		},
+		{
+			name:        "Role without pool",
+			mcs:         []*mcfgv1.MachineConfig{newMachineConfig("99-other", "other")},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := getPoolsForMachineConfigs(pools, testCase.mcs)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, result)
+		})
+	}
+}
+
+func TestApplyMachineConfigsAndWait(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPoolWithMCSelector("worker", "rendered-worker-1")
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	mc := newMachineConfig("99-worker-test", "worker")
+
+	kubeclient, mcfgclient := newFakeClients(pool, node)
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.applyMachineConfigsAndWait(ctx, []*mcfgv1.MachineConfig{mc}, ApplyOpts{})
+	}()
+
+	// The pool should be paused while the MachineConfig is applied and rendered.
+	waitForPoolPauseState(ctx, t, mcfgclient, "worker", true)
+
+	_, err := mcfgclient.MachineconfigurationV1().MachineConfigs().Get(ctx, mc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	renderMachineConfigPool(ctx, t, mcfgclient, "worker", "rendered-worker-2", "99-worker-test")
+
+	waitForPoolPauseState(ctx, t, mcfgclient, "worker", false)
+
+	setNodeState(ctx, t, kubeclient, node, "rendered-worker-2", daemonconsts.MachineConfigDaemonStateDone)
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for MachineConfig to roll out")
+	}
+}
+
+func TestApplyMachineConfigsAndWaitRevertsOnFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPoolWithMCSelector("worker", "rendered-worker-1")
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	mc := newMachineConfig("99-worker-test", "worker")
+
+	kubeclient, mcfgclient := newFakeClients(pool, node)
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.applyMachineConfigsAndWait(ctx, []*mcfgv1.MachineConfig{mc}, ApplyOpts{DeleteOnFailure: true})
+	}()
+
+	waitForPoolPauseState(ctx, t, mcfgclient, "worker", true)
+	renderMachineConfigPool(ctx, t, mcfgclient, "worker", "rendered-worker-2", "99-worker-test")
+	waitForPoolPauseState(ctx, t, mcfgclient, "worker", false)
+
+	setNodeState(ctx, t, kubeclient, node, "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDegraded)
+
+	// The MachineConfig should be deleted once the node degrades.
+	require.Eventually(t, func() bool {
+		_, err := mcfgclient.MachineconfigurationV1().MachineConfigs().Get(ctx, mc.Name, metav1.GetOptions{})
+		return apierrs.IsNotFound(err)
+	}, time.Second*10, time.Millisecond*10)
+
+	renderMachineConfigPool(ctx, t, mcfgclient, "worker", "rendered-worker-1")
+	setNodeState(ctx, t, kubeclient, node, "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+
+	select {
+	case err := <-errCh:
+		assert.ErrorContains(t, err, "rollout failed and was reverted")
+		assert.ErrorContains(t, err, "Degraded")
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for revert")
+	}
+}
+
+func newTestPoolWaiterForApply(ctx context.Context, t *testing.T, kubeclient *fakekube.Clientset, mcfgclient *fakemcfg.Clientset) *poolWaiter {
+	t.Helper()
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	return newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{})
+}
+
+func waitForPoolPauseState(ctx context.Context, t *testing.T, mcfgclient *fakemcfg.Clientset, poolName string, paused bool) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		mcp, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+		require.NoError(t, err)
+		return mcp.Spec.Paused == paused
+	}, time.Second*10, time.Millisecond*10)
+}
+
+// Simulates the render controller by pointing the pool at a new rendered
+// config generated from the given MachineConfigs.
+func renderMachineConfigPool(ctx context.Context, t *testing.T, mcfgclient *fakemcfg.Clientset, poolName, renderedConfig string, mcNames ...string) {
+	t.Helper()
+
+	mcp, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	mcp.Spec.Configuration.Name = renderedConfig
+	mcp.Spec.Configuration.Source = []corev1.ObjectReference{{Name: "00-" + poolName}}
+
+	for _, mcName := range mcNames {
+		mcp.Spec.Configuration.Source = append(mcp.Spec.Configuration.Source, corev1.ObjectReference{Name: mcName})
+	}
+
+	_, err = mcfgclient.MachineconfigurationV1().MachineConfigPools().Update(ctx, mcp, metav1.UpdateOptions{})
+	require.NoError(t, err)
+}
+
+func setNodeState(ctx context.Context, t *testing.T, kubeclient *fakekube.Clientset, node *corev1.Node, renderedConfig, state string) {
+	t.Helper()
+
+	node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey] = renderedConfig
+	node.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey] = renderedConfig
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = state
+
+	_, err := kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+}
+
+func newMachineConfigPoolWithMCSelector(name, renderedConfig string) *mcfgv1.MachineConfigPool {
+	mcp := newMachineConfigPool(name, renderedConfig)
+	mcp.Spec.MachineConfigSelector = metav1.AddLabelToSelector(&metav1.LabelSelector{}, machineConfigRoleLabel, name)
+	mcp.Spec.Configuration.Source = []corev1.ObjectReference{{Name: "00-" + name}}
+	return mcp
+}
+
+func newMachineConfig(name, role string) *mcfgv1.MachineConfig {
+	mc := &mcfgv1.MachineConfig{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "MachineConfig",
+			APIVersion: mcfgv1.GroupVersion.String(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{},
+		},
+	}
+
+	if role != "" {
+		mc.Labels[machineConfigRoleLabel] = role
+	}
+
+	return mc
+}
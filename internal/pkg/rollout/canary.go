@@ -0,0 +1,538 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// Identifies canary pools created by this tool. The value is the name of
+	// the pool that the canary pool was created for.
+	canaryPoolLabelKey string = "machineconfiguration.openshift.io/canary-rollout-by-zacks-openshift-helpers"
+
+	nodeRoleLabelPrefix string = "node-role.kubernetes.io/"
+)
+
+// Verifies that the given nodes are healthy after they have been updated.
+// Returning an error aborts the rollout.
+type HealthCheckFunc func(ctx context.Context, nodes []string) error
+
+// Options for a canary rollout.
+type CanaryOpts struct {
+	WaitOpts
+	// The nodes to update in the first batch. If empty, the first batch is
+	// made up of the first BatchSize nodes which need to be updated.
+	CanaryNodes []string
+	// How many nodes to update in each batch after the canary batch. Defaults
+	// to 1.
+	BatchSize int
+	// If set, called after each batch finishes updating.
+	HealthCheck HealthCheckFunc
+}
+
+func (c *CanaryOpts) validate() error {
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch size must not be negative")
+	}
+
+	return nil
+}
+
+func (c *CanaryOpts) getBatchSize() int {
+	if c.BatchSize == 0 {
+		return 1
+	}
+
+	return c.BatchSize
+}
+
+// Holds the state for a single canary rollout.
+type canaryRollout struct {
+	w              *poolWaiter
+	opts           CanaryOpts
+	poolName       string
+	canaryPoolName string
+	// The nodes which have been moved into the canary pool.
+	movedNodes []string
+	// Whether this rollout paused the original pool, as opposed to it already
+	// being paused beforehand.
+	pausedPool bool
+}
+
+// Rolls out the pending config for the given pool in batches. The pool is
+// paused (unless it already was), then each batch of nodes is moved into a temporary canary pool which
+// renders the same config. Once a batch finishes updating, the health check is
+// run before moving on to the next batch. After every batch succeeds, the
+// nodes are returned to the original pool, the pool is unpaused if this
+// rollout paused it, and the canary pool is deleted.
+//
+// If a node degrades or a health check fails, the nodes are returned to the
+// original pool and the canary pool is deleted. The original pool is left
+// paused so that the remaining nodes do not receive the pending config.
+//
+// Because the MCO only allows a node to belong to a single custom pool, this
+// is only supported for the worker pool.
+func RolloutInBatches(ctx context.Context, cs *framework.ClientSet, poolName string, opts CanaryOpts) (err error) {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	// The informers must outlive the given context so that we can still
+	// restore the pool if it expires.
+	trackerCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	w, err := newPoolWaiter(trackerCtx, cs, opts.WaitOpts)
+	if err != nil {
+		return err
+	}
+
+	return w.rolloutInBatches(ctx, poolName, opts)
+}
+
+func (w *poolWaiter) rolloutInBatches(ctx context.Context, poolName string, opts CanaryOpts) (err error) {
+	if poolName != ctrlcommon.MachineConfigPoolWorker {
+		return fmt.Errorf("canary rollouts are only supported for the %s pool, got %s", ctrlcommon.MachineConfigPoolWorker, poolName)
+	}
+
+	c := &canaryRollout{
+		w:              w,
+		opts:           opts,
+		poolName:       poolName,
+		canaryPoolName: getCanaryPoolName(poolName),
+	}
+
+	defer func() {
+		w.reporter.summary([]string{c.poolName, c.canaryPoolName}, err)
+	}()
+
+	return c.run(ctx)
+}
+
+func (c *canaryRollout) run(ctx context.Context) error {
+	mcp, err := c.w.tracker.getMachineConfigPool(c.poolName)
+	if err != nil {
+		return err
+	}
+
+	// Everything which could reject the rollout is checked before the pool is
+	// paused so that it is not left paused by a rollout which never started.
+	pending, err := c.getNodesNeedingUpdate(mcp)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		klog.Infof("All nodes in pool %s are already running %s", c.poolName, mcp.Spec.Configuration.Name)
+		return c.finish(ctx)
+	}
+
+	batches, err := getCanaryBatches(pending, c.opts.CanaryNodes, c.opts.getBatchSize())
+	if err != nil {
+		return err
+	}
+
+	if !mcp.Spec.Paused {
+		if err := utils.PauseMachineConfigPoolWithReason(ctx, c.w.cs, c.poolName, "canary rollout"); err != nil {
+			return fmt.Errorf("could not pause MachineConfigPool %s: %w", c.poolName, err)
+		}
+
+		c.pausedPool = true
+	}
+
+	if err := c.createCanaryPool(ctx, getLargestBatchSize(batches)); err != nil {
+		return c.abort(ctx, err)
+	}
+
+	for i, batch := range batches {
+		klog.Infof("Starting batch %d/%d for pool %s: %v", i+1, len(batches), c.poolName, batch)
+
+		if err := c.rolloutBatch(ctx, batch); err != nil {
+			return c.abort(ctx, fmt.Errorf("batch %d/%d failed: %w", i+1, len(batches), err))
+		}
+
+		klog.Infof("Batch %d/%d for pool %s completed", i+1, len(batches), c.poolName)
+	}
+
+	return c.finish(ctx)
+}
+
+// Gets the names of the nodes in the pool which are not running its current
+// rendered config.
+func (c *canaryRollout) getNodesNeedingUpdate(mcp *mcfgv1.MachineConfigPool) ([]string, error) {
+	nodes, err := c.w.tracker.listNodesForPool(c.poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []string{}
+
+	for _, node := range nodes {
+		if !isNodeDoneAtRenderedConfig(node, mcp.Spec.Configuration.Name) {
+			pending = append(pending, node.Name)
+		}
+	}
+
+	sort.Strings(pending)
+
+	return pending, nil
+}
+
+// Moves the given nodes into the canary pool, waits for them to update, and
+// runs the health check.
+func (c *canaryRollout) rolloutBatch(ctx context.Context, batch []string) error {
+	if err := c.setCanaryRoleOnNodes(ctx, batch, true); err != nil {
+		return err
+	}
+
+	c.movedNodes = append(c.movedNodes, batch...)
+
+	if err := c.waitForNodesToJoinPool(ctx, c.canaryPoolName, batch); err != nil {
+		return err
+	}
+
+	if err := c.w.waitForPoolTarget(ctx, c.canaryPoolName, c.newCanaryPoolTarget()); err != nil {
+		return err
+	}
+
+	if c.opts.HealthCheck == nil {
+		return nil
+	}
+
+	klog.Infof("Running health check for node(s) %v", batch)
+
+	if err := c.opts.HealthCheck(ctx, batch); err != nil {
+		return fmt.Errorf("health check failed for node(s) %v: %w", batch, err)
+	}
+
+	klog.Infof("Health check passed for node(s) %v", batch)
+
+	return nil
+}
+
+// Returns every moved node to the original pool, unpauses it if this rollout
+// paused it, waits for all of its nodes to be running its rendered config, and
+// deletes the canary pool. Since the canary pool rendered the same config, the
+// nodes which were already updated do not need to reboot again.
+func (c *canaryRollout) finish(ctx context.Context) (err error) {
+	if err := c.returnNodesToPool(ctx); err != nil {
+		return c.abort(ctx, err)
+	}
+
+	// Once every node is back in the original pool, the canary pool is no
+	// longer needed, even if the original pool does not finish updating. The
+	// given context may have expired by then, but we should still clean up.
+	defer func() {
+		if deleteErr := c.deleteCanaryPool(context.WithoutCancel(ctx)); deleteErr != nil {
+			err = errors.Join(err, deleteErr)
+		}
+	}()
+
+	if c.pausedPool {
+		if err := utils.UnpauseMachineConfigPool(ctx, c.w.cs, c.poolName); err != nil {
+			return fmt.Errorf("could not unpause MachineConfigPool %s: %w", c.poolName, err)
+		}
+	} else if c.isPoolPaused() {
+		// The nodes cannot pick up the original pool's rendered config until
+		// it is unpaused, so there is nothing left to wait for.
+		klog.Infof("Leaving pool %s paused since it was paused before the canary rollout", c.poolName)
+		return nil
+	}
+
+	return c.w.waitForPoolTarget(ctx, c.poolName, newPoolConfigTarget())
+}
+
+// Determines whether the original pool is currently paused.
+func (c *canaryRollout) isPoolPaused() bool {
+	mcp, err := c.w.tracker.getMachineConfigPool(c.poolName)
+	return err == nil && mcp.Spec.Paused
+}
+
+// Returns every moved node to the original pool and deletes the canary pool.
+// The original pool is left paused so that the remaining nodes do not receive
+// the pending config.
+func (c *canaryRollout) abort(ctx context.Context, cause error) error {
+	klog.Errorf("Aborting canary rollout for pool %s: %s", c.poolName, cause)
+
+	// The given context may have expired, but we should still try to restore
+	// the pool.
+	ctx = context.WithoutCancel(ctx)
+
+	restoreErr := c.returnNodesToPool(ctx)
+	if restoreErr == nil {
+		restoreErr = c.deleteCanaryPool(ctx)
+	}
+
+	if restoreErr != nil {
+		return errors.Join(cause, fmt.Errorf("could not restore pool %s: %w", c.poolName, restoreErr))
+	}
+
+	return fmt.Errorf("canary rollout for pool %s aborted, pool left paused: %w", c.poolName, cause)
+}
+
+// Removes the canary role from the nodes which were moved and waits for them
+// to be back in the original pool.
+func (c *canaryRollout) returnNodesToPool(ctx context.Context) error {
+	if len(c.movedNodes) == 0 {
+		return nil
+	}
+
+	if err := c.setCanaryRoleOnNodes(ctx, c.movedNodes, false); err != nil {
+		return err
+	}
+
+	return c.waitForNodesToJoinPool(ctx, c.poolName, c.movedNodes)
+}
+
+// Creates the canary pool. It selects the same MachineConfigs as the original
+// pool so that it renders the same config, and only selects nodes with the
+// canary role.
+func (c *canaryRollout) createCanaryPool(ctx context.Context, maxUnavailable int) error {
+	canaryRole := nodeRoleLabelPrefix + c.canaryPoolName
+	maxUnavailableVal := intstr.FromInt(maxUnavailable)
+
+	canaryPool := &mcfgv1.MachineConfigPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: c.canaryPoolName,
+			Labels: map[string]string{
+				canaryPoolLabelKey: c.poolName,
+			},
+		},
+		Spec: mcfgv1.MachineConfigPoolSpec{
+			MachineConfigSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{
+						Key:      machineConfigRoleLabel,
+						Operator: metav1.LabelSelectorOpIn,
+						Values:   []string{c.poolName, c.canaryPoolName},
+					},
+				},
+			},
+			NodeSelector:   metav1.AddLabelToSelector(&metav1.LabelSelector{}, canaryRole, ""),
+			MaxUnavailable: &maxUnavailableVal,
+		},
+	}
+
+	_, err := c.w.cs.MachineConfigPools().Create(ctx, canaryPool, metav1.CreateOptions{})
+	if err == nil {
+		klog.Infof("Created canary MachineConfigPool %s", c.canaryPoolName)
+		return nil
+	}
+
+	if !apierrs.IsAlreadyExists(err) {
+		return fmt.Errorf("could not create canary MachineConfigPool %s: %w", c.canaryPoolName, err)
+	}
+
+	existing, err := c.w.cs.MachineConfigPools().Get(ctx, c.canaryPoolName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get existing MachineConfigPool %s: %w", c.canaryPoolName, err)
+	}
+
+	// A canary pool may have been left behind by a previous run which was
+	// interrupted, in which case it is safe to reuse.
+	if existing.Labels[canaryPoolLabelKey] != c.poolName {
+		return fmt.Errorf("MachineConfigPool %s already exists and is not managed by us, missing label %q", c.canaryPoolName, canaryPoolLabelKey)
+	}
+
+	klog.Infof("Reusing existing canary MachineConfigPool %s", c.canaryPoolName)
+	return nil
+}
+
+// Deletes the canary pool, but only if we created it.
+func (c *canaryRollout) deleteCanaryPool(ctx context.Context) error {
+	existing, err := c.w.cs.MachineConfigPools().Get(ctx, c.canaryPoolName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get canary MachineConfigPool %s: %w", c.canaryPoolName, err)
+	}
+
+	if existing.Labels[canaryPoolLabelKey] != c.poolName {
+		klog.Warningf("MachineConfigPool %s missing label %q, will not delete", c.canaryPoolName, canaryPoolLabelKey)
+		return nil
+	}
+
+	if err := c.w.cs.MachineConfigPools().Delete(ctx, c.canaryPoolName, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not delete canary MachineConfigPool %s: %w", c.canaryPoolName, err)
+	}
+
+	klog.Infof("Deleted canary MachineConfigPool %s", c.canaryPoolName)
+	return nil
+}
+
+// Adds or removes the canary node role label on the given nodes.
+func (c *canaryRollout) setCanaryRoleOnNodes(ctx context.Context, nodeNames []string, isCanary bool) error {
+	canaryRole := nodeRoleLabelPrefix + c.canaryPoolName
+
+	for _, nodeName := range nodeNames {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			node, err := c.w.cs.CoreV1Interface.Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			_, hasRole := node.Labels[canaryRole]
+			if hasRole == isCanary {
+				return nil
+			}
+
+			if isCanary {
+				metav1.SetMetaDataLabel(&node.ObjectMeta, canaryRole, "")
+			} else {
+				delete(node.Labels, canaryRole)
+			}
+
+			_, err = c.w.cs.CoreV1Interface.Nodes().Update(ctx, node, metav1.UpdateOptions{})
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("could not update canary role on node %s: %w", nodeName, err)
+		}
+
+		if isCanary {
+			klog.Infof("Moved node %s into pool %s", nodeName, c.canaryPoolName)
+		} else {
+			klog.Infof("Returned node %s to pool %s", nodeName, c.poolName)
+		}
+	}
+
+	return nil
+}
+
+// Waits until the tracker sees that all of the given nodes belong to the
+// given pool. Otherwise, waiting on the pool could finish before the nodes
+// were considered.
+func (c *canaryRollout) waitForNodesToJoinPool(ctx context.Context, poolName string, nodeNames []string) error {
+	want := sets.New[string](nodeNames...)
+
+	return c.w.tracker.waitUntil(ctx, func(_ context.Context) (bool, error) {
+		nodes, err := c.w.tracker.listNodesForPool(poolName)
+		if apierrs.IsNotFound(err) {
+			// The tracker may not have seen the canary pool yet.
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		have := sets.New[string]()
+		for _, node := range nodes {
+			have.Insert(node.Name)
+		}
+
+		return have.IsSuperset(want), nil
+	})
+}
+
+// The canary pool is ready once it has rendered a config from at least the
+// same MachineConfigs as the original pool. The canary pool may also include
+// MachineConfigs which the MCO generates for it specifically.
+func (c *canaryRollout) newCanaryPoolTarget() *poolTarget {
+	return &poolTarget{
+		description: fmt.Sprintf("the config rendered for pool %s", c.poolName),
+		isPoolTargeting: func(canary *mcfgv1.MachineConfigPool) bool {
+			original, err := c.w.tracker.getMachineConfigPool(c.poolName)
+			if err != nil {
+				return false
+			}
+
+			return canary.Spec.Configuration.Name != "" && getSourceNames(canary).IsSuperset(getSourceNames(original))
+		},
+		isNodeDone: func(canary *mcfgv1.MachineConfigPool, node *corev1.Node) bool {
+			return isNodeDoneAtRenderedConfig(node, canary.Spec.Configuration.Name)
+		},
+	}
+}
+
+// Targets whichever rendered config the pool currently has.
+func newPoolConfigTarget() *poolTarget {
+	return &poolTarget{
+		description: "the pool's current rendered config",
+		isPoolTargeting: func(mcp *mcfgv1.MachineConfigPool) bool {
+			return mcp.Spec.Configuration.Name != ""
+		},
+		isNodeDone: func(mcp *mcfgv1.MachineConfigPool, node *corev1.Node) bool {
+			return isNodeDoneAtRenderedConfig(node, mcp.Spec.Configuration.Name)
+		},
+	}
+}
+
+// Splits the nodes which need to be updated into batches. The canary nodes, if
+// given, make up the first batch.
+func getCanaryBatches(pending, canaryNodes []string, batchSize int) ([][]string, error) {
+	if batchSize < 1 {
+		return nil, fmt.Errorf("batch size must be at least 1, got %d", batchSize)
+	}
+
+	remaining := sets.New[string](pending...)
+	batches := [][]string{}
+
+	if len(canaryNodes) != 0 {
+		for _, node := range canaryNodes {
+			if !remaining.Has(node) {
+				return nil, fmt.Errorf("canary node %s is not in the pool or has already been updated", node)
+			}
+		}
+
+		remaining.Delete(canaryNodes...)
+		canaries := sets.List(sets.New[string](canaryNodes...))
+		batches = append(batches, canaries)
+	}
+
+	ordered := []string{}
+	for _, node := range pending {
+		if remaining.Has(node) {
+			ordered = append(ordered, node)
+		}
+	}
+
+	for len(ordered) > 0 {
+		end := min(batchSize, len(ordered))
+		batches = append(batches, ordered[:end])
+		ordered = ordered[end:]
+	}
+
+	return batches, nil
+}
+
+func getLargestBatchSize(batches [][]string) int {
+	largest := 0
+
+	for _, batch := range batches {
+		largest = max(largest, len(batch))
+	}
+
+	return largest
+}
+
+func getSourceNames(mcp *mcfgv1.MachineConfigPool) sets.Set[string] {
+	names := sets.New[string]()
+
+	for _, source := range mcp.Spec.Configuration.Source {
+		names.Insert(source.Name)
+	}
+
+	return names
+}
+
+func getCanaryPoolName(poolName string) string {
+	return poolName + "-canary"
+}
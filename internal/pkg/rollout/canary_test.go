@@ -0,0 +1,331 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	fakemcfg "github.com/openshift/client-go/machineconfiguration/clientset/versioned/fake"
+	mcfglistersv1 "github.com/openshift/client-go/machineconfiguration/listers/machineconfiguration/v1"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/pkg/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetCanaryBatches(t *testing.T) {
+	t.Parallel()
+
+	pending := []string{"node-0", "node-1", "node-2", "node-3", "node-4"}
+
+	testCases := []struct {
+		name        string
+		canaryNodes []string
+		batchSize   int
+		expected    [][]string
+		errExpected bool
+	}{
+		{
+			name:      "One node at a time",
+			batchSize: 1,
+			expected:  [][]string{{"node-0"}, {"node-1"}, {"node-2"}, {"node-3"}, {"node-4"}},
+		},
+		{
+			name:      "Uneven batches",
+			batchSize: 2,
+			expected:  [][]string{{"node-0", "node-1"}, {"node-2", "node-3"}, {"node-4"}},
+		},
+		{
+			name:        "Canary nodes go first",
+			canaryNodes: []string{"node-3"},
+			batchSize:   2,
+			expected:    [][]string{{"node-3"}, {"node-0", "node-1"}, {"node-2", "node-4"}},
+		},
+		{
+			name:        "Canary node not pending",
+			canaryNodes: []string{"node-9"},
+			batchSize:   1,
+			errExpected: true,
+		},
+		{
+			name:        "Invalid batch size",
+			batchSize:   0,
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			batches, err := getCanaryBatches(pending, testCase.canaryNodes, testCase.batchSize)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, batches)
+		})
+	}
+}
+
+func TestRolloutInBatches(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	kubeclient, mcfgclient := newCanaryTestClients(false)
+
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+
+	checked := &healthCheckRecorder{}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.rolloutInBatches(ctx, "worker", CanaryOpts{
+			CanaryNodes: []string{"worker-2"},
+			BatchSize:   2,
+			HealthCheck: checked.check,
+		})
+	}()
+
+	// Nodes are only updated once the rollout has paused the pool. Otherwise,
+	// the simulated node controller would update all of them at once.
+	waitForPoolPauseState(ctx, t, mcfgclient, "worker", true)
+
+	go simulateNodeController(ctx, kubeclient, mcfgclient)
+
+	require.NoError(t, <-errCh)
+
+	assert.Equal(t, [][]string{{"worker-2"}, {"worker-0", "worker-1"}}, checked.get())
+
+	// The canary pool should be gone and the worker pool unpaused.
+	_, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker-canary", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	mcp, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.False(t, mcp.Spec.Paused)
+
+	nodes, err := kubeclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+
+	for _, node := range nodes.Items {
+		assert.NotContains(t, node.Labels, nodeRoleLabelPrefix+"worker-canary")
+		assert.Equal(t, "rendered-worker-2", node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey])
+	}
+}
+
+func TestRolloutInBatchesLeavesPausedPoolPaused(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	kubeclient, mcfgclient := newCanaryTestClients(true)
+
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+	go simulateNodeController(ctx, kubeclient, mcfgclient)
+
+	require.NoError(t, w.rolloutInBatches(ctx, "worker", CanaryOpts{BatchSize: 3}))
+
+	_, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker-canary", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	// The pool was paused before the rollout, so it should still be.
+	mcp, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, mcp.Spec.Paused)
+}
+
+func TestRolloutInBatchesInvalidCanaryNode(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	kubeclient, mcfgclient := newCanaryTestClients(false)
+
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+
+	err := w.rolloutInBatches(ctx, "worker", CanaryOpts{CanaryNodes: []string{"nonexistent"}})
+	assert.ErrorContains(t, err, "canary node nonexistent is not in the pool")
+
+	// Nothing should have been changed.
+	mcp, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.False(t, mcp.Spec.Paused)
+
+	_, err = mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker-canary", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+}
+
+func TestRolloutInBatchesAbortsOnFailedHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	kubeclient, mcfgclient := newCanaryTestClients(true)
+
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+	go simulateNodeController(ctx, kubeclient, mcfgclient)
+
+	checked := &healthCheckRecorder{err: fmt.Errorf("node is unhealthy")}
+
+	err := w.rolloutInBatches(ctx, "worker", CanaryOpts{
+		HealthCheck: checked.check,
+	})
+
+	assert.ErrorContains(t, err, "aborted, pool left paused")
+	assert.ErrorContains(t, err, "node is unhealthy")
+	assert.Equal(t, [][]string{{"worker-0"}}, checked.get())
+
+	_, err = mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker-canary", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	mcp, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, mcp.Spec.Paused)
+
+	// Only the canary node should have been updated.
+	for _, name := range []string{"worker-0", "worker-1", "worker-2"} {
+		node, err := kubeclient.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, node.Labels, nodeRoleLabelPrefix+"worker-canary")
+
+		if name == "worker-0" {
+			assert.Equal(t, "rendered-worker-canary-2", node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey])
+		} else {
+			assert.Equal(t, "rendered-worker-1", node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey])
+		}
+	}
+}
+
+func TestRolloutInBatchesOnlySupportsWorkerPool(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	kubeclient, mcfgclient := newCanaryTestClients(true)
+
+	w := newTestPoolWaiterForApply(ctx, t, kubeclient, mcfgclient)
+
+	assert.ErrorContains(t, w.rolloutInBatches(ctx, "master", CanaryOpts{}), "only supported for the worker pool")
+}
+
+type healthCheckRecorder struct {
+	mux     sync.Mutex
+	batches [][]string
+	err     error
+}
+
+func (h *healthCheckRecorder) check(_ context.Context, nodes []string) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.batches = append(h.batches, append([]string{}, nodes...))
+	return h.err
+}
+
+func (h *healthCheckRecorder) get() [][]string {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	return h.batches
+}
+
+// Creates a worker pool which has rendered a new config that none of its nodes
+// are running yet.
+func newCanaryTestClients(paused bool) (*fakekube.Clientset, *fakemcfg.Clientset) {
+	pool := newMachineConfigPoolWithMCSelector("worker", "rendered-worker-2")
+	pool.Spec.Paused = paused
+	pool.Spec.Configuration.Source = append(pool.Spec.Configuration.Source, corev1.ObjectReference{Name: "99-worker-test"})
+
+	objects := []runtime.Object{pool}
+
+	for i := 0; i < 3; i++ {
+		objects = append(objects, newNode(fmt.Sprintf("worker-%d", i), "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone))
+	}
+
+	return newFakeClients(objects...)
+}
+
+// Simulates the parts of the render and node controllers that a canary rollout
+// depends on: new pools render a config from the same sources as the worker
+// pool, and nodes in unpaused pools are updated to their pool's config.
+func simulateNodeController(ctx context.Context, kubeclient *fakekube.Clientset, mcfgclient *fakemcfg.Clientset) {
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pools, err := mcfgclient.MachineconfigurationV1().MachineConfigPools().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			continue
+		}
+
+		poolPtrs := []*mcfgv1.MachineConfigPool{}
+		var worker *mcfgv1.MachineConfigPool
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+		for i := range pools.Items {
+			poolPtrs = append(poolPtrs, &pools.Items[i])
+			indexer.Add(&pools.Items[i])
+			if pools.Items[i].Name == "worker" {
+				worker = &pools.Items[i]
+			}
+		}
+
+		for _, pool := range poolPtrs {
+			if pool.Spec.Configuration.Name != "" || worker == nil {
+				continue
+			}
+
+			pool.Spec.Configuration.Name = fmt.Sprintf("rendered-%s-2", pool.Name)
+			pool.Spec.Configuration.Source = append([]corev1.ObjectReference{}, worker.Spec.Configuration.Source...)
+			mcfgclient.MachineconfigurationV1().MachineConfigPools().Update(ctx, pool, metav1.UpdateOptions{})
+		}
+
+		nodes, err := kubeclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			continue
+		}
+
+		for i := range nodes.Items {
+			node := &nodes.Items[i]
+
+			pool, err := helpers.GetPrimaryPoolForNode(mcfglistersv1.NewMachineConfigPoolLister(indexer), node)
+			if err != nil || pool == nil || pool.Spec.Paused || pool.Spec.Configuration.Name == "" {
+				continue
+			}
+
+			if node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey] == pool.Spec.Configuration.Name {
+				continue
+			}
+
+			node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey] = pool.Spec.Configuration.Name
+			node.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey] = pool.Spec.Configuration.Name
+			kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		}
+	}
+}
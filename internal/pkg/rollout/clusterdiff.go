@@ -0,0 +1,490 @@
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_5/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Values longer than this (e.g., certificates) are truncated when describing
+// a field change.
+const maxDiffValueLength int = 120
+
+// Holds the differences between two cluster snapshots.
+type ClusterSnapshotDiff struct {
+	// Objects which are only in the after snapshot, as <kind>/<name>.
+	Added []string
+	// Objects which are only in the before snapshot, as <kind>/<name>.
+	Removed []string
+	// Objects which are in both snapshots but differ.
+	Changed []ObjectDiff
+}
+
+// Holds the differences for a single object.
+type ObjectDiff struct {
+	Kind string
+	Name string
+	// Human-readable descriptions of each change. For MachineConfigs, changes
+	// to Ignition files and systemd units include a unified diff of their
+	// contents.
+	Changes []string
+}
+
+// Determines whether the two snapshots were identical.
+func (c *ClusterSnapshotDiff) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+func (c *ClusterSnapshotDiff) String() string {
+	if c.IsEmpty() {
+		return "No differences found\n"
+	}
+
+	sb := &strings.Builder{}
+
+	for _, added := range c.Added {
+		fmt.Fprintf(sb, "+ %s\n", added)
+	}
+
+	for _, removed := range c.Removed {
+		fmt.Fprintf(sb, "- %s\n", removed)
+	}
+
+	for _, changed := range c.Changed {
+		fmt.Fprintf(sb, "~ %s/%s\n", changed.Kind, changed.Name)
+
+		for _, change := range changed.Changes {
+			lines := strings.Split(strings.TrimRight(change, "\n"), "\n")
+			for i, line := range lines {
+				if i == 0 {
+					fmt.Fprintf(sb, "    %s\n", line)
+				} else {
+					fmt.Fprintf(sb, "      %s\n", line)
+				}
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+// Semantically compares two cluster snapshots. Objects are compared field by
+// field and the Ignition config within each MachineConfig is compared file by
+// file and unit by unit.
+func DiffClusterSnapshots(before, after *ClusterSnapshot) *ClusterSnapshotDiff {
+	diff := &ClusterSnapshotDiff{}
+
+	for _, kind := range snapshotKinds {
+		beforeObjs := before.Objects[kind]
+		afterObjs := after.Objects[kind]
+
+		for _, name := range getSortedKeys(beforeObjs, afterObjs) {
+			beforeObj, inBefore := beforeObjs[name]
+			afterObj, inAfter := afterObjs[name]
+
+			switch {
+			case !inBefore:
+				diff.Added = append(diff.Added, kind+"/"+name)
+			case !inAfter:
+				diff.Removed = append(diff.Removed, kind+"/"+name)
+			default:
+				changes := diffSnapshotObjects(kind, beforeObj, afterObj)
+				if len(changes) != 0 {
+					diff.Changed = append(diff.Changed, ObjectDiff{Kind: kind, Name: name, Changes: changes})
+				}
+			}
+		}
+	}
+
+	return diff
+}
+
+func diffSnapshotObjects(kind string, before, after map[string]interface{}) []string {
+	if kind != snapshotKindMachineConfigs {
+		return diffValues("", before, after)
+	}
+
+	beforeIgn, beforeErr := getIgnitionConfigFromSnapshotObject(before)
+	afterIgn, afterErr := getIgnitionConfigFromSnapshotObject(after)
+
+	// If either Ignition config cannot be parsed, fall back to comparing it
+	// like any other field.
+	if beforeErr != nil || afterErr != nil {
+		return diffValues("", before, after)
+	}
+
+	changes := diffValues("", withoutMachineConfigIgnition(before), withoutMachineConfigIgnition(after))
+	return append(changes, diffIgnitionConfigs(beforeIgn, afterIgn)...)
+}
+
+// Parses the Ignition config from an unstructured MachineConfig. Returns an
+// empty config if the MachineConfig does not have one.
+func getIgnitionConfigFromSnapshotObject(obj map[string]interface{}) (ign3types.Config, error) {
+	spec, _ := obj["spec"].(map[string]interface{})
+
+	raw, ok := spec["config"]
+	if !ok || raw == nil {
+		return ign3types.Config{}, nil
+	}
+
+	rawIgn, err := json.Marshal(raw)
+	if err != nil {
+		return ign3types.Config{}, fmt.Errorf("could not marshal Ignition config: %w", err)
+	}
+
+	return ctrlcommon.ParseAndConvertConfig(rawIgn)
+}
+
+// Returns a shallow copy of the given MachineConfig without its Ignition
+// config so that the remaining fields can be compared generically.
+func withoutMachineConfigIgnition(obj map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for key, val := range obj {
+		out[key] = val
+	}
+
+	spec, ok := obj["spec"].(map[string]interface{})
+	if !ok {
+		return out
+	}
+
+	specCopy := map[string]interface{}{}
+	for key, val := range spec {
+		if key != "config" {
+			specCopy[key] = val
+		}
+	}
+
+	out["spec"] = specCopy
+	return out
+}
+
+// Compares two Ignition configs. Files are compared by path and units by name
+// with their contents shown as unified diffs. Everything else (users, kernel
+// arguments, etc.) is compared field by field.
+func diffIgnitionConfigs(before, after ign3types.Config) []string {
+	changes := diffIgnitionFiles(before.Storage.Files, after.Storage.Files)
+	changes = append(changes, diffIgnitionUnits(before.Systemd.Units, after.Systemd.Units)...)
+
+	before.Storage.Files = nil
+	after.Storage.Files = nil
+	before.Systemd.Units = nil
+	after.Systemd.Units = nil
+
+	beforeRest, beforeErr := toUnstructuredJSON(before)
+	afterRest, afterErr := toUnstructuredJSON(after)
+	if beforeErr != nil || afterErr != nil {
+		if !reflect.DeepEqual(before, after) {
+			changes = append(changes, "spec.config: changed")
+		}
+
+		return changes
+	}
+
+	return append(changes, diffValues("spec.config", beforeRest, afterRest)...)
+}
+
+func diffIgnitionFiles(before, after []ign3types.File) []string {
+	beforeFiles := map[string]ign3types.File{}
+	for _, file := range before {
+		beforeFiles[file.Path] = file
+	}
+
+	afterFiles := map[string]ign3types.File{}
+	for _, file := range after {
+		afterFiles[file.Path] = file
+	}
+
+	changes := []string{}
+
+	for _, path := range getSortedKeys(beforeFiles, afterFiles) {
+		beforeFile, inBefore := beforeFiles[path]
+		afterFile, inAfter := afterFiles[path]
+
+		label := fmt.Sprintf("file %s", path)
+
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s: added (mode %s)\n%s", label, formatFileMode(afterFile.Mode), diffFileContents("", decodeFileContents(afterFile))))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s: removed", label))
+		default:
+			if !reflect.DeepEqual(beforeFile.Mode, afterFile.Mode) {
+				changes = append(changes, fmt.Sprintf("%s: mode %s -> %s", label, formatFileMode(beforeFile.Mode), formatFileMode(afterFile.Mode)))
+			}
+
+			if !reflect.DeepEqual(beforeFile.User, afterFile.User) || !reflect.DeepEqual(beforeFile.Group, afterFile.Group) {
+				changes = append(changes, fmt.Sprintf("%s: ownership changed", label))
+			}
+
+			beforeContents := decodeFileContents(beforeFile)
+			afterContents := decodeFileContents(afterFile)
+			if beforeContents != afterContents {
+				changes = append(changes, fmt.Sprintf("%s: contents changed\n%s", label, diffFileContents(beforeContents, afterContents)))
+			}
+		}
+	}
+
+	return changes
+}
+
+func diffIgnitionUnits(before, after []ign3types.Unit) []string {
+	beforeUnits := map[string]ign3types.Unit{}
+	for _, unit := range before {
+		beforeUnits[unit.Name] = unit
+	}
+
+	afterUnits := map[string]ign3types.Unit{}
+	for _, unit := range after {
+		afterUnits[unit.Name] = unit
+	}
+
+	changes := []string{}
+
+	for _, name := range getSortedKeys(beforeUnits, afterUnits) {
+		beforeUnit, inBefore := beforeUnits[name]
+		afterUnit, inAfter := afterUnits[name]
+
+		label := fmt.Sprintf("unit %s", name)
+
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s: added (enabled: %s, mask: %s)\n%s", label, formatBoolPtr(afterUnit.Enabled), formatBoolPtr(afterUnit.Mask), diffFileContents("", stringPtrValue(afterUnit.Contents))))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s: removed", label))
+		default:
+			if !reflect.DeepEqual(beforeUnit.Enabled, afterUnit.Enabled) {
+				changes = append(changes, fmt.Sprintf("%s: enabled %s -> %s", label, formatBoolPtr(beforeUnit.Enabled), formatBoolPtr(afterUnit.Enabled)))
+			}
+
+			if !reflect.DeepEqual(beforeUnit.Mask, afterUnit.Mask) {
+				changes = append(changes, fmt.Sprintf("%s: mask %s -> %s", label, formatBoolPtr(beforeUnit.Mask), formatBoolPtr(afterUnit.Mask)))
+			}
+
+			if stringPtrValue(beforeUnit.Contents) != stringPtrValue(afterUnit.Contents) {
+				changes = append(changes, fmt.Sprintf("%s: contents changed\n%s", label, diffFileContents(stringPtrValue(beforeUnit.Contents), stringPtrValue(afterUnit.Contents))))
+			}
+		}
+
+		changes = append(changes, diffIgnitionDropins(label, beforeUnit.Dropins, afterUnit.Dropins)...)
+	}
+
+	return changes
+}
+
+func diffIgnitionDropins(unitLabel string, before, after []ign3types.Dropin) []string {
+	beforeDropins := map[string]string{}
+	for _, dropin := range before {
+		beforeDropins[dropin.Name] = stringPtrValue(dropin.Contents)
+	}
+
+	afterDropins := map[string]string{}
+	for _, dropin := range after {
+		afterDropins[dropin.Name] = stringPtrValue(dropin.Contents)
+	}
+
+	changes := []string{}
+
+	for _, name := range getSortedKeys(beforeDropins, afterDropins) {
+		beforeContents, inBefore := beforeDropins[name]
+		afterContents, inAfter := afterDropins[name]
+
+		label := fmt.Sprintf("%s dropin %s", unitLabel, name)
+
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s: added\n%s", label, diffFileContents("", afterContents)))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s: removed", label))
+		case beforeContents != afterContents:
+			changes = append(changes, fmt.Sprintf("%s: contents changed\n%s", label, diffFileContents(beforeContents, afterContents)))
+		}
+	}
+
+	return changes
+}
+
+// Decodes the contents of an Ignition file. Contents which cannot be decoded
+// are described rather than returned verbatim.
+func decodeFileContents(file ign3types.File) string {
+	if file.Contents.Source == nil {
+		return ""
+	}
+
+	contents, err := ctrlcommon.DecodeIgnitionFileContents(file.Contents.Source, file.Contents.Compression)
+	if err != nil {
+		return fmt.Sprintf("<could not decode contents: %s>\n", err)
+	}
+
+	if !utf8.Valid(contents) {
+		return fmt.Sprintf("<%d bytes of binary contents>\n", len(contents))
+	}
+
+	return string(contents)
+}
+
+// Produces a unified diff of two text file contents.
+func diffFileContents(before, after string) string {
+	out, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(before),
+		B:        splitLines(after),
+		FromFile: "before",
+		ToFile:   "after",
+		Context:  3,
+	})
+
+	if err != nil {
+		return fmt.Sprintf("<could not diff contents: %s>", err)
+	}
+
+	return out
+}
+
+// Splits the given text into lines, keeping their line endings. Unlike
+// difflib.SplitLines, a trailing newline does not produce an extra empty line.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// Recursively compares two unstructured values and describes each difference
+// along with the path to it, e.g., "metadata.annotations.foo: "a" -> "b"".
+func diffValues(path string, before, after interface{}) []string {
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+
+	beforeMap, beforeIsMap := before.(map[string]interface{})
+	afterMap, afterIsMap := after.(map[string]interface{})
+
+	if beforeIsMap && afterIsMap {
+		changes := []string{}
+
+		for _, key := range getSortedKeys(beforeMap, afterMap) {
+			beforeVal, inBefore := beforeMap[key]
+			afterVal, inAfter := afterMap[key]
+
+			keyPath := joinDiffPath(path, key)
+
+			switch {
+			case !inBefore:
+				changes = append(changes, fmt.Sprintf("%s: added %s", keyPath, formatDiffValue(afterVal)))
+			case !inAfter:
+				changes = append(changes, fmt.Sprintf("%s: removed %s", keyPath, formatDiffValue(beforeVal)))
+			default:
+				changes = append(changes, diffValues(keyPath, beforeVal, afterVal)...)
+			}
+		}
+
+		return changes
+	}
+
+	beforeSlice, beforeIsSlice := before.([]interface{})
+	afterSlice, afterIsSlice := after.([]interface{})
+
+	if beforeIsSlice && afterIsSlice && len(beforeSlice) == len(afterSlice) {
+		changes := []string{}
+
+		for i := range beforeSlice {
+			changes = append(changes, diffValues(fmt.Sprintf("%s[%d]", path, i), beforeSlice[i], afterSlice[i])...)
+		}
+
+		return changes
+	}
+
+	return []string{fmt.Sprintf("%s: %s -> %s", path, formatDiffValue(before), formatDiffValue(after))}
+}
+
+func joinDiffPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func formatDiffValue(val interface{}) string {
+	out, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+
+	if len(out) > maxDiffValueLength {
+		return string(out[:maxDiffValueLength]) + "..."
+	}
+
+	return string(out)
+}
+
+func formatFileMode(mode *int) string {
+	if mode == nil {
+		return "default"
+	}
+
+	return fmt.Sprintf("%#o", *mode)
+}
+
+func formatBoolPtr(b *bool) string {
+	if b == nil {
+		return "unset"
+	}
+
+	return fmt.Sprintf("%t", *b)
+}
+
+func stringPtrValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+// Converts a typed value into its unstructured JSON form.
+func toUnstructuredJSON(in interface{}) (interface{}, error) {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Gets the sorted union of the keys of the given maps.
+func getSortedKeys[V any](maps ...map[string]V) []string {
+	seen := map[string]struct{}{}
+	for _, m := range maps {
+		for key := range m {
+			seen[key] = struct{}{}
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for key := range seen {
+		out = append(out, key)
+	}
+
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,304 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog"
+)
+
+// The kinds of objects included in a cluster snapshot. Each kind is written to
+// a subdirectory of the same name.
+const (
+	snapshotKindMachineConfigs     string = "machineconfigs"
+	snapshotKindMachineConfigPools string = "machineconfigpools"
+	snapshotKindControllerConfigs  string = "controllerconfigs"
+	snapshotKindMachineOSConfigs   string = "machineosconfigs"
+	snapshotKindMachineOSBuilds    string = "machineosbuilds"
+	snapshotKindNodes              string = "nodes"
+	snapshotKindConfigMaps         string = "configmaps"
+
+	snapshotFileExtension string = ".yaml"
+)
+
+var snapshotKinds = []string{
+	snapshotKindMachineConfigs,
+	snapshotKindMachineConfigPools,
+	snapshotKindControllerConfigs,
+	snapshotKindMachineOSConfigs,
+	snapshotKindMachineOSBuilds,
+	snapshotKindNodes,
+	snapshotKindConfigMaps,
+}
+
+// Holds the MCO-related state of a cluster at a point in time.
+type ClusterSnapshot struct {
+	// The snapshotted objects keyed by kind (e.g., machineconfigs) and then by
+	// name. Each object is stored in its unstructured form without the fields
+	// that change on every write (managedFields and resourceVersion).
+	Objects map[string]map[string]map[string]interface{}
+}
+
+func newClusterSnapshot() *ClusterSnapshot {
+	c := &ClusterSnapshot{
+		Objects: map[string]map[string]map[string]interface{}{},
+	}
+
+	for _, kind := range snapshotKinds {
+		c.Objects[kind] = map[string]map[string]interface{}{}
+	}
+
+	return c
+}
+
+// Snapshots the MachineConfigs, MachineConfigPools, ControllerConfigs,
+// MachineOSConfigs, MachineOSBuilds, node metadata, and the MCO images
+// ConfigMap.
+func TakeClusterSnapshot(ctx context.Context, cs *framework.ClientSet) (*ClusterSnapshot, error) {
+	snapshot := newClusterSnapshot()
+
+	objs, err := listSnapshotObjects(ctx, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	for kind, items := range objs {
+		for _, item := range items {
+			if err := snapshot.add(kind, item); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cm, err := cs.CoreV1Interface.ConfigMaps(ctrlcommon.MCONamespace).Get(ctx, mcoImagesConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get ConfigMap %s: %w", mcoImagesConfigMap, err)
+	}
+
+	if err := snapshot.add(snapshotKindConfigMaps, cm); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Lists every object which should be included in the snapshot, keyed by kind.
+func listSnapshotObjects(ctx context.Context, cs *framework.ClientSet) (map[string][]runtime.Object, error) {
+	out := map[string][]runtime.Object{}
+
+	mcfg := cs.MachineconfigurationV1Interface
+
+	mcList, err := mcfg.MachineConfigs().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineConfigs: %w", err)
+	}
+
+	for i := range mcList.Items {
+		out[snapshotKindMachineConfigs] = append(out[snapshotKindMachineConfigs], &mcList.Items[i])
+	}
+
+	mcpList, err := mcfg.MachineConfigPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineConfigPools: %w", err)
+	}
+
+	for i := range mcpList.Items {
+		out[snapshotKindMachineConfigPools] = append(out[snapshotKindMachineConfigPools], &mcpList.Items[i])
+	}
+
+	ccList, err := mcfg.ControllerConfigs().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list ControllerConfigs: %w", err)
+	}
+
+	for i := range ccList.Items {
+		out[snapshotKindControllerConfigs] = append(out[snapshotKindControllerConfigs], &ccList.Items[i])
+	}
+
+	// Older clusters may not serve the MachineOSConfig and MachineOSBuild APIs.
+	moscList, err := mcfg.MachineOSConfigs().List(ctx, metav1.ListOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return nil, fmt.Errorf("could not list MachineOSConfigs: %w", err)
+	}
+
+	if err == nil {
+		for i := range moscList.Items {
+			out[snapshotKindMachineOSConfigs] = append(out[snapshotKindMachineOSConfigs], &moscList.Items[i])
+		}
+	} else {
+		klog.Infof("MachineOSConfigs are not available, skipping")
+	}
+
+	mosbList, err := mcfg.MachineOSBuilds().List(ctx, metav1.ListOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return nil, fmt.Errorf("could not list MachineOSBuilds: %w", err)
+	}
+
+	if err == nil {
+		for i := range mosbList.Items {
+			out[snapshotKindMachineOSBuilds] = append(out[snapshotKindMachineOSBuilds], &mosbList.Items[i])
+		}
+	} else {
+		klog.Infof("MachineOSBuilds are not available, skipping")
+	}
+
+	nodeList, err := cs.CoreV1Interface.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list nodes: %w", err)
+	}
+
+	for i := range nodeList.Items {
+		out[snapshotKindNodes] = append(out[snapshotKindNodes], &nodeList.Items[i])
+	}
+
+	return out, nil
+}
+
+// Converts the given object into its unstructured form, strips the fields
+// that are irrelevant for comparison, and adds it to the snapshot. The object
+// is round-tripped through JSON so that it is identical to what
+// LoadClusterSnapshot would read back (e.g., all numbers are float64).
+func (c *ClusterSnapshot) add(kind string, obj runtime.Object) error {
+	raw, err := toUnstructuredJSON(obj)
+	if err != nil {
+		return fmt.Errorf("could not convert %T to unstructured: %w", obj, err)
+	}
+
+	u, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%T did not convert to an object", obj)
+	}
+
+	normalizeSnapshotObject(kind, u)
+
+	name := getSnapshotObjectName(u)
+	if name == "" {
+		return fmt.Errorf("%s object has no name", kind)
+	}
+
+	c.Objects[kind][name] = u
+	return nil
+}
+
+// Removes the fields which change on every write and carry no meaning for
+// comparing two snapshots. Node status (heartbeats, images, etc.) changes
+// constantly and is not relevant to the MCO, so it is removed as well.
+func normalizeSnapshotObject(kind string, u map[string]interface{}) {
+	if kind == snapshotKindNodes {
+		delete(u, "status")
+	}
+
+	metadata, ok := u["metadata"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	delete(metadata, "managedFields")
+	delete(metadata, "resourceVersion")
+}
+
+func getSnapshotObjectName(u map[string]interface{}) string {
+	metadata, ok := u["metadata"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	name, _ := metadata["name"].(string)
+	return name
+}
+
+// Writes the snapshot to the given directory with each object in its own
+// YAML file under a subdirectory named after its kind. The directory must
+// either not exist or be empty so that objects from a previous snapshot are
+// not mixed in.
+func (c *ClusterSnapshot) WriteToDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read snapshot dir %s: %w", dir, err)
+	}
+
+	if len(entries) != 0 {
+		return fmt.Errorf("snapshot dir %s is not empty", dir)
+	}
+
+	for _, kind := range snapshotKinds {
+		kindDir := filepath.Join(dir, kind)
+
+		if err := os.MkdirAll(kindDir, 0o755); err != nil {
+			return fmt.Errorf("could not create snapshot dir %s: %w", kindDir, err)
+		}
+
+		for name, obj := range c.Objects[kind] {
+			out, err := yaml.Marshal(obj)
+			if err != nil {
+				return fmt.Errorf("could not marshal %s/%s: %w", kind, name, err)
+			}
+
+			path := filepath.Join(kindDir, name+snapshotFileExtension)
+			if err := os.WriteFile(path, out, 0o644); err != nil {
+				return fmt.Errorf("could not write %s: %w", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Loads a snapshot previously written by WriteToDir. Kinds which are missing
+// from the directory are treated as having no objects.
+func LoadClusterSnapshot(dir string) (*ClusterSnapshot, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("could not load snapshot from %s: %w", dir, err)
+	}
+
+	snapshot := newClusterSnapshot()
+
+	for _, kind := range snapshotKinds {
+		kindDir := filepath.Join(dir, kind)
+
+		entries, err := os.ReadDir(kindDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not read snapshot dir %s: %w", kindDir, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), snapshotFileExtension) {
+				continue
+			}
+
+			path := filepath.Join(kindDir, entry.Name())
+
+			in, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s: %w", path, err)
+			}
+
+			obj := map[string]interface{}{}
+			if err := yaml.Unmarshal(in, &obj); err != nil {
+				return nil, fmt.Errorf("could not parse %s: %w", path, err)
+			}
+
+			name := getSnapshotObjectName(obj)
+			if name == "" {
+				return nil, fmt.Errorf("%s has no name", path)
+			}
+
+			snapshot.Objects[kind][name] = obj
+		}
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,269 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ign3types "github.com/coreos/ignition/v2/config/v3_5/types"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestTakeClusterSnapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+
+	mc := newMachineConfigWithIgnition(t, "99-worker-test", "hello\n", "[Unit]\n")
+	mc.ResourceVersion = "12345"
+	mc.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}
+
+	objs := append(getMCOObjects(t, "quay.io/org/mco@sha256:abc"),
+		mc,
+		newMachineConfigPool("worker", "rendered-worker-1"),
+		node,
+	)
+
+	snapshot, err := TakeClusterSnapshot(ctx, newFakeClientSet(objs...))
+	require.NoError(t, err)
+
+	assert.Contains(t, snapshot.Objects[snapshotKindMachineConfigs], "99-worker-test")
+	assert.Contains(t, snapshot.Objects[snapshotKindMachineConfigPools], "worker")
+	assert.Contains(t, snapshot.Objects[snapshotKindConfigMaps], mcoImagesConfigMap)
+	assert.Empty(t, snapshot.Objects[snapshotKindMachineOSBuilds])
+
+	metadata := snapshot.Objects[snapshotKindMachineConfigs]["99-worker-test"]["metadata"].(map[string]interface{})
+	assert.NotContains(t, metadata, "resourceVersion")
+	assert.NotContains(t, metadata, "managedFields")
+
+	// Node status is dropped, but annotations are kept.
+	snapshotNode := snapshot.Objects[snapshotKindNodes]["worker-0"]
+	assert.NotContains(t, snapshotNode, "status")
+	annotations := snapshotNode["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	assert.Equal(t, "rendered-worker-1", annotations[daemonconsts.CurrentMachineConfigAnnotationKey])
+
+	// The snapshot should survive being written to disk and loaded again.
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	require.NoError(t, snapshot.WriteToDir(dir))
+	assert.FileExists(t, filepath.Join(dir, snapshotKindMachineConfigs, "99-worker-test.yaml"))
+
+	loaded, err := LoadClusterSnapshot(dir)
+	require.NoError(t, err)
+	assert.True(t, DiffClusterSnapshots(snapshot, loaded).IsEmpty(), DiffClusterSnapshots(snapshot, loaded).String())
+
+	// Writing over an existing snapshot is refused.
+	assert.Error(t, snapshot.WriteToDir(dir))
+}
+
+func TestLoadClusterSnapshotMissingDir(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadClusterSnapshot(filepath.Join(t.TempDir(), "does-not-exist"))
+	assert.Error(t, err)
+
+	// Kinds which are not present are treated as empty.
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, snapshotKindNodes), 0o755))
+
+	snapshot, err := LoadClusterSnapshot(dir)
+	require.NoError(t, err)
+	assert.Empty(t, snapshot.Objects[snapshotKindMachineConfigs])
+}
+
+func TestDiffClusterSnapshots(t *testing.T) {
+	t.Parallel()
+
+	beforeNode := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	afterNode := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-2", daemonconsts.MachineConfigDaemonStateWorking)
+	afterNode.ResourceVersion = "999"
+
+	before := newTestClusterSnapshot(t,
+		newMachineConfigWithIgnition(t, "99-worker-test", "line-1\nline-2\n", "[Service]\nExecStart=/bin/true\n"),
+		newMachineConfigWithIgnition(t, "99-worker-removed", "", ""),
+		beforeNode,
+	)
+
+	after := newTestClusterSnapshot(t,
+		newMachineConfigWithIgnition(t, "99-worker-test", "line-1\nline-2-changed\n", "[Service]\nExecStart=/bin/false\n"),
+		newMachineConfigWithIgnition(t, "99-worker-added", "", ""),
+		afterNode,
+	)
+
+	diff := DiffClusterSnapshots(before, after)
+
+	assert.Equal(t, []string{"machineconfigs/99-worker-added"}, diff.Added)
+	assert.Equal(t, []string{"machineconfigs/99-worker-removed"}, diff.Removed)
+	require.Len(t, diff.Changed, 2)
+
+	mcDiff := diff.Changed[0]
+	assert.Equal(t, snapshotKindMachineConfigs, mcDiff.Kind)
+	assert.Equal(t, "99-worker-test", mcDiff.Name)
+	require.Len(t, mcDiff.Changes, 2)
+	assert.Contains(t, mcDiff.Changes[0], "file /etc/test-file: contents changed")
+	assert.Contains(t, mcDiff.Changes[0], "-line-2\n")
+	assert.Contains(t, mcDiff.Changes[0], "+line-2-changed\n")
+	assert.Contains(t, mcDiff.Changes[1], "unit test.service: contents changed")
+	assert.Contains(t, mcDiff.Changes[1], "+ExecStart=/bin/false\n")
+
+	// The resourceVersion change is ignored.
+	nodeDiff := diff.Changed[1]
+	assert.Equal(t, snapshotKindNodes, nodeDiff.Kind)
+	assert.ElementsMatch(t, []string{
+		`metadata.annotations.machineconfiguration.openshift.io/desiredConfig: "rendered-worker-1" -> "rendered-worker-2"`,
+		`metadata.annotations.machineconfiguration.openshift.io/state: "Done" -> "Working"`,
+	}, nodeDiff.Changes)
+
+	out := diff.String()
+	assert.True(t, strings.HasPrefix(out, "+ machineconfigs/99-worker-added\n- machineconfigs/99-worker-removed\n~ machineconfigs/99-worker-test\n"), out)
+
+	assert.True(t, DiffClusterSnapshots(before, before).IsEmpty())
+}
+
+func TestDiffValues(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		before   interface{}
+		after    interface{}
+		expected []string
+	}{
+		{
+			name:   "Equal",
+			before: map[string]interface{}{"a": "b"},
+			after:  map[string]interface{}{"a": "b"},
+		},
+		{
+			name:     "Added and removed keys",
+			before:   map[string]interface{}{"a": "b"},
+			after:    map[string]interface{}{"c": int64(1)},
+			expected: []string{`a: removed "b"`, `c: added 1`},
+		},
+		{
+			name:     "Nested change",
+			before:   map[string]interface{}{"spec": map[string]interface{}{"paused": false}},
+			after:    map[string]interface{}{"spec": map[string]interface{}{"paused": true}},
+			expected: []string{`spec.paused: false -> true`},
+		},
+		{
+			name:     "Same length lists are compared by index",
+			before:   map[string]interface{}{"list": []interface{}{"a", "b"}},
+			after:    map[string]interface{}{"list": []interface{}{"a", "c"}},
+			expected: []string{`list[1]: "b" -> "c"`},
+		},
+		{
+			name:     "Different length lists are compared whole",
+			before:   map[string]interface{}{"list": []interface{}{"a"}},
+			after:    map[string]interface{}{"list": []interface{}{"a", "b"}},
+			expected: []string{`list: ["a"] -> ["a","b"]`},
+		},
+		{
+			name:     "Long values are truncated",
+			before:   map[string]interface{}{"cert": strings.Repeat("a", 200)},
+			after:    map[string]interface{}{"cert": strings.Repeat("b", 200)},
+			expected: []string{`cert: "` + strings.Repeat("a", maxDiffValueLength-1) + `... -> "` + strings.Repeat("b", maxDiffValueLength-1) + `...`},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, testCase.expected, diffValues("", testCase.before, testCase.after))
+		})
+	}
+}
+
+func TestDiffIgnitionConfigs(t *testing.T) {
+	t.Parallel()
+
+	enabled := true
+	mode := 0o644
+	otherMode := 0o755
+
+	before := ctrlcommon.NewIgnConfig()
+	before.Storage.Files = []ign3types.File{ctrlcommon.NewIgnFile("/etc/removed", "gone\n"), ctrlcommon.NewIgnFile("/etc/mode", "same\n")}
+	before.Storage.Files[1].Mode = &mode
+
+	after := ctrlcommon.NewIgnConfig()
+	after.Storage.Files = []ign3types.File{ctrlcommon.NewIgnFile("/etc/added", "new\n"), ctrlcommon.NewIgnFile("/etc/mode", "same\n")}
+	after.Storage.Files[1].Mode = &otherMode
+	after.Systemd.Units = []ign3types.Unit{
+		{
+			Name:    "added.service",
+			Enabled: &enabled,
+			Dropins: []ign3types.Dropin{{Name: "10-override.conf"}},
+		},
+	}
+	after.Passwd.Users = []ign3types.PasswdUser{{Name: "core", SSHAuthorizedKeys: []ign3types.SSHAuthorizedKey{"ssh-ed25519 key"}}}
+
+	changes := diffIgnitionConfigs(before, after)
+	require.Len(t, changes, 6)
+
+	assert.True(t, strings.HasPrefix(changes[0], "file /etc/added: added (mode 0644)\n"), changes[0])
+	assert.Contains(t, changes[0], "+new\n")
+	assert.Equal(t, "file /etc/mode: mode 0644 -> 0755", changes[1])
+	assert.Equal(t, "file /etc/removed: removed", changes[2])
+	assert.True(t, strings.HasPrefix(changes[3], "unit added.service: added (enabled: true, mask: unset)"), changes[3])
+	assert.True(t, strings.HasPrefix(changes[4], "unit added.service dropin 10-override.conf: added"), changes[4])
+	assert.True(t, strings.HasPrefix(changes[5], "spec.config.passwd.users: "), changes[5])
+}
+
+func newTestClusterSnapshot(t *testing.T, objs ...runtime.Object) *ClusterSnapshot {
+	t.Helper()
+
+	snapshot := newClusterSnapshot()
+
+	for _, obj := range objs {
+		kind := snapshotKindNodes
+		if _, ok := obj.(*mcfgv1.MachineConfig); ok {
+			kind = snapshotKindMachineConfigs
+		}
+
+		require.NoError(t, snapshot.add(kind, obj))
+	}
+
+	return snapshot
+}
+
+// Creates a MachineConfig which writes /etc/test-file with the given contents
+// and configures test.service with the given unit contents. Either are
+// omitted if empty.
+func newMachineConfigWithIgnition(t *testing.T, name, fileContents, unitContents string) *mcfgv1.MachineConfig {
+	t.Helper()
+
+	ignConfig := ctrlcommon.NewIgnConfig()
+
+	if fileContents != "" {
+		ignConfig.Storage.Files = append(ignConfig.Storage.Files, ctrlcommon.NewIgnFile("/etc/test-file", fileContents))
+	}
+
+	if unitContents != "" {
+		ignConfig.Systemd.Units = append(ignConfig.Systemd.Units, ign3types.Unit{
+			Name:     "test.service",
+			Contents: &unitContents,
+		})
+	}
+
+	raw, err := json.Marshal(ignConfig)
+	require.NoError(t, err)
+
+	mc := newMachineConfig(name, "worker")
+	mc.Spec.Config = runtime.RawExtension{Raw: raw}
+
+	return mc
+}
@@ -3,129 +3,343 @@ package rollout
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	errhelpers "github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/errors"
+	"github.com/distribution/reference"
 	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 	"github.com/openshift/machine-config-operator/test/framework"
 	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
 )
 
+const (
+	componentKindDeployment string = "deployment"
+	componentKindDaemonset  string = "daemonset"
+)
+
+// Prefixes that container runtimes may add to a container status ImageID.
+var imageIDPrefixes = []string{
+	"docker-pullable://",
+	"docker://",
+}
+
+// Holds the rollout status of a single MCO deployment or daemonset.
+type componentStatus struct {
+	// The name of the deployment or daemonset.
+	name string
+	// Whether this is a deployment or daemonset.
+	kind string
+	// Whether the object exists at all. The machine-os-builder is only present
+	// when on-cluster layering is in use.
+	exists bool
+	// Whether the controller has observed the latest generation.
+	observed bool
+	// How many pods the controller wants.
+	desired int32
+	// How many pods are running the target image and are ready.
+	updated int32
+	// How many pods exist for the component, including those on the old image.
+	total int32
+}
+
+// Determines whether the component has fully rolled out.
+func (c *componentStatus) isDone() bool {
+	if !c.exists {
+		return true
+	}
+
+	return c.observed && c.updated == c.desired && c.total == c.desired
+}
+
+func (c *componentStatus) String() string {
+	if !c.exists {
+		return fmt.Sprintf("%s/%s: not present", c.kind, c.name)
+	}
+
+	if !c.observed {
+		return fmt.Sprintf("%s/%s: waiting for controller to observe latest generation", c.kind, c.name)
+	}
+
+	return fmt.Sprintf("%s/%s: %d/%d pod(s) updated and ready, %d total", c.kind, c.name, c.updated, c.desired, c.total)
+}
+
+func (c *componentStatus) equal(other *componentStatus) bool {
+	if other == nil {
+		return false
+	}
+
+	return *c == *other
+}
+
 func WaitForRolloutToComplete(cs *framework.ClientSet, digestedPullspec string, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	allComponents := sets.New[string](mcoDaemonsets...).Insert(mcoDeployments...)
-	updatedComponents := sets.New[string]()
+	klog.Infof("Waiting up to %s for MCO components to roll out %s", timeout, digestedPullspec)
 
-	return wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
-		for _, daemonset := range mcoDaemonsets {
-			if updatedComponents.Has(daemonset) {
-				continue
-			}
+	return WaitForRolloutToCompleteWithContext(ctx, cs, digestedPullspec)
+}
 
-			isUpdated, err := isDaemonsetUpToDate(ctx, cs, daemonset, digestedPullspec)
-			if err != nil {
-				return false, err
-			}
+// Waits for all of the MCO deployments and daemonsets to be running the given
+// digested pullspec. Progress is logged whenever a component's status changes.
+func WaitForRolloutToCompleteWithContext(ctx context.Context, cs *framework.ClientSet, digestedPullspec string) error {
+	digest, err := getDigestFromPullspec(digestedPullspec)
+	if err != nil {
+		return err
+	}
 
-			if isUpdated {
-				updatedComponents.Insert(daemonset)
-			}
+	return waitForComponentStatuses(ctx, cs, getAllMCOComponents(), func(pod *corev1.Pod, componentName string) bool {
+		return isPodOnLatestPullspec(pod, componentName, digest)
+	}, fmt.Sprintf("rolled out %s", digestedPullspec))
+}
+
+// Waits for the given MCO components to finish rolling out. A pod is
+// considered updated when the given function returns true for it. Progress is
+// logged whenever a component's status changes.
+func waitForComponentStatuses(ctx context.Context, cs *framework.ClientSet, components []string, isUpdated isPodUpdatedFunc, description string) error {
+	start := time.Now()
+
+	previous := map[string]*componentStatus{}
+
+	retryer := errhelpers.NewTimeRetryer(retryableErrThreshold)
+
+	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
+		statuses, err := getStatusesForComponents(ctx, cs, components, isUpdated)
+
+		shouldContinue, err := handleQueryErr(err, retryer)
+		if err != nil {
+			return false, err
 		}
 
-		for _, deployment := range mcoDeployments {
-			if updatedComponents.Has(deployment) {
-				continue
-			}
+		if !shouldContinue {
+			return false, nil
+		}
 
-			isUpdated, err := isDeploymenttUpToDate(ctx, cs, deployment, digestedPullspec)
-			if err != nil {
-				return false, err
+		isDone := true
+		remaining := []string{}
+
+		for _, status := range statuses {
+			if !status.equal(previous[status.name]) {
+				klog.Infof("%s after %s", status, time.Since(start))
+				previous[status.name] = status
 			}
 
-			if isUpdated {
-				updatedComponents.Insert(deployment)
+			if !status.isDone() {
+				isDone = false
+				remaining = append(remaining, status.name)
 			}
 		}
 
-		return updatedComponents.Equal(allComponents), nil
+		if isDone {
+			klog.Infof("MCO component(s) %v %s after %s", components, description, time.Since(start))
+		} else {
+			klog.V(4).Infof("Waiting on MCO component(s): %v", remaining)
+		}
+
+		return isDone, nil
 	})
 }
 
-func isAllPodsForComponentUpdated(ctx context.Context, cs *framework.ClientSet, componentName, digestedPullspec string) (bool, error) {
+// Determines whether a pod belonging to the named MCO component is running the
+// desired revision of it.
+type isPodUpdatedFunc func(pod *corev1.Pod, componentName string) bool
+
+// Gets the names of every MCO daemonset and deployment.
+func getAllMCOComponents() []string {
+	return append(append([]string{}, mcoDaemonsets...), mcoDeployments...)
+}
+
+// Determines whether the named MCO component is a daemonset.
+func isMCODaemonset(name string) bool {
+	for _, ds := range mcoDaemonsets {
+		if ds == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gets the rollout status for each of the named MCO components.
+func getStatusesForComponents(ctx context.Context, cs *framework.ClientSet, components []string, isUpdated isPodUpdatedFunc) ([]*componentStatus, error) {
+	out := []*componentStatus{}
+
+	for _, name := range components {
+		var status *componentStatus
+		var err error
+
+		if isMCODaemonset(name) {
+			status, err = getDaemonsetStatus(ctx, cs, name, isUpdated)
+		} else {
+			status, err = getDeploymentStatus(ctx, cs, name, isUpdated)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, status)
+	}
+
+	return out, nil
+}
+
+func getDeploymentStatus(ctx context.Context, cs *framework.ClientSet, name string, isUpdated isPodUpdatedFunc) (*componentStatus, error) {
+	status := &componentStatus{
+		name: name,
+		kind: componentKindDeployment,
+	}
+
+	dp, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+	if name == "machine-os-builder" && apierrs.IsNotFound(err) {
+		return status, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not get deployment/%s: %w", name, err)
+	}
+
+	status.exists = true
+	status.observed = dp.Status.ObservedGeneration >= dp.Generation
+	status.desired = 1
+	if dp.Spec.Replicas != nil {
+		status.desired = *dp.Spec.Replicas
+	}
+
+	if err := countUpdatedPodsForComponent(ctx, cs, status, isUpdated); err != nil {
+		return nil, err
+	}
+
+	// If the controller has not yet brought up the updated replicas, the pods
+	// cannot be considered updated regardless of what they're running.
+	if dp.Status.UpdatedReplicas < status.desired || dp.Status.AvailableReplicas < status.desired {
+		status.updated = min(status.updated, dp.Status.UpdatedReplicas, dp.Status.AvailableReplicas)
+	}
+
+	return status, nil
+}
+
+func getDaemonsetStatus(ctx context.Context, cs *framework.ClientSet, name string, isUpdated isPodUpdatedFunc) (*componentStatus, error) {
+	status := &componentStatus{
+		name: name,
+		kind: componentKindDaemonset,
+	}
+
+	ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get daemonset/%s: %w", name, err)
+	}
+
+	status.exists = true
+	status.observed = ds.Status.ObservedGeneration >= ds.Generation
+	status.desired = ds.Status.DesiredNumberScheduled
+
+	if err := countUpdatedPodsForComponent(ctx, cs, status, isUpdated); err != nil {
+		return nil, err
+	}
+
+	if ds.Status.UpdatedNumberScheduled < status.desired || ds.Status.NumberAvailable < status.desired {
+		status.updated = min(status.updated, ds.Status.UpdatedNumberScheduled, ds.Status.NumberAvailable)
+	}
+
+	return status, nil
+}
+
+// Counts the pods for the given component and how many of those are updated.
+// Pods which are being deleted are ignored.
+func countUpdatedPodsForComponent(ctx context.Context, cs *framework.ClientSet, status *componentStatus, isUpdated isPodUpdatedFunc) error {
 	pods, err := cs.CoreV1Interface.Pods(ctrlcommon.MCONamespace).List(ctx, metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("k8s-app=%s", componentName),
+		LabelSelector: fmt.Sprintf("k8s-app=%s", status.name),
 	})
 
 	if err != nil {
-		return false, err
+		return fmt.Errorf("could not list pods for %s/%s: %w", status.kind, status.name, err)
 	}
 
 	for _, pod := range pods.Items {
 		pod := pod
-		if !isPodOnLatestPullspec(&pod, componentName, digestedPullspec) {
-			return false, nil
+
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		status.total++
+
+		if isUpdated(&pod, status.name) {
+			status.updated++
 		}
 	}
 
-	return true, nil
+	return nil
 }
 
-func isPodOnLatestPullspec(pod *corev1.Pod, componentName, digestedPullspec string) bool {
-	trueBool := true
+// Determines whether the named container within the given pod is running the
+// given digest and that it has started and is ready.
+func isPodOnLatestPullspec(pod *corev1.Pod, componentName, digest string) bool {
+	status := getReadyContainerStatus(pod, componentName)
+	if status == nil {
+		return false
+	}
 
-	for _, status := range pod.Status.ContainerStatuses {
-		if status.Name != componentName {
-			continue
-		}
+	return getDigestFromImageID(status.ImageID) == digest
+}
 
-		if status.ImageID != digestedPullspec {
-			return false
-		}
+// Gets the status of the named container within the given pod if the pod is
+// running and the container has started and is ready. Returns nil otherwise.
+func getReadyContainerStatus(pod *corev1.Pod, containerName string) *corev1.ContainerStatus {
+	if pod.Status.Phase != corev1.PodRunning {
+		return nil
+	}
 
-		if !status.Ready {
-			return false
-		}
+	for i := range pod.Status.ContainerStatuses {
+		status := &pod.Status.ContainerStatuses[i]
 
-		if status.Started == nil {
-			return false
+		if status.Name != containerName {
+			continue
 		}
 
-		if status.Started != &trueBool {
-			return false
+		if status.Started == nil || !*status.Started || !status.Ready {
+			return nil
 		}
 
-		return true
+		return status
 	}
 
-	return false
+	return nil
 }
 
-func isDeploymenttUpToDate(ctx context.Context, cs *framework.ClientSet, componentName, digestedPullspec string) (bool, error) {
-	dp, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(ctx, componentName, metav1.GetOptions{})
+// Gets the digest from the given digested pullspec.
+func getDigestFromPullspec(digestedPullspec string) (string, error) {
+	named, err := reference.ParseNamed(digestedPullspec)
 	if err != nil {
-		return false, err
+		return "", fmt.Errorf("could not parse pullspec %s: %w", digestedPullspec, err)
 	}
 
-	if dp.Status.Replicas != dp.Status.UpdatedReplicas {
-		return false, nil
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return "", fmt.Errorf("pullspec %s is not digested", digestedPullspec)
 	}
 
-	return isAllPodsForComponentUpdated(ctx, cs, componentName, digestedPullspec)
+	return canonical.Digest().String(), nil
 }
 
-func isDaemonsetUpToDate(ctx context.Context, cs *framework.ClientSet, componentName, digestedPullspec string) (bool, error) {
-	ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(ctx, componentName, metav1.GetOptions{})
-	if err != nil {
-		return false, err
+// Normalizes a container status ImageID down to its digest. Container
+// runtimes may prefix the ImageID (e.g., docker-pullable://) and the
+// repository portion may refer to a registry mirror rather than the pullspec
+// that was requested, so only the digest is meaningful for comparison.
+func getDigestFromImageID(imageID string) string {
+	for _, prefix := range imageIDPrefixes {
+		imageID = strings.TrimPrefix(imageID, prefix)
 	}
 
-	if ds.Status.DesiredNumberScheduled != ds.Status.UpdatedNumberScheduled {
-		return false, nil
+	if idx := strings.LastIndex(imageID, "@"); idx != -1 {
+		return imageID[idx+1:]
 	}
 
-	return isAllPodsForComponentUpdated(ctx, cs, componentName, digestedPullspec)
+	return imageID
 }
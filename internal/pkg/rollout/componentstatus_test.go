@@ -0,0 +1,358 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	targetDigest     string = "sha256:628e4e8f0a78d91015c7cebeee95931b5ef8d8f89b2d4a4e4c4b3e8a48f0ee0a"
+	oldDigest        string = "sha256:1b1e5ad2d5c4a0ac56c3c0b9e63f77d25b5c3b4d3c1b5e7a0f3c9a2a17b7f0c1"
+	targetPullspec   string = "quay.io/org/mco@" + targetDigest
+	mirroredImageID  string = "mirror.host.com/org/mco@" + targetDigest
+	dockerPullableID string = "docker-pullable://quay.io/org/mco@" + targetDigest
+)
+
+func TestGetDigestFromImageID(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		imageID  string
+		expected string
+	}{
+		{
+			imageID:  targetPullspec,
+			expected: targetDigest,
+		},
+		{
+			imageID:  dockerPullableID,
+			expected: targetDigest,
+		},
+		{
+			imageID:  "docker://" + targetDigest,
+			expected: targetDigest,
+		},
+		{
+			imageID:  mirroredImageID,
+			expected: targetDigest,
+		},
+		{
+			imageID:  targetDigest,
+			expected: targetDigest,
+		},
+		{
+			imageID:  "",
+			expected: "",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.imageID, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, testCase.expected, getDigestFromImageID(testCase.imageID))
+		})
+	}
+}
+
+func TestIsPodOnLatestPullspec(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		pod      *corev1.Pod
+		expected bool
+	}{
+		{
+			name:     "updated and ready",
+			pod:      newComponentPod("mcc", "machine-config-controller", targetPullspec, true, true),
+			expected: true,
+		},
+		{
+			name:     "updated and ready with docker-pullable prefix",
+			pod:      newComponentPod("mcc", "machine-config-controller", dockerPullableID, true, true),
+			expected: true,
+		},
+		{
+			name:     "updated and ready from registry mirror",
+			pod:      newComponentPod("mcc", "machine-config-controller", mirroredImageID, true, true),
+			expected: true,
+		},
+		{
+			name:     "old digest",
+			pod:      newComponentPod("mcc", "machine-config-controller", "quay.io/org/mco@"+oldDigest, true, true),
+			expected: false,
+		},
+		{
+			name:     "not ready",
+			pod:      newComponentPod("mcc", "machine-config-controller", targetPullspec, true, false),
+			expected: false,
+		},
+		{
+			name:     "not started",
+			pod:      newComponentPod("mcc", "machine-config-controller", targetPullspec, false, true),
+			expected: false,
+		},
+		{
+			name: "started is nil",
+			pod: func() *corev1.Pod {
+				pod := newComponentPod("mcc", "machine-config-controller", targetPullspec, true, true)
+				pod.Status.ContainerStatuses[0].Started = nil
+				return pod
+			}(),
+			expected: false,
+		},
+		{
+			name: "pod pending",
+			pod: func() *corev1.Pod {
+				pod := newComponentPod("mcc", "machine-config-controller", targetPullspec, true, true)
+				pod.Status.Phase = corev1.PodPending
+				return pod
+			}(),
+			expected: false,
+		},
+		{
+			name: "only sidecar container is updated",
+			pod: func() *corev1.Pod {
+				pod := newComponentPod("mcc", "machine-config-controller", "quay.io/org/mco@"+oldDigest, true, true)
+				pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+					Name:    "kube-rbac-proxy",
+					ImageID: targetPullspec,
+					Ready:   true,
+					Started: boolPtr(true),
+				})
+				return pod
+			}(),
+			expected: false,
+		},
+		{
+			name: "component container missing",
+			pod: func() *corev1.Pod {
+				pod := newComponentPod("mcc", "machine-config-controller", targetPullspec, true, true)
+				pod.Status.ContainerStatuses[0].Name = "other"
+				return pod
+			}(),
+			expected: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, testCase.expected, isPodOnLatestPullspec(testCase.pod, "machine-config-controller", targetDigest))
+		})
+	}
+}
+
+func TestGetComponentStatuses(t *testing.T) {
+	t.Parallel()
+
+	updatedDeployment := func(name string, replicas int32) *appsv1.Deployment {
+		dp := newDeployment(name, ctrlcommon.MCONamespace, targetPullspec)
+		dp.Generation = 2
+		dp.Spec.Replicas = &replicas
+		dp.Status = appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			Replicas:           replicas,
+			UpdatedReplicas:    replicas,
+			AvailableReplicas:  replicas,
+		}
+		return dp
+	}
+
+	updatedDaemonset := func(name string, nodes int32) *appsv1.DaemonSet {
+		ds := newDaemonset(name, targetPullspec)
+		ds.Generation = 3
+		ds.Status = appsv1.DaemonSetStatus{
+			ObservedGeneration:     3,
+			DesiredNumberScheduled: nodes,
+			UpdatedNumberScheduled: nodes,
+			NumberAvailable:        nodes,
+		}
+		return ds
+	}
+
+	updatedPods := func(component string, count int) []runtime.Object {
+		out := []runtime.Object{}
+		for i := 0; i < count; i++ {
+			out = append(out, newComponentPod(fmt.Sprintf("%s-%d", component, i), component, targetPullspec, true, true))
+		}
+		return out
+	}
+
+	allUpdated := func() []runtime.Object {
+		objs := []runtime.Object{
+			updatedDeployment("machine-config-operator", 1),
+			updatedDeployment("machine-config-controller", 1),
+			updatedDaemonset("machine-config-daemon", 3),
+			updatedDaemonset("machine-config-server", 2),
+		}
+
+		objs = append(objs, updatedPods("machine-config-operator", 1)...)
+		objs = append(objs, updatedPods("machine-config-controller", 1)...)
+		objs = append(objs, updatedPods("machine-config-daemon", 3)...)
+		objs = append(objs, updatedPods("machine-config-server", 2)...)
+		return objs
+	}
+
+	testCases := []struct {
+		name        string
+		objects     func() []runtime.Object
+		notDone     []string
+		errExpected bool
+	}{
+		{
+			name:    "all components updated, machine-os-builder absent",
+			objects: allUpdated,
+		},
+		{
+			name: "deployment generation not observed",
+			objects: func() []runtime.Object {
+				objs := allUpdated()
+				objs[1].(*appsv1.Deployment).Status.ObservedGeneration = 1
+				return objs
+			},
+			notDone: []string{"machine-config-controller"},
+		},
+		{
+			name: "daemonset still rolling",
+			objects: func() []runtime.Object {
+				objs := allUpdated()
+				objs[2].(*appsv1.DaemonSet).Status.UpdatedNumberScheduled = 2
+				return objs
+			},
+			notDone: []string{"machine-config-daemon"},
+		},
+		{
+			name: "old pod still running",
+			objects: func() []runtime.Object {
+				objs := allUpdated()
+				return append(objs, newComponentPod("mcc-old", "machine-config-controller", "quay.io/org/mco@"+oldDigest, true, true))
+			},
+			notDone: []string{"machine-config-controller"},
+		},
+		{
+			name: "terminating old pod is ignored",
+			objects: func() []runtime.Object {
+				objs := allUpdated()
+				pod := newComponentPod("mcc-old", "machine-config-controller", "quay.io/org/mco@"+oldDigest, true, true)
+				now := metav1.Now()
+				pod.DeletionTimestamp = &now
+				pod.Finalizers = []string{"test"}
+				return append(objs, pod)
+			},
+		},
+		{
+			name: "daemonset pod not ready",
+			objects: func() []runtime.Object {
+				objs := allUpdated()
+				objs = append(objs[:len(objs)-1], newComponentPod("machine-config-server-1", "machine-config-server", targetPullspec, true, false))
+				return objs
+			},
+			notDone: []string{"machine-config-server"},
+		},
+		{
+			name: "machine-os-builder present but not updated",
+			objects: func() []runtime.Object {
+				objs := allUpdated()
+				return append(objs, updatedDeployment("machine-os-builder", 1))
+			},
+			notDone: []string{"machine-os-builder"},
+		},
+		{
+			name: "daemonset missing",
+			objects: func() []runtime.Object {
+				return allUpdated()[:2]
+			},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			cs := newFakeClientSet(testCase.objects()...)
+
+			statuses, err := getStatusesForComponents(context.TODO(), cs, getAllMCOComponents(), func(pod *corev1.Pod, componentName string) bool {
+				return isPodOnLatestPullspec(pod, componentName, targetDigest)
+			})
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			notDone := []string{}
+			for _, status := range statuses {
+				if !status.isDone() {
+					notDone = append(notDone, status.name)
+				}
+			}
+
+			assert.ElementsMatch(t, testCase.notDone, notDone)
+		})
+	}
+}
+
+func TestWaitForRolloutToComplete(t *testing.T) {
+	t.Parallel()
+
+	assert.Error(t, WaitForRolloutToComplete(newFakeClientSet(), "quay.io/org/mco:latest", time.Millisecond))
+
+	objs := []runtime.Object{}
+	for _, name := range mcoDeployments[:2] {
+		replicas := int32(1)
+		dp := newDeployment(name, ctrlcommon.MCONamespace, targetPullspec)
+		dp.Spec.Replicas = &replicas
+		dp.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+		objs = append(objs, dp, newComponentPod(name, name, targetPullspec, true, true))
+	}
+
+	for _, name := range mcoDaemonsets {
+		ds := newDaemonset(name, targetPullspec)
+		ds.Status = appsv1.DaemonSetStatus{DesiredNumberScheduled: 1, UpdatedNumberScheduled: 1, NumberAvailable: 1}
+		objs = append(objs, ds, newComponentPod(name, name, targetPullspec, true, true))
+	}
+
+	assert.NoError(t, WaitForRolloutToComplete(newFakeClientSet(objs...), targetPullspec, time.Second*5))
+}
+
+func newComponentPod(name, component, imageID string, started, ready bool) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ctrlcommon.MCONamespace,
+			Labels: map[string]string{
+				"k8s-app": component,
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:    component,
+					ImageID: imageID,
+					Ready:   ready,
+					Started: boolPtr(started),
+				},
+			},
+		},
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
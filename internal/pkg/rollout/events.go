@@ -0,0 +1,292 @@
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"k8s.io/klog"
+)
+
+// The kind of progress event emitted while waiting on MachineConfigPools.
+type ProgressEventType string
+
+const (
+	// The pool began updating.
+	PoolStartedEvent ProgressEventType = "PoolStarted"
+	// The machine counts in the pool status changed.
+	PoolCountsChangedEvent ProgressEventType = "PoolCountsChanged"
+	// A node in the pool reached its target state.
+	NodeUpdatedEvent ProgressEventType = "NodeUpdated"
+	// A node's phase (e.g., Working, Draining, Rebooting) or cordon state
+	// changed.
+	NodePhaseChangedEvent ProgressEventType = "NodePhaseChanged"
+	// A node has been in its current phase for longer than the configured
+	// threshold.
+	NodeStuckEvent ProgressEventType = "NodeStuck"
+	// The MachineOSBuild for a layered pool changed state (e.g., Building,
+	// Succeeded).
+	BuildPhaseChangedEvent ProgressEventType = "BuildPhaseChanged"
+	// The pool (or one of its nodes) became degraded.
+	PoolDegradedEvent ProgressEventType = "PoolDegraded"
+	// The pool and all of its nodes finished updating.
+	PoolCompletedEvent ProgressEventType = "PoolCompleted"
+	// Emitted once at the end of a wait with the overall result.
+	SummaryEvent ProgressEventType = "Summary"
+)
+
+// The machine counts from a MachineConfigPool status.
+type PoolCounts struct {
+	Machines    int32 `json:"machines"`
+	Ready       int32 `json:"ready"`
+	Updated     int32 `json:"updated"`
+	Unavailable int32 `json:"unavailable"`
+	Degraded    int32 `json:"degraded"`
+}
+
+func newPoolCounts(mcp *mcfgv1.MachineConfigPool) *PoolCounts {
+	return &PoolCounts{
+		Machines:    mcp.Status.MachineCount,
+		Ready:       mcp.Status.ReadyMachineCount,
+		Updated:     mcp.Status.UpdatedMachineCount,
+		Unavailable: mcp.Status.UnavailableMachineCount,
+		Degraded:    mcp.Status.DegradedMachineCount,
+	}
+}
+
+// The result of waiting on a single pool.
+type PoolSummary struct {
+	// Whether the pool and all of its nodes finished updating.
+	Completed bool `json:"completed"`
+	// How long the pool took to finish updating, in seconds.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	// How long each node took to update, in seconds, keyed by node name. This
+	// is measured from when the node was first seen leaving Done until it
+	// became Done again, so nodes which were never seen updating are omitted.
+	NodeUpdateSeconds map[string]float64 `json:"nodeUpdateSeconds,omitempty"`
+	// The observed phase transitions for each node, keyed by node name.
+	NodeTimelines map[string][]NodePhaseTransition `json:"nodeTimelines,omitempty"`
+}
+
+// The overall result of a wait.
+type Summary struct {
+	Pools map[string]*PoolSummary `json:"pools"`
+	Error string                  `json:"error,omitempty"`
+}
+
+// A single progress event emitted while waiting on MachineConfigPools.
+type ProgressEvent struct {
+	Type      ProgressEventType `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	// How long it has been since the wait began, in seconds.
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	Pool           string  `json:"pool,omitempty"`
+	Node           string  `json:"node,omitempty"`
+	// Populated for PoolCountsChanged events.
+	PreviousCounts *PoolCounts `json:"previousCounts,omitempty"`
+	Counts         *PoolCounts `json:"counts,omitempty"`
+	// The nodes in the pool which have not yet updated. Populated for
+	// NodeUpdated events.
+	RemainingNodes []string `json:"remainingNodes,omitempty"`
+	// The node phase and cordon state. Populated for NodePhaseChanged and
+	// NodeStuck events.
+	Phase    NodePhase `json:"phase,omitempty"`
+	Cordoned bool      `json:"cordoned,omitempty"`
+	// How long the node has been in its current phase, in seconds. Populated
+	// for NodeStuck events.
+	PhaseSeconds float64 `json:"phaseSeconds,omitempty"`
+	// The MachineOSBuild name and state. Populated for BuildPhaseChanged
+	// events.
+	Build      string `json:"build,omitempty"`
+	BuildPhase string `json:"buildPhase,omitempty"`
+	Message    string `json:"message,omitempty"`
+	// Populated for Summary events.
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Receives progress events. Handlers may be called concurrently when waiting
+// on multiple pools.
+type ProgressHandler func(ProgressEvent)
+
+// Returns a ProgressHandler which sends each event to the given channel. Note
+// that this blocks the wait until the event is received.
+func NewChannelProgressHandler(ch chan<- ProgressEvent) ProgressHandler {
+	return func(event ProgressEvent) {
+		ch <- event
+	}
+}
+
+// Returns a ProgressHandler which writes each event to the given writer as a
+// single line of JSON.
+func NewJSONLinesProgressHandler(w io.Writer) ProgressHandler {
+	mu := &sync.Mutex{}
+	encoder := json.NewEncoder(w)
+
+	return func(event ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err := encoder.Encode(event); err != nil {
+			klog.Warningf("Could not write progress event: %s", err)
+		}
+	}
+}
+
+// Builds progress events, sends them to the configured handler, and keeps
+// track of per-pool and per-node durations for the final summary.
+type progressReporter struct {
+	handler ProgressHandler
+	start   time.Time
+
+	mu    sync.Mutex
+	pools map[string]*PoolSummary
+}
+
+func newProgressReporter(handler ProgressHandler) *progressReporter {
+	return &progressReporter{
+		handler: handler,
+		start:   time.Now(),
+		pools:   map[string]*PoolSummary{},
+	}
+}
+
+func (p *progressReporter) emit(event ProgressEvent) {
+	if p.handler == nil {
+		return
+	}
+
+	event.Timestamp = time.Now()
+	event.ElapsedSeconds = time.Since(p.start).Seconds()
+	p.handler(event)
+}
+
+// Gets the summary for the given pool, creating it if needed. Must be called
+// with the lock held.
+func (p *progressReporter) poolSummary(poolName string) *PoolSummary {
+	if _, ok := p.pools[poolName]; !ok {
+		p.pools[poolName] = &PoolSummary{
+			NodeUpdateSeconds: map[string]float64{},
+		}
+	}
+
+	return p.pools[poolName]
+}
+
+func (p *progressReporter) poolStarted(poolName string) {
+	p.emit(ProgressEvent{
+		Type: PoolStartedEvent,
+		Pool: poolName,
+	})
+}
+
+func (p *progressReporter) poolCountsChanged(previous, current *mcfgv1.MachineConfigPool) {
+	p.emit(ProgressEvent{
+		Type:           PoolCountsChangedEvent,
+		Pool:           current.Name,
+		PreviousCounts: newPoolCounts(previous),
+		Counts:         newPoolCounts(current),
+	})
+}
+
+func (p *progressReporter) nodeUpdated(poolName, nodeName string, remaining []string) {
+	p.emit(ProgressEvent{
+		Type:           NodeUpdatedEvent,
+		Pool:           poolName,
+		Node:           nodeName,
+		RemainingNodes: remaining,
+	})
+}
+
+// Records how long the given node took to update in the summary.
+func (p *progressReporter) nodeUpdateDuration(poolName, nodeName string, took time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.poolSummary(poolName).NodeUpdateSeconds[nodeName] = took.Seconds()
+}
+
+func (p *progressReporter) nodePhaseChanged(poolName, nodeName string, transition NodePhaseTransition) {
+	p.emit(ProgressEvent{
+		Type:     NodePhaseChangedEvent,
+		Pool:     poolName,
+		Node:     nodeName,
+		Phase:    transition.Phase,
+		Cordoned: transition.Cordoned,
+	})
+}
+
+func (p *progressReporter) nodeStuck(poolName, nodeName string, phase NodePhase, inPhase, threshold time.Duration) {
+	p.emit(ProgressEvent{
+		Type:         NodeStuckEvent,
+		Pool:         poolName,
+		Node:         nodeName,
+		Phase:        phase,
+		PhaseSeconds: inPhase.Seconds(),
+		Message:      fmt.Sprintf("node %s has been %s for %s, exceeding the threshold of %s", nodeName, phase, inPhase.Round(time.Second), threshold),
+	})
+}
+
+// Records the node phase timelines for the given pool in the summary.
+func (p *progressReporter) nodeTimelines(poolName string, timelines map[string][]NodePhaseTransition) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.poolSummary(poolName).NodeTimelines = timelines
+}
+
+func (p *progressReporter) buildPhaseChanged(poolName, buildName string, state mcfgv1.BuildProgress) {
+	p.emit(ProgressEvent{
+		Type:       BuildPhaseChangedEvent,
+		Pool:       poolName,
+		Build:      buildName,
+		BuildPhase: string(state),
+	})
+}
+
+func (p *progressReporter) poolDegraded(poolName, nodeName string, err error) {
+	p.emit(ProgressEvent{
+		Type:    PoolDegradedEvent,
+		Pool:    poolName,
+		Node:    nodeName,
+		Message: err.Error(),
+	})
+}
+
+func (p *progressReporter) poolCompleted(poolName string, after time.Duration) {
+	p.mu.Lock()
+	summary := p.poolSummary(poolName)
+	summary.Completed = true
+	summary.DurationSeconds = after.Seconds()
+	p.mu.Unlock()
+
+	p.emit(ProgressEvent{
+		Type: PoolCompletedEvent,
+		Pool: poolName,
+	})
+}
+
+// Emits the final summary event for the given pools along with the error the
+// wait returned, if any.
+func (p *progressReporter) summary(poolNames []string, err error) {
+	p.mu.Lock()
+	summary := &Summary{
+		Pools: map[string]*PoolSummary{},
+	}
+
+	for _, poolName := range poolNames {
+		summary.Pools[poolName] = p.poolSummary(poolName)
+	}
+
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	p.mu.Unlock()
+
+	p.emit(ProgressEvent{
+		Type:    SummaryEvent,
+		Summary: summary,
+	})
+}
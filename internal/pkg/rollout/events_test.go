@@ -0,0 +1,145 @@
+package rollout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Collects progress events for later inspection.
+type eventCollector struct {
+	mu     sync.Mutex
+	events []ProgressEvent
+}
+
+func (e *eventCollector) handle(event ProgressEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.events = append(e.events, event)
+}
+
+func (e *eventCollector) get() []ProgressEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]ProgressEvent{}, e.events...)
+}
+
+func (e *eventCollector) types() []ProgressEventType {
+	out := []ProgressEventType{}
+	for _, event := range e.get() {
+		out = append(out, event.Type)
+	}
+
+	return out
+}
+
+// Returns only the events which are not of the given types.
+func (e *eventCollector) without(eventTypes ...ProgressEventType) *eventCollector {
+	filtered := &eventCollector{}
+
+	for _, event := range e.get() {
+		if !slices.Contains(eventTypes, event.Type) {
+			filtered.handle(event)
+		}
+	}
+
+	return filtered
+}
+
+func TestProgressReporter(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBuffer([]byte{})
+
+	reporter := newProgressReporter(NewJSONLinesProgressHandler(buf))
+
+	previous := &mcfgv1.MachineConfigPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker"},
+		Status: mcfgv1.MachineConfigPoolStatus{
+			MachineCount:      3,
+			ReadyMachineCount: 3,
+		},
+	}
+
+	current := previous.DeepCopy()
+	current.Status.ReadyMachineCount = 2
+	current.Status.UnavailableMachineCount = 1
+
+	reporter.poolStarted("worker")
+	reporter.poolCountsChanged(previous, current)
+	reporter.nodeUpdated("worker", "worker-0", []string{"worker-1"})
+	reporter.nodeUpdateDuration("worker", "worker-0", time.Minute)
+	reporter.nodeUpdated("worker", "worker-1", nil)
+	reporter.nodeUpdateDuration("worker", "worker-1", time.Minute*2)
+	reporter.poolCompleted("worker", time.Minute*3)
+	reporter.poolDegraded("infra", "infra-0", fmt.Errorf("infra-0 is degraded"))
+	reporter.summary([]string{"worker", "infra"}, fmt.Errorf("pool infra degraded"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 7)
+
+	events := []ProgressEvent{}
+	for _, line := range lines {
+		event := ProgressEvent{}
+		require.NoError(t, json.Unmarshal([]byte(line), &event))
+		assert.False(t, event.Timestamp.IsZero())
+		events = append(events, event)
+	}
+
+	assert.Equal(t, PoolStartedEvent, events[0].Type)
+
+	assert.Equal(t, PoolCountsChangedEvent, events[1].Type)
+	assert.Equal(t, int32(3), events[1].PreviousCounts.Ready)
+	assert.Equal(t, int32(2), events[1].Counts.Ready)
+	assert.Equal(t, int32(1), events[1].Counts.Unavailable)
+
+	assert.Equal(t, NodeUpdatedEvent, events[2].Type)
+	assert.Equal(t, "worker-0", events[2].Node)
+	assert.Equal(t, []string{"worker-1"}, events[2].RemainingNodes)
+
+	assert.Equal(t, PoolCompletedEvent, events[4].Type)
+
+	assert.Equal(t, PoolDegradedEvent, events[5].Type)
+	assert.Equal(t, "infra-0 is degraded", events[5].Message)
+
+	summary := events[6].Summary
+	require.NotNil(t, summary)
+	assert.Equal(t, "pool infra degraded", summary.Error)
+	assert.True(t, summary.Pools["worker"].Completed)
+	assert.Equal(t, float64(180), summary.Pools["worker"].DurationSeconds)
+	assert.Equal(t, map[string]float64{"worker-0": 60, "worker-1": 120}, summary.Pools["worker"].NodeUpdateSeconds)
+	assert.False(t, summary.Pools["infra"].Completed)
+}
+
+func TestChannelProgressHandler(t *testing.T) {
+	t.Parallel()
+
+	ch := make(chan ProgressEvent, 1)
+
+	reporter := newProgressReporter(NewChannelProgressHandler(ch))
+	reporter.poolStarted("worker")
+
+	event := <-ch
+	assert.Equal(t, PoolStartedEvent, event.Type)
+	assert.Equal(t, "worker", event.Pool)
+}
+
+func TestProgressReporterNoHandler(t *testing.T) {
+	t.Parallel()
+
+	reporter := newProgressReporter(nil)
+	reporter.poolStarted("worker")
+	reporter.summary([]string{"worker"}, nil)
+}
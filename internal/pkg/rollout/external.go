@@ -3,123 +3,404 @@ package rollout
 import (
 	"context"
 	"fmt"
-	"os/exec"
+	"time"
 
-	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/errors"
-	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	routev1 "github.com/openshift/api/route/v1"
 	routeClient "github.com/openshift/client-go/route/clientset/versioned"
+	routev1client "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
 	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 	"github.com/openshift/machine-config-operator/test/framework"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	k8stypes "k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	rbacv1client "k8s.io/client-go/kubernetes/typed/rbac/v1"
 	"k8s.io/klog"
 )
 
 const (
 	imageRegistryNamespace string = "openshift-image-registry"
 	imageRegistryObject    string = "image-registry"
+
+	// Identifies objects created to expose the cluster image registry so that
+	// we only ever remove objects that we created.
+	registryExposureLabelKey string = "machineconfiguration.openshift.io/registry-exposed-by-zacks-openshift-helpers"
+
+	// The RoleBinding which allows anonymous pulls from the MCO namespace.
+	registryViewerRoleBindingName string = "zacks-openshift-helpers-registry-viewer"
+	registryViewerClusterRole     string = "registry-viewer"
+	anonymousGroup                string = "system:anonymous"
 )
 
+// Holds the clients needed to expose and unexpose the cluster image registry.
+type registryExposer struct {
+	routes routev1client.RoutesGetter
+	rbac   rbacv1client.RbacV1Interface
+	core   corev1client.CoreV1Interface
+	// When the objects created by this exposer may be cleaned up.
+	expires time.Time
+}
+
+func newRegistryExposer(cs *framework.ClientSet) (*registryExposer, error) {
+	rc, err := routeClient.NewForConfig(cs.GetRestConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create route client: %w", err)
+	}
+
+	return &registryExposer{
+		routes:  rc.RouteV1(),
+		rbac:    cs.RbacV1Interface,
+		core:    cs.CoreV1Interface,
+		expires: time.Now().Add(defaultRegistryExposureLifetime),
+	}, nil
+}
+
+// Exposes the cluster image registry via a Route and allows anonymous pulls
+// from the MCO namespace. Returns the external hostname of the registry. This
+// is idempotent; if a Route for the registry already exists that we did not
+// create, it is used as-is. The created objects are labeled with an expiry so
+// that CleanupStaleRegistryExposures can remove them if they are never
+// unexposed.
 func ExposeClusterImageRegistry(cs *framework.ClientSet) (string, error) {
-	kubeconfig, err := cs.GetKubeconfig()
+	r, err := newRegistryExposer(cs)
 	if err != nil {
 		return "", err
 	}
 
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	return r.expose(context.TODO())
+}
+
+// Removes the Route and RoleBinding created by ExposeClusterImageRegistry.
+// Objects which we did not create are left alone, and the Route is only
+// removed if no other unexpired exposures are using it.
+func UnexposeClusterImageRegistry(cs *framework.ClientSet) error {
+	r, err := newRegistryExposer(cs)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	rc := routeClient.NewForConfigOrDie(config)
+	return r.unexpose(context.TODO())
+}
 
-	_, err = rc.RouteV1().Routes(imageRegistryNamespace).Get(context.TODO(), imageRegistryObject, metav1.GetOptions{})
-	if err != nil && !apierrs.IsNotFound(err) {
+// Exposes the cluster image registry via a Route only. Unlike
+// ExposeClusterImageRegistry, no access is granted, so callers must bring
+// their own credentials such as a service account pull secret. Returns the
+// external hostname of the registry.
+func ExposeClusterImageRegistryRoute(ctx context.Context, cs *framework.ClientSet) (string, error) {
+	r, err := newRegistryExposer(cs)
+	if err != nil {
 		return "", err
 	}
 
-	if apierrs.IsNotFound(err) {
-		cmd := exec.Command("oc", "expose", "-n", imageRegistryNamespace, fmt.Sprintf("svc/%s", imageRegistryObject))
-		cmd.Env = utils.ToEnvVars(map[string]string{
-			"KUBECONFIG": kubeconfig,
-		})
-		klog.Infof("Running %s", cmd)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return "", errors.NewExecError(cmd, out, err)
-		}
-	}
+	return r.exposeRoute(ctx)
+}
 
-	// Ensure that the route was created.
-	_, err = rc.RouteV1().Routes(imageRegistryNamespace).Get(context.TODO(), imageRegistryObject, metav1.GetOptions{})
+// Removes the Route created by ExposeClusterImageRegistryRoute unless other
+// unexpired exposures are still using it. RoleBindings are left alone.
+func UnexposeClusterImageRegistryRoute(ctx context.Context, cs *framework.ClientSet) error {
+	r, err := newRegistryExposer(cs)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	registryPatchSpec := []byte(`{"spec": {"tls": {"insecureEdgeTerminationPolicy": "Redirect", "termination": "reencrypt"}}}`)
+	return r.deleteRouteIfUnused(ctx, time.Now())
+}
 
-	_, err = rc.RouteV1().Routes(imageRegistryNamespace).Patch(context.TODO(), imageRegistryObject, k8stypes.MergePatchType, registryPatchSpec, metav1.PatchOptions{})
+func (r *registryExposer) expose(ctx context.Context) (string, error) {
+	extHostname, err := r.exposeRoute(ctx)
 	if err != nil {
-		return "", fmt.Errorf("could not patch image-registry: %w", err)
+		return "", err
 	}
-	klog.Infof("Patched %s", imageRegistryObject)
 
-	cmd := exec.Command("oc", "-n", ctrlcommon.MCONamespace, "policy", "add-role-to-group", "registry-viewer", "system:anonymous")
-	cmd.Env = utils.ToEnvVars(map[string]string{
-		"KUBECONFIG": kubeconfig,
-	})
-	klog.Infof("Running %s", cmd)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return "", errors.NewExecError(cmd, out, err)
+	if err := r.ensureRoleBinding(ctx); err != nil {
+		return "", err
 	}
-	klog.Infof("Policies added")
 
-	imgRegistryRoute, err := rc.RouteV1().Routes(imageRegistryNamespace).Get(context.TODO(), imageRegistryObject, metav1.GetOptions{})
+	return extHostname, nil
+}
+
+func (r *registryExposer) exposeRoute(ctx context.Context) (string, error) {
+	route, err := r.ensureRoute(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	extHostname, err := getRouteHostname(route)
 	if err != nil {
 		return "", err
 	}
 
-	extHostname := imgRegistryRoute.Spec.Host
 	klog.Infof("Cluster image registry exposed using external hostname %s", extHostname)
-	return extHostname, err
+	return extHostname, nil
 }
 
-func UnexposeClusterImageRegistry(cs *framework.ClientSet) error {
-	kubeconfig, err := cs.GetKubeconfig()
-	if err != nil {
+func (r *registryExposer) unexpose(ctx context.Context) error {
+	if err := r.deleteRoleBindingIfOurs(ctx, ctrlcommon.MCONamespace, registryViewerRoleBindingName); err != nil {
 		return err
 	}
 
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	return r.deleteRouteIfUnused(ctx, time.Now())
+}
+
+// Deletes the Route if we created it and no other unexpired exposures are
+// using it.
+func (r *registryExposer) deleteRouteIfUnused(ctx context.Context, now time.Time) error {
+	inUse, err := r.isRouteInUse(ctx, now)
 	if err != nil {
 		return err
 	}
 
-	rc := routeClient.NewForConfigOrDie(config)
+	if inUse {
+		klog.Infof("Route for %s is still in use by other exposures, will not delete", imageRegistryObject)
+		return nil
+	}
 
-	if err := rc.RouteV1().Routes(imageRegistryNamespace).Delete(context.TODO(), imageRegistryObject, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+	if err := r.deleteRouteIfOurs(ctx); err != nil {
 		return err
 	}
-	klog.Infof("Route for %s deleted", imageRegistryObject)
 
-	if err := cs.Services(imageRegistryNamespace).Delete(context.TODO(), imageRegistryObject, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
-		return err
+	klog.Infof("Cluster image registry is no longer exposed")
+
+	return nil
+}
+
+// Creates the Route for the image registry service, or updates it if we
+// created it previously and it has drifted.
+func (r *registryExposer) ensureRoute(ctx context.Context) (*routev1.Route, error) {
+	desired, err := r.newImageRegistryRoute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := r.routes.Routes(imageRegistryNamespace)
+
+	existing, err := routes.Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		created, err := routes.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not create route for %s: %w", imageRegistryObject, err)
+		}
+
+		klog.Infof("Route for %s created", imageRegistryObject)
+		return created, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not get route for %s: %w", imageRegistryObject, err)
+	}
+
+	if !metav1.HasLabel(existing.ObjectMeta, registryExposureLabelKey) {
+		klog.Infof("Using preexisting route for %s which we did not create", imageRegistryObject)
+		return existing, nil
+	}
+
+	expiryChanged := r.extendExpiry(&existing.ObjectMeta)
+
+	if !expiryChanged &&
+		equality.Semantic.DeepEqual(existing.Spec.To, desired.Spec.To) &&
+		equality.Semantic.DeepEqual(existing.Spec.Port, desired.Spec.Port) &&
+		equality.Semantic.DeepEqual(existing.Spec.TLS, desired.Spec.TLS) {
+		klog.Infof("Route for %s already exists", imageRegistryObject)
+		return existing, nil
+	}
+
+	existing.Spec.To = desired.Spec.To
+	existing.Spec.Port = desired.Spec.Port
+	existing.Spec.TLS = desired.Spec.TLS
+
+	updated, err := routes.Update(ctx, existing, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not update route for %s: %w", imageRegistryObject, err)
+	}
+
+	klog.Infof("Route for %s updated", imageRegistryObject)
+	return updated, nil
+}
+
+// Builds the same Route that "oc expose svc/image-registry" would, with TLS
+// reencryption so that the registry can be reached over HTTPS.
+func (r *registryExposer) newImageRegistryRoute(ctx context.Context) (*routev1.Route, error) {
+	svc, err := r.core.Services(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get service for %s: %w", imageRegistryObject, err)
+	}
+
+	if len(svc.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("service %s has no ports", imageRegistryObject)
+	}
+
+	targetPort := intstr.FromInt32(svc.Spec.Ports[0].Port)
+	if svc.Spec.Ports[0].Name != "" {
+		targetPort = intstr.FromString(svc.Spec.Ports[0].Name)
 	}
-	klog.Infof("Service for %s deleted", imageRegistryObject)
 
-	cmd := exec.Command("oc", "-n", ctrlcommon.MCONamespace, "policy", "remove-role-from-group", "registry-viewer", "system:anonymous")
-	cmd.Env = utils.ToEnvVars(map[string]string{
-		"KUBECONFIG": kubeconfig,
+	return &routev1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      imageRegistryObject,
+			Namespace: imageRegistryNamespace,
+			Labels:    r.getLabels(),
+		},
+		Spec: routev1.RouteSpec{
+			To: routev1.RouteTargetReference{
+				Kind: "Service",
+				Name: imageRegistryObject,
+			},
+			Port: &routev1.RoutePort{
+				TargetPort: targetPort,
+			},
+			TLS: &routev1.TLSConfig{
+				Termination:                   routev1.TLSTerminationReencrypt,
+				InsecureEdgeTerminationPolicy: routev1.InsecureEdgeTerminationPolicyRedirect,
+			},
+		},
+	}, nil
+}
+
+// Grants the registry-viewer role to anonymous users in the MCO namespace,
+// which is what "oc policy add-role-to-group" would do.
+func (r *registryExposer) ensureRoleBinding(ctx context.Context) error {
+	return r.ensureRegistryViewerRoleBinding(ctx, ctrlcommon.MCONamespace, registryViewerRoleBindingName, rbacv1.Subject{
+		APIGroup: rbacv1.GroupName,
+		Kind:     rbacv1.GroupKind,
+		Name:     anonymousGroup,
 	})
+}
 
-	klog.Infof("Running %s", cmd)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return errors.NewExecError(cmd, out, err)
+// Creates a RoleBinding which grants the registry-viewer role to the given
+// subject in the given namespace, or updates it if we created it previously
+// and it has drifted.
+func (r *registryExposer) ensureRegistryViewerRoleBinding(ctx context.Context, namespace, name string, subject rbacv1.Subject) error {
+	desired := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    r.getLabels(),
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     registryViewerClusterRole,
+		},
+		Subjects: []rbacv1.Subject{subject},
 	}
-	klog.Infof("Policies removed")
 
-	klog.Infof("Cluster image registry is no longer exposed")
+	roleBindings := r.rbac.RoleBindings(namespace)
+
+	existing, err := roleBindings.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		if _, err := roleBindings.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not create RoleBinding %s/%s: %w", namespace, desired.Name, err)
+		}
+
+		klog.Infof("RoleBinding %s/%s created", namespace, desired.Name)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get RoleBinding %s/%s: %w", namespace, desired.Name, err)
+	}
 
+	if !metav1.HasLabel(existing.ObjectMeta, registryExposureLabelKey) {
+		return fmt.Errorf("unmanaged preexisting RoleBinding %s/%s already exists, missing label %q", namespace, desired.Name, registryExposureLabelKey)
+	}
+
+	// The RoleRef is immutable, so if it has changed, the RoleBinding must be
+	// recreated.
+	if !equality.Semantic.DeepEqual(existing.RoleRef, desired.RoleRef) {
+		if err := roleBindings.Delete(ctx, desired.Name, metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("could not delete RoleBinding %s/%s: %w", namespace, desired.Name, err)
+		}
+
+		if _, err := roleBindings.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not recreate RoleBinding %s/%s: %w", namespace, desired.Name, err)
+		}
+
+		klog.Infof("RoleBinding %s/%s recreated", namespace, desired.Name)
+		return nil
+	}
+
+	expiryChanged := r.extendExpiry(&existing.ObjectMeta)
+
+	if !expiryChanged && equality.Semantic.DeepEqual(existing.Subjects, desired.Subjects) {
+		klog.Infof("RoleBinding %s/%s already exists", namespace, desired.Name)
+		return nil
+	}
+
+	existing.Subjects = desired.Subjects
+
+	if _, err := roleBindings.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update RoleBinding %s/%s: %w", namespace, desired.Name, err)
+	}
+
+	klog.Infof("RoleBinding %s/%s updated", namespace, desired.Name)
 	return nil
 }
+
+func (r *registryExposer) deleteRouteIfOurs(ctx context.Context) error {
+	routes := r.routes.Routes(imageRegistryNamespace)
+
+	route, err := routes.Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get route for %s: %w", imageRegistryObject, err)
+	}
+
+	if !metav1.HasLabel(route.ObjectMeta, registryExposureLabelKey) {
+		klog.Infof("Route for %s missing label %q, will not delete", imageRegistryObject, registryExposureLabelKey)
+		return nil
+	}
+
+	if err := routes.Delete(ctx, imageRegistryObject, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not delete route for %s: %w", imageRegistryObject, err)
+	}
+
+	klog.Infof("Route for %s deleted", imageRegistryObject)
+	return nil
+}
+
+func (r *registryExposer) deleteRoleBindingIfOurs(ctx context.Context, namespace, name string) error {
+	roleBindings := r.rbac.RoleBindings(namespace)
+
+	rb, err := roleBindings.Get(ctx, name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get RoleBinding %s/%s: %w", namespace, name, err)
+	}
+
+	if !metav1.HasLabel(rb.ObjectMeta, registryExposureLabelKey) {
+		klog.Infof("RoleBinding %s/%s missing label %q, will not delete", namespace, name, registryExposureLabelKey)
+		return nil
+	}
+
+	if err := roleBindings.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not delete RoleBinding %s/%s: %w", namespace, name, err)
+	}
+
+	klog.Infof("RoleBinding %s/%s deleted", namespace, name)
+	return nil
+}
+
+// Gets the external hostname for the route. The API server normally assigns
+// one when the route is created, but the router may also report it in the
+// route status.
+func getRouteHostname(route *routev1.Route) (string, error) {
+	if route.Spec.Host != "" {
+		return route.Spec.Host, nil
+	}
+
+	for _, ingress := range route.Status.Ingress {
+		if ingress.Host != "" {
+			return ingress.Host, nil
+		}
+	}
+
+	return "", fmt.Errorf("route %s/%s has no hostname", route.Namespace, route.Name)
+}
@@ -0,0 +1,275 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	routev1 "github.com/openshift/api/route/v1"
+	fakeroute "github.com/openshift/client-go/route/clientset/versioned/fake"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testRegistryHostname string = "image-registry-openshift-image-registry.apps.cluster.example.com"
+
+func TestExposeClusterImageRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	kubeclient := fakekube.NewSimpleClientset(newImageRegistryService())
+	routeclient := newFakeRouteClient()
+
+	r := newRegistryExposerForClients(kubeclient, routeclient)
+
+	hostname, err := r.expose(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testRegistryHostname, hostname)
+
+	route, err := routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, route.Labels, registryExposureLabelKey)
+	assert.Equal(t, "Service", route.Spec.To.Kind)
+	assert.Equal(t, imageRegistryObject, route.Spec.To.Name)
+	assert.Equal(t, "5000-tcp", route.Spec.Port.TargetPort.String())
+	assert.Equal(t, routev1.TLSTerminationReencrypt, route.Spec.TLS.Termination)
+	assert.Equal(t, routev1.InsecureEdgeTerminationPolicyRedirect, route.Spec.TLS.InsecureEdgeTerminationPolicy)
+
+	rb, err := kubeclient.RbacV1().RoleBindings(ctrlcommon.MCONamespace).Get(ctx, registryViewerRoleBindingName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, rb.Labels, registryExposureLabelKey)
+	assert.Equal(t, registryViewerClusterRole, rb.RoleRef.Name)
+	assert.Equal(t, []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.GroupKind, Name: anonymousGroup}}, rb.Subjects)
+
+	// Exposing again should be a no-op.
+	hostname, err = r.expose(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testRegistryHostname, hostname)
+
+	require.NoError(t, r.unexpose(ctx))
+
+	_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	_, err = kubeclient.RbacV1().RoleBindings(ctrlcommon.MCONamespace).Get(ctx, registryViewerRoleBindingName, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	// The registry service is not ours and must be left alone.
+	_, err = kubeclient.CoreV1().Services(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// Unexposing again should be a no-op.
+	assert.NoError(t, r.unexpose(ctx))
+}
+
+func TestExposeClusterImageRegistryRoute(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	kubeclient := fakekube.NewSimpleClientset(newImageRegistryService())
+	routeclient := newFakeRouteClient()
+
+	r := newRegistryExposerForClients(kubeclient, routeclient)
+
+	hostname, err := r.exposeRoute(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testRegistryHostname, hostname)
+
+	_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	// Anonymous pulls must not be granted.
+	rbs, err := kubeclient.RbacV1().RoleBindings(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, rbs.Items)
+
+	// Another exposure which is still in use keeps the Route alive, and its
+	// RoleBinding is left alone.
+	other := newRegistryExposerForClients(kubeclient, routeclient)
+	_, err = other.expose(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, r.deleteRouteIfUnused(ctx, time.Now()))
+
+	_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	_, err = kubeclient.RbacV1().RoleBindings(ctrlcommon.MCONamespace).Get(ctx, registryViewerRoleBindingName, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	require.NoError(t, other.unexpose(ctx))
+
+	_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+}
+
+func TestExposeClusterImageRegistryPreexistingObjects(t *testing.T) {
+	t.Parallel()
+
+	unmanagedRoute := &routev1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      imageRegistryObject,
+			Namespace: imageRegistryNamespace,
+		},
+		Spec: routev1.RouteSpec{
+			Host: "unmanaged.apps.cluster.example.com",
+			To: routev1.RouteTargetReference{
+				Kind: "Service",
+				Name: imageRegistryObject,
+			},
+		},
+	}
+
+	unmanagedRoleBinding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      registryViewerRoleBindingName,
+			Namespace: ctrlcommon.MCONamespace,
+		},
+	}
+
+	staleRoute := unmanagedRoute.DeepCopy()
+	staleRoute.Labels = map[string]string{registryExposureLabelKey: ""}
+	staleRoute.Spec.TLS = nil
+
+	testCases := []struct {
+		name             string
+		kubeObjects      []runtime.Object
+		routeObjects     []runtime.Object
+		expectedHostname string
+		errExpected      bool
+		routeRemains     bool
+		checkRoute       func(*testing.T, *routev1.Route)
+	}{
+		{
+			name:             "Unmanaged route is used as-is and not deleted",
+			routeObjects:     []runtime.Object{unmanagedRoute},
+			expectedHostname: "unmanaged.apps.cluster.example.com",
+			routeRemains:     true,
+			checkRoute: func(t *testing.T, route *routev1.Route) {
+				assert.NotContains(t, route.Labels, registryExposureLabelKey)
+				assert.Nil(t, route.Spec.TLS)
+			},
+		},
+		{
+			name:             "Managed route which drifted is updated",
+			routeObjects:     []runtime.Object{staleRoute},
+			expectedHostname: "unmanaged.apps.cluster.example.com",
+			checkRoute: func(t *testing.T, route *routev1.Route) {
+				require.NotNil(t, route.Spec.TLS)
+				assert.Equal(t, routev1.TLSTerminationReencrypt, route.Spec.TLS.Termination)
+			},
+		},
+		{
+			name:        "Unmanaged RoleBinding is an error",
+			kubeObjects: []runtime.Object{unmanagedRoleBinding},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+
+			kubeclient := fakekube.NewSimpleClientset(append(testCase.kubeObjects, newImageRegistryService())...)
+			routeclient := newFakeRouteClient(testCase.routeObjects...)
+
+			r := newRegistryExposerForClients(kubeclient, routeclient)
+
+			hostname, err := r.expose(ctx)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedHostname, hostname)
+
+			route, err := routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+			require.NoError(t, err)
+			testCase.checkRoute(t, route)
+
+			require.NoError(t, r.unexpose(ctx))
+
+			_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+			if testCase.routeRemains {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, apierrs.IsNotFound(err))
+			}
+		})
+	}
+}
+
+func TestGetRouteHostname(t *testing.T) {
+	t.Parallel()
+
+	route := &routev1.Route{}
+	_, err := getRouteHostname(route)
+	assert.Error(t, err)
+
+	route.Status.Ingress = []routev1.RouteIngress{{Host: "from-status"}}
+	hostname, err := getRouteHostname(route)
+	require.NoError(t, err)
+	assert.Equal(t, "from-status", hostname)
+
+	route.Spec.Host = "from-spec"
+	hostname, err = getRouteHostname(route)
+	require.NoError(t, err)
+	assert.Equal(t, "from-spec", hostname)
+}
+
+func newRegistryExposerForClients(kubeclient *fakekube.Clientset, routeclient *fakeroute.Clientset) *registryExposer {
+	return &registryExposer{
+		routes:  routeclient.RouteV1(),
+		rbac:    kubeclient.RbacV1(),
+		core:    kubeclient.CoreV1(),
+		expires: time.Now().Add(time.Hour),
+	}
+}
+
+// The API server assigns a hostname to routes which do not have one when they
+// are created, but the fake clientset does not.
+func newFakeRouteClient(objs ...runtime.Object) *fakeroute.Clientset {
+	routeclient := fakeroute.NewSimpleClientset(objs...)
+
+	routeclient.PrependReactor("create", "routes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		route := action.(k8stesting.CreateAction).GetObject().(*routev1.Route)
+		if route.Spec.Host == "" {
+			route.Spec.Host = testRegistryHostname
+		}
+
+		return false, nil, nil
+	})
+
+	return routeclient
+}
+
+func newImageRegistryService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      imageRegistryObject,
+			Namespace: imageRegistryNamespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{
+					Name: "5000-tcp",
+					Port: 5000,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,112 @@
+package rollout
+
+import (
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	fakemcfg "github.com/openshift/client-go/machineconfiguration/clientset/versioned/fake"
+	"github.com/openshift/machine-config-operator/test/framework"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// Creates a framework.ClientSet backed by fake clientsets. MachineConfig API
+// objects are routed to the fake MachineConfig clientset while everything
+// else is routed to the fake Kubernetes clientset.
+func newFakeClientSet(objs ...runtime.Object) *framework.ClientSet {
+	return newFakeClientSetFromClients(newFakeClients(objs...))
+}
+
+// Wraps the given fake clientsets in a framework.ClientSet.
+func newFakeClientSetFromClients(kubeclient *fakekube.Clientset, mcfgclient *fakemcfg.Clientset) *framework.ClientSet {
+	return &framework.ClientSet{
+		CoreV1Interface:                 kubeclient.CoreV1(),
+		AppsV1Interface:                 kubeclient.AppsV1(),
+		RbacV1Interface:                 kubeclient.RbacV1(),
+		MachineconfigurationV1Interface: mcfgclient.MachineconfigurationV1(),
+	}
+}
+
+// Creates the fake Kubernetes and MachineConfig clientsets, routing each of
+// the provided objects to the appropriate one.
+func newFakeClients(objs ...runtime.Object) (*fakekube.Clientset, *fakemcfg.Clientset) {
+	kubeObjs := []runtime.Object{}
+	mcfgObjs := []runtime.Object{}
+
+	for _, obj := range objs {
+		if isMcfgObject(obj) {
+			mcfgObjs = append(mcfgObjs, obj)
+		} else {
+			kubeObjs = append(kubeObjs, obj)
+		}
+	}
+
+	kubeclient := fakekube.NewSimpleClientset(kubeObjs...)
+	addDeploymentScaleReactors(kubeclient)
+
+	return kubeclient, fakemcfg.NewSimpleClientset(mcfgObjs...)
+}
+
+func isMcfgObject(obj runtime.Object) bool {
+	switch obj.(type) {
+	case *mcfgv1.MachineConfig, *mcfgv1.MachineConfigPool, *mcfgv1.MachineOSConfig, *mcfgv1.MachineOSBuild, *mcfgv1.ControllerConfig:
+		return true
+	}
+
+	return false
+}
+
+// The fake clientset does not understand the deployment scale subresource, so
+// we map it onto the deployment replica count.
+func addDeploymentScaleReactors(kubeclient *fakekube.Clientset) {
+	tracker := kubeclient.Tracker()
+
+	kubeclient.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+
+		get := action.(k8stesting.GetAction)
+		obj, err := tracker.Get(appsv1.SchemeGroupVersion.WithResource("deployments"), get.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		deploy := obj.(*appsv1.Deployment)
+
+		replicas := int32(1)
+		if deploy.Spec.Replicas != nil {
+			replicas = *deploy.Spec.Replicas
+		}
+
+		return true, &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: deploy.Name, Namespace: deploy.Namespace},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: replicas},
+		}, nil
+	})
+
+	kubeclient.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+
+		update := action.(k8stesting.UpdateAction)
+		scale := update.GetObject().(*autoscalingv1.Scale)
+
+		obj, err := tracker.Get(appsv1.SchemeGroupVersion.WithResource("deployments"), update.GetNamespace(), scale.Name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		deploy := obj.(*appsv1.Deployment).DeepCopy()
+		deploy.Spec.Replicas = &scale.Spec.Replicas
+
+		if err := tracker.Update(appsv1.SchemeGroupVersion.WithResource("deployments"), deploy, update.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+
+		return true, scale, nil
+	})
+}
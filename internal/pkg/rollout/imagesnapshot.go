@@ -0,0 +1,302 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	aggerrs "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	mcoImageSnapshotFilename string = "mco-image-snapshot.json"
+)
+
+// Holds the state of the MCO components as they were before an image
+// replacement. This is used to roll back a failed replacement and may be
+// persisted to disk so that a later revert can restore it.
+type MCOImageSnapshot struct {
+	// When the snapshot was taken.
+	Timestamp time.Time `json:"timestamp"`
+	// The raw images.json value from the MCO images ConfigMap.
+	ImagesJSON string `json:"imagesJSON"`
+	// The containers for each MCO deployment, keyed by deployment name.
+	// Deployments which did not exist at snapshot time are omitted.
+	Deployments map[string][]corev1.Container `json:"deployments"`
+	// The containers for each MCO daemonset, keyed by daemonset name.
+	Daemonsets map[string][]corev1.Container `json:"daemonsets"`
+	// The replica counts for the CVO and MCO deployments, keyed by
+	// namespace/name.
+	Replicas map[string]int32 `json:"replicas"`
+}
+
+// Returns the default path where the MCO image snapshot is persisted.
+func DefaultMCOImageSnapshotPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine user cache dir: %w", err)
+	}
+
+	return filepath.Join(cacheDir, "zacks-openshift-helpers", mcoImageSnapshotFilename), nil
+}
+
+// Captures the current images ConfigMap, the containers for all of the MCO
+// deployments and daemonsets, and the CVO / MCO replica counts.
+func TakeMCOImageSnapshot(cs *framework.ClientSet) (*MCOImageSnapshot, error) {
+	ctx := context.TODO()
+
+	cm, _, err := loadMCOImagesConfigMap(cs)
+	if err != nil {
+		return nil, fmt.Errorf("could not load or parse ConfigMap %s: %w", mcoImagesConfigMap, err)
+	}
+
+	snapshot := &MCOImageSnapshot{
+		Timestamp:   time.Now(),
+		ImagesJSON:  cm.Data[mcoImagesJSON],
+		Deployments: map[string][]corev1.Container{},
+		Daemonsets:  map[string][]corev1.Container{},
+		Replicas:    map[string]int32{},
+	}
+
+	for _, name := range mcoDeployments {
+		deploy, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+		if name == "machine-os-builder" && apierrs.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not get deployment/%s: %w", name, err)
+		}
+
+		snapshot.Deployments[name] = deploy.Spec.Template.Spec.Containers
+	}
+
+	for _, name := range mcoDaemonsets {
+		ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not get daemonset/%s: %w", name, err)
+		}
+
+		snapshot.Daemonsets[name] = ds.Spec.Template.Spec.Containers
+	}
+
+	replicaTargets := []struct {
+		name      string
+		namespace string
+	}{
+		{name: cvoName, namespace: cvoNamespace},
+		{name: mcoName, namespace: ctrlcommon.MCONamespace},
+	}
+
+	for _, target := range replicaTargets {
+		deploy, err := cs.AppsV1Interface.Deployments(target.namespace).Get(ctx, target.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not get deployment %s/%s: %w", target.namespace, target.name, err)
+		}
+
+		replicas := int32(1)
+		if deploy.Spec.Replicas != nil {
+			replicas = *deploy.Spec.Replicas
+		}
+
+		snapshot.Replicas[replicaKey(target.namespace, target.name)] = replicas
+	}
+
+	klog.Infof("Took snapshot of MCO images and replica counts")
+
+	return snapshot, nil
+}
+
+// Reads a previously persisted snapshot from the given path.
+func LoadMCOImageSnapshot(path string) (*MCOImageSnapshot, error) {
+	snapshotBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read snapshot %s: %w", path, err)
+	}
+
+	snapshot := &MCOImageSnapshot{}
+	if err := json.Unmarshal(snapshotBytes, snapshot); err != nil {
+		return nil, fmt.Errorf("could not decode snapshot %s: %w", path, err)
+	}
+
+	return snapshot, nil
+}
+
+// Persists the snapshot to the given path, creating any parent directories.
+func (s *MCOImageSnapshot) WriteToFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("could not create directory for snapshot %s: %w", path, err)
+	}
+
+	snapshotBytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode snapshot: %w", err)
+	}
+
+	if err := os.WriteFile(path, snapshotBytes, 0o644); err != nil {
+		return fmt.Errorf("could not write snapshot %s: %w", path, err)
+	}
+
+	klog.Infof("Wrote MCO image snapshot to %s", path)
+
+	return nil
+}
+
+// Restores the MCO images ConfigMap, the deployment and daemonset containers,
+// and the CVO / MCO replica counts to what was captured in the snapshot. This
+// attempts every step even if an earlier one fails and returns all of the
+// encountered errors.
+func RestoreMCOImageSnapshot(cs *framework.ClientSet, snapshot *MCOImageSnapshot) error {
+	klog.Infof("Restoring MCO images and replica counts from snapshot taken at %s", snapshot.Timestamp.Format(time.RFC3339))
+
+	errs := []error{}
+
+	if err := restoreMCOConfigMap(cs, snapshot.ImagesJSON); err != nil {
+		errs = append(errs, fmt.Errorf("could not restore ConfigMap %s: %w", mcoImagesConfigMap, err))
+	}
+
+	for name, containers := range snapshot.Deployments {
+		if err := restoreDeploymentContainers(cs, name, containers); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore deployment/%s: %w", name, err))
+		}
+	}
+
+	for name, containers := range snapshot.Daemonsets {
+		if err := restoreDaemonsetContainers(cs, name, containers); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore daemonset/%s: %w", name, err))
+		}
+	}
+
+	// The MCO must be restored before the CVO so that the CVO does not observe
+	// a partially restored MCO.
+	if err := restoreReplicas(cs, snapshot, mcoName, ctrlcommon.MCONamespace); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := restoreReplicas(cs, snapshot, cvoName, cvoNamespace); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		klog.Infof("Restored MCO images and replica counts from snapshot")
+	}
+
+	return aggerrs.NewAggregate(errs)
+}
+
+// Loads the snapshot from the given path and restores it.
+func RestoreMCOImageSnapshotFromFile(cs *framework.ClientSet, path string) error {
+	snapshot, err := LoadMCOImageSnapshot(path)
+	if err != nil {
+		return err
+	}
+
+	return RestoreMCOImageSnapshot(cs, snapshot)
+}
+
+func restoreMCOConfigMap(cs *framework.ClientSet, imagesJSON string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := cs.CoreV1Interface.ConfigMaps(ctrlcommon.MCONamespace).Get(context.TODO(), mcoImagesConfigMap, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if cm.Data[mcoImagesJSON] == imagesJSON {
+			return nil
+		}
+
+		cm.Data[mcoImagesJSON] = imagesJSON
+
+		_, err = cs.CoreV1Interface.ConfigMaps(ctrlcommon.MCONamespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func restoreDeploymentContainers(cs *framework.ClientSet, name string, containers []corev1.Container) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		deploy, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if !containerImagesDiffer(deploy.Spec.Template.Spec.Containers, containers) {
+			return nil
+		}
+
+		klog.Infof("Restoring deployment/%s", name)
+		deploy.Spec.Template.Spec.Containers = containers
+
+		_, err = cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Update(context.TODO(), deploy, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func restoreDaemonsetContainers(cs *framework.ClientSet, name string, containers []corev1.Container) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if !containerImagesDiffer(ds.Spec.Template.Spec.Containers, containers) {
+			return nil
+		}
+
+		klog.Infof("Restoring daemonset/%s", name)
+		ds.Spec.Template.Spec.Containers = containers
+
+		_, err = cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Update(context.TODO(), ds, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func restoreReplicas(cs *framework.ClientSet, snapshot *MCOImageSnapshot, name, namespace string) error {
+	replicas, ok := snapshot.Replicas[replicaKey(namespace, name)]
+	if !ok {
+		return nil
+	}
+
+	if err := setDeploymentReplicas(cs, name, namespace, replicas); err != nil {
+		return fmt.Errorf("could not restore replicas for %s/%s to %d: %w", namespace, name, replicas, err)
+	}
+
+	return nil
+}
+
+// Determines whether the image or pull policy differs between the two sets of
+// containers.
+func containerImagesDiffer(current, original []corev1.Container) bool {
+	if len(current) != len(original) {
+		return true
+	}
+
+	for i := range current {
+		if current[i].Name != original[i].Name {
+			return true
+		}
+
+		if current[i].Image != original[i].Image {
+			return true
+		}
+
+		if current[i].ImagePullPolicy != original[i].ImagePullPolicy {
+			return true
+		}
+	}
+
+	return false
+}
+
+func replicaKey(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
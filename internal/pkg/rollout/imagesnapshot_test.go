@@ -0,0 +1,280 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	originalMCOPullspec string = "registry.host.com/org/mco:original"
+	newMCOPullspec      string = "registry.host.com/org/mco:new"
+)
+
+func TestMCOImageSnapshot(t *testing.T) {
+	t.Parallel()
+
+	cs := newFakeClientSet(getMCOObjects(t, originalMCOPullspec)...)
+
+	snapshot, err := TakeMCOImageSnapshot(cs)
+	require.NoError(t, err)
+
+	assert.Len(t, snapshot.Deployments, len(mcoDeployments))
+	assert.Len(t, snapshot.Daemonsets, len(mcoDaemonsets))
+	assert.Equal(t, int32(1), snapshot.Replicas[replicaKey(cvoNamespace, cvoName)])
+	assert.Equal(t, int32(1), snapshot.Replicas[replicaKey(ctrlcommon.MCONamespace, mcoName)])
+
+	snapshotPath := filepath.Join(t.TempDir(), "nested", mcoImageSnapshotFilename)
+	require.NoError(t, snapshot.WriteToFile(snapshotPath))
+
+	loaded, err := LoadMCOImageSnapshot(snapshotPath)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.ImagesJSON, loaded.ImagesJSON)
+	assert.Equal(t, snapshot.Deployments, loaded.Deployments)
+	assert.Equal(t, snapshot.Daemonsets, loaded.Daemonsets)
+	assert.Equal(t, snapshot.Replicas, loaded.Replicas)
+
+	require.NoError(t, replaceMCOImage(cs, newMCOPullspec, false))
+	assertMCOImage(t, cs, newMCOPullspec)
+
+	// The CVO is left scaled down after the replacement.
+	cvo, err := cs.AppsV1Interface.Deployments(cvoNamespace).Get(context.TODO(), cvoName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), *cvo.Spec.Replicas)
+
+	require.NoError(t, RestoreMCOImageSnapshotFromFile(cs, snapshotPath))
+	assertMCOImage(t, cs, originalMCOPullspec)
+
+	cvo, err = cs.AppsV1Interface.Deployments(cvoNamespace).Get(context.TODO(), cvoName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), *cvo.Spec.Replicas)
+}
+
+func TestReplaceMCOImageRollsBackOnFailure(t *testing.T) {
+	t.Parallel()
+
+	// Take the snapshot with all of the objects present, then delete one of
+	// the daemonsets so that the replacement fails partway through.
+	cs := newFakeClientSet(getMCOObjects(t, originalMCOPullspec)...)
+	snapshot, err := TakeMCOImageSnapshot(cs)
+	require.NoError(t, err)
+
+	require.NoError(t, cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Delete(context.TODO(), "machine-config-server", metav1.DeleteOptions{}))
+
+	snapshotPath := filepath.Join(t.TempDir(), mcoImageSnapshotFilename)
+	require.NoError(t, snapshot.WriteToFile(snapshotPath))
+
+	err = replaceMCOImage(cs, newMCOPullspec, false)
+	require.Error(t, err)
+
+	rollbackErr := rollbackMCOImage(cs, snapshot, snapshotPath, err)
+	assert.ErrorIs(t, rollbackErr, err)
+
+	// The missing daemonset could not be restored, so the snapshot is kept for
+	// a later revert.
+	assert.FileExists(t, snapshotPath)
+
+	cm, images, err := loadMCOImagesConfigMap(cs)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.ImagesJSON, cm.Data[mcoImagesJSON])
+	assert.Equal(t, originalMCOPullspec, images[mcoImageKey])
+
+	for _, name := range mcoDeployments {
+		deploy, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, originalMCOPullspec, deploy.Spec.Template.Spec.Containers[0].Image)
+	}
+
+	cvo, err := cs.AppsV1Interface.Deployments(cvoNamespace).Get(context.TODO(), cvoName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), *cvo.Spec.Replicas)
+}
+
+func TestReplaceMCOImageRemovesSnapshotAfterRollback(t *testing.T) {
+	t.Parallel()
+
+	kubeclient, mcfgclient := newFakeClients(getMCOObjects(t, originalMCOPullspec)...)
+
+	// Fail the first daemonset update so that the replacement fails partway
+	// through but the rollback succeeds.
+	failed := false
+	kubeclient.PrependReactor("update", "daemonsets", func(_ k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+
+		failed = true
+		return true, nil, fmt.Errorf("injected daemonset update failure")
+	})
+
+	cs := newFakeClientSetFromClients(kubeclient, mcfgclient)
+
+	snapshotPath := filepath.Join(t.TempDir(), mcoImageSnapshotFilename)
+
+	err := ReplaceMCOImageWithOpts(cs, ReplaceOpts{
+		Pullspec:      newMCOPullspec,
+		SnapshotPath:  snapshotPath,
+		SkipPrechecks: true,
+	})
+	assert.ErrorContains(t, err, "injected daemonset update failure")
+	assert.NotContains(t, err.Error(), "rollback also failed")
+
+	assertMCOImage(t, cs, originalMCOPullspec)
+
+	// Nothing is left to revert, so the snapshot should be removed.
+	assert.NoFileExists(t, snapshotPath)
+}
+
+func TestReplaceOptsValidate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		opts        ReplaceOpts
+		errExpected bool
+	}{
+		{
+			name:        "empty pullspec",
+			opts:        ReplaceOpts{},
+			errExpected: true,
+		},
+		{
+			name: "tagged pullspec without waiting",
+			opts: ReplaceOpts{Pullspec: newMCOPullspec},
+		},
+		{
+			name:        "tagged pullspec with waiting",
+			opts:        ReplaceOpts{Pullspec: newMCOPullspec, RolloutTimeout: 1},
+			errExpected: true,
+		},
+		{
+			name: "digested pullspec with waiting",
+			opts: ReplaceOpts{
+				Pullspec:       "registry.host.com/org/mco@sha256:e1b9a1e4bd2b6ad4c3aba7c1d2ab5f3bc2e6b2da0e0b1e2c6f0cfd1bd8d6f8b5",
+				RolloutTimeout: 1,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := testCase.opts.validate()
+			if testCase.errExpected {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func assertMCOImage(t *testing.T, cs *framework.ClientSet, pullspec string) {
+	t.Helper()
+
+	_, images, err := loadMCOImagesConfigMap(cs)
+	require.NoError(t, err)
+	assert.Equal(t, pullspec, images[mcoImageKey])
+
+	for _, name := range mcoDeployments {
+		deploy, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, pullspec, deploy.Spec.Template.Spec.Containers[0].Image, name)
+	}
+
+	for _, name := range mcoDaemonsets {
+		ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(context.TODO(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, pullspec, ds.Spec.Template.Spec.Containers[0].Image, name)
+	}
+}
+
+// Gets the MCO images ConfigMap, the MCO deployments and daemonsets, and the
+// CVO deployment all configured to use the given pullspec.
+func getMCOObjects(t *testing.T, pullspec string) []runtime.Object {
+	t.Helper()
+
+	imagesBytes, err := json.Marshal(map[string]string{
+		mcoImageKey: pullspec,
+	})
+	require.NoError(t, err)
+
+	out := []runtime.Object{
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      mcoImagesConfigMap,
+				Namespace: ctrlcommon.MCONamespace,
+			},
+			Data: map[string]string{
+				mcoImagesJSON: string(imagesBytes),
+			},
+		},
+		newDeployment(cvoName, cvoNamespace, "registry.host.com/org/cvo:latest"),
+	}
+
+	for _, name := range mcoDeployments {
+		out = append(out, newDeployment(name, ctrlcommon.MCONamespace, pullspec))
+	}
+
+	for _, name := range mcoDaemonsets {
+		out = append(out, newDaemonset(name, pullspec))
+	}
+
+	return out
+}
+
+func newDeployment(name, namespace, pullspec string) *appsv1.Deployment {
+	replicas := int32(1)
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: newPodTemplateSpec(name, pullspec),
+		},
+	}
+}
+
+func newDaemonset(name, pullspec string) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ctrlcommon.MCONamespace,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Template: newPodTemplateSpec(name, pullspec),
+		},
+	}
+}
+
+func newPodTemplateSpec(name, pullspec string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  name,
+					Image: pullspec,
+				},
+			},
+		},
+	}
+}
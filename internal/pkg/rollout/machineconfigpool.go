@@ -11,20 +11,57 @@ import (
 	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
 	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
 	"github.com/openshift/machine-config-operator/pkg/apihelpers"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	"github.com/openshift/machine-config-operator/test/framework"
 	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
-	apierrs "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
 
 var pollInterval = time.Second
 var retryableErrThreshold = time.Minute
 
+// Options for waiting on MachineConfigPools.
+type WaitOpts struct {
+	// If set, receives structured progress events as the wait progresses and
+	// a summary event once it finishes.
+	ProgressHandler ProgressHandler
+	// How long a node may remain in a single phase (e.g., Working, Draining,
+	// Rebooting) before it is flagged as stuck. Zero disables stuck node
+	// detection.
+	StuckNodeThreshold time.Duration
+}
+
+// Holds the shared state for waiting on one or more MachineConfigPools.
+type poolWaiter struct {
+	cs       *framework.ClientSet
+	tracker  *clusterStateTracker
+	reporter *progressReporter
+	opts     WaitOpts
+}
+
+// Starts the cluster state tracker and returns a poolWaiter which uses it.
+// The tracker stops when the given context is canceled.
+func newPoolWaiter(ctx context.Context, cs *framework.ClientSet, opts WaitOpts) (*poolWaiter, error) {
+	tracker, err := startClusterStateTracker(ctx, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPoolWaiterForTracker(cs, tracker, opts), nil
+}
+
+func newPoolWaiterForTracker(cs *framework.ClientSet, tracker *clusterStateTracker, opts WaitOpts) *poolWaiter {
+	return &poolWaiter{
+		cs:       cs,
+		tracker:  tracker,
+		reporter: newProgressReporter(opts.ProgressHandler),
+		opts:     opts,
+	}
+}
+
 func WaitForMachineConfigPoolsToComplete(cs *framework.ClientSet, poolNames []string, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -35,19 +72,56 @@ func WaitForMachineConfigPoolsToComplete(cs *framework.ClientSet, poolNames []st
 }
 
 func WaitForMachineConfigPoolsToCompleteWithContext(ctx context.Context, cs *framework.ClientSet, poolNames []string) error {
-	return waitForMachineConfigPoolsToCompleteWithContext(ctx, cs, poolNames)
+	return WaitForMachineConfigPoolsToCompleteWithOpts(ctx, cs, poolNames, WaitOpts{})
+}
+
+// Waits for the given MachineConfigPools and their nodes to finish updating.
+// If no pool names are given, all pools are waited on.
+func WaitForMachineConfigPoolsToCompleteWithOpts(ctx context.Context, cs *framework.ClientSet, poolNames []string, opts WaitOpts) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := newPoolWaiter(ctx, cs, opts)
+	if err != nil {
+		return err
+	}
+
+	if len(poolNames) == 0 {
+		poolNames, err = getMachineConfigPoolNames(w.tracker)
+		if err != nil {
+			return err
+		}
+
+		klog.Infof("Watching MachineConfigPool(s): %v", poolNames)
+	}
+
+	defer func() {
+		w.reporter.summary(poolNames, err)
+	}()
+
+	return w.waitForMachineConfigPoolsToComplete(ctx, poolNames)
 }
 
 func WaitForMachineConfigPoolUpdateToCompleteWithContext(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+	return WaitForMachineConfigPoolUpdateToCompleteWithOpts(ctx, cs, poolName, WaitOpts{})
+}
+
+// Waits for the given MachineConfigPool to begin updating and then for it and
+// its nodes to finish updating.
+func WaitForMachineConfigPoolUpdateToCompleteWithOpts(ctx context.Context, cs *framework.ClientSet, poolName string, opts WaitOpts) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Wait for the pool to begin updating.
-	if err := waitForMachineConfigPoolToStart(ctx, cs, poolName); err != nil {
-		return fmt.Errorf("pool %s did not start updating: %w", poolName, err)
+	w, err := newPoolWaiter(ctx, cs, opts)
+	if err != nil {
+		return err
 	}
 
-	return waitForMachineConfigPoolAndNodesToComplete(ctx, cs, poolName)
+	defer func() {
+		w.reporter.summary([]string{poolName}, err)
+	}()
+
+	return w.waitForMachineConfigPoolUpdateToComplete(ctx, poolName)
 }
 
 func WaitForMachineConfigPoolUpdateToComplete(cs *framework.ClientSet, timeout time.Duration, poolName string) error {
@@ -82,16 +156,9 @@ func WaitForAllMachineConfigPoolsToComplete(cs *framework.ClientSet, timeout tim
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	poolNames, err := getMachineConfigPoolNames(ctx, cs)
-	if err != nil {
-		return err
-	}
-
-	klog.Infof("Watching MachineConfigPool(s): %v", poolNames)
-
 	start := time.Now()
 
-	err = waitForMachineConfigPoolsToCompleteWithContext(ctx, cs, poolNames)
+	err := WaitForMachineConfigPoolsToCompleteWithOpts(ctx, cs, nil, WaitOpts{})
 	if err == nil {
 		klog.Infof("All pools updated in %s", time.Since(start))
 		return nil
@@ -106,42 +173,61 @@ func WaitForOnlyMachineConfigPoolToComplete(cs *framework.ClientSet, poolName st
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	w, err := newPoolWaiter(ctx, cs, WaitOpts{})
+	if err != nil {
+		return err
+	}
+
 	// Wait for the pool to begin updating.
-	if err := waitForMachineConfigPoolToStart(ctx, cs, poolName); err != nil {
+	if err := w.waitForMachineConfigPoolToStart(ctx, poolName); err != nil {
 		return fmt.Errorf("pool %s did not start updating: %w", poolName, err)
 	}
 
-	return waitForMachineConfigPoolToComplete(ctx, cs, poolName)
+	return w.waitForMachineConfigPoolToComplete(ctx, poolName)
 }
 
 func WaitForMachineConfigPoolToComplete(cs *framework.ClientSet, poolName string, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	return waitForNodesToComplete(ctx, cs, poolName)
+	w, err := newPoolWaiter(ctx, cs, WaitOpts{})
+	if err != nil {
+		return err
+	}
+
+	return w.waitForNodesToComplete(ctx, poolName)
+}
+
+func (w *poolWaiter) waitForMachineConfigPoolUpdateToComplete(ctx context.Context, poolName string) error {
+	// Wait for the pool to begin updating.
+	if err := w.waitForMachineConfigPoolToStart(ctx, poolName); err != nil {
+		return fmt.Errorf("pool %s did not start updating: %w", poolName, err)
+	}
+
+	return w.waitForMachineConfigPoolAndNodesToComplete(ctx, poolName)
 }
 
-func waitForMachineConfigPoolsToCompleteWithContext(ctx context.Context, cs *framework.ClientSet, poolNames []string) error {
+func (w *poolWaiter) waitForMachineConfigPoolsToComplete(ctx context.Context, poolNames []string) error {
 	eg := errgroup.Group{}
 
 	for _, poolName := range poolNames {
 		poolName := poolName
 
 		eg.Go(func() error {
-			return waitForMachineConfigPoolAndNodesToComplete(ctx, cs, poolName)
+			return w.waitForMachineConfigPoolAndNodesToComplete(ctx, poolName)
 		})
 	}
 
 	return eg.Wait()
 }
 
-func waitForMachineConfigPoolToStart(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+func (w *poolWaiter) waitForMachineConfigPoolToStart(ctx context.Context, poolName string) error {
 	start := time.Now()
 
 	retryer := errhelpers.NewTimeRetryer(retryableErrThreshold)
 
-	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
-		mcp, err := cs.MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+	return w.tracker.waitUntil(ctx, func(_ context.Context) (bool, error) {
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
 
 		shouldContinue, err := handleQueryErr(err, retryer)
 		if err != nil {
@@ -154,39 +240,59 @@ func waitForMachineConfigPoolToStart(ctx context.Context, cs *framework.ClientSe
 
 		if apihelpers.IsMachineConfigPoolConditionTrue(mcp.Status.Conditions, mcfgv1.MachineConfigPoolUpdating) {
 			klog.Infof("MachineConfigPool %s began updating after %s", mcp.Name, time.Since(start))
+			w.reporter.poolStarted(mcp.Name)
 			return true, nil
 		}
 
-		return false, validatePoolIsNotDegraded(mcp)
+		return false, w.validatePoolIsNotDegraded(mcp)
 	})
 }
 
-func waitForMachineConfigPoolAndNodesToComplete(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+// Validates that the pool is not degraded, emitting a progress event if it
+// is.
+func (w *poolWaiter) validatePoolIsNotDegraded(mcp *mcfgv1.MachineConfigPool) error {
+	err := validatePoolIsNotDegraded(mcp)
+	if err != nil {
+		w.reporter.poolDegraded(mcp.Name, "", err)
+	}
+
+	return err
+}
+
+func (w *poolWaiter) waitForMachineConfigPoolAndNodesToComplete(ctx context.Context, poolName string) error {
+	start := time.Now()
+
 	eg := errgroup.Group{}
 
 	eg.Go(func() error {
-		return waitForMachineConfigPoolToComplete(ctx, cs, poolName)
+		return w.waitForMachineConfigPoolToComplete(ctx, poolName)
 	})
 
 	eg.Go(func() error {
-		return waitForNodesToComplete(ctx, cs, poolName)
+		return w.waitForNodesToComplete(ctx, poolName)
 	})
 
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	w.reporter.poolCompleted(poolName, time.Since(start))
+
+	return nil
 }
 
-func waitForMachineConfigPoolToComplete(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+func (w *poolWaiter) waitForMachineConfigPoolToComplete(ctx context.Context, poolName string) error {
 	start := time.Now()
 
-	initial, err := cs.MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+	initial, err := w.tracker.getMachineConfigPool(poolName)
 	if err != nil {
 		return err
 	}
 
 	retryer := errhelpers.NewTimeRetryer(retryableErrThreshold)
 
-	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
-		mcp, err := cs.MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+	return w.tracker.waitUntil(ctx, func(_ context.Context) (bool, error) {
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
 
 		shouldContinue, err := handleQueryErr(err, retryer)
 		if err != nil {
@@ -199,6 +305,7 @@ func waitForMachineConfigPoolToComplete(ctx context.Context, cs *framework.Clien
 
 		if hasMachineConfigPoolStatusChanged(initial, mcp) {
 			logMCPChange(initial, mcp, start)
+			w.reporter.poolCountsChanged(initial, mcp)
 			initial = mcp
 		}
 
@@ -207,7 +314,7 @@ func waitForMachineConfigPoolToComplete(ctx context.Context, cs *framework.Clien
 			return true, nil
 		}
 
-		return false, validatePoolIsNotDegraded(mcp)
+		return false, w.validatePoolIsNotDegraded(mcp)
 	})
 }
 
@@ -293,46 +400,94 @@ func hasMachineConfigPoolStatusChanged(initial, current *mcfgv1.MachineConfigPoo
 	return false
 }
 
-func waitForNodesToComplete(ctx context.Context, cs *framework.ClientSet, poolName string) error {
-	doneNodes := sets.New[string]()
-	nodesForPool := sets.New[string]()
+func (w *poolWaiter) waitForNodesToComplete(ctx context.Context, poolName string) error {
+	return w.waitForNodesToMatch(ctx, poolName, func(node *corev1.Node) bool {
+		// The pool, its MachineOSConfig, and its MachineOSBuild may have moved
+		// on since we last checked, so we get the latest version of each of
+		// them each time.
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
+		if err != nil {
+			return false
+		}
+
+		if !isNodeDoneAtPool(mcp, node) {
+			return false
+		}
 
-	nodes, err := cs.CoreV1Interface.Nodes().List(ctx, metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("node-role.kubernetes.io/%s", poolName),
+		pullspec, isLayered, err := w.getDesiredImageForPool(ctx, mcp)
+		if err != nil {
+			klog.V(4).Infof("Could not get desired image for pool %s: %s", poolName, err)
+			return false
+		}
+
+		if !isLayered {
+			return true
+		}
+
+		return isNodeDoneAtPullspec(pullspec, node)
 	})
+}
 
+// Gets the image which the nodes in the given pool should be running. Returns
+// false if the pool does not have a MachineOSConfig. If there is a
+// MachineOSBuild for the pool's current rendered config, its image is used
+// once it succeeds, since the MachineOSConfig status lags behind it. Until
+// then, an empty pullspec is returned so that no node is considered done.
+func (w *poolWaiter) getDesiredImageForPool(ctx context.Context, mcp *mcfgv1.MachineConfigPool) (string, bool, error) {
+	mosc, err := w.tracker.getMachineOSConfigForPool(mcp)
 	if err != nil {
-		return err
+		return "", false, fmt.Errorf("could not get MachineOSConfig: %w", err)
 	}
 
-	for _, node := range nodes.Items {
-		nodesForPool.Insert(node.Name)
+	if mosc == nil {
+		return "", false, nil
 	}
 
-	start := time.Now()
+	mosb, err := w.tracker.getCurrentMachineOSBuildForPool(ctx, mcp)
+	if utils.IsNotFoundErr(err) {
+		return string(mosc.Status.CurrentImagePullSpec), true, nil
+	}
 
-	klog.Infof("Current nodes for pool %q are: %v", poolName, sets.List(nodesForPool))
+	if err != nil {
+		return "", true, fmt.Errorf("could not get MachineOSBuild: %w", err)
+	}
+
+	if !ctrlcommon.NewMachineOSBuildState(mosb).IsBuildSuccess() {
+		return "", true, nil
+	}
 
-	mcp, err := cs.MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+	return string(mosb.Status.DigestedImagePushSpec), true, nil
+}
+
+// Waits for every node in the given pool to satisfy the given function. Nodes
+// which join the pool while waiting are also waited on. Returns an error if
+// any node becomes degraded.
+func (w *poolWaiter) waitForNodesToMatch(ctx context.Context, poolName string, isNodeDoneFunc func(*corev1.Node) bool) error {
+	doneNodes := sets.New[string]()
+	nodesForPool := sets.New[string]()
+
+	nodes, err := w.tracker.listNodesForPool(poolName)
 	if err != nil {
 		return err
 	}
 
-	mosc, err := utils.GetMachineOSConfigForPool(ctx, cs, mcp)
-	if err != nil && !apierrs.IsNotFound(err) {
-		return fmt.Errorf("could not get MachineOSConfig: %w", err)
+	for _, node := range nodes {
+		nodesForPool.Insert(node.Name)
 	}
 
-	if mosc == nil && apierrs.IsNotFound(err) {
-		klog.Infof("No MachineOSConfig found, will only consider MachineConfigs")
-	}
+	start := time.Now()
+
+	klog.Infof("Current nodes for pool %q are: %v", poolName, sets.List(nodesForPool))
+
+	timelines := newNodeTimelineTracker(w.opts.StuckNodeThreshold)
+	defer func() {
+		w.reporter.nodeTimelines(poolName, timelines.timelinesByNode())
+	}()
 
 	retryer := errhelpers.NewTimeRetryer(retryableErrThreshold)
 
-	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
-		nodes, err := cs.CoreV1Interface.Nodes().List(ctx, metav1.ListOptions{
-			LabelSelector: fmt.Sprintf("node-role.kubernetes.io/%s", poolName),
-		})
+	return w.tracker.waitUntil(ctx, func(_ context.Context) (bool, error) {
+		nodes, err := w.tracker.listNodesForPool(poolName)
 
 		shouldContinue, err := handleQueryErr(err, retryer)
 		if err != nil {
@@ -343,29 +498,29 @@ func waitForNodesToComplete(ctx context.Context, cs *framework.ClientSet, poolNa
 			return false, nil
 		}
 
-		for _, node := range nodes.Items {
-			node := node
-
+		for _, node := range nodes {
 			if !nodesForPool.Has(node.Name) {
 				klog.Infof("Pool %s has gained a new node %s", poolName, node.Name)
 				nodesForPool.Insert(node.Name)
 			}
 
-			if doneNodes.Has(node.Name) {
-				continue
+			if err := w.observeNode(poolName, node, timelines); err != nil {
+				return false, err
 			}
 
-			isDone := false
-			if mosc == nil {
-				isDone = isNodeDoneAtPool(mcp, &node)
-			} else {
-				isDone = isNodeDoneAtPool(mcp, &node) && isNodeDoneAtMosc(mosc, &node)
+			if doneNodes.Has(node.Name) {
+				continue
 			}
 
-			if isDone {
+			if isNodeDoneFunc(node) {
 				doneNodes.Insert(node.Name)
 				diff := sets.List(nodesForPool.Difference(doneNodes))
 				klog.Infof("Node %s in pool %s updated after %s. %d node(s) remaining: %v", node.Name, poolName, time.Since(start), len(diff), diff)
+				w.reporter.nodeUpdated(poolName, node.Name, diff)
+
+				if took, ok := timelines.updateDuration(node.Name); ok {
+					w.reporter.nodeUpdateDuration(poolName, node.Name, took)
+				}
 			}
 		}
 
@@ -378,6 +533,29 @@ func waitForNodesToComplete(ctx context.Context, cs *framework.ClientSet, poolNa
 	})
 }
 
+// Records the node's current phase, flags it if it has been in that phase for
+// too long, and returns an error if it has become degraded.
+func (w *poolWaiter) observeNode(poolName string, node *corev1.Node, timelines *nodeTimelineTracker) error {
+	now := time.Now()
+
+	if transition := timelines.observe(node, now); transition != nil {
+		klog.V(4).Infof("Node %s in pool %s is %s (cordoned: %v)", node.Name, poolName, transition.Phase, transition.Cordoned)
+		w.reporter.nodePhaseChanged(poolName, node.Name, *transition)
+	}
+
+	if err := validateNodeIsNotDegraded(poolName, node); err != nil {
+		w.reporter.poolDegraded(poolName, node.Name, err)
+		return err
+	}
+
+	if phase, inPhase, isStuck := timelines.checkStuck(node.Name, now); isStuck {
+		klog.Warningf("Node %s in pool %s has been %s for %s, exceeding the threshold of %s", node.Name, poolName, phase, inPhase.Round(time.Second), w.opts.StuckNodeThreshold)
+		w.reporter.nodeStuck(poolName, node.Name, phase, inPhase, w.opts.StuckNodeThreshold)
+	}
+
+	return nil
+}
+
 // Determines if an error is retryable. Currently, that means whether the
 // context has been canceled or the deadline has been exceeded. In either of
 // those scenarios, we cannot retry.
@@ -393,15 +571,15 @@ func isRetryableErr(err error) bool {
 	return true
 }
 
-func getMachineConfigPoolNames(ctx context.Context, cs *framework.ClientSet) ([]string, error) {
-	pools, err := cs.MachineconfigurationV1Interface.MachineConfigPools().List(ctx, metav1.ListOptions{})
+func getMachineConfigPoolNames(tracker *clusterStateTracker) ([]string, error) {
+	pools, err := tracker.listMachineConfigPools()
 	if err != nil {
 		return nil, err
 	}
 
 	out := []string{}
 
-	for _, pool := range pools.Items {
+	for _, pool := range pools {
 		out = append(out, pool.Name)
 	}
 
@@ -425,10 +603,10 @@ func isNodeImageDone(node *corev1.Node) bool {
 	return isNodeDone(node) && current == desired
 }
 
-func isNodeDoneAtMosc(mosc *mcfgv1.MachineOSConfig, node *corev1.Node) bool {
+func isNodeDoneAtPullspec(pullspec string, node *corev1.Node) bool {
 	current := node.Annotations[daemonconsts.CurrentImageAnnotationKey]
 	desired := node.Annotations[daemonconsts.DesiredImageAnnotationKey]
-	return isNodeDone(node) && isNodeImageDone(node) && desired == string(mosc.Status.CurrentImagePullSpec) && desired != "" && current != ""
+	return isNodeDone(node) && isNodeImageDone(node) && desired == pullspec && desired != "" && current != ""
 }
 
 func isNodeDone(node *corev1.Node) bool {
@@ -0,0 +1,277 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	errhelpers "github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/errors"
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/test/framework"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// How many lines of each builder pod container's logs to include when a
+// build fails.
+var builderPodLogTailLines int64 = 100
+
+// The state of a MachineOSBuild which does not have any build conditions set
+// yet.
+const machineOSBuildPending mcfgv1.BuildProgress = "Pending"
+
+// Returned when the MachineOSBuild for a pool fails or is interrupted.
+type MachineOSBuildFailedError struct {
+	Pool  string
+	Build string
+	State mcfgv1.BuildProgress
+	// The message from the failed or interrupted condition.
+	Message string
+	// The tail of the builder pod logs, if they could be retrieved.
+	Logs string
+}
+
+func (m *MachineOSBuildFailedError) Error() string {
+	if m.Message == "" {
+		return fmt.Sprintf("MachineOSBuild %s for pool %s %s", m.Build, m.Pool, m.State)
+	}
+
+	return fmt.Sprintf("MachineOSBuild %s for pool %s %s: %s", m.Build, m.Pool, m.State, m.Message)
+}
+
+func WaitForMachineOSBuildAndRollout(cs *framework.ClientSet, poolName string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	klog.Infof("Waiting up to %s for MachineOSBuild for pool %s to complete and roll out", timeout, poolName)
+
+	return WaitForMachineOSBuildAndRolloutWithOpts(ctx, cs, poolName, WaitOpts{})
+}
+
+// Waits for the MachineOSBuild for the given layered pool to finish building
+// and then for all of the nodes in the pool to be running the built image. If
+// the build fails, this returns a MachineOSBuildFailedError immediately and
+// logs the builder pod's logs.
+func WaitForMachineOSBuildAndRolloutWithOpts(ctx context.Context, cs *framework.ClientSet, poolName string, opts WaitOpts) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := newPoolWaiter(ctx, cs, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		w.reporter.summary([]string{poolName}, err)
+	}()
+
+	return w.waitForMachineOSBuildAndRollout(ctx, poolName)
+}
+
+func (w *poolWaiter) waitForMachineOSBuildAndRollout(ctx context.Context, poolName string) error {
+	start := time.Now()
+
+	mosb, err := w.waitForMachineOSBuildToComplete(ctx, poolName)
+	if err != nil {
+		return err
+	}
+
+	digest, err := getDigestFromPullspec(string(mosb.Status.DigestedImagePushSpec))
+	if err != nil {
+		return fmt.Errorf("could not get digest for MachineOSBuild %s: %w", mosb.Name, err)
+	}
+
+	klog.Infof("Waiting for nodes in pool %s to be running %s", poolName, mosb.Status.DigestedImagePushSpec)
+
+	err = w.waitForNodesToMatch(ctx, poolName, func(node *corev1.Node) bool {
+		return isNodeDoneAtImageDigest(node, mosb.Spec.MachineConfig.Name, digest)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	w.reporter.poolCompleted(poolName, time.Since(start))
+
+	return nil
+}
+
+// Waits for the MachineOSBuild for the pool's current rendered config to
+// reach a terminal state. Returns the MachineOSBuild if it succeeded.
+func (w *poolWaiter) waitForMachineOSBuildToComplete(ctx context.Context, poolName string) (*mcfgv1.MachineOSBuild, error) {
+	start := time.Now()
+
+	var lastState mcfgv1.BuildProgress
+	var lastBuild string
+	var result *mcfgv1.MachineOSBuild
+
+	retryer := errhelpers.NewTimeRetryer(retryableErrThreshold)
+
+	err := w.tracker.waitUntil(ctx, func(ctx context.Context) (bool, error) {
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
+
+		shouldContinue, err := handleQueryErr(err, retryer)
+		if err != nil {
+			return false, err
+		}
+
+		if !shouldContinue {
+			return false, nil
+		}
+
+		mosb, err := w.tracker.getCurrentMachineOSBuildForPool(ctx, mcp)
+		if utils.IsNotFoundErr(err) {
+			// The MachineOSBuild may not have been created yet.
+			klog.V(4).Infof("No MachineOSBuild found yet for pool %s with config %s", poolName, mcp.Spec.Configuration.Name)
+			return false, nil
+		}
+
+		shouldContinue, err = handleQueryErr(err, retryer)
+		if err != nil {
+			return false, err
+		}
+
+		if !shouldContinue {
+			return false, nil
+		}
+
+		state := getMachineOSBuildState(mosb)
+		if state != lastState || mosb.Name != lastBuild {
+			klog.Infof("MachineOSBuild %s for pool %s is %s after %s", mosb.Name, poolName, state, time.Since(start))
+			w.reporter.buildPhaseChanged(poolName, mosb.Name, state)
+			lastState = state
+			lastBuild = mosb.Name
+		}
+
+		mosbState := ctrlcommon.NewMachineOSBuildState(mosb)
+
+		if mosbState.IsBuildSuccess() {
+			result = mosb
+			return true, nil
+		}
+
+		if mosbState.IsBuildFailure() || mosbState.IsBuildInterrupted() {
+			buildErr := w.newMachineOSBuildFailedError(ctx, poolName, mosb, state)
+			w.reporter.poolDegraded(poolName, "", buildErr)
+			return false, buildErr
+		}
+
+		return false, nil
+	})
+
+	return result, err
+}
+
+// Builds the error for a failed or interrupted MachineOSBuild, including the
+// builder pod logs. The logs are also written out so that they are visible
+// even if the caller discards the error details.
+func (w *poolWaiter) newMachineOSBuildFailedError(ctx context.Context, poolName string, mosb *mcfgv1.MachineOSBuild, state mcfgv1.BuildProgress) *MachineOSBuildFailedError {
+	buildErr := &MachineOSBuildFailedError{
+		Pool:  poolName,
+		Build: mosb.Name,
+		State: state,
+	}
+
+	if cond := meta.FindStatusCondition(mosb.Status.Conditions, string(state)); cond != nil {
+		buildErr.Message = cond.Message
+	}
+
+	logs, err := getBuilderPodLogs(ctx, w.cs, mosb)
+	if err != nil {
+		klog.Warningf("Could not get builder pod logs for MachineOSBuild %s: %s", mosb.Name, err)
+		return buildErr
+	}
+
+	buildErr.Logs = logs
+	klog.Infof("Builder pod logs for MachineOSBuild %s:\n%s", mosb.Name, logs)
+
+	return buildErr
+}
+
+// Gets the tail of the logs for each container in the most recent builder pod
+// for the given MachineOSBuild.
+func getBuilderPodLogs(ctx context.Context, cs *framework.ClientSet, mosb *mcfgv1.MachineOSBuild) (string, error) {
+	if mosb.Status.Builder == nil || mosb.Status.Builder.Job == nil {
+		return "", fmt.Errorf("MachineOSBuild %s has no builder job", mosb.Name)
+	}
+
+	job := mosb.Status.Builder.Job
+
+	namespace := job.Namespace
+	if namespace == "" {
+		namespace = ctrlcommon.MCONamespace
+	}
+
+	pods, err := cs.CoreV1Interface.Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", batchv1.JobNameLabel, job.Name),
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("could not list pods for job %s: %w", job.Name, err)
+	}
+
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("no pods found for job %s", job.Name)
+	}
+
+	// A job may have retried, so only the most recent pod is relevant.
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[j].CreationTimestamp.Before(&pods.Items[i].CreationTimestamp)
+	})
+
+	pod := pods.Items[0]
+
+	containers := append([]corev1.Container{}, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+
+	sb := &strings.Builder{}
+
+	for _, container := range containers {
+		logs, err := cs.CoreV1Interface.Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container: container.Name,
+			TailLines: &builderPodLogTailLines,
+		}).DoRaw(ctx)
+
+		if err != nil {
+			fmt.Fprintf(sb, "--- %s/%s: could not get logs: %s\n", pod.Name, container.Name, err)
+			continue
+		}
+
+		fmt.Fprintf(sb, "--- %s/%s:\n%s\n", pod.Name, container.Name, strings.TrimSpace(string(logs)))
+	}
+
+	return sb.String(), nil
+}
+
+// Gets the current build state for the given MachineOSBuild. A build that has
+// no conditions set yet is considered to be pending.
+func getMachineOSBuildState(mosb *mcfgv1.MachineOSBuild) mcfgv1.BuildProgress {
+	mosbState := ctrlcommon.NewMachineOSBuildState(mosb)
+
+	if terminal := mosbState.GetTerminalState(); terminal != "" {
+		return terminal
+	}
+
+	if transient := mosbState.GetTransientState(); transient != "" {
+		return transient
+	}
+
+	return machineOSBuildPending
+}
+
+// Determines whether the node is done updating to the given rendered config
+// and is running an image with the given digest.
+func isNodeDoneAtImageDigest(node *corev1.Node, renderedConfig, digest string) bool {
+	current := node.Annotations[daemonconsts.CurrentImageAnnotationKey]
+	currentConfig := node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey]
+
+	return isNodeConfigDone(node) && isNodeImageDone(node) && currentConfig == renderedConfig && current != "" && getDigestFromImageID(current) == digest
+}
@@ -0,0 +1,253 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/openshift/machine-config-operator/pkg/apihelpers"
+	buildconstants "github.com/openshift/machine-config-operator/pkg/controller/build/constants"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testBuiltImage string = "registry.host.com/org/os-image@sha256:8c2be4b3f1dfd6b5c2e3c5b4f6c4a9d0e2b1f3a5c7d9e1f3a5c7d9e1f3a5c7d9"
+	testOldImage   string = "registry.host.com/org/os-image@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+)
+
+func TestWaitForMachineOSBuildAndRollout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-2")
+	mosb := newMachineOSBuild("worker-build", "rendered-worker-2", apihelpers.MachineOSBuildPendingConditions())
+	node := newLayeredNode("worker-0", "rendered-worker-2", testOldImage)
+
+	kubeclient, mcfgclient := newFakeClients(pool, newMachineOSConfig(pool.Name), mosb, node)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	events := &eventCollector{}
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{ProgressHandler: events.handle})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.waitForMachineOSBuildAndRollout(ctx, pool.Name)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(events.get()) != 0
+	}, time.Second*10, time.Millisecond*10)
+
+	mosb.Status.Conditions = apihelpers.MachineOSBuildRunningConditions()
+	_, err = mcfgclient.MachineconfigurationV1().MachineOSBuilds().UpdateStatus(ctx, mosb, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(events.get()) == 2
+	}, time.Second*10, time.Millisecond*10)
+
+	mosb.Status.Conditions = apihelpers.MachineOSBuildSucceededConditions()
+	mosb.Status.DigestedImagePushSpec = mcfgv1.ImageDigestFormat(testBuiltImage)
+	_, err = mcfgclient.MachineconfigurationV1().MachineOSBuilds().UpdateStatus(ctx, mosb, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// The node should not be considered done until it is running the built
+	// image.
+	select {
+	case err := <-errCh:
+		t.Fatalf("wait returned before node was updated: %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	node.Annotations[daemonconsts.CurrentImageAnnotationKey] = testBuiltImage
+	node.Annotations[daemonconsts.DesiredImageAnnotationKey] = testBuiltImage
+	_, err = kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for rollout")
+	}
+
+	builds := events.without(NodePhaseChangedEvent)
+	assert.Equal(t, []ProgressEventType{BuildPhaseChangedEvent, BuildPhaseChangedEvent, BuildPhaseChangedEvent, NodeUpdatedEvent, PoolCompletedEvent}, builds.types())
+
+	phases := []string{}
+	for _, event := range builds.get()[:3] {
+		phases = append(phases, event.BuildPhase)
+	}
+
+	assert.Equal(t, []string{string(mcfgv1.MachineOSBuildPrepared), string(mcfgv1.MachineOSBuilding), string(mcfgv1.MachineOSBuildSucceeded)}, phases)
+}
+
+func TestWaitForMachineOSBuildFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-2")
+
+	mosb := newMachineOSBuild("worker-build", "rendered-worker-2", apihelpers.MachineOSBuildFailedConditions())
+	mosb.Status.Builder = &mcfgv1.MachineOSBuilderReference{
+		ImageBuilderType: mcfgv1.JobBuilder,
+		Job: &mcfgv1.ObjectReference{
+			Group:     batchv1.SchemeGroupVersion.Group,
+			Resource:  "jobs",
+			Namespace: ctrlcommon.MCONamespace,
+			Name:      "build-worker-build",
+		},
+	}
+
+	builderPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "build-worker-build-abcde",
+			Namespace: ctrlcommon.MCONamespace,
+			Labels: map[string]string{
+				batchv1.JobNameLabel: "build-worker-build",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "image-build"}},
+		},
+	}
+
+	kubeclient, mcfgclient := newFakeClients(pool, newMachineOSConfig(pool.Name), mosb, builderPod)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	events := &eventCollector{}
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{ProgressHandler: events.handle})
+
+	err = w.waitForMachineOSBuildAndRollout(ctx, pool.Name)
+	require.Error(t, err)
+
+	var buildErr *MachineOSBuildFailedError
+	require.True(t, errors.As(err, &buildErr))
+	assert.Equal(t, "worker-build", buildErr.Build)
+	assert.Equal(t, mcfgv1.MachineOSBuildFailed, buildErr.State)
+	// The fake clientset returns a fixed string for pod logs.
+	assert.Contains(t, buildErr.Logs, "build-worker-build-abcde/image-build")
+	assert.Contains(t, buildErr.Logs, "fake logs")
+
+	assert.Equal(t, []ProgressEventType{BuildPhaseChangedEvent, PoolDegradedEvent}, events.types())
+}
+
+func TestWaitForNodesToCompleteFollowsMachineOSBuild(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-2")
+
+	// The MachineOSConfig status still refers to the image the node is
+	// running, but a newer build for the pool's rendered config is underway.
+	mosc := newMachineOSConfig(pool.Name)
+	mosc.Status.CurrentImagePullSpec = mcfgv1.ImageDigestFormat(testOldImage)
+
+	mosb := newMachineOSBuild("worker-build", "rendered-worker-2", apihelpers.MachineOSBuildRunningConditions())
+	node := newLayeredNode("worker-0", "rendered-worker-2", testOldImage)
+
+	kubeclient, mcfgclient := newFakeClients(pool, mosc, mosb, node)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.waitForNodesToComplete(ctx, pool.Name)
+	}()
+
+	assertNotDone := func(msg string) {
+		t.Helper()
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("wait returned %s: %v", msg, err)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	assertNotDone("while the build was running")
+
+	mosb.Status.Conditions = apihelpers.MachineOSBuildSucceededConditions()
+	mosb.Status.DigestedImagePushSpec = mcfgv1.ImageDigestFormat(testBuiltImage)
+	_, err = mcfgclient.MachineconfigurationV1().MachineOSBuilds().UpdateStatus(ctx, mosb, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	assertNotDone("before node was updated to the built image")
+
+	node.Annotations[daemonconsts.CurrentImageAnnotationKey] = testBuiltImage
+	node.Annotations[daemonconsts.DesiredImageAnnotationKey] = testBuiltImage
+	_, err = kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for rollout")
+	}
+}
+
+// Creates a MachineOSConfig with the same name as the pool it targets.
+func newMachineOSConfig(poolName string) *mcfgv1.MachineOSConfig {
+	return &mcfgv1.MachineOSConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: poolName,
+		},
+		Spec: mcfgv1.MachineOSConfigSpec{
+			MachineConfigPool: mcfgv1.MachineConfigPoolReference{
+				Name: poolName,
+			},
+		},
+	}
+}
+
+// Creates a MachineOSBuild owned by the worker MachineOSConfig.
+func newMachineOSBuild(name, renderedConfig string, conditions []metav1.Condition) *mcfgv1.MachineOSBuild {
+	return &mcfgv1.MachineOSBuild{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				buildconstants.MachineOSConfigNameLabelKey: "worker",
+			},
+		},
+		Spec: mcfgv1.MachineOSBuildSpec{
+			MachineConfig: mcfgv1.MachineConfigReference{
+				Name: renderedConfig,
+			},
+			MachineOSConfig: mcfgv1.MachineOSConfigReference{
+				Name: "worker",
+			},
+		},
+		Status: mcfgv1.MachineOSBuildStatus{
+			Conditions: conditions,
+		},
+	}
+}
+
+func newLayeredNode(name, renderedConfig, image string) *corev1.Node {
+	node := newNode(name, "worker", renderedConfig, renderedConfig, daemonconsts.MachineConfigDaemonStateDone)
+	node.Annotations[daemonconsts.CurrentImageAnnotationKey] = image
+	node.Annotations[daemonconsts.DesiredImageAnnotationKey] = image
+	return node
+}
@@ -0,0 +1,398 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// Identifies the secrets which were cloned into the MCO namespace for a
+// MachineOSConfig so that they can be deleted along with it. The value is the
+// name of the MachineOSConfig.
+const clonedForMachineOSConfigLabelKey string = "machineconfiguration.openshift.io/cloned-for-machineosconfig"
+
+// Builds a MachineOSConfig which enables on-cluster layering for a single
+// MachineConfigPool. Secrets may live in any namespace; secrets outside of the
+// MCO namespace are cloned into it when the MachineOSConfig is created since
+// that is the only namespace the MCO reads them from.
+type MachineOSConfigBuilder struct {
+	poolName            string
+	name                string
+	containerfile       string
+	pushspec            string
+	pushSecret          *utils.SecretRef
+	baseImagePullSecret *utils.SecretRef
+}
+
+// Creates a MachineOSConfigBuilder for the given MachineConfigPool. The
+// MachineOSConfig is named after the pool unless WithName is used.
+func NewMachineOSConfigBuilder(poolName string) *MachineOSConfigBuilder {
+	return &MachineOSConfigBuilder{
+		poolName: poolName,
+		name:     poolName,
+	}
+}
+
+// Sets the name of the MachineOSConfig.
+func (m *MachineOSConfigBuilder) WithName(name string) *MachineOSConfigBuilder {
+	m.name = name
+	return m
+}
+
+// Sets the Containerfile used for every architecture.
+func (m *MachineOSConfigBuilder) WithContainerfile(containerfile string) *MachineOSConfigBuilder {
+	m.containerfile = containerfile
+	return m
+}
+
+// Sets the tagged pullspec that the built image is pushed to.
+func (m *MachineOSConfigBuilder) WithRenderedImagePushspec(pushspec string) *MachineOSConfigBuilder {
+	m.pushspec = pushspec
+	return m
+}
+
+// Sets the secret used to push the built image.
+func (m *MachineOSConfigBuilder) WithPushSecret(src utils.SecretRef) *MachineOSConfigBuilder {
+	m.pushSecret = &src
+	return m
+}
+
+// Sets the secret used to pull the base image. If not set, the MCO uses the
+// global pull secret.
+func (m *MachineOSConfigBuilder) WithBaseImagePullSecret(src utils.SecretRef) *MachineOSConfigBuilder {
+	m.baseImagePullSecret = &src
+	return m
+}
+
+func (m *MachineOSConfigBuilder) validate() error {
+	if m.poolName == "" {
+		return fmt.Errorf("no MachineConfigPool name given")
+	}
+
+	if m.name == "" {
+		return fmt.Errorf("no MachineOSConfig name given")
+	}
+
+	if m.pushspec == "" {
+		return fmt.Errorf("no rendered image pushspec given")
+	}
+
+	if m.pushSecret == nil || m.pushSecret.Name == "" {
+		return fmt.Errorf("no push secret given")
+	}
+
+	if m.baseImagePullSecret != nil && m.baseImagePullSecret.Name == "" {
+		return fmt.Errorf("base image pull secret has no name")
+	}
+
+	return nil
+}
+
+// Gets the reference to the secret in the MCO namespace that the
+// MachineOSConfig should use for the given source secret.
+func (m *MachineOSConfigBuilder) getSecretRefInMCONamespace(src *utils.SecretRef, purpose string) utils.SecretRef {
+	if src.Namespace == "" || src.Namespace == ctrlcommon.MCONamespace {
+		return utils.SecretRef{Name: src.Name, Namespace: ctrlcommon.MCONamespace}
+	}
+
+	return utils.SecretRef{
+		Name:      fmt.Sprintf("%s-%s", m.name, purpose),
+		Namespace: ctrlcommon.MCONamespace,
+	}
+}
+
+// Builds the MachineOSConfig without creating it or any secrets.
+func (m *MachineOSConfigBuilder) Build() (*mcfgv1.MachineOSConfig, error) {
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid MachineOSConfig: %w", err)
+	}
+
+	mosc := &mcfgv1.MachineOSConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: m.name,
+		},
+		Spec: mcfgv1.MachineOSConfigSpec{
+			MachineConfigPool: mcfgv1.MachineConfigPoolReference{
+				Name: m.poolName,
+			},
+			ImageBuilder: mcfgv1.MachineOSImageBuilder{
+				ImageBuilderType: mcfgv1.JobBuilder,
+			},
+			RenderedImagePushSecret: mcfgv1.ImageSecretObjectReference{
+				Name: m.getSecretRefInMCONamespace(m.pushSecret, "push-secret").Name,
+			},
+			RenderedImagePushSpec: mcfgv1.ImageTagFormat(m.pushspec),
+		},
+	}
+
+	if m.containerfile != "" {
+		mosc.Spec.Containerfile = []mcfgv1.MachineOSContainerfile{
+			{
+				ContainerfileArch: mcfgv1.NoArch,
+				Content:           m.containerfile,
+			},
+		}
+	}
+
+	if m.baseImagePullSecret != nil {
+		mosc.Spec.BaseImagePullSecret = &mcfgv1.ImageSecretObjectReference{
+			Name: m.getSecretRefInMCONamespace(m.baseImagePullSecret, "base-pull-secret").Name,
+		}
+	}
+
+	return mosc, nil
+}
+
+// Clones any secrets which live outside of the MCO namespace into it.
+func (m *MachineOSConfigBuilder) cloneSecrets(cs *framework.ClientSet) error {
+	toClone := map[string]*utils.SecretRef{
+		"push-secret":      m.pushSecret,
+		"base-pull-secret": m.baseImagePullSecret,
+	}
+
+	for purpose, src := range toClone {
+		if src == nil {
+			continue
+		}
+
+		dst := m.getSecretRefInMCONamespace(src, purpose)
+		if dst.Name == src.Name {
+			continue
+		}
+
+		labels := map[string]string{
+			clonedForMachineOSConfigLabelKey: m.name,
+		}
+
+		if err := utils.CloneSecretWithLabels(cs, *src, dst, labels); err != nil {
+			return fmt.Errorf("could not clone secret %s to %s: %w", src, dst.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// Clones the secrets into the MCO namespace and creates the MachineOSConfig.
+// The MCO begins building the image as soon as the MachineOSConfig exists.
+func CreateMachineOSConfig(ctx context.Context, cs *framework.ClientSet, builder *MachineOSConfigBuilder) (*mcfgv1.MachineOSConfig, error) {
+	mosc, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cs.MachineConfigPools().Get(ctx, builder.poolName, metav1.GetOptions{}); err != nil {
+		return nil, fmt.Errorf("could not get MachineConfigPool %s: %w", builder.poolName, err)
+	}
+
+	// The cloned secrets are named after the MachineOSConfig, so cloning them
+	// for one which already exists would replace the secrets it uses.
+	_, err = cs.MachineOSConfigs().Get(ctx, mosc.Name, metav1.GetOptions{})
+	if err == nil {
+		return nil, fmt.Errorf("MachineOSConfig %s already exists", mosc.Name)
+	}
+
+	if !apierrs.IsNotFound(err) {
+		return nil, fmt.Errorf("could not get MachineOSConfig %s: %w", mosc.Name, err)
+	}
+
+	if err := builder.cloneSecrets(cs); err != nil {
+		return nil, cleanupSecretsClonedForMachineOSConfig(ctx, cs, mosc.Name, err)
+	}
+
+	created, err := cs.MachineOSConfigs().Create(ctx, mosc, metav1.CreateOptions{})
+	if err != nil {
+		return nil, cleanupSecretsClonedForMachineOSConfig(ctx, cs, mosc.Name, fmt.Errorf("could not create MachineOSConfig %s: %w", mosc.Name, err))
+	}
+
+	klog.Infof("Created MachineOSConfig %s for pool %s", created.Name, builder.poolName)
+
+	return created, nil
+}
+
+// Deletes the secrets cloned for a MachineOSConfig which could not be
+// created. Returns the given cause along with any error from deleting them.
+func cleanupSecretsClonedForMachineOSConfig(ctx context.Context, cs *framework.ClientSet, moscName string, cause error) error {
+	if err := deleteSecretsClonedForMachineOSConfig(context.WithoutCancel(ctx), cs, moscName); err != nil {
+		return errors.Join(cause, err)
+	}
+
+	return cause
+}
+
+// Creates the MachineOSConfig and waits for its first MachineOSBuild to
+// complete and roll out to every node in the pool.
+func CreateMachineOSConfigAndWait(ctx context.Context, cs *framework.ClientSet, builder *MachineOSConfigBuilder, opts WaitOpts) (*mcfgv1.MachineOSConfig, error) {
+	mosc, err := CreateMachineOSConfig(ctx, cs, builder)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WaitForMachineOSBuildAndRolloutWithOpts(ctx, cs, builder.poolName, opts); err != nil {
+		return mosc, err
+	}
+
+	return mosc, nil
+}
+
+// Applies the given mutation to the named MachineOSConfig, retrying on
+// conflicts. Changing the spec causes the MCO to start a new build.
+func UpdateMachineOSConfig(ctx context.Context, cs *framework.ClientSet, name string, mutateFunc func(*mcfgv1.MachineOSConfig)) (*mcfgv1.MachineOSConfig, error) {
+	var updated *mcfgv1.MachineOSConfig
+
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		mosc, err := cs.MachineOSConfigs().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		mutateFunc(mosc)
+
+		updated, err = cs.MachineOSConfigs().Update(ctx, mosc, metav1.UpdateOptions{})
+		return err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not update MachineOSConfig %s: %w", name, err)
+	}
+
+	klog.Infof("Updated MachineOSConfig %s", name)
+
+	return updated, nil
+}
+
+// Options for deleting a MachineOSConfig.
+type DeleteMachineOSConfigOpts struct {
+	WaitOpts
+	// Wait for every node in the pool to leave the layered image and return to
+	// the pool's non-layered rendered config.
+	RestoreNonLayered bool
+	// How long to wait for the pool to return to its non-layered state.
+	// Defaults to 30 minutes.
+	RestoreTimeout time.Duration
+}
+
+// Deletes the named MachineOSConfig, its MachineOSBuilds, and any secrets
+// which were cloned for it. A MachineOSConfig which does not exist is not an
+// error so that teardown can be retried.
+func DeleteMachineOSConfig(ctx context.Context, cs *framework.ClientSet, name string, opts DeleteMachineOSConfigOpts) error {
+	mosc, err := cs.MachineOSConfigs().Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not get MachineOSConfig %s: %w", name, err)
+	}
+
+	poolName := ""
+
+	if err == nil {
+		poolName = mosc.Spec.MachineConfigPool.Name
+
+		if err := cs.MachineOSConfigs().Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			return fmt.Errorf("could not delete MachineOSConfig %s: %w", name, err)
+		}
+
+		klog.Infof("Deleted MachineOSConfig %s", name)
+	} else {
+		klog.Infof("MachineOSConfig %s already deleted", name)
+	}
+
+	if err := deleteMachineOSBuildsForMachineOSConfig(ctx, cs, name); err != nil {
+		return err
+	}
+
+	if err := deleteSecretsClonedForMachineOSConfig(ctx, cs, name); err != nil {
+		return err
+	}
+
+	if !opts.RestoreNonLayered || poolName == "" {
+		return nil
+	}
+
+	return waitForPoolToLeaveLayering(ctx, cs, poolName, opts)
+}
+
+func deleteMachineOSBuildsForMachineOSConfig(ctx context.Context, cs *framework.ClientSet, moscName string) error {
+	mosbs, err := utils.NewMachineOSBuildQuery(cs).GetMachineOSBuildsForMachineOSConfig(ctx, moscName)
+	if err != nil {
+		return err
+	}
+
+	for _, mosb := range mosbs {
+		if err := cs.MachineOSBuilds().Delete(ctx, mosb.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			return fmt.Errorf("could not delete MachineOSBuild %s: %w", mosb.Name, err)
+		}
+
+		klog.Infof("Deleted MachineOSBuild %s", mosb.Name)
+	}
+
+	return nil
+}
+
+func deleteSecretsClonedForMachineOSConfig(ctx context.Context, cs *framework.ClientSet, moscName string) error {
+	secrets, err := cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", clonedForMachineOSConfigLabelKey, moscName),
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not list secrets cloned for MachineOSConfig %s: %w", moscName, err)
+	}
+
+	for _, secret := range secrets.Items {
+		if err := cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			return fmt.Errorf("could not delete secret %s: %w", secret.Name, err)
+		}
+
+		klog.Infof("Deleted secret %s/%s", ctrlcommon.MCONamespace, secret.Name)
+	}
+
+	return nil
+}
+
+// Waits for every node in the pool to be running its rendered config without
+// a layered image.
+func waitForPoolToLeaveLayering(ctx context.Context, cs *framework.ClientSet, poolName string, opts DeleteMachineOSConfigOpts) (err error) {
+	timeout := opts.RestoreTimeout
+	if timeout == 0 {
+		timeout = defaultRevertTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	w, err := newPoolWaiter(ctx, cs, opts.WaitOpts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		w.reporter.summary([]string{poolName}, err)
+	}()
+
+	klog.Infof("Waiting up to %s for nodes in pool %s to leave the layered image", timeout, poolName)
+
+	start := time.Now()
+
+	if err := w.waitForNodesToMatch(ctx, poolName, isNodeDoneWithoutImage); err != nil {
+		return err
+	}
+
+	w.reporter.poolCompleted(poolName, time.Since(start))
+
+	return nil
+}
+
+func isNodeDoneWithoutImage(node *corev1.Node) bool {
+	current := node.Annotations[daemonconsts.CurrentImageAnnotationKey]
+	desired := node.Annotations[daemonconsts.DesiredImageAnnotationKey]
+	return isNodeConfigDone(node) && current == "" && desired == ""
+}
@@ -0,0 +1,214 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMachineOSConfigBuilder(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		builder       *MachineOSConfigBuilder
+		errExpected   bool
+		expectedPush  string
+		expectedPull  string
+		containerfile bool
+	}{
+		{
+			name:        "Missing pushspec",
+			builder:     NewMachineOSConfigBuilder("worker").WithPushSecret(utils.SecretRef{Name: "push"}),
+			errExpected: true,
+		},
+		{
+			name:        "Missing push secret",
+			builder:     NewMachineOSConfigBuilder("worker").WithRenderedImagePushspec("registry.host.com/org/image:latest"),
+			errExpected: true,
+		},
+		{
+			name: "Secrets in MCO namespace are used as-is",
+			builder: NewMachineOSConfigBuilder("worker").
+				WithRenderedImagePushspec("registry.host.com/org/image:latest").
+				WithPushSecret(utils.SecretRef{Name: "push", Namespace: ctrlcommon.MCONamespace}),
+			expectedPush: "push",
+		},
+		{
+			name: "Secrets in other namespaces are renamed",
+			builder: NewMachineOSConfigBuilder("worker").
+				WithName("layered").
+				WithContainerfile("FROM configs AS final\nRUN echo hello").
+				WithRenderedImagePushspec("registry.host.com/org/image:latest").
+				WithPushSecret(utils.SecretRef{Name: "push", Namespace: "other"}).
+				WithBaseImagePullSecret(utils.SecretRef{Name: "pull", Namespace: "other"}),
+			expectedPush:  "layered-push-secret",
+			expectedPull:  "layered-base-pull-secret",
+			containerfile: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			mosc, err := testCase.builder.Build()
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "worker", mosc.Spec.MachineConfigPool.Name)
+			assert.Equal(t, mcfgv1.JobBuilder, mosc.Spec.ImageBuilder.ImageBuilderType)
+			assert.Equal(t, testCase.expectedPush, mosc.Spec.RenderedImagePushSecret.Name)
+
+			if testCase.expectedPull == "" {
+				assert.Nil(t, mosc.Spec.BaseImagePullSecret)
+			} else {
+				assert.Equal(t, testCase.expectedPull, mosc.Spec.BaseImagePullSecret.Name)
+			}
+
+			if testCase.containerfile {
+				require.Len(t, mosc.Spec.Containerfile, 1)
+				assert.Equal(t, mcfgv1.NoArch, mosc.Spec.Containerfile[0].ContainerfileArch)
+			} else {
+				assert.Empty(t, mosc.Spec.Containerfile)
+			}
+		})
+	}
+}
+
+func TestMachineOSConfigLifecycle(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	pushSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "push",
+			Namespace: "other",
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`),
+		},
+	}
+
+	cs := newFakeClientSet(newMachineConfigPool("worker", "rendered-worker-1"), pushSecret)
+
+	builder := NewMachineOSConfigBuilder("worker").
+		WithRenderedImagePushspec("registry.host.com/org/image:latest").
+		WithPushSecret(utils.SecretRef{Name: "push", Namespace: "other"})
+
+	mosc, err := CreateMachineOSConfig(ctx, cs, builder)
+	require.NoError(t, err)
+	assert.Equal(t, "worker-push-secret", mosc.Spec.RenderedImagePushSecret.Name)
+
+	cloned, err := cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Get(ctx, "worker-push-secret", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, pushSecret.Data, cloned.Data)
+	assert.Equal(t, "worker", cloned.Labels[clonedForMachineOSConfigLabelKey])
+
+	// Creating the MachineOSConfig again fails without replacing the secrets
+	// the existing one uses.
+	_, err = CreateMachineOSConfig(ctx, cs, builder)
+	assert.ErrorContains(t, err, "already exists")
+
+	_, err = cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Get(ctx, "worker-push-secret", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	// Creating a MachineOSConfig for a pool which does not exist fails.
+	_, err = CreateMachineOSConfig(ctx, cs, NewMachineOSConfigBuilder("infra").
+		WithRenderedImagePushspec("registry.host.com/org/image:latest").
+		WithPushSecret(utils.SecretRef{Name: "push", Namespace: "other"}))
+	assert.Error(t, err)
+
+	updated, err := UpdateMachineOSConfig(ctx, cs, "worker", func(mosc *mcfgv1.MachineOSConfig) {
+		mosc.Spec.RenderedImagePushSpec = "registry.host.com/org/image:updated"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, mcfgv1.ImageTagFormat("registry.host.com/org/image:updated"), updated.Spec.RenderedImagePushSpec)
+
+	_, err = cs.MachineOSBuilds().Create(ctx, newMachineOSBuild("worker-build", "rendered-worker-1", nil), metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, DeleteMachineOSConfig(ctx, cs, "worker", DeleteMachineOSConfigOpts{}))
+
+	_, err = cs.MachineOSConfigs().Get(ctx, "worker", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	_, err = cs.MachineOSBuilds().Get(ctx, "worker-build", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	_, err = cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Get(ctx, "worker-push-secret", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	// The source secret is left alone.
+	_, err = cs.CoreV1Interface.Secrets("other").Get(ctx, "push", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// Deleting again is a no-op.
+	assert.NoError(t, DeleteMachineOSConfig(ctx, cs, "worker", DeleteMachineOSConfigOpts{}))
+}
+
+func TestCreateMachineOSConfigDeletesClonedSecretsOnFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	pushSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "push",
+			Namespace: "other",
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`),
+		},
+	}
+
+	kubeclient, mcfgclient := newFakeClients(newMachineConfigPool("worker", "rendered-worker-1"), pushSecret)
+	mcfgclient.PrependReactor("create", "machineosconfigs", func(_ k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("admission webhook denied the request")
+	})
+
+	cs := newFakeClientSetFromClients(kubeclient, mcfgclient)
+
+	builder := NewMachineOSConfigBuilder("worker").
+		WithRenderedImagePushspec("registry.host.com/org/image:latest").
+		WithPushSecret(utils.SecretRef{Name: "push", Namespace: "other"})
+
+	_, err := CreateMachineOSConfig(ctx, cs, builder)
+	assert.ErrorContains(t, err, "admission webhook denied the request")
+
+	_, err = cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Get(ctx, "worker-push-secret", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	// The source secret is left alone.
+	_, err = cs.CoreV1Interface.Secrets("other").Get(ctx, "push", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestIsNodeDoneWithoutImage(t *testing.T) {
+	t.Parallel()
+
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	assert.True(t, isNodeDoneWithoutImage(node))
+
+	layered := newLayeredNode("worker-0", "rendered-worker-1", testBuiltImage)
+	assert.False(t, isNodeDoneWithoutImage(layered))
+}
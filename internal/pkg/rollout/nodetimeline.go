@@ -0,0 +1,253 @@
+package rollout
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The phase a node is in while being updated. This is mostly the MCD state
+// annotation, except that a Working node which has requested a drain that
+// has not yet completed is considered to be Draining.
+type NodePhase string
+
+const (
+	NodePhaseDone           NodePhase = NodePhase(daemonconsts.MachineConfigDaemonStateDone)
+	NodePhaseWorking        NodePhase = NodePhase(daemonconsts.MachineConfigDaemonStateWorking)
+	NodePhaseDraining       NodePhase = "Draining"
+	NodePhaseRebooting      NodePhase = NodePhase(daemonconsts.MachineConfigDaemonStateRebooting)
+	NodePhaseDegraded       NodePhase = NodePhase(daemonconsts.MachineConfigDaemonStateDegraded)
+	NodePhaseUnreconcilable NodePhase = NodePhase(daemonconsts.MachineConfigDaemonStateUnreconcilable)
+	NodePhaseUnknown        NodePhase = "Unknown"
+)
+
+// A single observed change in a node's phase or cordon state.
+type NodePhaseTransition struct {
+	Phase     NodePhase `json:"phase"`
+	Cordoned  bool      `json:"cordoned"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Returned when a node becomes Degraded or Unreconcilable while we're waiting
+// on it.
+type NodeDegradedError struct {
+	Node   string
+	Pool   string
+	Phase  NodePhase
+	Reason string
+}
+
+func (n *NodeDegradedError) Error() string {
+	if n.Reason == "" {
+		return fmt.Sprintf("node %s in pool %s is %s", n.Node, n.Pool, n.Phase)
+	}
+
+	return fmt.Sprintf("node %s in pool %s is %s: %s", n.Node, n.Pool, n.Phase, n.Reason)
+}
+
+// Determines the current phase of the given node from its MCD state and
+// drain annotations.
+func getNodePhase(node *corev1.Node) NodePhase {
+	state := node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey]
+	if state == "" {
+		return NodePhaseUnknown
+	}
+
+	if state == daemonconsts.MachineConfigDaemonStateWorking && isNodeDraining(node) {
+		return NodePhaseDraining
+	}
+
+	return NodePhase(state)
+}
+
+// Determines whether the MCD has requested a drain which the controller has
+// not yet completed.
+func isNodeDraining(node *corev1.Node) bool {
+	desired := node.Annotations[daemonconsts.DesiredDrainerAnnotationKey]
+	lastApplied := node.Annotations[daemonconsts.LastAppliedDrainerAnnotationKey]
+	return strings.HasPrefix(desired, daemonconsts.DrainerStateDrain) && desired != lastApplied
+}
+
+// Keeps track of the phase transitions for each node in a pool and
+// determines when a node has been in its current phase for too long.
+type nodeTimelineTracker struct {
+	// How long a node may remain in a phase other than Done before it is
+	// considered stuck. Zero disables stuck detection.
+	stuckThreshold time.Duration
+
+	mu        sync.Mutex
+	timelines map[string]*nodeTimeline
+}
+
+type nodeTimeline struct {
+	transitions []NodePhaseTransition
+	// Whether the node has already been reported as stuck in its current
+	// phase. This ensures it is only reported once per phase.
+	stuckReported bool
+}
+
+func (n *nodeTimeline) current() *NodePhaseTransition {
+	if len(n.transitions) == 0 {
+		return nil
+	}
+
+	return &n.transitions[len(n.transitions)-1]
+}
+
+func newNodeTimelineTracker(stuckThreshold time.Duration) *nodeTimelineTracker {
+	return &nodeTimelineTracker{
+		stuckThreshold: stuckThreshold,
+		timelines:      map[string]*nodeTimeline{},
+	}
+}
+
+// Records the current phase and cordon state of the given node. Returns the
+// new transition if either one changed since the last observation.
+func (n *nodeTimelineTracker) observe(node *corev1.Node, now time.Time) *NodePhaseTransition {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.timelines[node.Name]; !ok {
+		n.timelines[node.Name] = &nodeTimeline{}
+	}
+
+	timeline := n.timelines[node.Name]
+
+	observed := NodePhaseTransition{
+		Phase:     getNodePhase(node),
+		Cordoned:  node.Spec.Unschedulable,
+		Timestamp: now,
+	}
+
+	current := timeline.current()
+	if current != nil && current.Phase == observed.Phase && current.Cordoned == observed.Cordoned {
+		return nil
+	}
+
+	if current == nil || current.Phase != observed.Phase {
+		timeline.stuckReported = false
+	}
+
+	timeline.transitions = append(timeline.transitions, observed)
+
+	return &observed
+}
+
+// Determines whether the given node has been in its current phase for longer
+// than the stuck threshold. Returns the phase and how long it has been in it.
+// A node is only reported as stuck once per phase.
+func (n *nodeTimelineTracker) checkStuck(nodeName string, now time.Time) (NodePhase, time.Duration, bool) {
+	if n.stuckThreshold == 0 {
+		return "", 0, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	timeline, ok := n.timelines[nodeName]
+	if !ok || timeline.stuckReported {
+		return "", 0, false
+	}
+
+	// Find when the node entered its current phase. Cordon changes do not
+	// reset the clock.
+	current := timeline.current()
+	if current == nil || current.Phase == NodePhaseDone {
+		return "", 0, false
+	}
+
+	enteredAt := current.Timestamp
+	for i := len(timeline.transitions) - 1; i >= 0; i-- {
+		if timeline.transitions[i].Phase != current.Phase {
+			break
+		}
+
+		enteredAt = timeline.transitions[i].Timestamp
+	}
+
+	inPhase := now.Sub(enteredAt)
+	if inPhase < n.stuckThreshold {
+		return "", 0, false
+	}
+
+	timeline.stuckReported = true
+
+	return current.Phase, inPhase, true
+}
+
+// Determines how long the given node took to update, from when it was first
+// observed in a phase other than Done until it most recently became Done.
+// Returns false if the node is not currently Done or was never observed
+// updating.
+func (n *nodeTimelineTracker) updateDuration(nodeName string) (time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	timeline, ok := n.timelines[nodeName]
+	if !ok {
+		return 0, false
+	}
+
+	current := timeline.current()
+	if current == nil || current.Phase != NodePhaseDone {
+		return 0, false
+	}
+
+	var startedAt *time.Time
+	for i := range timeline.transitions {
+		if timeline.transitions[i].Phase != NodePhaseDone {
+			startedAt = &timeline.transitions[i].Timestamp
+			break
+		}
+	}
+
+	if startedAt == nil {
+		return 0, false
+	}
+
+	// Find when the node became Done. Cordon changes after that do not extend
+	// the update.
+	doneAt := current.Timestamp
+	for i := len(timeline.transitions) - 1; i >= 0; i-- {
+		if timeline.transitions[i].Phase != NodePhaseDone {
+			break
+		}
+
+		doneAt = timeline.transitions[i].Timestamp
+	}
+
+	return doneAt.Sub(*startedAt), true
+}
+
+// Returns a copy of the timeline for every observed node.
+func (n *nodeTimelineTracker) timelinesByNode() map[string][]NodePhaseTransition {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out := map[string][]NodePhaseTransition{}
+	for name, timeline := range n.timelines {
+		out[name] = append([]NodePhaseTransition{}, timeline.transitions...)
+	}
+
+	return out
+}
+
+// Returns an error if the given node is Degraded or Unreconcilable, including
+// the reason that the MCD reported.
+func validateNodeIsNotDegraded(poolName string, node *corev1.Node) error {
+	phase := getNodePhase(node)
+	if phase != NodePhaseDegraded && phase != NodePhaseUnreconcilable {
+		return nil
+	}
+
+	return &NodeDegradedError{
+		Node:   node.Name,
+		Pool:   poolName,
+		Phase:  phase,
+		Reason: node.Annotations[daemonconsts.MachineConfigDaemonReasonAnnotationKey],
+	}
+}
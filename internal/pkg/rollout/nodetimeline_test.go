@@ -0,0 +1,271 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetNodePhase(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    NodePhase
+	}{
+		{
+			name:     "No state annotation",
+			expected: NodePhaseUnknown,
+		},
+		{
+			name: "Done",
+			annotations: map[string]string{
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: daemonconsts.MachineConfigDaemonStateDone,
+			},
+			expected: NodePhaseDone,
+		},
+		{
+			name: "Working without drain request",
+			annotations: map[string]string{
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: daemonconsts.MachineConfigDaemonStateWorking,
+			},
+			expected: NodePhaseWorking,
+		},
+		{
+			name: "Working with pending drain request",
+			annotations: map[string]string{
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: daemonconsts.MachineConfigDaemonStateWorking,
+				daemonconsts.DesiredDrainerAnnotationKey:           "drain-rendered-worker-2",
+				daemonconsts.LastAppliedDrainerAnnotationKey:       "uncordon-rendered-worker-1",
+			},
+			expected: NodePhaseDraining,
+		},
+		{
+			name: "Working with completed drain request",
+			annotations: map[string]string{
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: daemonconsts.MachineConfigDaemonStateWorking,
+				daemonconsts.DesiredDrainerAnnotationKey:           "drain-rendered-worker-2",
+				daemonconsts.LastAppliedDrainerAnnotationKey:       "drain-rendered-worker-2",
+			},
+			expected: NodePhaseWorking,
+		},
+		{
+			name: "Rebooting",
+			annotations: map[string]string{
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: daemonconsts.MachineConfigDaemonStateRebooting,
+			},
+			expected: NodePhaseRebooting,
+		},
+		{
+			name: "Degraded",
+			annotations: map[string]string{
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: daemonconsts.MachineConfigDaemonStateDegraded,
+			},
+			expected: NodePhaseDegraded,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "worker-0",
+					Annotations: testCase.annotations,
+				},
+			}
+
+			assert.Equal(t, testCase.expected, getNodePhase(node))
+		})
+	}
+}
+
+func TestNodeTimelineTracker(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	tracker := newNodeTimelineTracker(time.Minute * 10)
+
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+
+	transition := tracker.observe(node, start)
+	require.NotNil(t, transition)
+	assert.Equal(t, NodePhaseDone, transition.Phase)
+
+	// Observing the same state again is not a transition.
+	assert.Nil(t, tracker.observe(node, start.Add(time.Minute)))
+
+	// Done nodes are never stuck.
+	_, _, isStuck := tracker.checkStuck(node.Name, start.Add(time.Hour))
+	assert.False(t, isStuck)
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateWorking
+	node.Annotations[daemonconsts.DesiredDrainerAnnotationKey] = "drain-rendered-worker-2"
+	transition = tracker.observe(node, start.Add(time.Minute*2))
+	require.NotNil(t, transition)
+	assert.Equal(t, NodePhaseDraining, transition.Phase)
+	assert.False(t, transition.Cordoned)
+
+	// Cordoning the node is a transition, but does not reset the time in phase.
+	node.Spec.Unschedulable = true
+	transition = tracker.observe(node, start.Add(time.Minute*5))
+	require.NotNil(t, transition)
+	assert.Equal(t, NodePhaseDraining, transition.Phase)
+	assert.True(t, transition.Cordoned)
+
+	_, _, isStuck = tracker.checkStuck(node.Name, start.Add(time.Minute*11))
+	assert.False(t, isStuck)
+
+	phase, inPhase, isStuck := tracker.checkStuck(node.Name, start.Add(time.Minute*12))
+	assert.True(t, isStuck)
+	assert.Equal(t, NodePhaseDraining, phase)
+	assert.Equal(t, time.Minute*10, inPhase)
+
+	// A stuck node is only reported once per phase.
+	_, _, isStuck = tracker.checkStuck(node.Name, start.Add(time.Minute*20))
+	assert.False(t, isStuck)
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateRebooting
+	require.NotNil(t, tracker.observe(node, start.Add(time.Minute*21)))
+
+	phase, _, isStuck = tracker.checkStuck(node.Name, start.Add(time.Minute*31))
+	assert.True(t, isStuck)
+	assert.Equal(t, NodePhaseRebooting, phase)
+
+	timelines := tracker.timelinesByNode()
+	phases := []NodePhase{}
+	for _, transition := range timelines[node.Name] {
+		phases = append(phases, transition.Phase)
+	}
+
+	assert.Equal(t, []NodePhase{NodePhaseDone, NodePhaseDraining, NodePhaseDraining, NodePhaseRebooting}, phases)
+}
+
+func TestNodeTimelineTrackerUpdateDuration(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	tracker := newNodeTimelineTracker(0)
+
+	// A node which was never seen updating has no update duration.
+	idle := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	tracker.observe(idle, start)
+
+	_, ok := tracker.updateDuration(idle.Name)
+	assert.False(t, ok)
+
+	_, ok = tracker.updateDuration("unknown")
+	assert.False(t, ok)
+
+	// The node starts updating well after the wait began, so its duration
+	// should not include the time spent waiting for it to start.
+	node := newNode("worker-1", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	tracker.observe(node, start)
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateWorking
+	tracker.observe(node, start.Add(time.Minute*10))
+
+	_, ok = tracker.updateDuration(node.Name)
+	assert.False(t, ok, "node which is not Done has no update duration")
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateRebooting
+	node.Spec.Unschedulable = true
+	tracker.observe(node, start.Add(time.Minute*12))
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateDone
+	tracker.observe(node, start.Add(time.Minute*15))
+
+	// Uncordoning the node after it is Done does not extend the update.
+	node.Spec.Unschedulable = false
+	tracker.observe(node, start.Add(time.Minute*16))
+
+	took, ok := tracker.updateDuration(node.Name)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute*5, took)
+}
+
+func TestNodeTimelineTrackerStuckDisabled(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	tracker := newNodeTimelineTracker(0)
+
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-2", daemonconsts.MachineConfigDaemonStateWorking)
+	tracker.observe(node, start)
+
+	_, _, isStuck := tracker.checkStuck(node.Name, start.Add(time.Hour*24))
+	assert.False(t, isStuck)
+}
+
+func TestValidateNodeIsNotDegraded(t *testing.T) {
+	t.Parallel()
+
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-2", daemonconsts.MachineConfigDaemonStateWorking)
+	assert.NoError(t, validateNodeIsNotDegraded("worker", node))
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateDegraded
+	node.Annotations[daemonconsts.MachineConfigDaemonReasonAnnotationKey] = "unexpected on-disk state"
+
+	err := validateNodeIsNotDegraded("worker", node)
+	assert.EqualError(t, err, "node worker-0 in pool worker is Degraded: unexpected on-disk state")
+
+	var degradedErr *NodeDegradedError
+	require.True(t, errors.As(err, &degradedErr))
+	assert.Equal(t, "unexpected on-disk state", degradedErr.Reason)
+}
+
+func TestClusterStateTrackerDegradedNode(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-2")
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-2", daemonconsts.MachineConfigDaemonStateWorking)
+
+	kubeclient, mcfgclient := newFakeClients(pool, node)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	events := &eventCollector{}
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{ProgressHandler: events.handle})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.waitForNodesToComplete(ctx, pool.Name)
+	}()
+
+	// Wait for the initial phase to be observed before degrading the node.
+	require.Eventually(t, func() bool {
+		return len(events.get()) != 0
+	}, time.Second*10, time.Millisecond*10)
+
+	node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateDegraded
+	node.Annotations[daemonconsts.MachineConfigDaemonReasonAnnotationKey] = "failed to drain node"
+
+	_, err = kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.ErrorContains(t, err, "failed to drain node")
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for degraded node")
+	}
+
+	assert.Equal(t, []ProgressEventType{NodePhaseChangedEvent, NodePhaseChangedEvent, PoolDegradedEvent}, events.types())
+	assert.Equal(t, NodePhaseWorking, events.get()[0].Phase)
+	assert.Equal(t, NodePhaseDegraded, events.get()[1].Phase)
+	assert.Equal(t, "worker-0", events.get()[2].Node)
+}
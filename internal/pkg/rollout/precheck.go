@@ -0,0 +1,379 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	configv1 "github.com/openshift/api/config/v1"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	configv1client "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
+	mcfgv1client "github.com/openshift/client-go/machineconfiguration/clientset/versioned/typed/machineconfiguration/v1"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/test/framework"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	certificatesv1client "k8s.io/client-go/kubernetes/typed/certificates/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog"
+)
+
+// How serious a precheck finding is.
+type PrecheckSeverity string
+
+const (
+	// The cluster is in an unusual state, but it is safe to continue.
+	PrecheckSeverityWarning PrecheckSeverity = "Warning"
+	// The cluster is unhealthy and continuing may make things worse or make
+	// the outcome impossible to interpret.
+	PrecheckSeverityError PrecheckSeverity = "Error"
+)
+
+// The names of the individual prechecks.
+const (
+	precheckClusterOperators string = "ClusterOperators"
+	precheckPools            string = "MachineConfigPools"
+	precheckNodes            string = "Nodes"
+	precheckCVO              string = "ClusterVersionOperator"
+	precheckCSRs             string = "CertificateSigningRequests"
+)
+
+// A single problem found by a precheck.
+type PrecheckFinding struct {
+	Severity PrecheckSeverity `json:"severity"`
+	// The name of the check which produced the finding.
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+func (p PrecheckFinding) String() string {
+	return fmt.Sprintf("[%s] %s: %s", p.Severity, p.Check, p.Message)
+}
+
+// The result of running every precheck against a cluster.
+type PrecheckReport struct {
+	Findings []PrecheckFinding `json:"findings"`
+}
+
+func (p *PrecheckReport) add(severity PrecheckSeverity, check, msg string, args ...interface{}) {
+	p.Findings = append(p.Findings, PrecheckFinding{
+		Severity: severity,
+		Check:    check,
+		Message:  fmt.Sprintf(msg, args...),
+	})
+}
+
+// Gets the findings with the given severity.
+func (p *PrecheckReport) GetFindings(severity PrecheckSeverity) []PrecheckFinding {
+	out := []PrecheckFinding{}
+
+	for _, finding := range p.Findings {
+		if finding.Severity == severity {
+			out = append(out, finding)
+		}
+	}
+
+	return out
+}
+
+// Determines whether any of the findings are errors.
+func (p *PrecheckReport) HasErrors() bool {
+	return len(p.GetFindings(PrecheckSeverityError)) != 0
+}
+
+func (p *PrecheckReport) String() string {
+	if len(p.Findings) == 0 {
+		return "All prechecks passed"
+	}
+
+	lines := []string{}
+	for _, finding := range p.Findings {
+		lines = append(lines, finding.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Gets a copy of the report with every error downgraded to a warning.
+func (p *PrecheckReport) downgradeErrors() *PrecheckReport {
+	out := &PrecheckReport{}
+
+	for _, finding := range p.Findings {
+		finding.Severity = PrecheckSeverityWarning
+		out.Findings = append(out.Findings, finding)
+	}
+
+	return out
+}
+
+// Logs each finding at a level matching its severity.
+func (p *PrecheckReport) Log() {
+	if len(p.Findings) == 0 {
+		klog.Infof("All prechecks passed")
+		return
+	}
+
+	for _, finding := range p.Findings {
+		if finding.Severity == PrecheckSeverityError {
+			klog.Errorf("Precheck failed: %s", finding)
+		} else {
+			klog.Warningf("Precheck warning: %s", finding)
+		}
+	}
+}
+
+// Runs the prechecks, logs the report, and returns an error if any of them
+// failed. If skip is true, the prechecks are not run at all.
+func EnforcePrechecks(ctx context.Context, cs *framework.ClientSet, skip bool) error {
+	if skip {
+		klog.Warningf("Skipping cluster health prechecks")
+		return nil
+	}
+
+	return newPrechecker(cs).enforce(ctx)
+}
+
+// Runs the prechecks and logs the report, but never stops the caller. Failed
+// prechecks are logged as warnings. This is used before recovery operations
+// such as reverting the MCO image, which are most needed when the cluster is
+// unhealthy.
+func reportPrechecks(ctx context.Context, cs *framework.ClientSet, skip bool) {
+	if skip {
+		klog.Warningf("Skipping cluster health prechecks")
+		return
+	}
+
+	newPrechecker(cs).report(ctx)
+}
+
+// Checks whether the cluster is healthy enough for a disruptive operation
+// such as replacing the MCO image or rolling out a MachineConfig. Checks for
+// degraded or unavailable ClusterOperators, degraded or paused
+// MachineConfigPools, nodes which are not Ready, a scaled-down CVO, and
+// pending CertificateSigningRequests.
+func RunPrechecks(ctx context.Context, cs *framework.ClientSet) (*PrecheckReport, error) {
+	return newPrechecker(cs).run(ctx)
+}
+
+// Holds the clients needed by the prechecks so that they can be replaced with
+// fakes in tests.
+type prechecker struct {
+	config configv1client.ClusterOperatorsGetter
+	mcfg   mcfgv1client.MachineConfigPoolsGetter
+	core   corev1client.NodesGetter
+	apps   appsv1client.DeploymentsGetter
+	certs  certificatesv1client.CertificateSigningRequestsGetter
+}
+
+func newPrechecker(cs *framework.ClientSet) *prechecker {
+	return &prechecker{
+		config: cs.ConfigV1Interface,
+		mcfg:   cs.MachineconfigurationV1Interface,
+		core:   cs.CoreV1Interface,
+		apps:   cs.AppsV1Interface,
+		certs:  cs.GetKubeclient().CertificatesV1(),
+	}
+}
+
+func (p *prechecker) enforce(ctx context.Context) error {
+	report, err := p.run(ctx)
+	if err != nil {
+		return err
+	}
+
+	report.Log()
+
+	if !report.HasErrors() {
+		return nil
+	}
+
+	return fmt.Errorf("cluster failed %d precheck(s), rerun with --skip-prechecks to continue anyway", len(report.GetFindings(PrecheckSeverityError)))
+}
+
+// Runs the prechecks and logs every finding as a warning. Returns the
+// downgraded report, or nil if the prechecks could not be run.
+func (p *prechecker) report(ctx context.Context) *PrecheckReport {
+	report, err := p.run(ctx)
+	if err != nil {
+		klog.Warningf("Could not run cluster health prechecks, continuing anyway: %s", err)
+		return nil
+	}
+
+	failed := len(report.GetFindings(PrecheckSeverityError))
+
+	report = report.downgradeErrors()
+	report.Log()
+
+	if failed != 0 {
+		klog.Warningf("Continuing despite %d failed precheck(s) since this may be needed to recover the cluster", failed)
+	}
+
+	return report
+}
+
+func (p *prechecker) run(ctx context.Context) (*PrecheckReport, error) {
+	report := &PrecheckReport{}
+
+	checks := []func(context.Context, *PrecheckReport) error{
+		p.checkClusterOperators,
+		p.checkPools,
+		p.checkNodes,
+		p.checkCVO,
+		p.checkCSRs,
+	}
+
+	for _, check := range checks {
+		if err := check(ctx, report); err != nil {
+			return nil, fmt.Errorf("could not run prechecks: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+func (p *prechecker) checkClusterOperators(ctx context.Context, report *PrecheckReport) error {
+	coList, err := p.config.ClusterOperators().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list ClusterOperators: %w", err)
+	}
+
+	for _, co := range coList.Items {
+		for _, cond := range co.Status.Conditions {
+			if cond.Type == configv1.OperatorDegraded && cond.Status == configv1.ConditionTrue {
+				report.add(PrecheckSeverityError, precheckClusterOperators, "ClusterOperator %s is degraded: %s", co.Name, cond.Message)
+			}
+
+			if cond.Type == configv1.OperatorAvailable && cond.Status == configv1.ConditionFalse {
+				report.add(PrecheckSeverityError, precheckClusterOperators, "ClusterOperator %s is unavailable: %s", co.Name, cond.Message)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *prechecker) checkPools(ctx context.Context, report *PrecheckReport) error {
+	poolList, err := p.mcfg.MachineConfigPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list MachineConfigPools: %w", err)
+	}
+
+	degradedConditions := []mcfgv1.MachineConfigPoolConditionType{
+		mcfgv1.MachineConfigPoolDegraded,
+		mcfgv1.MachineConfigPoolNodeDegraded,
+		mcfgv1.MachineConfigPoolRenderDegraded,
+	}
+
+	for _, pool := range poolList.Items {
+		for _, cond := range pool.Status.Conditions {
+			for _, degraded := range degradedConditions {
+				if cond.Type == degraded && cond.Status == corev1.ConditionTrue {
+					report.add(PrecheckSeverityError, precheckPools, "MachineConfigPool %s is %s: %s", pool.Name, cond.Type, cond.Message)
+				}
+			}
+		}
+
+		if pool.Spec.Paused {
+			report.add(PrecheckSeverityWarning, precheckPools, "MachineConfigPool %s is paused", pool.Name)
+		}
+	}
+
+	return nil
+}
+
+// Nodes which are not Ready because the MCD is updating them (e.g., they are
+// rebooting) are expected during a rollout, so those are only warnings.
+func (p *prechecker) checkNodes(ctx context.Context, report *PrecheckReport) error {
+	nodeList, err := p.core.Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list nodes: %w", err)
+	}
+
+	for _, node := range nodeList.Items {
+		if isNodeReady(&node) {
+			continue
+		}
+
+		if isNodeUpdating(&node) {
+			report.add(PrecheckSeverityWarning, precheckNodes, "Node %s is not Ready, but is being updated by the MCO", node.Name)
+		} else {
+			report.add(PrecheckSeverityError, precheckNodes, "Node %s is not Ready", node.Name)
+		}
+	}
+
+	return nil
+}
+
+func isNodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// Determines whether the MCD is in the middle of updating the node. Degraded
+// nodes are not considered to be updating.
+func isNodeUpdating(node *corev1.Node) bool {
+	if node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] == daemonconsts.MachineConfigDaemonStateDegraded {
+		return false
+	}
+
+	return !isNodeConfigDone(node) || !isNodeImageDone(node)
+}
+
+// A scaled-down CVO usually means a previous MCO image replacement was never
+// reverted.
+func (p *prechecker) checkCVO(ctx context.Context, report *PrecheckReport) error {
+	cvo, err := p.apps.Deployments(cvoNamespace).Get(ctx, cvoName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get deployment %s/%s: %w", cvoNamespace, cvoName, err)
+	}
+
+	if cvo.Spec.Replicas != nil && *cvo.Spec.Replicas == 0 {
+		report.add(PrecheckSeverityWarning, precheckCVO, "%s is scaled down to 0 replicas; a previous MCO image replacement may not have been reverted", cvoName)
+	}
+
+	return nil
+}
+
+func (p *prechecker) checkCSRs(ctx context.Context, report *PrecheckReport) error {
+	csrList, err := p.certs.CertificateSigningRequests().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list CertificateSigningRequests: %w", err)
+	}
+
+	pending := []string{}
+
+	for _, csr := range csrList.Items {
+		if isCSRPending(&csr) {
+			pending = append(pending, csr.Name)
+		}
+	}
+
+	if len(pending) != 0 {
+		report.add(PrecheckSeverityWarning, precheckCSRs, "%d CertificateSigningRequest(s) pending approval: %v", len(pending), pending)
+	}
+
+	return nil
+}
+
+func isCSRPending(csr *certificatesv1.CertificateSigningRequest) bool {
+	for _, cond := range csr.Status.Conditions {
+		switch cond.Type {
+		case certificatesv1.CertificateApproved, certificatesv1.CertificateDenied, certificatesv1.CertificateFailed:
+			return false
+		}
+	}
+
+	return true
+}
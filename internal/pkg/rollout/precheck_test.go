@@ -0,0 +1,247 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+
+	configv1 "github.com/openshift/api/config/v1"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRunPrechecks(t *testing.T) {
+	t.Parallel()
+
+	zero := int32(0)
+
+	scaledDownCVO := newDeployment(cvoName, cvoNamespace, "quay.io/openshift/cvo:latest")
+	scaledDownCVO.Spec.Replicas = &zero
+
+	degradedPool := newMachineConfigPool("worker", "rendered-worker-1")
+	degradedPool.Status.Conditions = []mcfgv1.MachineConfigPoolCondition{
+		{Type: mcfgv1.MachineConfigPoolNodeDegraded, Status: corev1.ConditionTrue, Message: "node worker-0 is degraded"},
+	}
+
+	pausedPool := newMachineConfigPool("infra", "rendered-infra-1")
+	pausedPool.Spec.Paused = true
+
+	testCases := []struct {
+		name           string
+		kubeObjects    []runtime.Object
+		configObjects  []runtime.Object
+		expected       []PrecheckFinding
+		errorsExpected bool
+	}{
+		{
+			name: "Healthy cluster",
+			kubeObjects: []runtime.Object{
+				newDeployment(cvoName, cvoNamespace, "quay.io/openshift/cvo:latest"),
+				newMachineConfigPool("worker", "rendered-worker-1"),
+				newReadyNode("worker-0", true),
+				newCSR("approved", certificatesv1.CertificateApproved),
+			},
+			configObjects: []runtime.Object{
+				newClusterOperator("machine-config", configv1.ConditionFalse, configv1.ConditionTrue),
+			},
+		},
+		{
+			name: "Degraded ClusterOperator",
+			configObjects: []runtime.Object{
+				newClusterOperator("machine-config", configv1.ConditionTrue, configv1.ConditionFalse),
+			},
+			expected: []PrecheckFinding{
+				{Severity: PrecheckSeverityError, Check: precheckClusterOperators, Message: "ClusterOperator machine-config is degraded: Degraded message"},
+				{Severity: PrecheckSeverityError, Check: precheckClusterOperators, Message: "ClusterOperator machine-config is unavailable: Available message"},
+			},
+			errorsExpected: true,
+		},
+		{
+			name:        "Degraded and paused pools",
+			kubeObjects: []runtime.Object{degradedPool, pausedPool},
+			expected: []PrecheckFinding{
+				{Severity: PrecheckSeverityWarning, Check: precheckPools, Message: "MachineConfigPool infra is paused"},
+				{Severity: PrecheckSeverityError, Check: precheckPools, Message: "MachineConfigPool worker is NodeDegraded: node worker-0 is degraded"},
+			},
+			errorsExpected: true,
+		},
+		{
+			name: "Nodes which are not Ready",
+			kubeObjects: []runtime.Object{
+				newReadyNode("worker-0", false),
+				newUpdatingNode("worker-1"),
+			},
+			expected: []PrecheckFinding{
+				{Severity: PrecheckSeverityError, Check: precheckNodes, Message: "Node worker-0 is not Ready"},
+				{Severity: PrecheckSeverityWarning, Check: precheckNodes, Message: "Node worker-1 is not Ready, but is being updated by the MCO"},
+			},
+			errorsExpected: true,
+		},
+		{
+			name: "Scaled down CVO and pending CSRs",
+			kubeObjects: []runtime.Object{
+				scaledDownCVO,
+				newCSR("pending", ""),
+				newCSR("denied", certificatesv1.CertificateDenied),
+			},
+			expected: []PrecheckFinding{
+				{Severity: PrecheckSeverityWarning, Check: precheckCVO, Message: "cluster-version-operator is scaled down to 0 replicas; a previous MCO image replacement may not have been reverted"},
+				{Severity: PrecheckSeverityWarning, Check: precheckCSRs, Message: "1 CertificateSigningRequest(s) pending approval: [pending]"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			kubeclient, mcfgclient := newFakeClients(testCase.kubeObjects...)
+			configclient := fakeconfig.NewSimpleClientset(testCase.configObjects...)
+
+			p := &prechecker{
+				config: configclient.ConfigV1(),
+				mcfg:   mcfgclient.MachineconfigurationV1(),
+				core:   kubeclient.CoreV1(),
+				apps:   kubeclient.AppsV1(),
+				certs:  kubeclient.CertificatesV1(),
+			}
+
+			report, err := p.run(context.Background())
+			require.NoError(t, err)
+
+			assert.ElementsMatch(t, testCase.expected, report.Findings, report.String())
+			assert.Equal(t, testCase.errorsExpected, report.HasErrors())
+		})
+	}
+}
+
+func TestPrecheckerEnforceAndReport(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		configObjects []runtime.Object
+		errExpected   bool
+	}{
+		{
+			name: "Healthy cluster",
+			configObjects: []runtime.Object{
+				newClusterOperator("machine-config", configv1.ConditionFalse, configv1.ConditionTrue),
+			},
+		},
+		{
+			name: "Degraded ClusterOperator",
+			configObjects: []runtime.Object{
+				newClusterOperator("machine-config", configv1.ConditionTrue, configv1.ConditionFalse),
+			},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			kubeclient, mcfgclient := newFakeClients()
+			configclient := fakeconfig.NewSimpleClientset(testCase.configObjects...)
+
+			p := &prechecker{
+				config: configclient.ConfigV1(),
+				mcfg:   mcfgclient.MachineconfigurationV1(),
+				core:   kubeclient.CoreV1(),
+				apps:   kubeclient.AppsV1(),
+				certs:  kubeclient.CertificatesV1(),
+			}
+
+			err := p.enforce(context.Background())
+			if testCase.errExpected {
+				assert.ErrorContains(t, err, "--skip-prechecks")
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// Reporting never fails and downgrades every finding to a warning.
+			report := p.report(context.Background())
+			require.NotNil(t, report)
+			assert.False(t, report.HasErrors())
+			assert.Len(t, report.GetFindings(PrecheckSeverityWarning), len(report.Findings))
+
+			if testCase.errExpected {
+				assert.NotEmpty(t, report.Findings)
+			}
+		})
+	}
+}
+
+func TestPrecheckReportString(t *testing.T) {
+	t.Parallel()
+
+	report := &PrecheckReport{}
+	assert.Equal(t, "All prechecks passed", report.String())
+
+	report.add(PrecheckSeverityError, precheckNodes, "Node %s is not Ready", "worker-0")
+	report.add(PrecheckSeverityWarning, precheckPools, "MachineConfigPool %s is paused", "worker")
+
+	assert.Equal(t, "[Error] Nodes: Node worker-0 is not Ready\n[Warning] MachineConfigPools: MachineConfigPool worker is paused", report.String())
+	assert.Len(t, report.GetFindings(PrecheckSeverityWarning), 1)
+}
+
+func newClusterOperator(name string, degraded, available configv1.ConditionStatus) *configv1.ClusterOperator {
+	return &configv1.ClusterOperator{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Status: configv1.ClusterOperatorStatus{
+			Conditions: []configv1.ClusterOperatorStatusCondition{
+				{Type: configv1.OperatorDegraded, Status: degraded, Message: "Degraded message"},
+				{Type: configv1.OperatorAvailable, Status: available, Message: "Available message"},
+			},
+		},
+	}
+}
+
+func newReadyNode(name string, ready bool) *corev1.Node {
+	node := newNode(name, "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+
+	status := corev1.ConditionTrue
+	if !ready {
+		status = corev1.ConditionFalse
+	}
+
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}
+
+	return node
+}
+
+// Creates a node which is rebooting into a new config.
+func newUpdatingNode(name string) *corev1.Node {
+	node := newNode(name, "worker", "rendered-worker-1", "rendered-worker-2", daemonconsts.MachineConfigDaemonStateWorking)
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionUnknown}}
+	return node
+}
+
+// Creates a CSR with the given condition. If condType is empty, the CSR is
+// pending.
+func newCSR(name string, condType certificatesv1.RequestConditionType) *certificatesv1.CertificateSigningRequest {
+	csr := &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+
+	if condType != "" {
+		csr.Status.Conditions = []certificatesv1.CertificateSigningRequestCondition{
+			{Type: condType, Status: corev1.ConditionTrue},
+		}
+	}
+
+	return csr
+}
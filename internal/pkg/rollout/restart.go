@@ -0,0 +1,147 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// The same annotation that "kubectl rollout restart" sets on the pod
+	// template. Pods inherit it, which lets us tell which pods were created by
+	// our restart.
+	restartedAtAnnotationKey string = "kubectl.kubernetes.io/restartedAt"
+
+	defaultRestartTimeout time.Duration = 10 * time.Minute
+)
+
+// Options for restarting the MCO components.
+type RestartOpts struct {
+	// The names of the MCO deployments and / or daemonsets to restart, e.g.,
+	// machine-config-controller. Defaults to all of them.
+	Components []string
+}
+
+func (r *RestartOpts) getComponents() ([]string, error) {
+	if len(r.Components) == 0 {
+		return getAllMCOComponents(), nil
+	}
+
+	known := map[string]struct{}{}
+	for _, name := range getAllMCOComponents() {
+		known[name] = struct{}{}
+	}
+
+	seen := map[string]struct{}{}
+	out := []string{}
+
+	for _, name := range r.Components {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown MCO component %q, expected one of: %v", name, getAllMCOComponents())
+		}
+
+		if _, ok := seen[name]; ok {
+			continue
+		}
+
+		seen[name] = struct{}{}
+		out = append(out, name)
+	}
+
+	return out, nil
+}
+
+// Gets the names of the MCO deployments and daemonsets which may be restarted.
+func GetMCOComponentNames() []string {
+	return getAllMCOComponents()
+}
+
+// Restarts the selected MCO components by setting the restartedAt annotation
+// on their pod templates, the same way "kubectl rollout restart" does, and
+// waits for the restarted pods to become ready. Unlike ReplaceMCOImage, the
+// CVO, the MCO replica count, and the component images are left untouched.
+func RestartMCOComponents(ctx context.Context, cs *framework.ClientSet, opts RestartOpts) error {
+	components, err := opts.getComponents()
+	if err != nil {
+		return err
+	}
+
+	restartedAt := time.Now().Format(time.RFC3339)
+
+	for _, name := range components {
+		if err := restartComponent(ctx, cs, name, restartedAt); err != nil {
+			return err
+		}
+	}
+
+	return waitForComponentStatuses(ctx, cs, components, func(pod *corev1.Pod, componentName string) bool {
+		return isPodRestartedAt(pod, componentName, restartedAt)
+	}, "restarted")
+}
+
+// Sets the restartedAt annotation on the pod template for the named MCO
+// deployment or daemonset. The machine-os-builder is skipped if it is not
+// present since it only exists when on-cluster layering is in use.
+func restartComponent(ctx context.Context, cs *framework.ClientSet, name, restartedAt string) error {
+	if isMCODaemonset(name) {
+		return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("could not get daemonset/%s: %w", name, err)
+			}
+
+			ds.Spec.Template.Annotations = setRestartedAt(ds.Spec.Template.Annotations, restartedAt)
+
+			klog.Infof("Restarting daemonset/%s", name)
+
+			_, err = cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Update(ctx, ds, metav1.UpdateOptions{})
+			return err
+		})
+	}
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		deploy, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+		if name == "machine-os-builder" && apierrs.IsNotFound(err) {
+			klog.Infof("deployment/%s not present, skipping", name)
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("could not get deployment/%s: %w", name, err)
+		}
+
+		deploy.Spec.Template.Annotations = setRestartedAt(deploy.Spec.Template.Annotations, restartedAt)
+
+		klog.Infof("Restarting deployment/%s", name)
+
+		_, err = cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Update(ctx, deploy, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func setRestartedAt(annotations map[string]string, restartedAt string) map[string]string {
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[restartedAtAnnotationKey] = restartedAt
+	return annotations
+}
+
+// Determines whether the given pod was created by the restart with the given
+// timestamp and that the named container has started and is ready.
+func isPodRestartedAt(pod *corev1.Pod, componentName, restartedAt string) bool {
+	if pod.Annotations[restartedAtAnnotationKey] != restartedAt {
+		return false
+	}
+
+	return getReadyContainerStatus(pod, componentName) != nil
+}
@@ -0,0 +1,241 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	fakemcfg "github.com/openshift/client-go/machineconfiguration/clientset/versioned/fake"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRestartOptsGetComponents(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		components  []string
+		expected    []string
+		errExpected bool
+	}{
+		{
+			name:     "Defaults to all components",
+			expected: getAllMCOComponents(),
+		},
+		{
+			name:       "Single component",
+			components: []string{"machine-config-controller"},
+			expected:   []string{"machine-config-controller"},
+		},
+		{
+			name:       "Duplicates are removed",
+			components: []string{"machine-config-daemon", "machine-config-controller", "machine-config-daemon"},
+			expected:   []string{"machine-config-daemon", "machine-config-controller"},
+		},
+		{
+			name:        "Unknown component",
+			components:  []string{"machine-config-nonexistent"},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := RestartOpts{Components: testCase.components}
+
+			components, err := opts.getComponents()
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, components)
+		})
+	}
+}
+
+func TestRestartMCOComponents(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		components []string
+		restarted  []string
+	}{
+		{
+			name:      "All components",
+			restarted: []string{"machine-config-daemon", "machine-config-server", "machine-config-operator", "machine-config-controller"},
+		},
+		{
+			name:       "Only the controller",
+			components: []string{"machine-config-controller"},
+			restarted:  []string{"machine-config-controller"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+
+			cs := newFakeClientSetFromClients(newRestartTestClients())
+
+			cvoBefore, err := cs.AppsV1Interface.Deployments(cvoNamespace).Get(ctx, cvoName, metav1.GetOptions{})
+			require.NoError(t, err)
+
+			require.NoError(t, RestartMCOComponents(ctx, cs, RestartOpts{Components: testCase.components}))
+
+			for _, name := range getAllMCOComponents() {
+				if name == "machine-os-builder" {
+					continue
+				}
+
+				template := getPodTemplateForComponent(ctx, t, cs, name)
+
+				if assert.NotNil(t, template) {
+					if slices.Contains(testCase.restarted, name) {
+						assert.Contains(t, template.Annotations, restartedAtAnnotationKey, name)
+					} else {
+						assert.NotContains(t, template.Annotations, restartedAtAnnotationKey, name)
+					}
+
+					// Images must be left alone.
+					assert.Equal(t, targetPullspec, template.Spec.Containers[0].Image)
+				}
+			}
+
+			// The CVO must not be touched.
+			cvoAfter, err := cs.AppsV1Interface.Deployments(cvoNamespace).Get(ctx, cvoName, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, cvoBefore, cvoAfter)
+		})
+	}
+}
+
+func TestRestartMCOComponentsTimesOut(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	objs := []runtime.Object{}
+	for _, name := range mcoDaemonsets {
+		objs = append(objs, newDaemonset(name, targetPullspec), newComponentPod(name, name, targetPullspec, true, true))
+	}
+
+	// The pods are never replaced, so the restart never converges.
+	cs := newFakeClientSet(objs...)
+
+	assert.Error(t, RestartMCOComponents(ctx, cs, RestartOpts{Components: mcoDaemonsets}))
+}
+
+func TestIsPodRestartedAt(t *testing.T) {
+	t.Parallel()
+
+	restartedAt := "2025-01-01T00:00:00Z"
+
+	pod := newComponentPod("pod", "machine-config-controller", targetPullspec, true, true)
+	assert.False(t, isPodRestartedAt(pod, "machine-config-controller", restartedAt))
+
+	pod.Annotations = map[string]string{restartedAtAnnotationKey: "2024-01-01T00:00:00Z"}
+	assert.False(t, isPodRestartedAt(pod, "machine-config-controller", restartedAt))
+
+	pod.Annotations[restartedAtAnnotationKey] = restartedAt
+	assert.True(t, isPodRestartedAt(pod, "machine-config-controller", restartedAt))
+
+	pod.Status.ContainerStatuses[0].Ready = false
+	assert.False(t, isPodRestartedAt(pod, "machine-config-controller", restartedAt))
+}
+
+// Creates the MCO components (except for the machine-os-builder) along with
+// the CVO. Whenever one of the components is updated, its pods are replaced
+// with a ready pod created from the updated template, similar to what the
+// deployment and daemonset controllers would do.
+func newRestartTestClients() (*fakekube.Clientset, *fakemcfg.Clientset) {
+	replicas := int32(1)
+
+	objs := []runtime.Object{newDeployment(cvoName, cvoNamespace, "quay.io/openshift/cvo:latest")}
+
+	for _, name := range mcoDeployments {
+		if name == "machine-os-builder" {
+			continue
+		}
+
+		dp := newDeployment(name, ctrlcommon.MCONamespace, targetPullspec)
+		dp.Spec.Replicas = &replicas
+		dp.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+		objs = append(objs, dp, newComponentPod(name, name, targetPullspec, true, true))
+	}
+
+	for _, name := range mcoDaemonsets {
+		ds := newDaemonset(name, targetPullspec)
+		ds.Status = appsv1.DaemonSetStatus{DesiredNumberScheduled: 1, UpdatedNumberScheduled: 1, NumberAvailable: 1}
+		objs = append(objs, ds, newComponentPod(name, name, targetPullspec, true, true))
+	}
+
+	kubeclient, mcfgclient := newFakeClients(objs...)
+
+	replacePods := func(name string, template corev1.PodTemplateSpec) error {
+		tracker := kubeclient.Tracker()
+		podGVR := corev1.SchemeGroupVersion.WithResource("pods")
+
+		// The original pod is named after its component.
+		if err := tracker.Delete(podGVR, ctrlcommon.MCONamespace, name); err != nil && !apierrs.IsNotFound(err) {
+			return err
+		}
+
+		pod := newComponentPod(fmt.Sprintf("%s-restarted", name), name, targetPullspec, true, true)
+		pod.Annotations = template.Annotations
+
+		if err := tracker.Delete(podGVR, ctrlcommon.MCONamespace, pod.Name); err != nil && !apierrs.IsNotFound(err) {
+			return err
+		}
+
+		return tracker.Add(pod)
+	}
+
+	kubeclient.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		dp := action.(k8stesting.UpdateAction).GetObject().(*appsv1.Deployment)
+		return false, nil, replacePods(dp.Name, dp.Spec.Template)
+	})
+
+	kubeclient.PrependReactor("update", "daemonsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		ds := action.(k8stesting.UpdateAction).GetObject().(*appsv1.DaemonSet)
+		return false, nil, replacePods(ds.Name, ds.Spec.Template)
+	})
+
+	return kubeclient, mcfgclient
+}
+
+func getPodTemplateForComponent(ctx context.Context, t *testing.T, cs *framework.ClientSet, name string) *corev1.PodTemplateSpec {
+	t.Helper()
+
+	if isMCODaemonset(name) {
+		ds, err := cs.AppsV1Interface.DaemonSets(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return &ds.Spec.Template
+	}
+
+	dp, err := cs.AppsV1Interface.Deployments(ctrlcommon.MCONamespace).Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	return &dp.Spec.Template
+}
@@ -3,7 +3,10 @@ package rollout
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -43,7 +46,39 @@ const (
 	mcoImagesJSON      string = "images.json"
 )
 
+// Options for reverting the MCO image.
+type RevertOpts struct {
+	// Whether to delete the pods for each MCO component after updating it.
+	ForceRestart bool
+	// If set, the snapshot written by a previous replacement is restored from
+	// this path instead of the MCO image from the cluster release. The
+	// snapshot is removed once it has been restored.
+	SnapshotPath string
+	// Whether to skip the cluster health prechecks. Unlike a replacement, a
+	// revert is never stopped by failed prechecks since it is most needed when
+	// the cluster is unhealthy; the failures are only reported.
+	SkipPrechecks bool
+}
+
 func RevertToOriginalMCOImage(cs *framework.ClientSet, forceRestart bool) error {
+	return RevertMCOImageWithOpts(cs, RevertOpts{
+		ForceRestart: forceRestart,
+	})
+}
+
+// Reverts the MCO image either to the one in the cluster release or to a
+// previously taken snapshot.
+func RevertMCOImageWithOpts(cs *framework.ClientSet, opts RevertOpts) error {
+	reportPrechecks(context.TODO(), cs, opts.SkipPrechecks)
+
+	if opts.SnapshotPath != "" {
+		return revertToSnapshot(cs, opts.SnapshotPath)
+	}
+
+	return revertToOriginalMCOImage(cs, opts.ForceRestart)
+}
+
+func revertToOriginalMCOImage(cs *framework.ClientSet, forceRestart bool) error {
 	clusterVersion, err := cs.ConfigV1Interface.ClusterVersions().Get(context.TODO(), "version", metav1.GetOptions{})
 	if err != nil {
 		return fmt.Errorf("could not get cluster version: %w", err)
@@ -57,7 +92,15 @@ func RevertToOriginalMCOImage(cs *framework.ClientSet, forceRestart bool) error
 
 	klog.Infof("Found original MCO image %s for the currently running cluster release (%s)", originalMCOImage, currentRelease)
 
-	if err := ReplaceMCOImage(cs, originalMCOImage, forceRestart); err != nil {
+	// The prechecks have already been reported, so they should not stop the
+	// replacement.
+	err = ReplaceMCOImageWithOpts(cs, ReplaceOpts{
+		Pullspec:      originalMCOImage,
+		ForceRestart:  forceRestart,
+		SkipPrechecks: true,
+	})
+
+	if err != nil {
 		return fmt.Errorf("could not roll MCO back to image %s: %w", originalMCOImage, err)
 	}
 
@@ -68,7 +111,131 @@ func RevertToOriginalMCOImage(cs *framework.ClientSet, forceRestart bool) error
 	return nil
 }
 
+// Restores the snapshot at the given path and removes it so that the next
+// replacement can write a new one.
+func revertToSnapshot(cs *framework.ClientSet, snapshotPath string) error {
+	klog.Infof("Restoring MCO snapshot from %s", snapshotPath)
+
+	if err := RestoreMCOImageSnapshotFromFile(cs, snapshotPath); err != nil {
+		return err
+	}
+
+	if err := os.Remove(snapshotPath); err != nil {
+		return fmt.Errorf("could not remove restored snapshot %s: %w", snapshotPath, err)
+	}
+
+	klog.Infof("Removed restored snapshot %s", snapshotPath)
+
+	return nil
+}
+
+// Options for replacing the MCO image.
+type ReplaceOpts struct {
+	// The MCO image pullspec to roll out. Must be digested if RolloutTimeout is
+	// set.
+	Pullspec string
+	// Whether to delete the pods for each MCO component after updating it.
+	ForceRestart bool
+	// If set, the pre-replacement snapshot is written to this path so that a
+	// later revert can restore it.
+	SnapshotPath string
+	// If nonzero, waits up to this long for the new image to roll out to all of
+	// the MCO components. Everything is rolled back if it does not.
+	RolloutTimeout time.Duration
+	// Whether to skip the cluster health prechecks which otherwise stop the
+	// replacement if the cluster is already unhealthy.
+	SkipPrechecks bool
+}
+
+func (r *ReplaceOpts) validate() error {
+	if r.Pullspec == "" {
+		return fmt.Errorf("pullspec must be provided")
+	}
+
+	if r.RolloutTimeout == 0 {
+		return nil
+	}
+
+	if _, err := getDigestFromPullspec(r.Pullspec); err != nil {
+		return fmt.Errorf("pullspec must be digested to wait for the rollout to complete: %w", err)
+	}
+
+	return nil
+}
+
 func ReplaceMCOImage(cs *framework.ClientSet, pullspec string, forceRestart bool) error {
+	return ReplaceMCOImageWithOpts(cs, ReplaceOpts{
+		Pullspec:     pullspec,
+		ForceRestart: forceRestart,
+	})
+}
+
+// Replaces the MCO image transactionally. Unless skipped, the cluster health
+// prechecks are run first. The current state of the MCO components is then
+// snapshotted and if any step fails (or the rollout does not complete within
+// the given timeout), everything is rolled back to the snapshotted state.
+func ReplaceMCOImageWithOpts(cs *framework.ClientSet, opts ReplaceOpts) error {
+	if err := opts.validate(); err != nil {
+		return fmt.Errorf("invalid replace options: %w", err)
+	}
+
+	if err := EnforcePrechecks(context.TODO(), cs, opts.SkipPrechecks); err != nil {
+		return err
+	}
+
+	snapshot, err := TakeMCOImageSnapshot(cs)
+	if err != nil {
+		return fmt.Errorf("could not snapshot MCO state prior to image replacement: %w", err)
+	}
+
+	if opts.SnapshotPath != "" {
+		if err := snapshot.WriteToFile(opts.SnapshotPath); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceMCOImage(cs, opts.Pullspec, opts.ForceRestart); err != nil {
+		return rollbackMCOImage(cs, snapshot, opts.SnapshotPath, err)
+	}
+
+	if opts.RolloutTimeout == 0 {
+		return nil
+	}
+
+	if err := WaitForRolloutToComplete(cs, opts.Pullspec, opts.RolloutTimeout); err != nil {
+		return rollbackMCOImage(cs, snapshot, opts.SnapshotPath, fmt.Errorf("MCO image %s did not roll out: %w", opts.Pullspec, err))
+	}
+
+	return nil
+}
+
+// Restores the given snapshot after a failed image replacement. If the
+// snapshot was written to disk, it is removed once it has been restored since
+// there is nothing left to revert. Returns the original error along with any
+// error encountered while rolling back.
+func rollbackMCOImage(cs *framework.ClientSet, snapshot *MCOImageSnapshot, snapshotPath string, cause error) error {
+	klog.Errorf("MCO image replacement failed, rolling back: %s", cause)
+
+	if err := RestoreMCOImageSnapshot(cs, snapshot); err != nil {
+		return fmt.Errorf("%w; rollback also failed: %w", cause, err)
+	}
+
+	klog.Infof("Rolled back MCO image replacement")
+
+	if snapshotPath == "" {
+		return cause
+	}
+
+	if err := os.Remove(snapshotPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w; could not remove snapshot %s after rolling back: %w", cause, snapshotPath, err)
+	}
+
+	klog.Infof("Removed snapshot %s after rolling back", snapshotPath)
+
+	return cause
+}
+
+func replaceMCOImage(cs *framework.ClientSet, pullspec string, forceRestart bool) error {
 	if err := setDeploymentReplicas(cs, cvoName, cvoNamespace, 0); err != nil {
 		return fmt.Errorf("could not scale cluster version operator down to zero: %w", err)
 	}
@@ -93,12 +260,10 @@ func RestartMCO(cs *framework.ClientSet, forceRestart bool) error {
 		return forceRestartMCO(cs)
 	}
 
-	_, images, err := loadMCOImagesConfigMap(cs)
-	if err != nil {
-		return fmt.Errorf("could not load or parse ConfigMap %s: %w", mcoImagesConfigMap, err)
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRestartTimeout)
+	defer cancel()
 
-	return ReplaceMCOImage(cs, images[mcoImageKey], forceRestart)
+	return RestartMCOComponents(ctx, cs, RestartOpts{})
 }
 
 func forceRestartMCO(cs *framework.ClientSet) error {
@@ -0,0 +1,496 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// The name used for the service account, RoleBinding, and pull secret
+	// created for a scoped exposure.
+	registryPullerName string = "zacks-openshift-helpers-registry-puller"
+
+	internalRegistryHostname string = "image-registry.openshift-image-registry.svc:5000"
+
+	// When the objects created to expose the cluster image registry may be
+	// removed, as a Unix timestamp. Labels are used instead of annotations so
+	// that stale objects can be found with a label selector.
+	registryExposureExpiryLabelKey string = "machineconfiguration.openshift.io/registry-exposure-expires"
+
+	// How long an exposure lasts if the caller did not specify.
+	defaultRegistryExposureLifetime time.Duration = time.Hour
+)
+
+// Gets the labels to apply to each object we create.
+func (r *registryExposer) getLabels() map[string]string {
+	return map[string]string{
+		registryExposureLabelKey:       "",
+		registryExposureExpiryLabelKey: strconv.FormatInt(r.expires.Unix(), 10),
+	}
+}
+
+// Sets the expiry label on the given object, unless it already expires later.
+// Returns true if the label was changed.
+func (r *registryExposer) extendExpiry(obj *metav1.ObjectMeta) bool {
+	if existing, err := getRegistryExposureExpiry(*obj); err == nil && !existing.Before(r.expires) {
+		return false
+	}
+
+	metav1.SetMetaDataLabel(obj, registryExposureExpiryLabelKey, strconv.FormatInt(r.expires.Unix(), 10))
+	return true
+}
+
+// Gets the expiry time from the given object's labels.
+func getRegistryExposureExpiry(obj metav1.ObjectMeta) (time.Time, error) {
+	val, ok := obj.Labels[registryExposureExpiryLabelKey]
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing label %q", registryExposureExpiryLabelKey)
+	}
+
+	unix, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse label %q value %q: %w", registryExposureExpiryLabelKey, val, err)
+	}
+
+	return time.Unix(unix, 0), nil
+}
+
+// Options for exposing the cluster image registry to a short-lived service
+// account token instead of to anonymous users.
+type ScopedExposureOpts struct {
+	// The namespace whose images may be pulled. Defaults to the MCO namespace.
+	Namespace string
+	// How long the token and exposure should last. Defaults to 1 hour.
+	Lifetime time.Duration
+}
+
+func (s *ScopedExposureOpts) getNamespace() string {
+	if s.Namespace == "" {
+		return ctrlcommon.MCONamespace
+	}
+
+	return s.Namespace
+}
+
+func (s *ScopedExposureOpts) getLifetime() time.Duration {
+	if s.Lifetime == 0 {
+		return defaultRegistryExposureLifetime
+	}
+
+	return s.Lifetime
+}
+
+// Describes a scoped exposure of the cluster image registry.
+type ScopedExposure struct {
+	// The external hostname of the cluster image registry.
+	Hostname string
+	// The namespace whose images may be pulled.
+	Namespace string
+	// The name of the pull secret in Namespace.
+	SecretName string
+	// When the token expires and the exposure may be cleaned up.
+	Expires time.Time
+	// The pull secret in .dockerconfigjson format. It includes an entry for
+	// Hostname.
+	PullSecret []byte
+}
+
+// Creates a pull secret for the given service account.
+type pullSecretCreator func(context.Context, utils.LongLivedSecretOpts) error
+
+// Exposes the cluster image registry via a Route and creates a pull secret
+// backed by a short-lived service account token which may only pull images
+// from a single namespace. Unlike ExposeClusterImageRegistry, anonymous users
+// are not granted access. Every object is labeled with an expiry so that
+// CleanupStaleRegistryExposures can remove them if they are never unexposed.
+func ExposeClusterImageRegistryWithToken(ctx context.Context, cs *framework.ClientSet, opts ScopedExposureOpts) (*ScopedExposure, error) {
+	r, err := newRegistryExposer(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.exposeScoped(ctx, opts, func(ctx context.Context, secretOpts utils.LongLivedSecretOpts) error {
+		return utils.CreateLongLivedPullSecret(ctx, cs, secretOpts)
+	})
+}
+
+// Removes the objects created by ExposeClusterImageRegistryWithToken for the
+// given namespace. The Route is only removed if no other unexpired exposures
+// are using it.
+func UnexposeScopedClusterImageRegistry(ctx context.Context, cs *framework.ClientSet, namespace string) error {
+	r, err := newRegistryExposer(cs)
+	if err != nil {
+		return err
+	}
+
+	return r.unexposeScoped(ctx, namespace, time.Now())
+}
+
+func (r *registryExposer) exposeScoped(ctx context.Context, opts ScopedExposureOpts, createPullSecret pullSecretCreator) (*ScopedExposure, error) {
+	namespace := opts.getNamespace()
+	lifetime := opts.getLifetime()
+
+	r.expires = time.Now().Add(lifetime)
+
+	route, err := r.ensureRoute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := getRouteHostname(route)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.ensureServiceAccount(ctx, namespace); err != nil {
+		return nil, err
+	}
+
+	err = r.ensureRegistryViewerRoleBinding(ctx, namespace, registryPullerName, rbacv1.Subject{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      registryPullerName,
+		Namespace: namespace,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to replace a secret which we did not create.
+	if _, err := r.getSecretIfOurs(ctx, namespace, registryPullerName); err != nil && !apierrs.IsNotFound(err) {
+		return nil, err
+	}
+
+	err = createPullSecret(ctx, utils.LongLivedSecretOpts{
+		DeleteIfExists: true,
+		ServiceAccount: metav1.ObjectMeta{
+			Name:      registryPullerName,
+			Namespace: namespace,
+		},
+		Lifetime: lifetime.String(),
+		Secret: metav1.ObjectMeta{
+			Name:      registryPullerName,
+			Namespace: namespace,
+			Labels:    r.getLabels(),
+		},
+		// The secret must expire along with the rest of the exposure.
+		DisableRotation: true,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not create pull secret for service account %s/%s: %w", namespace, registryPullerName, err)
+	}
+
+	pullSecret, err := r.addHostnameToPullSecret(ctx, namespace, registryPullerName, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Cluster image registry exposed using external hostname %s for namespace %s until %s", hostname, namespace, r.expires.Format(time.RFC3339))
+
+	return &ScopedExposure{
+		Hostname:   hostname,
+		Namespace:  namespace,
+		SecretName: registryPullerName,
+		Expires:    r.expires,
+		PullSecret: pullSecret,
+	}, nil
+}
+
+func (r *registryExposer) unexposeScoped(ctx context.Context, namespace string, now time.Time) error {
+	if err := r.deleteSecretIfOurs(ctx, namespace, registryPullerName); err != nil {
+		return err
+	}
+
+	if err := r.deleteRoleBindingIfOurs(ctx, namespace, registryPullerName); err != nil {
+		return err
+	}
+
+	if err := r.deleteServiceAccountIfOurs(ctx, namespace, registryPullerName); err != nil {
+		return err
+	}
+
+	return r.deleteRouteIfUnused(ctx, now)
+}
+
+// Determines whether any unexpired RoleBindings which we created remain,
+// meaning that another exposure still needs the Route.
+func (r *registryExposer) isRouteInUse(ctx context.Context, now time.Time) (bool, error) {
+	rbs, err := r.rbac.RoleBindings(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: registryExposureLabelKey,
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("could not list RoleBindings: %w", err)
+	}
+
+	for _, rb := range rbs.Items {
+		if !isRegistryExposureStale(rb.ObjectMeta, now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *registryExposer) ensureServiceAccount(ctx context.Context, namespace string) error {
+	serviceAccounts := r.core.ServiceAccounts(namespace)
+
+	existing, err := serviceAccounts.Get(ctx, registryPullerName, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		sa := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      registryPullerName,
+				Namespace: namespace,
+				Labels:    r.getLabels(),
+			},
+		}
+
+		if _, err := serviceAccounts.Create(ctx, sa, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not create service account %s/%s: %w", namespace, registryPullerName, err)
+		}
+
+		klog.Infof("Service account %s/%s created", namespace, registryPullerName)
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get service account %s/%s: %w", namespace, registryPullerName, err)
+	}
+
+	if !metav1.HasLabel(existing.ObjectMeta, registryExposureLabelKey) {
+		return fmt.Errorf("unmanaged preexisting service account %s/%s already exists, missing label %q", namespace, registryPullerName, registryExposureLabelKey)
+	}
+
+	if !r.extendExpiry(&existing.ObjectMeta) {
+		return nil
+	}
+
+	if _, err := serviceAccounts.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update service account %s/%s: %w", namespace, registryPullerName, err)
+	}
+
+	return nil
+}
+
+// Adds an entry for the external registry hostname to the given pull secret
+// using the credentials for the internal registry hostname. Returns the
+// updated .dockerconfigjson bytes.
+func (r *registryExposer) addHostnameToPullSecret(ctx context.Context, namespace, name, hostname string) ([]byte, error) {
+	secret, err := r.core.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get pull secret %s/%s: %w", namespace, name, err)
+	}
+
+	updated, err := addHostnameToDockerConfigJSON(secret.Data[corev1.DockerConfigJsonKey], hostname)
+	if err != nil {
+		return nil, fmt.Errorf("could not update pull secret %s/%s: %w", namespace, name, err)
+	}
+
+	secret.Data[corev1.DockerConfigJsonKey] = updated
+
+	if _, err := r.core.Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("could not update pull secret %s/%s: %w", namespace, name, err)
+	}
+
+	return updated, nil
+}
+
+// Copies the auth for the internal registry hostname to the given hostname.
+// If there is no entry for the internal registry hostname, the first entry is
+// used instead, since every entry uses the same token.
+func addHostnameToDockerConfigJSON(in []byte, hostname string) ([]byte, error) {
+	type dockerConfigJSON struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+
+	decoded := &dockerConfigJSON{}
+	if err := json.Unmarshal(in, decoded); err != nil {
+		return nil, fmt.Errorf("could not decode pull secret: %w", err)
+	}
+
+	if len(decoded.Auths) == 0 {
+		return nil, fmt.Errorf("pull secret has no auths")
+	}
+
+	auth, ok := decoded.Auths[internalRegistryHostname]
+	if !ok {
+		for _, val := range decoded.Auths {
+			auth = val
+			break
+		}
+	}
+
+	decoded.Auths[hostname] = auth
+
+	return json.Marshal(decoded)
+}
+
+// Gets the named secret, returning an error if we did not create it.
+func (r *registryExposer) getSecretIfOurs(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	secret, err := r.core.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if !metav1.HasLabel(secret.ObjectMeta, registryExposureLabelKey) {
+		return nil, fmt.Errorf("unmanaged preexisting secret %s/%s already exists, missing label %q", namespace, name, registryExposureLabelKey)
+	}
+
+	return secret, nil
+}
+
+func (r *registryExposer) deleteSecretIfOurs(ctx context.Context, namespace, name string) error {
+	_, err := r.getSecretIfOurs(ctx, namespace, name)
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		klog.Infof("Will not delete secret: %s", err)
+		return nil
+	}
+
+	if err := r.core.Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not delete secret %s/%s: %w", namespace, name, err)
+	}
+
+	klog.Infof("Secret %s/%s deleted", namespace, name)
+	return nil
+}
+
+func (r *registryExposer) deleteServiceAccountIfOurs(ctx context.Context, namespace, name string) error {
+	sa, err := r.core.ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get service account %s/%s: %w", namespace, name, err)
+	}
+
+	if !metav1.HasLabel(sa.ObjectMeta, registryExposureLabelKey) {
+		klog.Infof("Service account %s/%s missing label %q, will not delete", namespace, name, registryExposureLabelKey)
+		return nil
+	}
+
+	if err := r.core.ServiceAccounts(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not delete service account %s/%s: %w", namespace, name, err)
+	}
+
+	klog.Infof("Service account %s/%s deleted", namespace, name)
+	return nil
+}
+
+// Options for cleaning up registry exposures.
+type CleanupRegistryExposureOpts struct {
+	// Remove every object we created, even if it has not expired yet.
+	All bool
+}
+
+// Removes the objects created by ExposeClusterImageRegistry and
+// ExposeClusterImageRegistryWithToken which have expired, such as when the
+// process which created them crashed before unexposing. Objects without an
+// expiry are considered stale. Returns a description of each removed object.
+func CleanupStaleRegistryExposures(ctx context.Context, cs *framework.ClientSet, opts CleanupRegistryExposureOpts) ([]string, error) {
+	r, err := newRegistryExposer(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.cleanupStale(ctx, time.Now(), opts)
+}
+
+func (r *registryExposer) cleanupStale(ctx context.Context, now time.Time, opts CleanupRegistryExposureOpts) ([]string, error) {
+	listOpts := metav1.ListOptions{
+		LabelSelector: registryExposureLabelKey,
+	}
+
+	isStale := func(obj metav1.ObjectMeta) bool {
+		return opts.All || isRegistryExposureStale(obj, now)
+	}
+
+	removed := []string{}
+	errs := []error{}
+
+	record := func(kind string, obj metav1.ObjectMeta, err error) {
+		if err != nil && !apierrs.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("could not delete %s %s/%s: %w", kind, obj.Namespace, obj.Name, err))
+			return
+		}
+
+		klog.Infof("Removed stale %s %s/%s", kind, obj.Namespace, obj.Name)
+		removed = append(removed, fmt.Sprintf("%s %s/%s", kind, obj.Namespace, obj.Name))
+	}
+
+	secrets, err := r.core.Secrets(metav1.NamespaceAll).List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not list secrets: %w", err)
+	}
+
+	for _, secret := range secrets.Items {
+		if isStale(secret.ObjectMeta) {
+			record("Secret", secret.ObjectMeta, r.core.Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}))
+		}
+	}
+
+	rbs, err := r.rbac.RoleBindings(metav1.NamespaceAll).List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not list RoleBindings: %w", err)
+	}
+
+	for _, rb := range rbs.Items {
+		if isStale(rb.ObjectMeta) {
+			record("RoleBinding", rb.ObjectMeta, r.rbac.RoleBindings(rb.Namespace).Delete(ctx, rb.Name, metav1.DeleteOptions{}))
+		}
+	}
+
+	sas, err := r.core.ServiceAccounts(metav1.NamespaceAll).List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not list service accounts: %w", err)
+	}
+
+	for _, sa := range sas.Items {
+		if isStale(sa.ObjectMeta) {
+			record("ServiceAccount", sa.ObjectMeta, r.core.ServiceAccounts(sa.Namespace).Delete(ctx, sa.Name, metav1.DeleteOptions{}))
+		}
+	}
+
+	routes, err := r.routes.Routes(imageRegistryNamespace).List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not list routes: %w", err)
+	}
+
+	for _, route := range routes.Items {
+		if isStale(route.ObjectMeta) {
+			record("Route", route.ObjectMeta, r.routes.Routes(route.Namespace).Delete(ctx, route.Name, metav1.DeleteOptions{}))
+		}
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// Determines whether the given object has expired. Objects without a valid
+// expiry are considered stale since there is no way to know whether they are
+// still in use.
+func isRegistryExposureStale(obj metav1.ObjectMeta, now time.Time) bool {
+	expires, err := getRegistryExposureExpiry(obj)
+	if err != nil {
+		return true
+	}
+
+	return !now.Before(expires)
+}
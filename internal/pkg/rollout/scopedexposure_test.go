@@ -0,0 +1,287 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	routev1 "github.com/openshift/api/route/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+const testPullSecret string = `{"auths":{"image-registry.openshift-image-registry.svc:5000":{"auth":"dG9rZW4="}}}`
+
+func TestExposeClusterImageRegistryWithToken(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	kubeclient := fakekube.NewSimpleClientset(newImageRegistryService())
+	routeclient := newFakeRouteClient()
+
+	r := newRegistryExposerForClients(kubeclient, routeclient)
+
+	var secretOpts utils.LongLivedSecretOpts
+
+	exposure, err := r.exposeScoped(ctx, ScopedExposureOpts{Namespace: "my-namespace", Lifetime: time.Minute * 10}, newFakePullSecretCreator(kubeclient, &secretOpts))
+	require.NoError(t, err)
+
+	assert.Equal(t, testRegistryHostname, exposure.Hostname)
+	assert.Equal(t, "my-namespace", exposure.Namespace)
+	assert.Equal(t, registryPullerName, exposure.SecretName)
+	assert.WithinDuration(t, time.Now().Add(time.Minute*10), exposure.Expires, time.Minute)
+
+	assert.Equal(t, "10m0s", secretOpts.Lifetime)
+	assert.Equal(t, registryPullerName, secretOpts.ServiceAccount.Name)
+	assert.Equal(t, "my-namespace", secretOpts.ServiceAccount.Namespace)
+	// Scoped exposures must expire rather than be rotated indefinitely.
+	assert.True(t, secretOpts.DisableRotation)
+
+	auths := map[string]map[string]map[string]string{}
+	require.NoError(t, json.Unmarshal(exposure.PullSecret, &auths))
+	assert.Equal(t, "dG9rZW4=", auths["auths"][testRegistryHostname]["auth"])
+	assert.Equal(t, "dG9rZW4=", auths["auths"][internalRegistryHostname]["auth"])
+
+	expiry := strconv.FormatInt(exposure.Expires.Unix(), 10)
+
+	sa, err := kubeclient.CoreV1().ServiceAccounts("my-namespace").Get(ctx, registryPullerName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expiry, sa.Labels[registryExposureExpiryLabelKey])
+
+	rb, err := kubeclient.RbacV1().RoleBindings("my-namespace").Get(ctx, registryPullerName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expiry, rb.Labels[registryExposureExpiryLabelKey])
+	assert.Equal(t, []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: registryPullerName, Namespace: "my-namespace"}}, rb.Subjects)
+
+	secret, err := kubeclient.CoreV1().Secrets("my-namespace").Get(ctx, registryPullerName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expiry, secret.Labels[registryExposureExpiryLabelKey])
+	assert.Equal(t, exposure.PullSecret, secret.Data[corev1.DockerConfigJsonKey])
+
+	// Anonymous users should not have been granted access.
+	_, err = kubeclient.RbacV1().RoleBindings(metav1.NamespaceAll).Get(ctx, registryViewerRoleBindingName, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	require.NoError(t, r.unexposeScoped(ctx, "my-namespace", time.Now()))
+
+	_, err = kubeclient.CoreV1().ServiceAccounts("my-namespace").Get(ctx, registryPullerName, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	_, err = kubeclient.RbacV1().RoleBindings("my-namespace").Get(ctx, registryPullerName, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	_, err = kubeclient.CoreV1().Secrets("my-namespace").Get(ctx, registryPullerName, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+}
+
+func TestUnexposeScopedKeepsRouteInUse(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	kubeclient := fakekube.NewSimpleClientset(newImageRegistryService())
+	routeclient := newFakeRouteClient()
+
+	r := newRegistryExposerForClients(kubeclient, routeclient)
+
+	for _, namespace := range []string{"namespace-a", "namespace-b"} {
+		_, err := r.exposeScoped(ctx, ScopedExposureOpts{Namespace: namespace}, newFakePullSecretCreator(kubeclient, nil))
+		require.NoError(t, err)
+	}
+
+	// The route is still needed by namespace-b.
+	require.NoError(t, r.unexposeScoped(ctx, "namespace-a", time.Now()))
+
+	_, err := routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	require.NoError(t, r.unexposeScoped(ctx, "namespace-b", time.Now()))
+
+	_, err = routeclient.RouteV1().Routes(imageRegistryNamespace).Get(ctx, imageRegistryObject, metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+}
+
+func TestExposeClusterImageRegistryWithTokenUnmanagedSecret(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	unmanaged := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      registryPullerName,
+			Namespace: "my-namespace",
+		},
+	}
+
+	kubeclient := fakekube.NewSimpleClientset(newImageRegistryService(), unmanaged)
+	r := newRegistryExposerForClients(kubeclient, newFakeRouteClient())
+
+	_, err := r.exposeScoped(ctx, ScopedExposureOpts{Namespace: "my-namespace"}, newFakePullSecretCreator(kubeclient, nil))
+	assert.ErrorContains(t, err, "unmanaged preexisting secret")
+}
+
+func TestCleanupStaleRegistryExposures(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	expired := now.Add(-time.Minute)
+	unexpired := now.Add(time.Hour)
+
+	newLabels := func(expires *time.Time) map[string]string {
+		labels := map[string]string{registryExposureLabelKey: ""}
+		if expires != nil {
+			labels[registryExposureExpiryLabelKey] = strconv.FormatInt(expires.Unix(), 10)
+		}
+
+		return labels
+	}
+
+	kubeObjects := []runtime.Object{
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "expired", Namespace: "ns", Labels: newLabels(&expired)}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unexpired", Namespace: "ns", Labels: newLabels(&unexpired)}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unmanaged", Namespace: "ns"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "no-expiry", Namespace: "ns", Labels: newLabels(nil)}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "unexpired", Namespace: "ns", Labels: newLabels(&unexpired)}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "expired", Namespace: "other-ns", Labels: newLabels(&expired)}},
+	}
+
+	routeObjects := []runtime.Object{
+		&routev1.Route{ObjectMeta: metav1.ObjectMeta{Name: imageRegistryObject, Namespace: imageRegistryNamespace, Labels: newLabels(&unexpired)}},
+	}
+
+	testCases := []struct {
+		name     string
+		opts     CleanupRegistryExposureOpts
+		expected []string
+	}{
+		{
+			name: "Only stale objects",
+			expected: []string{
+				"Secret ns/expired",
+				"RoleBinding ns/no-expiry",
+				"ServiceAccount other-ns/expired",
+			},
+		},
+		{
+			name: "All objects",
+			opts: CleanupRegistryExposureOpts{All: true},
+			expected: []string{
+				"Secret ns/expired",
+				"Secret ns/unexpired",
+				"RoleBinding ns/no-expiry",
+				"RoleBinding ns/unexpired",
+				"ServiceAccount other-ns/expired",
+				"Route openshift-image-registry/image-registry",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+
+			kubeclient := fakekube.NewSimpleClientset(kubeObjects...)
+			r := newRegistryExposerForClients(kubeclient, newFakeRouteClient(routeObjects...))
+
+			removed, err := r.cleanupStale(ctx, now, testCase.opts)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, testCase.expected, removed)
+
+			// Objects we did not create are never removed.
+			_, err = kubeclient.CoreV1().Secrets("ns").Get(ctx, "unmanaged", metav1.GetOptions{})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAddHostnameToDockerConfigJSON(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		input       string
+		expected    string
+		errExpected bool
+	}{
+		{
+			name:     "Uses internal registry auth",
+			input:    `{"auths":{"other.host.com":{"auth":"b3RoZXI="},"image-registry.openshift-image-registry.svc:5000":{"auth":"dG9rZW4="}}}`,
+			expected: `{"auths":{"external.host.com":{"auth":"dG9rZW4="},"image-registry.openshift-image-registry.svc:5000":{"auth":"dG9rZW4="},"other.host.com":{"auth":"b3RoZXI="}}}`,
+		},
+		{
+			name:     "Falls back to another entry",
+			input:    `{"auths":{"other.host.com":{"auth":"b3RoZXI="}}}`,
+			expected: `{"auths":{"external.host.com":{"auth":"b3RoZXI="},"other.host.com":{"auth":"b3RoZXI="}}}`,
+		},
+		{
+			name:        "No auths",
+			input:       `{"auths":{}}`,
+			errExpected: true,
+		},
+		{
+			name:        "Invalid JSON",
+			input:       `not-json`,
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			out, err := addHostnameToDockerConfigJSON([]byte(testCase.input), "external.host.com")
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.JSONEq(t, testCase.expected, string(out))
+		})
+	}
+}
+
+// Stands in for utils.CreateLongLivedPullSecret, which needs a REST config to
+// create its clients. Records the options it was called with if recorded is not nil.
+func newFakePullSecretCreator(kubeclient *fakekube.Clientset, recorded *utils.LongLivedSecretOpts) pullSecretCreator {
+	return func(ctx context.Context, opts utils.LongLivedSecretOpts) error {
+		if recorded != nil {
+			*recorded = opts
+		}
+
+		secret := &corev1.Secret{
+			ObjectMeta: opts.Secret,
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(testPullSecret),
+			},
+		}
+
+		secrets := kubeclient.CoreV1().Secrets(opts.Secret.Namespace)
+
+		if err := secrets.Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			return err
+		}
+
+		_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+}
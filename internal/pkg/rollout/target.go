@@ -0,0 +1,198 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	errhelpers "github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/errors"
+	godigest "github.com/opencontainers/go-digest"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Describes a specific state that every node in a pool must reach. Unlike
+// waiting for the pool to start and then finish updating, waiting for a target
+// state returns immediately if the state has already been reached and cannot
+// return early if the pool flips between Updating and Updated quickly.
+type poolTarget struct {
+	description string
+	// Determines whether the pool itself is targeting the desired state. Nodes
+	// are not considered until this is true.
+	isPoolTargeting func(*mcfgv1.MachineConfigPool) bool
+	// Determines whether the given node has reached the desired state.
+	isNodeDone func(*mcfgv1.MachineConfigPool, *corev1.Node) bool
+}
+
+// Waits for every node in the given pool to be running the named rendered
+// MachineConfig.
+func WaitForPoolToReachRenderedConfig(ctx context.Context, cs *framework.ClientSet, poolName, renderedConfig string, opts WaitOpts) error {
+	return waitForPoolTarget(ctx, cs, poolName, newRenderedConfigTarget(renderedConfig), opts)
+}
+
+// Waits for every node in the given pool to be running an OS image with the
+// given digest. Either a bare digest (sha256:...) or a digested pullspec may
+// be provided.
+func WaitForPoolToReachImageDigest(ctx context.Context, cs *framework.ClientSet, poolName, digest string, opts WaitOpts) error {
+	target, err := newImageDigestTarget(digest)
+	if err != nil {
+		return err
+	}
+
+	return waitForPoolTarget(ctx, cs, poolName, target, opts)
+}
+
+// Waits for the given pool to render a config which includes the named
+// MachineConfig and for every node in the pool to be running it.
+func WaitForPoolToIncludeMachineConfig(ctx context.Context, cs *framework.ClientSet, poolName, mcName string, opts WaitOpts) error {
+	return waitForPoolTarget(ctx, cs, poolName, newMachineConfigTarget(mcName), opts)
+}
+
+func waitForPoolTarget(ctx context.Context, cs *framework.ClientSet, poolName string, target *poolTarget, opts WaitOpts) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := newPoolWaiter(ctx, cs, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		w.reporter.summary([]string{poolName}, err)
+	}()
+
+	return w.waitForPoolTarget(ctx, poolName, target)
+}
+
+func (w *poolWaiter) waitForPoolTarget(ctx context.Context, poolName string, target *poolTarget) error {
+	start := time.Now()
+
+	klog.Infof("Waiting for nodes in pool %s to reach %s", poolName, target.description)
+
+	if err := w.waitForPoolToTarget(ctx, poolName, target); err != nil {
+		return err
+	}
+
+	err := w.waitForNodesToMatch(ctx, poolName, func(node *corev1.Node) bool {
+		// The pool may have moved on since we last checked, so we get the
+		// latest version of it each time.
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
+		if err != nil {
+			return false
+		}
+
+		return target.isPoolTargeting(mcp) && target.isNodeDone(mcp, node)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("All nodes in pool %s reached %s after %s", poolName, target.description, time.Since(start))
+	w.reporter.poolCompleted(poolName, time.Since(start))
+
+	return nil
+}
+
+// Waits for the pool to target the desired state, failing if it becomes
+// degraded while doing so.
+func (w *poolWaiter) waitForPoolToTarget(ctx context.Context, poolName string, target *poolTarget) error {
+	start := time.Now()
+
+	retryer := errhelpers.NewTimeRetryer(retryableErrThreshold)
+
+	return w.tracker.waitUntil(ctx, func(_ context.Context) (bool, error) {
+		mcp, err := w.tracker.getMachineConfigPool(poolName)
+
+		shouldContinue, err := handleQueryErr(err, retryer)
+		if err != nil {
+			return false, err
+		}
+
+		if !shouldContinue {
+			return false, nil
+		}
+
+		if target.isPoolTargeting(mcp) {
+			klog.Infof("MachineConfigPool %s is targeting %s after %s", poolName, target.description, time.Since(start))
+			return true, nil
+		}
+
+		return false, w.validatePoolIsNotDegraded(mcp)
+	})
+}
+
+func newRenderedConfigTarget(renderedConfig string) *poolTarget {
+	return &poolTarget{
+		description: fmt.Sprintf("rendered config %s", renderedConfig),
+		isPoolTargeting: func(mcp *mcfgv1.MachineConfigPool) bool {
+			return mcp.Spec.Configuration.Name == renderedConfig
+		},
+		isNodeDone: func(_ *mcfgv1.MachineConfigPool, node *corev1.Node) bool {
+			return isNodeDoneAtRenderedConfig(node, renderedConfig)
+		},
+	}
+}
+
+func newImageDigestTarget(digest string) (*poolTarget, error) {
+	if strings.Contains(digest, "@") {
+		parsed, err := getDigestFromPullspec(digest)
+		if err != nil {
+			return nil, err
+		}
+
+		digest = parsed
+	}
+
+	if _, err := godigest.Parse(digest); err != nil {
+		return nil, fmt.Errorf("invalid image digest %q: %w", digest, err)
+	}
+
+	return &poolTarget{
+		description: fmt.Sprintf("image digest %s", digest),
+		// The pool does not carry the desired image, so there is nothing to
+		// check here.
+		isPoolTargeting: func(_ *mcfgv1.MachineConfigPool) bool {
+			return true
+		},
+		isNodeDone: func(_ *mcfgv1.MachineConfigPool, node *corev1.Node) bool {
+			current := node.Annotations[daemonconsts.CurrentImageAnnotationKey]
+			return isNodeConfigDone(node) && isNodeImageDone(node) && current != "" && getDigestFromImageID(current) == digest
+		},
+	}, nil
+}
+
+func newMachineConfigTarget(mcName string) *poolTarget {
+	return &poolTarget{
+		description: fmt.Sprintf("a rendered config containing MachineConfig %s", mcName),
+		isPoolTargeting: func(mcp *mcfgv1.MachineConfigPool) bool {
+			return doesPoolConfigIncludeMachineConfig(mcp, mcName)
+		},
+		isNodeDone: func(mcp *mcfgv1.MachineConfigPool, node *corev1.Node) bool {
+			return isNodeDoneAtRenderedConfig(node, mcp.Spec.Configuration.Name)
+		},
+	}
+}
+
+// Determines whether the pool's current rendered config was generated from
+// the named MachineConfig.
+func doesPoolConfigIncludeMachineConfig(mcp *mcfgv1.MachineConfigPool, mcName string) bool {
+	for _, source := range mcp.Spec.Configuration.Source {
+		if source.Name == mcName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Determines whether the node is done updating and is currently running the
+// named rendered config.
+func isNodeDoneAtRenderedConfig(node *corev1.Node, renderedConfig string) bool {
+	current := node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey]
+	return isNodeConfigDone(node) && isNodeImageDone(node) && current == renderedConfig
+}
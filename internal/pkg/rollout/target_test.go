@@ -0,0 +1,170 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWaitForPoolTargetAlreadyReached(t *testing.T) {
+	t.Parallel()
+
+	imageTarget, err := newImageDigestTarget(testBuiltImage)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		target *poolTarget
+	}{
+		{
+			name:   "Rendered config",
+			target: newRenderedConfigTarget("rendered-worker-2"),
+		},
+		{
+			name:   "Image digest",
+			target: imageTarget,
+		},
+		{
+			name:   "MachineConfig",
+			target: newMachineConfigTarget("99-worker-ssh"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+
+			// The pool has already finished updating and is not updating again,
+			// so waiting for it to start updating would hang.
+			pool := newMachineConfigPool("worker", "rendered-worker-2")
+			pool.Spec.Configuration.Source = []corev1.ObjectReference{
+				{Name: "00-worker"},
+				{Name: "99-worker-ssh"},
+			}
+
+			node := newLayeredNode("worker-0", "rendered-worker-2", testBuiltImage)
+
+			kubeclient, mcfgclient := newFakeClients(pool, node)
+
+			tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+			require.NoError(t, err)
+
+			events := &eventCollector{}
+			w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{ProgressHandler: events.handle})
+
+			assert.NoError(t, w.waitForPoolTarget(ctx, pool.Name, testCase.target))
+			assert.Equal(t, []ProgressEventType{NodeUpdatedEvent, PoolCompletedEvent}, events.without(NodePhaseChangedEvent).types())
+		})
+	}
+}
+
+func TestWaitForPoolToReachRenderedConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-1")
+	node := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+
+	kubeclient, mcfgclient := newFakeClients(pool, node)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.waitForPoolTarget(ctx, pool.Name, newRenderedConfigTarget("rendered-worker-2"))
+	}()
+
+	assertNotDone := func() {
+		t.Helper()
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("wait returned before target was reached: %v", err)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	assertNotDone()
+
+	// Even though the node is at the desired config, the pool is not.
+	pool.Spec.Configuration.Name = "rendered-worker-2"
+	_, err = mcfgclient.MachineconfigurationV1().MachineConfigPools().Update(ctx, pool, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	assertNotDone()
+
+	node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey] = "rendered-worker-2"
+	node.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey] = "rendered-worker-2"
+	_, err = kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for rendered config")
+	}
+}
+
+func TestNewImageDigestTarget(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:8c2be4b3f1dfd6b5c2e3c5b4f6c4a9d0e2b1f3a5c7d9e1f3a5c7d9e1f3a5c7d9"
+
+	testCases := []struct {
+		name        string
+		input       string
+		errExpected bool
+	}{
+		{
+			name:  "Bare digest",
+			input: digest,
+		},
+		{
+			name:  "Digested pullspec",
+			input: testBuiltImage,
+		},
+		{
+			name:        "Not a digest",
+			input:       "registry.host.com/org/os-image:latest",
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			target, err := newImageDigestTarget(testCase.input)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "image digest "+digest, target.description)
+
+			node := newLayeredNode("worker-0", "rendered-worker-1", testBuiltImage)
+			assert.True(t, target.isNodeDone(nil, node))
+
+			node = newLayeredNode("worker-0", "rendered-worker-1", testOldImage)
+			assert.False(t, target.isNodeDone(nil, node))
+		})
+	}
+}
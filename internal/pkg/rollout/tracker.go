@@ -0,0 +1,230 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cheesesashimi/zacks-openshift-helpers/internal/pkg/utils"
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	mcfgclientset "github.com/openshift/client-go/machineconfiguration/clientset/versioned"
+	mcfginformers "github.com/openshift/client-go/machineconfiguration/informers/externalversions"
+	mcfglistersv1 "github.com/openshift/client-go/machineconfiguration/listers/machineconfiguration/v1"
+	"github.com/openshift/machine-config-operator/pkg/helpers"
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// How often waiters re-evaluate their conditions even if no change has been
+// observed. This allows time-based conditions to be evaluated.
+var resyncInterval = 30 * time.Second
+
+// Watches MachineConfigPools, Nodes, MachineOSConfigs, and MachineOSBuilds
+// using shared informers and wakes up any waiters whenever one of those
+// objects changes.
+// A single tracker is shared between all of the concurrent waits started by
+// one of the public WaitFor* functions so that each object kind is only
+// watched once regardless of how many pools are being waited on.
+type clusterStateTracker struct {
+	nodeLister corelistersv1.NodeLister
+	mcpLister  mcfglistersv1.MachineConfigPoolLister
+	moscLister mcfglistersv1.MachineOSConfigLister
+	mosbLister mcfglistersv1.MachineOSBuildLister
+	mosbQuery  *utils.MachineOSBuildQuery
+
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+// Starts a cluster state tracker using the clients from the provided
+// framework.ClientSet. The informers stop when the given context is
+// canceled.
+func startClusterStateTracker(ctx context.Context, cs *framework.ClientSet) (*clusterStateTracker, error) {
+	kubeclient := cs.GetKubeclient()
+	mcfgclient := cs.GetMcfgclient()
+
+	if kubeclient == nil || mcfgclient == nil {
+		return nil, fmt.Errorf("ClientSet is missing the Kubernetes or MachineConfig clientset needed to start informers")
+	}
+
+	return newClusterStateTracker(ctx, kubeclient, mcfgclient)
+}
+
+// Creates a cluster state tracker, starts its informers, and waits for their
+// caches to sync. The informers stop when the given context is canceled.
+func newClusterStateTracker(ctx context.Context, kubeclient kubernetes.Interface, mcfgclient mcfgclientset.Interface) (*clusterStateTracker, error) {
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeclient, 0)
+	mcfgInformerFactory := mcfginformers.NewSharedInformerFactory(mcfgclient, 0)
+
+	nodeInformer := kubeInformerFactory.Core().V1().Nodes()
+	mcpInformer := mcfgInformerFactory.Machineconfiguration().V1().MachineConfigPools()
+	moscInformer := mcfgInformerFactory.Machineconfiguration().V1().MachineOSConfigs()
+	mosbInformer := mcfgInformerFactory.Machineconfiguration().V1().MachineOSBuilds()
+
+	t := &clusterStateTracker{
+		nodeLister:  nodeInformer.Lister(),
+		mcpLister:   mcpInformer.Lister(),
+		moscLister:  moscInformer.Lister(),
+		mosbLister:  mosbInformer.Lister(),
+		subscribers: map[chan struct{}]struct{}{},
+	}
+
+	t.mosbQuery = utils.NewMachineOSBuildQueryForListers(t.moscLister, t.mosbLister)
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(_ interface{}) {
+			t.notify()
+		},
+		UpdateFunc: func(_, _ interface{}) {
+			t.notify()
+		},
+		DeleteFunc: func(_ interface{}) {
+			t.notify()
+		},
+	}
+
+	for _, informer := range []cache.SharedIndexInformer{nodeInformer.Informer(), mcpInformer.Informer(), moscInformer.Informer(), mosbInformer.Informer()} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("could not add event handler: %w", err)
+		}
+	}
+
+	kubeInformerFactory.Start(ctx.Done())
+	mcfgInformerFactory.Start(ctx.Done())
+
+	start := time.Now()
+
+	for informerType, synced := range kubeInformerFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("could not sync informer cache for %s: %w", informerType, ctx.Err())
+		}
+	}
+
+	for informerType, synced := range mcfgInformerFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("could not sync informer cache for %s: %w", informerType, ctx.Err())
+		}
+	}
+
+	klog.V(4).Infof("Informer caches synced after %s", time.Since(start))
+
+	return t, nil
+}
+
+// Wakes up all current subscribers. If a subscriber has not yet consumed a
+// previous notification, it is not notified again since it will re-evaluate
+// the current state anyway.
+func (t *clusterStateTracker) notify() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for ch := range t.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Registers a new subscriber. Returns a channel which receives a value
+// whenever the cluster state changes and a function to unsubscribe.
+func (t *clusterStateTracker) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	t.mu.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mu.Unlock()
+
+	return ch, func() {
+		t.mu.Lock()
+		delete(t.subscribers, ch)
+		t.mu.Unlock()
+	}
+}
+
+// Evaluates the given condition immediately and again every time the cluster
+// state changes until it returns true, returns an error, or the context is
+// canceled. The condition is also periodically re-evaluated even without any
+// changes.
+func (t *clusterStateTracker) waitUntil(ctx context.Context, condition func(context.Context) (bool, error)) error {
+	changes, unsubscribe := t.subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := condition(ctx)
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gets the named MachineConfigPool from the informer cache. The returned
+// object must not be mutated.
+func (t *clusterStateTracker) getMachineConfigPool(name string) (*mcfgv1.MachineConfigPool, error) {
+	return t.mcpLister.Get(name)
+}
+
+// Lists all MachineConfigPools from the informer cache.
+func (t *clusterStateTracker) listMachineConfigPools() ([]*mcfgv1.MachineConfigPool, error) {
+	return t.mcpLister.List(labels.Everything())
+}
+
+// Lists the nodes which belong to the given pool from the informer cache. The
+// returned objects must not be mutated.
+//
+// Membership is determined by the MCO's own helpers so that it cannot drift
+// from how the MCO determines it. For example, a node which matches the
+// selectors of both the worker pool and a custom pool only belongs to the
+// custom pool.
+func (t *clusterStateTracker) listNodesForPool(poolName string) ([]*corev1.Node, error) {
+	mcp, err := t.getMachineConfigPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	return helpers.GetNodesForPool(t.mcpLister, t.nodeLister, mcp)
+}
+
+// Gets the MachineOSConfig for the given pool from the informer cache.
+// Returns nil if the pool does not have a MachineOSConfig.
+func (t *clusterStateTracker) getMachineOSConfigForPool(mcp *mcfgv1.MachineConfigPool) (*mcfgv1.MachineOSConfig, error) {
+	moscs, err := t.moscLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mosc := range moscs {
+		if mosc.Spec.MachineConfigPool.Name == mcp.Name {
+			return mosc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Gets the MachineOSBuild for the pool's current rendered MachineConfig from
+// the informer cache. See utils.MachineOSBuildQuery for how it is chosen.
+func (t *clusterStateTracker) getCurrentMachineOSBuildForPool(ctx context.Context, mcp *mcfgv1.MachineConfigPool) (*mcfgv1.MachineOSBuild, error) {
+	return t.mosbQuery.GetCurrentMachineOSBuildForPool(ctx, mcp)
+}
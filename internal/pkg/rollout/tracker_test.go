@@ -0,0 +1,351 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	mcfglistersv1 "github.com/openshift/client-go/machineconfiguration/listers/machineconfiguration/v1"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/pkg/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestClusterStateTrackerWaitsForPoolAndNodes(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-2")
+	nodes := []*corev1.Node{
+		newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-2", daemonconsts.MachineConfigDaemonStateWorking),
+		newNode("worker-1", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone),
+	}
+
+	kubeclient, mcfgclient := newFakeClients(pool, nodes[0], nodes[1])
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	events := &eventCollector{}
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{ProgressHandler: events.handle})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.waitForMachineConfigPoolAndNodesToComplete(ctx, pool.Name)
+	}()
+
+	// Progress the first node, then the second node, then mark the pool as
+	// updated. Each change should be observed via the informers.
+	for _, node := range nodes {
+		node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey] = "rendered-worker-2"
+		node.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey] = "rendered-worker-2"
+		node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] = daemonconsts.MachineConfigDaemonStateDone
+
+		_, err := kubeclient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("wait returned before pool was updated: %v", err)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	pool.Status.Conditions = []mcfgv1.MachineConfigPoolCondition{
+		{
+			Type:   mcfgv1.MachineConfigPoolUpdated,
+			Status: corev1.ConditionTrue,
+		},
+	}
+
+	_, err = mcfgclient.MachineconfigurationV1().MachineConfigPools().Update(ctx, pool, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for pool to complete")
+	}
+
+	updates := events.without(NodePhaseChangedEvent)
+	assert.Equal(t, []ProgressEventType{NodeUpdatedEvent, NodeUpdatedEvent, PoolCompletedEvent}, updates.types())
+	assert.Equal(t, "worker-0", updates.get()[0].Node)
+	assert.Equal(t, []string{"worker-1"}, updates.get()[0].RemainingNodes)
+	assert.Equal(t, "worker-1", updates.get()[1].Node)
+	assert.Empty(t, updates.get()[1].RemainingNodes)
+}
+
+func TestClusterStateTrackerDegradedPool(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	pool := newMachineConfigPool("worker", "rendered-worker-2")
+
+	kubeclient, mcfgclient := newFakeClients(pool)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	events := &eventCollector{}
+	w := newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{ProgressHandler: events.handle})
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- w.waitForMachineConfigPoolToStart(ctx, pool.Name)
+	}()
+
+	pool.Status.Conditions = []mcfgv1.MachineConfigPoolCondition{
+		{
+			Type:   mcfgv1.MachineConfigPoolDegraded,
+			Status: corev1.ConditionTrue,
+		},
+	}
+
+	_, err = mcfgclient.MachineconfigurationV1().MachineConfigPools().Update(ctx, pool, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.ErrorContains(t, err, "degraded")
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for degraded pool")
+	}
+
+	assert.Equal(t, []ProgressEventType{PoolDegradedEvent}, events.types())
+}
+
+func TestClusterStateTrackerContextCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kubeclient, mcfgclient := newFakeClients(newMachineConfigPool("worker", "rendered-worker-1"))
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- newPoolWaiterForTracker(newFakeClientSetFromClients(kubeclient, mcfgclient), tracker, WaitOpts{}).waitForMachineConfigPoolToStart(ctx, "worker")
+	}()
+
+	cancel()
+
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
+
+// Pool membership is determined by the MCO's own helpers. These cases ensure
+// that they behave the way the waiters expect, particularly for custom pools
+// which select nodes by something other than the node role.
+func TestGetPrimaryPoolForNode(t *testing.T) {
+	t.Parallel()
+
+	master := newMachineConfigPool("master", "rendered-master-1")
+	worker := newMachineConfigPool("worker", "rendered-worker-1")
+	infra := newMachineConfigPool("infra", "rendered-infra-1")
+
+	// A custom pool which selects nodes by a label other than the node role.
+	gpu := newMachineConfigPool("gpu", "rendered-gpu-1")
+	gpu.Spec.NodeSelector = metav1.AddLabelToSelector(&metav1.LabelSelector{}, "gpu", "true")
+
+	// A pool with an empty selector should not match anything.
+	empty := newMachineConfigPool("empty", "rendered-empty-1")
+	empty.Spec.NodeSelector = &metav1.LabelSelector{}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pool := range []*mcfgv1.MachineConfigPool{master, worker, infra, gpu, empty} {
+		require.NoError(t, indexer.Add(pool))
+	}
+
+	lister := mcfglistersv1.NewMachineConfigPoolLister(indexer)
+
+	testCases := []struct {
+		name        string
+		labels      map[string]string
+		expected    string
+		errExpected bool
+	}{
+		{
+			name:     "Worker only",
+			labels:   map[string]string{"node-role.kubernetes.io/worker": ""},
+			expected: "worker",
+		},
+		{
+			name: "Master and worker",
+			labels: map[string]string{
+				"node-role.kubernetes.io/master": "",
+				"node-role.kubernetes.io/worker": "",
+			},
+			expected: "master",
+		},
+		{
+			name: "Custom pool wins over worker",
+			labels: map[string]string{
+				"node-role.kubernetes.io/worker": "",
+				"node-role.kubernetes.io/infra":  "",
+			},
+			expected: "infra",
+		},
+		{
+			name: "Custom pool selected by non-role label wins over worker",
+			labels: map[string]string{
+				"node-role.kubernetes.io/worker": "",
+				"gpu":                            "true",
+			},
+			expected: "gpu",
+		},
+		{
+			name:     "Custom pool selected by non-role label only",
+			labels:   map[string]string{"gpu": "true"},
+			expected: "gpu",
+		},
+		{
+			name: "Master wins over custom pool",
+			labels: map[string]string{
+				"node-role.kubernetes.io/master": "",
+				"gpu":                            "true",
+			},
+			expected: "master",
+		},
+		{
+			name: "Multiple custom pools",
+			labels: map[string]string{
+				"node-role.kubernetes.io/worker": "",
+				"node-role.kubernetes.io/infra":  "",
+				"gpu":                            "true",
+			},
+			errExpected: true,
+		},
+		{
+			name:   "No matching pools",
+			labels: map[string]string{"node-role.kubernetes.io/other": ""},
+		},
+		{
+			name: "Windows node",
+			labels: map[string]string{
+				"node-role.kubernetes.io/worker": "",
+				corev1.LabelOSStable:             "windows",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "node",
+					Labels: testCase.labels,
+				},
+			}
+
+			primary, err := helpers.GetPrimaryPoolForNode(lister, node)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			if testCase.expected == "" {
+				assert.Nil(t, primary)
+				return
+			}
+
+			require.NotNil(t, primary)
+			assert.Equal(t, testCase.expected, primary.Name)
+		})
+	}
+}
+
+func TestClusterStateTrackerListNodesForPool(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	worker := newMachineConfigPool("worker", "rendered-worker-1")
+	infra := newMachineConfigPool("infra", "rendered-infra-1")
+
+	worker0 := newNode("worker-0", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	worker1 := newNode("worker-1", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	worker1.Labels["node-role.kubernetes.io/infra"] = ""
+
+	// A custom pool which selects nodes by a label other than the node role.
+	gpu := newMachineConfigPool("gpu", "rendered-gpu-1")
+	gpu.Spec.NodeSelector = metav1.AddLabelToSelector(&metav1.LabelSelector{}, "gpu", "true")
+
+	worker2 := newNode("worker-2", "worker", "rendered-worker-1", "rendered-worker-1", daemonconsts.MachineConfigDaemonStateDone)
+	worker2.Labels["gpu"] = "true"
+
+	kubeclient, mcfgclient := newFakeClients(worker, infra, gpu, worker0, worker1, worker2)
+
+	tracker, err := newClusterStateTracker(ctx, kubeclient, mcfgclient)
+	require.NoError(t, err)
+
+	assertNodeNames := func(t *testing.T, poolName string, expected []string) {
+		t.Helper()
+
+		nodes, err := tracker.listNodesForPool(poolName)
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, node := range nodes {
+			names = append(names, node.Name)
+		}
+
+		assert.ElementsMatch(t, expected, names)
+	}
+
+	assertNodeNames(t, "worker", []string{"worker-0"})
+	assertNodeNames(t, "infra", []string{"worker-1"})
+	assertNodeNames(t, "gpu", []string{"worker-2"})
+
+	_, err = tracker.listNodesForPool("nonexistent")
+	assert.Error(t, err)
+}
+
+func newMachineConfigPool(name, renderedConfig string) *mcfgv1.MachineConfigPool {
+	return &mcfgv1.MachineConfigPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: mcfgv1.MachineConfigPoolSpec{
+			NodeSelector: metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role.kubernetes.io/"+name, ""),
+			Configuration: mcfgv1.MachineConfigPoolStatusConfiguration{
+				ObjectReference: corev1.ObjectReference{
+					Name: renderedConfig,
+				},
+			},
+		},
+	}
+}
+
+func newNode(name, role, current, desired, state string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"node-role.kubernetes.io/" + role: "",
+			},
+			Annotations: map[string]string{
+				daemonconsts.CurrentMachineConfigAnnotationKey:     current,
+				daemonconsts.DesiredMachineConfigAnnotationKey:     desired,
+				daemonconsts.MachineConfigDaemonStateAnnotationKey: state,
+			},
+		},
+	}
+}
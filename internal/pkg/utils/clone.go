@@ -2,7 +2,10 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 
 	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
@@ -16,45 +19,69 @@ import (
 const (
 	ClonedObjectLabelKey      string = "machineconfiguration.openshift.io/cloned-by-zacks-openshift-helpers"
 	RecreatableSecretLabelKey string = "machineconfiguration.openshift.io/recreatable-secret"
+	// Records the namespace/name of the object that a clone was made from so
+	// that the clone can be refreshed when the source changes.
+	ClonedFromAnnotationKey string = "machineconfiguration.openshift.io/cloned-from"
 )
 
-type SecretRef struct {
+// The namespace and name of the cluster-wide pull secret.
+const (
+	globalPullSecretNamespace string = "openshift-config"
+	globalPullSecretName      string = "pull-secret"
+)
+
+// Refers to a namespaced object. If the namespace is empty when used as a
+// clone destination, the MCO namespace is used.
+type ObjectRef struct {
 	Name      string
 	Namespace string
 }
 
-func (s *SecretRef) String() string {
-	return fmt.Sprintf("%s/%s", s.Namespace, s.Name)
+func (o ObjectRef) String() string {
+	return fmt.Sprintf("%s/%s", o.Namespace, o.Name)
 }
 
-func CloneSecret(cs *framework.ClientSet, src, dst SecretRef) error {
-	originalSecret, err := cs.CoreV1Interface.Secrets(src.Namespace).Get(context.TODO(), src.Name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("could not get secret %s: %w", src, err)
+func (o ObjectRef) withDefaultNamespace() ObjectRef {
+	if o.Namespace == "" {
+		o.Namespace = ctrlcommon.MCONamespace
 	}
 
-	return createSecret(cs, prepareSecret(originalSecret, dst, nil))
+	return o
 }
 
-func CloneSecretWithLabels(cs *framework.ClientSet, src, dst SecretRef, addlLabels map[string]string) error {
-	originalSecret, err := cs.CoreV1Interface.Secrets(src.Namespace).Get(context.TODO(), src.Name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("could not get secret %s: %w", src, err)
+// Parses a namespace/name reference such as the value of the
+// ClonedFromAnnotationKey annotation.
+func parseObjectRef(in string) (ObjectRef, error) {
+	namespace, name, ok := strings.Cut(in, "/")
+	if !ok || namespace == "" || name == "" {
+		return ObjectRef{}, fmt.Errorf("invalid object reference %q, expected namespace/name", in)
 	}
 
-	return createSecret(cs, prepareSecret(originalSecret, dst, addlLabels))
+	return ObjectRef{Name: name, Namespace: namespace}, nil
 }
 
-func prepareSecret(originalSecret *corev1.Secret, dstRef SecretRef, addlLabels map[string]string) *corev1.Secret {
-	return &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      dstRef.Name,
-			Namespace: dstRef.Namespace,
-			Labels:    getLabelsForClonedObject(addlLabels),
-		},
-		Data: originalSecret.Data,
-		Type: originalSecret.Type,
-	}
+type SecretRef = ObjectRef
+
+func CloneSecret(cs *framework.ClientSet, src, dst SecretRef) error {
+	return cloneObject(context.TODO(), cs, secretKind, src, dst, nil)
+}
+
+func CloneSecretWithLabels(cs *framework.ClientSet, src, dst SecretRef, addlLabels map[string]string) error {
+	return cloneObject(context.TODO(), cs, secretKind, src, dst, addlLabels)
+}
+
+// Clones the cluster-wide pull secret (openshift-config/pull-secret) to the
+// given destination.
+func CloneGlobalPullSecret(cs *framework.ClientSet, dst SecretRef) error {
+	return CloneSecret(cs, SecretRef{Name: globalPullSecretName, Namespace: globalPullSecretNamespace}, dst)
+}
+
+func CloneConfigMap(cs *framework.ClientSet, src, dst ObjectRef) error {
+	return cloneObject(context.TODO(), cs, configMapKind, src, dst, nil)
+}
+
+func CloneConfigMapWithLabels(cs *framework.ClientSet, src, dst ObjectRef, addlLabels map[string]string) error {
+	return cloneObject(context.TODO(), cs, configMapKind, src, dst, addlLabels)
 }
 
 func getLabelsForClonedObject(addlLabels map[string]string) map[string]string {
@@ -75,38 +102,269 @@ func getLabelsForClonedObject(addlLabels map[string]string) map[string]string {
 }
 
 func createSecret(cs *framework.ClientSet, s *corev1.Secret) error {
-	_, err := cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Create(context.TODO(), s, metav1.CreateOptions{})
+	return createOrRecreateObject(context.TODO(), cs, secretKind, s)
+}
+
+func CreateOrRecreateSecret(cs *framework.ClientSet, s *corev1.Secret) error {
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+
+	s.Labels[RecreatableSecretLabelKey] = ""
+
+	return createSecret(cs, s)
+}
+
+// The subset of a typed client needed to clone objects of a given kind.
+// The typed Secret and ConfigMap clients satisfy this.
+type clonableClient[T metav1.Object] interface {
+	Get(context.Context, string, metav1.GetOptions) (T, error)
+	Create(context.Context, T, metav1.CreateOptions) (T, error)
+	Update(context.Context, T, metav1.UpdateOptions) (T, error)
+	Delete(context.Context, string, metav1.DeleteOptions) error
+}
+
+// Describes how to clone one kind of namespaced object.
+type clonableKind[T metav1.Object] struct {
+	name string
+	// Gets the client for the given namespace.
+	client func(cs *framework.ClientSet, namespace string) clonableClient[T]
+	// Lists objects in the given namespace, or all namespaces if empty.
+	list func(ctx context.Context, cs *framework.ClientSet, namespace string, opts metav1.ListOptions) ([]T, error)
+	// Creates a new object with the given metadata and the source's payload.
+	copy func(src T, meta metav1.ObjectMeta) T
+	// Determines whether two objects have the same payload.
+	equal func(a, b T) bool
+}
+
+var secretKind = clonableKind[*corev1.Secret]{
+	name: "secret",
+	client: func(cs *framework.ClientSet, namespace string) clonableClient[*corev1.Secret] {
+		return cs.CoreV1Interface.Secrets(namespace)
+	},
+	list: func(ctx context.Context, cs *framework.ClientSet, namespace string, opts metav1.ListOptions) ([]*corev1.Secret, error) {
+		secretList, err := cs.CoreV1Interface.Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		out := []*corev1.Secret{}
+		for i := range secretList.Items {
+			out = append(out, &secretList.Items[i])
+		}
+
+		return out, nil
+	},
+	copy: func(src *corev1.Secret, meta metav1.ObjectMeta) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: meta,
+			Data:       src.Data,
+			Type:       src.Type,
+		}
+	},
+	equal: func(a, b *corev1.Secret) bool {
+		return a.Type == b.Type && reflect.DeepEqual(a.Data, b.Data)
+	},
+}
+
+var configMapKind = clonableKind[*corev1.ConfigMap]{
+	name: "ConfigMap",
+	client: func(cs *framework.ClientSet, namespace string) clonableClient[*corev1.ConfigMap] {
+		return cs.CoreV1Interface.ConfigMaps(namespace)
+	},
+	list: func(ctx context.Context, cs *framework.ClientSet, namespace string, opts metav1.ListOptions) ([]*corev1.ConfigMap, error) {
+		cmList, err := cs.CoreV1Interface.ConfigMaps(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		out := []*corev1.ConfigMap{}
+		for i := range cmList.Items {
+			out = append(out, &cmList.Items[i])
+		}
+
+		return out, nil
+	},
+	copy: func(src *corev1.ConfigMap, meta metav1.ObjectMeta) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: meta,
+			Data:       src.Data,
+			BinaryData: src.BinaryData,
+		}
+	},
+	equal: func(a, b *corev1.ConfigMap) bool {
+		return reflect.DeepEqual(a.Data, b.Data) && reflect.DeepEqual(a.BinaryData, b.BinaryData)
+	},
+}
+
+func cloneObject[T metav1.Object](ctx context.Context, cs *framework.ClientSet, kind clonableKind[T], src, dst ObjectRef, addlLabels map[string]string) error {
+	dst = dst.withDefaultNamespace()
+
+	original, err := kind.client(cs, src.Namespace).Get(ctx, src.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get %s %s: %w", kind.name, src, err)
+	}
+
+	clone := kind.copy(original, metav1.ObjectMeta{
+		Name:      dst.Name,
+		Namespace: dst.Namespace,
+		Labels:    getLabelsForClonedObject(addlLabels),
+		Annotations: map[string]string{
+			ClonedFromAnnotationKey: src.String(),
+		},
+	})
+
+	return createOrRecreateObject(ctx, cs, kind, clone)
+}
+
+// Creates the given object. If it already exists and is labeled as
+// recreatable, it is deleted and created again. The MCO namespace is used if
+// the object has no namespace.
+func createOrRecreateObject[T metav1.Object](ctx context.Context, cs *framework.ClientSet, kind clonableKind[T], obj T) error {
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(ctrlcommon.MCONamespace)
+	}
+
+	client := kind.client(cs, obj.GetNamespace())
+
+	_, err := client.Create(ctx, obj, metav1.CreateOptions{})
 	if err == nil {
-		klog.Infof("Created secret %q in namespace %q", s.Name, ctrlcommon.MCONamespace)
+		klog.Infof("Created %s %q in namespace %q", kind.name, obj.GetName(), obj.GetNamespace())
 		return nil
 	}
 
-	if err != nil && !apierrs.IsAlreadyExists(err) {
+	if !apierrs.IsAlreadyExists(err) {
 		return err
 	}
 
-	secret, err := cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Get(context.TODO(), s.Name, metav1.GetOptions{})
+	existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
-	if _, ok := secret.Labels[RecreatableSecretLabelKey]; ok {
-		if err := cs.CoreV1Interface.Secrets(ctrlcommon.MCONamespace).Delete(context.TODO(), s.Name, metav1.DeleteOptions{}); err != nil {
+	if _, ok := existing.GetLabels()[RecreatableSecretLabelKey]; ok {
+		if err := client.Delete(ctx, obj.GetName(), metav1.DeleteOptions{}); err != nil {
 			return err
 		}
 
-		return createSecret(cs, s)
+		return createOrRecreateObject(ctx, cs, kind, obj)
 	}
 
-	return fmt.Errorf("unmanaged preexisting secret %s already exists, missing label %q", s.Name, RecreatableSecretLabelKey)
+	return fmt.Errorf("unmanaged preexisting %s %s already exists, missing label %q", kind.name, obj.GetName(), RecreatableSecretLabelKey)
 }
 
-func CreateOrRecreateSecret(cs *framework.ClientSet, s *corev1.Secret) error {
-	if s.Labels == nil {
-		s.Labels = map[string]string{}
+// Refreshes every cloned Secret and ConfigMap whose source has changed since
+// it was cloned. Clones whose source no longer exists are left alone. Returns
+// the clones which were updated.
+func SyncClonedObjects(ctx context.Context, cs *framework.ClientSet) ([]string, error) {
+	secrets, err := syncClonedObjects(ctx, cs, secretKind)
+	if err != nil {
+		return nil, err
 	}
 
-	s.Labels[RecreatableSecretLabelKey] = ""
+	configMaps, err := syncClonedObjects(ctx, cs, configMapKind)
+	if err != nil {
+		return nil, err
+	}
 
-	return createSecret(cs, s)
+	return append(secrets, configMaps...), nil
+}
+
+func syncClonedObjects[T metav1.Object](ctx context.Context, cs *framework.ClientSet, kind clonableKind[T]) ([]string, error) {
+	clones, err := kind.list(ctx, cs, metav1.NamespaceAll, metav1.ListOptions{LabelSelector: ClonedObjectLabelKey})
+	if err != nil {
+		return nil, fmt.Errorf("could not list cloned %ss: %w", kind.name, err)
+	}
+
+	updated := []string{}
+	errs := []error{}
+
+	for _, clone := range clones {
+		cloneRef := ObjectRef{Name: clone.GetName(), Namespace: clone.GetNamespace()}
+
+		srcAnnotation, ok := clone.GetAnnotations()[ClonedFromAnnotationKey]
+		if !ok {
+			klog.Warningf("Cloned %s %s missing annotation %q, cannot sync", kind.name, cloneRef, ClonedFromAnnotationKey)
+			continue
+		}
+
+		src, err := parseObjectRef(srcAnnotation)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not sync %s %s: %w", kind.name, cloneRef, err))
+			continue
+		}
+
+		original, err := kind.client(cs, src.Namespace).Get(ctx, src.Name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			klog.Warningf("Source %s %s for clone %s no longer exists, skipping", kind.name, src, cloneRef)
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not get %s %s: %w", kind.name, src, err))
+			continue
+		}
+
+		if kind.equal(original, clone) {
+			klog.V(4).Infof("Cloned %s %s is up-to-date with %s", kind.name, cloneRef, src)
+			continue
+		}
+
+		refreshed := kind.copy(original, metav1.ObjectMeta{
+			Name:            clone.GetName(),
+			Namespace:       clone.GetNamespace(),
+			Labels:          clone.GetLabels(),
+			Annotations:     clone.GetAnnotations(),
+			ResourceVersion: clone.GetResourceVersion(),
+		})
+
+		if _, err := kind.client(cs, clone.GetNamespace()).Update(ctx, refreshed, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("could not update %s %s: %w", kind.name, cloneRef, err))
+			continue
+		}
+
+		klog.Infof("Updated cloned %s %s from %s", kind.name, cloneRef, src)
+		updated = append(updated, fmt.Sprintf("%s %s", kind.name, cloneRef))
+	}
+
+	return updated, errors.Join(errs...)
+}
+
+// Deletes every Secret and ConfigMap in every namespace that was cloned by
+// these helpers. Returns the objects which were deleted.
+func CleanupClonedObjects(ctx context.Context, cs *framework.ClientSet) ([]string, error) {
+	secrets, err := cleanupClonedObjects(ctx, cs, secretKind)
+	if err != nil {
+		return nil, err
+	}
+
+	configMaps, err := cleanupClonedObjects(ctx, cs, configMapKind)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(secrets, configMaps...), nil
+}
+
+func cleanupClonedObjects[T metav1.Object](ctx context.Context, cs *framework.ClientSet, kind clonableKind[T]) ([]string, error) {
+	clones, err := kind.list(ctx, cs, metav1.NamespaceAll, metav1.ListOptions{LabelSelector: ClonedObjectLabelKey})
+	if err != nil {
+		return nil, fmt.Errorf("could not list cloned %ss: %w", kind.name, err)
+	}
+
+	deleted := []string{}
+
+	for _, clone := range clones {
+		cloneRef := ObjectRef{Name: clone.GetName(), Namespace: clone.GetNamespace()}
+
+		err := kind.client(cs, clone.GetNamespace()).Delete(ctx, clone.GetName(), metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			return deleted, fmt.Errorf("could not delete %s %s: %w", kind.name, cloneRef, err)
+		}
+
+		klog.Infof("Deleted cloned %s %s", kind.name, cloneRef)
+		deleted = append(deleted, fmt.Sprintf("%s %s", kind.name, cloneRef))
+	}
+
+	return deleted, nil
 }
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCloneObjects(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		existing          []runtime.Object
+		clone             func(cs *framework.ClientSet) error
+		expectedNamespace string
+		expectedName      string
+		errExpected       bool
+	}{
+		{
+			name: "Secret to another namespace",
+			clone: func(cs *framework.ClientSet) error {
+				return CloneSecret(cs, SecretRef{Name: "src-secret", Namespace: "src"}, SecretRef{Name: "dst-secret", Namespace: "dst"})
+			},
+			expectedNamespace: "dst",
+			expectedName:      "dst-secret",
+		},
+		{
+			name: "Secret defaults to the MCO namespace",
+			clone: func(cs *framework.ClientSet) error {
+				return CloneSecret(cs, SecretRef{Name: "src-secret", Namespace: "src"}, SecretRef{Name: "dst-secret"})
+			},
+			expectedNamespace: ctrlcommon.MCONamespace,
+			expectedName:      "dst-secret",
+		},
+		{
+			name: "Global pull secret",
+			clone: func(cs *framework.ClientSet) error {
+				return CloneGlobalPullSecret(cs, SecretRef{Name: "global-pull-secret", Namespace: "dst"})
+			},
+			expectedNamespace: "dst",
+			expectedName:      "global-pull-secret",
+		},
+		{
+			name: "ConfigMap to another namespace",
+			clone: func(cs *framework.ClientSet) error {
+				return CloneConfigMap(cs, ObjectRef{Name: "src-cm", Namespace: "src"}, ObjectRef{Name: "dst-cm", Namespace: "dst"})
+			},
+			expectedNamespace: "dst",
+			expectedName:      "dst-cm",
+		},
+		{
+			name:     "Recreatable ConfigMap is replaced",
+			existing: []runtime.Object{newClonedConfigMap("dst-cm", "dst", "stale", true)},
+			clone: func(cs *framework.ClientSet) error {
+				return CloneConfigMap(cs, ObjectRef{Name: "src-cm", Namespace: "src"}, ObjectRef{Name: "dst-cm", Namespace: "dst"})
+			},
+			expectedNamespace: "dst",
+			expectedName:      "dst-cm",
+		},
+		{
+			name:     "Unmanaged ConfigMap is not replaced",
+			existing: []runtime.Object{newClonedConfigMap("dst-cm", "dst", "unmanaged", false)},
+			clone: func(cs *framework.ClientSet) error {
+				return CloneConfigMap(cs, ObjectRef{Name: "src-cm", Namespace: "src"}, ObjectRef{Name: "dst-cm", Namespace: "dst"})
+			},
+			errExpected: true,
+		},
+		{
+			name: "Missing source",
+			clone: func(cs *framework.ClientSet) error {
+				return CloneSecret(cs, SecretRef{Name: "missing", Namespace: "src"}, SecretRef{Name: "dst-secret", Namespace: "dst"})
+			},
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+
+			cs := newCloneTestClientSet(testCase.existing...)
+
+			err := testCase.clone(cs)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			var meta metav1.ObjectMeta
+			var data map[string]string
+
+			if secret, err := cs.CoreV1Interface.Secrets(testCase.expectedNamespace).Get(ctx, testCase.expectedName, metav1.GetOptions{}); err == nil {
+				meta = secret.ObjectMeta
+				data = map[string]string{}
+				for k, v := range secret.Data {
+					data[k] = string(v)
+				}
+				assert.Equal(t, corev1.SecretTypeDockerConfigJson, secret.Type)
+			} else {
+				cm, err := cs.CoreV1Interface.ConfigMaps(testCase.expectedNamespace).Get(ctx, testCase.expectedName, metav1.GetOptions{})
+				require.NoError(t, err)
+				meta = cm.ObjectMeta
+				data = cm.Data
+			}
+
+			assert.Contains(t, meta.Labels, ClonedObjectLabelKey)
+			assert.Contains(t, meta.Labels, RecreatableSecretLabelKey)
+			assert.NotEmpty(t, meta.Annotations[ClonedFromAnnotationKey])
+			assert.NotContains(t, data, "stale")
+			assert.Len(t, data, 1)
+		})
+	}
+}
+
+func TestSyncAndCleanupClonedObjects(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	unmanaged := newClonedConfigMap("unmanaged", "dst", "unmanaged", false)
+	delete(unmanaged.Labels, ClonedObjectLabelKey)
+
+	cs := newCloneTestClientSet(unmanaged)
+
+	require.NoError(t, CloneSecret(cs, SecretRef{Name: "src-secret", Namespace: "src"}, SecretRef{Name: "dst-secret", Namespace: "dst"}))
+	require.NoError(t, CloneConfigMap(cs, ObjectRef{Name: "src-cm", Namespace: "src"}, ObjectRef{Name: "dst-cm", Namespace: "dst"}))
+	require.NoError(t, CloneConfigMap(cs, ObjectRef{Name: "src-cm", Namespace: "src"}, ObjectRef{Name: "orphaned-cm", Namespace: "dst"}))
+
+	// Nothing has changed yet.
+	updated, err := SyncClonedObjects(ctx, cs)
+	require.NoError(t, err)
+	assert.Empty(t, updated)
+
+	// Change the source ConfigMap and remove the source of one of the clones.
+	srcCM, err := cs.CoreV1Interface.ConfigMaps("src").Get(ctx, "src-cm", metav1.GetOptions{})
+	require.NoError(t, err)
+	srcCM.Data["ca-bundle.crt"] = "rotated"
+	_, err = cs.CoreV1Interface.ConfigMaps("src").Update(ctx, srcCM, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	orphaned, err := cs.CoreV1Interface.ConfigMaps("dst").Get(ctx, "orphaned-cm", metav1.GetOptions{})
+	require.NoError(t, err)
+	orphaned.Annotations[ClonedFromAnnotationKey] = "src/missing"
+	_, err = cs.CoreV1Interface.ConfigMaps("dst").Update(ctx, orphaned, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	updated, err = SyncClonedObjects(ctx, cs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ConfigMap dst/dst-cm"}, updated)
+
+	dstCM, err := cs.CoreV1Interface.ConfigMaps("dst").Get(ctx, "dst-cm", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", dstCM.Data["ca-bundle.crt"])
+	assert.Contains(t, dstCM.Labels, ClonedObjectLabelKey)
+
+	deleted, err := CleanupClonedObjects(ctx, cs)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"secret dst/dst-secret", "ConfigMap dst/dst-cm", "ConfigMap dst/orphaned-cm"}, deleted)
+
+	_, err = cs.CoreV1Interface.Secrets("dst").Get(ctx, "dst-secret", metav1.GetOptions{})
+	assert.True(t, apierrs.IsNotFound(err))
+
+	// Sources and unmanaged objects are left alone.
+	_, err = cs.CoreV1Interface.ConfigMaps("dst").Get(ctx, "unmanaged", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	_, err = cs.CoreV1Interface.Secrets("src").Get(ctx, "src-secret", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestParseObjectRef(t *testing.T) {
+	t.Parallel()
+
+	ref, err := parseObjectRef("openshift-config/pull-secret")
+	require.NoError(t, err)
+	assert.Equal(t, ObjectRef{Name: "pull-secret", Namespace: "openshift-config"}, ref)
+	assert.Equal(t, "openshift-config/pull-secret", ref.String())
+
+	for _, invalid := range []string{"", "pull-secret", "/pull-secret", "openshift-config/"} {
+		_, err := parseObjectRef(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// Creates a fake ClientSet containing a source secret, a source ConfigMap, the
+// global pull secret, and any additional objects.
+func newCloneTestClientSet(objs ...runtime.Object) *framework.ClientSet {
+	dockerconfig := map[string][]byte{
+		corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`),
+	}
+
+	objs = append(objs,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "src-secret", Namespace: "src"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       dockerconfig,
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: globalPullSecretName, Namespace: globalPullSecretNamespace},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       dockerconfig,
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "src-cm", Namespace: "src"},
+			Data: map[string]string{
+				"ca-bundle.crt": "cert",
+			},
+		},
+	)
+
+	kubeclient := fakekube.NewSimpleClientset(objs...)
+
+	return &framework.ClientSet{
+		CoreV1Interface: kubeclient.CoreV1(),
+	}
+}
+
+func newClonedConfigMap(name, namespace, value string, recreatable bool) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				ClonedObjectLabelKey: "",
+			},
+		},
+		Data: map[string]string{
+			value: value,
+		},
+	}
+
+	if recreatable {
+		cm.Labels[RecreatableSecretLabelKey] = ""
+	}
+
+	return cm
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	imagev1 "github.com/openshift/api/image/v1"
+	imageclientset "github.com/openshift/client-go/image/clientset/versioned"
+	imagev1client "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1"
+	"github.com/openshift/machine-config-operator/test/framework"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The prefixes accepted for ImageStreamTag references, as used by oc.
+var imageStreamTagPrefixes = []string{"istag/", "imagestreamtag/", "imagestreamtags/"}
+
+// Refers to a tag in an ImageStream.
+type ImageStreamTagRef struct {
+	Namespace   string
+	ImageStream string
+	Tag         string
+}
+
+func (i ImageStreamTagRef) String() string {
+	return fmt.Sprintf("%s/%s:%s", i.Namespace, i.ImageStream, i.Tag)
+}
+
+// Parses an ImageStreamTag reference in either the "namespace/imagestream:tag"
+// or "istag/imagestream:tag" form. The latter uses the given default
+// namespace. The tag defaults to "latest". Returns false if the given string
+// is not an ImageStreamTag reference, e.g., because it is a full pullspec such
+// as "quay.io/org/image:tag".
+func ParseImageStreamTagRef(in, defaultNamespace string) (ImageStreamTagRef, bool, error) {
+	for _, prefix := range imageStreamTagPrefixes {
+		if !strings.HasPrefix(in, prefix) {
+			continue
+		}
+
+		if defaultNamespace == "" {
+			return ImageStreamTagRef{}, true, fmt.Errorf("ImageStreamTag reference %q requires a namespace", in)
+		}
+
+		ref, err := parseImageStreamTag(defaultNamespace, strings.TrimPrefix(in, prefix))
+		return ref, true, err
+	}
+
+	namespace, rest, ok := strings.Cut(in, "/")
+	if !ok || strings.Contains(rest, "/") || strings.Contains(rest, "@") {
+		return ImageStreamTagRef{}, false, nil
+	}
+
+	// The first component of a pullspec is a registry hostname if it contains
+	// a dot or port, which namespace names cannot.
+	if strings.ContainsAny(namespace, ".:") || namespace == "localhost" {
+		return ImageStreamTagRef{}, false, nil
+	}
+
+	ref, err := parseImageStreamTag(namespace, rest)
+	return ref, true, err
+}
+
+func parseImageStreamTag(namespace, in string) (ImageStreamTagRef, error) {
+	name, tag, ok := strings.Cut(in, ":")
+	if !ok {
+		tag = "latest"
+	}
+
+	if name == "" || tag == "" {
+		return ImageStreamTagRef{}, fmt.Errorf("invalid ImageStreamTag %q, expected imagestream:tag", in)
+	}
+
+	return ImageStreamTagRef{Namespace: namespace, ImageStream: name, Tag: tag}, nil
+}
+
+// Describes the image a tag in an ImageStream currently points to.
+type ImageStreamTagInfo struct {
+	ImageStreamTagRef
+	// The digest of the image.
+	Digest string
+	// The digested pullspec for the image in the cluster image registry.
+	Pullspec string
+	// When the tag was pointed to the image.
+	Created time.Time
+}
+
+// Queries ImageStreams through the image API.
+type ImageStreamQuery struct {
+	images imagev1client.ImageStreamsGetter
+}
+
+// Constructs an ImageStreamQuery from the given ClientSet.
+func NewImageStreamQuery(cs *framework.ClientSet) (*ImageStreamQuery, error) {
+	ic, err := imageclientset.NewForConfig(cs.GetRestConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create image client: %w", err)
+	}
+
+	return newImageStreamQueryForClient(ic.ImageV1()), nil
+}
+
+func newImageStreamQueryForClient(images imagev1client.ImageStreamsGetter) *ImageStreamQuery {
+	return &ImageStreamQuery{images: images}
+}
+
+// Resolves the given ImageStreamTag to the digested pullspec of the image it
+// currently points to in the cluster image registry.
+func (q *ImageStreamQuery) Resolve(ctx context.Context, ref ImageStreamTagRef) (*ImageStreamTagInfo, error) {
+	is, err := q.images.ImageStreams(ref.Namespace).Get(ctx, ref.ImageStream, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get ImageStream %s/%s: %w", ref.Namespace, ref.ImageStream, err)
+	}
+
+	for _, tag := range is.Status.Tags {
+		if tag.Tag != ref.Tag {
+			continue
+		}
+
+		info, ok := getImageStreamTagInfo(is, tag)
+		if !ok {
+			break
+		}
+
+		return info, nil
+	}
+
+	return nil, fmt.Errorf("ImageStreamTag %s has no image", ref)
+}
+
+// Lists every tag with an image in every ImageStream in the given namespace,
+// sorted by ImageStream name and tag.
+func (q *ImageStreamQuery) ListTags(ctx context.Context, namespace string) ([]ImageStreamTagInfo, error) {
+	isList, err := q.images.ImageStreams(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list ImageStreams in namespace %q: %w", namespace, err)
+	}
+
+	out := []ImageStreamTagInfo{}
+
+	for i := range isList.Items {
+		for _, tag := range isList.Items[i].Status.Tags {
+			if info, ok := getImageStreamTagInfo(&isList.Items[i], tag); ok {
+				out = append(out, *info)
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ImageStream != out[j].ImageStream {
+			return out[i].ImageStream < out[j].ImageStream
+		}
+
+		return out[i].Tag < out[j].Tag
+	})
+
+	return out, nil
+}
+
+// Gets the image the given tag currently points to, which is the first item
+// in its history. Returns false if the tag has no image, e.g., because the
+// import failed.
+func getImageStreamTagInfo(is *imagev1.ImageStream, tag imagev1.NamedTagEventList) (*ImageStreamTagInfo, bool) {
+	if len(tag.Items) == 0 || tag.Items[0].Image == "" {
+		return nil, false
+	}
+
+	current := tag.Items[0]
+
+	// The ImageStream's repository in the cluster image registry is preferred
+	// so that images imported from elsewhere are pulled through it.
+	pullspec := current.DockerImageReference
+	if is.Status.DockerImageRepository != "" {
+		pullspec = fmt.Sprintf("%s@%s", is.Status.DockerImageRepository, current.Image)
+	}
+
+	return &ImageStreamTagInfo{
+		ImageStreamTagRef: ImageStreamTagRef{
+			Namespace:   is.Namespace,
+			ImageStream: is.Name,
+			Tag:         tag.Tag,
+		},
+		Digest:   current.Image,
+		Pullspec: pullspec,
+		Created:  current.Created.Time,
+	}, true
+}
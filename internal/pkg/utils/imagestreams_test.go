@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	imagev1 "github.com/openshift/api/image/v1"
+	fakeimage "github.com/openshift/client-go/image/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseImageStreamTagRef(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		input            string
+		defaultNamespace string
+		expected         ImageStreamTagRef
+		isRef            bool
+		errExpected      bool
+	}{
+		{
+			name:     "Namespace, ImageStream, and tag",
+			input:    "openshift-machine-config-operator/os-image:worker",
+			expected: ImageStreamTagRef{Namespace: "openshift-machine-config-operator", ImageStream: "os-image", Tag: "worker"},
+			isRef:    true,
+		},
+		{
+			name:     "Tag defaults to latest",
+			input:    "my-namespace/my-imagestream",
+			expected: ImageStreamTagRef{Namespace: "my-namespace", ImageStream: "my-imagestream", Tag: "latest"},
+			isRef:    true,
+		},
+		{
+			name:             "istag",
+			input:            "istag/my-imagestream:v1",
+			defaultNamespace: "my-namespace",
+			expected:         ImageStreamTagRef{Namespace: "my-namespace", ImageStream: "my-imagestream", Tag: "v1"},
+			isRef:            true,
+		},
+		{
+			name:             "imagestreamtag",
+			input:            "imagestreamtag/my-imagestream:v1",
+			defaultNamespace: "my-namespace",
+			expected:         ImageStreamTagRef{Namespace: "my-namespace", ImageStream: "my-imagestream", Tag: "v1"},
+			isRef:            true,
+		},
+		{
+			name:        "istag without namespace",
+			input:       "istag/my-imagestream:v1",
+			isRef:       true,
+			errExpected: true,
+		},
+		{
+			name:        "Empty tag",
+			input:       "my-namespace/my-imagestream:",
+			isRef:       true,
+			errExpected: true,
+		},
+		{
+			name:  "Internal registry pullspec",
+			input: "image-registry.openshift-image-registry.svc:5000/my-namespace/my-imagestream:latest",
+		},
+		{
+			name:  "Registry with a single path component",
+			input: "quay.io/image:latest",
+		},
+		{
+			name:  "localhost",
+			input: "localhost/image:latest",
+		},
+		{
+			name:  "Digested",
+			input: "my-namespace/my-imagestream@sha256:544d9fd59f8c711929d53e50ac22b19b329d95c2fcf1093cb590ac255267b2d8",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ref, isRef, err := ParseImageStreamTagRef(testCase.input, testCase.defaultNamespace)
+			assert.Equal(t, testCase.isRef, isRef)
+
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, ref)
+		})
+	}
+}
+
+func TestImageStreamQuery(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	older := metav1.NewTime(time.Now().Add(-time.Hour))
+	newer := metav1.NewTime(time.Now())
+
+	osImage := &imagev1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "os-image", Namespace: "mco"},
+		Status: imagev1.ImageStreamStatus{
+			DockerImageRepository: "image-registry.openshift-image-registry.svc:5000/mco/os-image",
+			Tags: []imagev1.NamedTagEventList{
+				{
+					Tag: "worker",
+					Items: []imagev1.TagEvent{
+						{Image: "sha256:new", Created: newer, DockerImageReference: "image-registry.openshift-image-registry.svc:5000/mco/os-image@sha256:new"},
+						{Image: "sha256:old", Created: older},
+					},
+				},
+				{
+					// A failed import has no image.
+					Tag: "failed",
+				},
+				{
+					Tag:   "infra",
+					Items: []imagev1.TagEvent{{Image: "sha256:infra", Created: older}},
+				},
+			},
+		},
+	}
+
+	// Imported images are pulled through the cluster image registry.
+	imported := &imagev1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "base", Namespace: "mco"},
+		Status: imagev1.ImageStreamStatus{
+			DockerImageRepository: "image-registry.openshift-image-registry.svc:5000/mco/base",
+			Tags: []imagev1.NamedTagEventList{
+				{
+					Tag:   "latest",
+					Items: []imagev1.TagEvent{{Image: "sha256:base", Created: older, DockerImageReference: "quay.io/org/base@sha256:base"}},
+				},
+			},
+		},
+	}
+
+	otherNamespace := &imagev1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other"},
+		Status: imagev1.ImageStreamStatus{
+			Tags: []imagev1.NamedTagEventList{
+				{
+					Tag:   "latest",
+					Items: []imagev1.TagEvent{{Image: "sha256:other", Created: older, DockerImageReference: "quay.io/org/other@sha256:other"}},
+				},
+			},
+		},
+	}
+
+	q := newImageStreamQueryForClient(fakeimage.NewSimpleClientset(osImage, imported, otherNamespace).ImageV1())
+
+	info, err := q.Resolve(ctx, ImageStreamTagRef{Namespace: "mco", ImageStream: "os-image", Tag: "worker"})
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:new", info.Digest)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/mco/os-image@sha256:new", info.Pullspec)
+	assert.Equal(t, newer.Time, info.Created)
+
+	info, err = q.Resolve(ctx, ImageStreamTagRef{Namespace: "mco", ImageStream: "base", Tag: "latest"})
+	require.NoError(t, err)
+	assert.Equal(t, "image-registry.openshift-image-registry.svc:5000/mco/base@sha256:base", info.Pullspec)
+
+	// Without a repository in the cluster image registry, the image reference
+	// is used as-is.
+	info, err = q.Resolve(ctx, ImageStreamTagRef{Namespace: "other", ImageStream: "other", Tag: "latest"})
+	require.NoError(t, err)
+	assert.Equal(t, "quay.io/org/other@sha256:other", info.Pullspec)
+
+	for _, missing := range []ImageStreamTagRef{
+		{Namespace: "mco", ImageStream: "os-image", Tag: "failed"},
+		{Namespace: "mco", ImageStream: "os-image", Tag: "missing"},
+		{Namespace: "mco", ImageStream: "missing", Tag: "latest"},
+	} {
+		_, err := q.Resolve(ctx, missing)
+		assert.Error(t, err, missing.String())
+	}
+
+	tags, err := q.ListTags(ctx, "mco")
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, tag := range tags {
+		names = append(names, tag.String())
+	}
+
+	assert.Equal(t, []string{"mco/base:latest", "mco/os-image:infra", "mco/os-image:worker"}, names)
+}
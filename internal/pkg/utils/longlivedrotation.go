@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openshift/machine-config-operator/test/framework"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// Options for rotating long-lived image pull secrets.
+type RotateLongLivedPullSecretOpts struct {
+	// Only rotate secrets in this namespace. Defaults to all namespaces.
+	Namespace string
+	// Rotate secrets whose tokens expire within this window. Secrets which
+	// have already expired are always rotated.
+	RenewWithin time.Duration
+	// Report which secrets would be rotated without rotating them.
+	DryRun bool
+}
+
+// Describes a long-lived image pull secret that was (or would be) rotated.
+type RotatedPullSecret struct {
+	// The namespace/name of the secret.
+	Secret string
+	// When the previous token expired or will expire.
+	PreviousExpiry time.Time
+	// When the new token expires. Zero for dry runs.
+	Expiry time.Time
+}
+
+func (r RotatedPullSecret) String() string {
+	previous := r.describePreviousExpiry(time.Now())
+
+	if r.Expiry.IsZero() {
+		return fmt.Sprintf("%s (%s)", r.Secret, previous)
+	}
+
+	return fmt.Sprintf("%s (%s, now expires %s)", r.Secret, previous, r.Expiry.Format(time.RFC3339))
+}
+
+// Describes when the previous token expired or will expire relative to the
+// given time.
+func (r RotatedPullSecret) describePreviousExpiry(now time.Time) string {
+	if r.PreviousExpiry.IsZero() {
+		return "expiry unknown"
+	}
+
+	if r.PreviousExpiry.After(now) {
+		return fmt.Sprintf("expires %s", r.PreviousExpiry.Format(time.RFC3339))
+	}
+
+	return fmt.Sprintf("expired %s", r.PreviousExpiry.Format(time.RFC3339))
+}
+
+// Finds the secrets created by CreateLongLivedPullSecret whose tokens expire
+// within the renewal window and replaces their contents with a new token.
+// Secrets created with DisableRotation are skipped. The
+// secrets are updated in place rather than deleted and re-created so that
+// consumers never observe a missing secret. This is safe to run repeatedly,
+// e.g., from cron.
+func RotateLongLivedPullSecrets(ctx context.Context, cs *framework.ClientSet, opts RotateLongLivedPullSecretOpts) ([]RotatedPullSecret, error) {
+	r := &secretRotator{
+		secrets: cs.CoreV1Interface,
+		newCreator: func(opts LongLivedSecretOpts) (*secretCreator, error) {
+			return newSecretCreator(cs, opts)
+		},
+	}
+
+	return r.rotate(ctx, opts)
+}
+
+// Holds the clients needed to rotate secrets so that they can be replaced
+// with fakes in tests.
+type secretRotator struct {
+	secrets    corev1client.SecretsGetter
+	newCreator func(LongLivedSecretOpts) (*secretCreator, error)
+}
+
+func (r *secretRotator) rotate(ctx context.Context, opts RotateLongLivedPullSecretOpts) ([]RotatedPullSecret, error) {
+	secretList, err := r.secrets.Secrets(opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s,!%s", LongLivedPullSecretLabelKey, longLivedPullSecretNoRotateLabelKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list long-lived pull secrets: %w", err)
+	}
+
+	rotated := []RotatedPullSecret{}
+	errs := []error{}
+
+	for _, secret := range secretList.Items {
+		name := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+
+		expiry, err := getLongLivedPullSecretExpiry(&secret)
+		if err != nil {
+			klog.Warningf("Could not determine when secret %s expires, rotating it: %s", name, err)
+		}
+
+		if err == nil && time.Until(expiry) > opts.RenewWithin {
+			klog.V(4).Infof("Secret %s expires at %s, not rotating", name, expiry.Format(time.RFC3339))
+			continue
+		}
+
+		result := RotatedPullSecret{Secret: name, PreviousExpiry: expiry}
+
+		if opts.DryRun {
+			klog.Infof("Would rotate secret %s", name)
+			rotated = append(rotated, result)
+			continue
+		}
+
+		newExpiry, err := r.rotateSecret(ctx, &secret)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not rotate secret %s: %w", name, err))
+			continue
+		}
+
+		klog.Infof("Rotated secret %s, now expires at %s", name, newExpiry.Format(time.RFC3339))
+
+		result.Expiry = newExpiry
+		rotated = append(rotated, result)
+	}
+
+	return rotated, errors.Join(errs...)
+}
+
+// Creates a new token for the secret's service account and updates the
+// secret in place. Returns when the new token expires.
+func (r *secretRotator) rotateSecret(ctx context.Context, secret *corev1.Secret) (time.Time, error) {
+	saRef, err := parseObjectRef(secret.Annotations[longLivedPullSecretServiceAccountAnnotationKey])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get service account from annotation %q: %w", longLivedPullSecretServiceAccountAnnotationKey, err)
+	}
+
+	creator, err := r.newCreator(LongLivedSecretOpts{
+		ServiceAccount: metav1.ObjectMeta{
+			Name:      saRef.Name,
+			Namespace: saRef.Namespace,
+		},
+		Lifetime: secret.Annotations[longLivedPullSecretLifetimeAnnotationKey],
+		Secret: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   secret.Namespace,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+	})
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	updated, err := creator.createSecretSpec(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := creator.updateSecret(ctx, updated); err != nil {
+		return time.Time{}, err
+	}
+
+	return getLongLivedPullSecretExpiry(updated)
+}
+
+// Gets when the token in the given long-lived pull secret expires.
+func getLongLivedPullSecretExpiry(secret *corev1.Secret) (time.Time, error) {
+	val, ok := secret.Annotations[LongLivedPullSecretExpiryAnnotationKey]
+	if !ok {
+		return time.Time{}, fmt.Errorf("missing annotation %q", LongLivedPullSecretExpiryAnnotationKey)
+	}
+
+	expiry, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse annotation %q value %q: %w", LongLivedPullSecretExpiryAnnotationKey, val, err)
+	}
+
+	return expiry, nil
+}
+
+// Replaces the contents, labels, and annotations of the existing secret with
+// those of the given secret, retrying on conflicts.
+func (s *secretCreator) updateSecret(ctx context.Context, secret *corev1.Secret) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		existing, err := s.core.Secrets(secret.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get secret %q: %w", secret.Name, err)
+		}
+
+		existing.Data = secret.Data
+
+		for k, v := range secret.Labels {
+			metav1.SetMetaDataLabel(&existing.ObjectMeta, k, v)
+		}
+
+		for k, v := range secret.Annotations {
+			metav1.SetMetaDataAnnotation(&existing.ObjectMeta, k, v)
+		}
+
+		_, err = s.core.Secrets(secret.Namespace).Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	fakeroute "github.com/openshift/client-go/route/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authv1client "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	"k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestRotateLongLivedPullSecrets(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	testCases := []struct {
+		name            string
+		expiry          string
+		renewWithin     time.Duration
+		dryRun          bool
+		disableRotation bool
+		rotateExpected  bool
+		updateExpected  bool
+	}{
+		{
+			name:           "Expiring soon",
+			expiry:         now.Add(time.Minute).UTC().Format(time.RFC3339),
+			renewWithin:    time.Hour,
+			rotateExpected: true,
+			updateExpected: true,
+		},
+		{
+			name:           "Already expired",
+			expiry:         now.Add(-time.Hour).UTC().Format(time.RFC3339),
+			rotateExpected: true,
+			updateExpected: true,
+		},
+		{
+			name:        "Not expiring soon",
+			expiry:      now.Add(48 * time.Hour).UTC().Format(time.RFC3339),
+			renewWithin: time.Hour,
+		},
+		{
+			name:           "Unparseable expiry",
+			expiry:         "not-a-time",
+			rotateExpected: true,
+			updateExpected: true,
+		},
+		{
+			name:            "Rotation disabled",
+			expiry:          now.Add(time.Minute).UTC().Format(time.RFC3339),
+			renewWithin:     time.Hour,
+			disableRotation: true,
+		},
+		{
+			name:           "Dry run",
+			expiry:         now.Add(time.Minute).UTC().Format(time.RFC3339),
+			renewWithin:    time.Hour,
+			dryRun:         true,
+			rotateExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+
+			kubeclient := newFakeKubeClientForToken("system:serviceaccount:test-ns:builder")
+
+			newCreator := func(opts LongLivedSecretOpts) (*secretCreator, error) {
+				return &secretCreator{
+					LongLivedSecretOpts: opts,
+					core:                kubeclient.CoreV1(),
+					images:              fakeconfig.NewSimpleClientset().ConfigV1(),
+					routes:              fakeroute.NewSimpleClientset().RouteV1(),
+					restConfig:          &rest.Config{Host: "https://api.example.com:6443"},
+					newAuthClient: func(_ *rest.Config) (authv1client.SelfSubjectReviewsGetter, error) {
+						return kubeclient.AuthenticationV1(), nil
+					},
+				}, nil
+			}
+
+			// Create the secret the same way CreateLongLivedPullSecret does so
+			// that it has all of the expected labels and annotations.
+			creator, err := newCreator(LongLivedSecretOpts{
+				ServiceAccount: metav1.ObjectMeta{Name: "builder", Namespace: "test-ns"},
+				Secret: metav1.ObjectMeta{
+					Name:      "long-lived",
+					Namespace: "test-ns",
+					Labels:    map[string]string{"user-label": ""},
+				},
+				Lifetime:        "24h",
+				DisableRotation: testCase.disableRotation,
+			})
+			require.NoError(t, err)
+
+			secret := creator.createSecretSpecFromBytes([]byte(`{"auths":{}}`), now)
+			secret.Annotations[LongLivedPullSecretExpiryAnnotationKey] = testCase.expiry
+			require.NoError(t, creator.createSecret(ctx, secret))
+
+			// Unmanaged secrets must never be touched.
+			_, err = kubeclient.CoreV1().Secrets("test-ns").Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "unmanaged", Namespace: "test-ns"},
+			}, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			r := &secretRotator{secrets: kubeclient.CoreV1(), newCreator: newCreator}
+
+			kubeclient.ClearActions()
+
+			rotated, err := r.rotate(ctx, RotateLongLivedPullSecretOpts{
+				RenewWithin: testCase.renewWithin,
+				DryRun:      testCase.dryRun,
+			})
+			require.NoError(t, err)
+
+			for _, action := range kubeclient.Actions() {
+				assert.False(t, action.Matches("delete", "secrets"), "secrets should never be deleted")
+				assert.False(t, action.Matches("create", "secrets"), "secrets should never be re-created")
+			}
+
+			updated, err := kubeclient.CoreV1().Secrets("test-ns").Get(ctx, "long-lived", metav1.GetOptions{})
+			require.NoError(t, err)
+
+			if !testCase.rotateExpected {
+				assert.Empty(t, rotated)
+				assert.Equal(t, testCase.expiry, updated.Annotations[LongLivedPullSecretExpiryAnnotationKey])
+				return
+			}
+
+			require.Len(t, rotated, 1)
+			assert.Equal(t, "test-ns/long-lived", rotated[0].Secret)
+
+			if !testCase.updateExpected {
+				assert.True(t, rotated[0].Expiry.IsZero())
+				assert.Equal(t, testCase.expiry, updated.Annotations[LongLivedPullSecretExpiryAnnotationKey])
+				assert.False(t, hasUpdateAction(kubeclient.Actions()))
+				return
+			}
+
+			assert.True(t, hasUpdateAction(kubeclient.Actions()))
+
+			expiry, err := getLongLivedPullSecretExpiry(updated)
+			require.NoError(t, err)
+			assert.Equal(t, rotated[0].Expiry, expiry)
+			assert.WithinDuration(t, now.Add(24*time.Hour), expiry, time.Minute)
+
+			assert.Contains(t, updated.Labels, "user-label")
+			assert.Contains(t, updated.Labels, LongLivedPullSecretLabelKey)
+			assert.Contains(t, string(updated.Data[corev1.DockerConfigJsonKey]), defaultInternalRegistryHostname)
+		})
+	}
+}
+
+func TestRotatedPullSecretString(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	past := now.Add(-time.Hour).UTC()
+	future := now.Add(time.Hour).UTC()
+	renewed := now.Add(24 * time.Hour).UTC()
+
+	testCases := []struct {
+		name     string
+		rotated  RotatedPullSecret
+		expected string
+	}{
+		{
+			name:     "Dry run before expiry",
+			rotated:  RotatedPullSecret{Secret: "ns/name", PreviousExpiry: future},
+			expected: fmt.Sprintf("ns/name (expires %s)", future.Format(time.RFC3339)),
+		},
+		{
+			name:     "Dry run after expiry",
+			rotated:  RotatedPullSecret{Secret: "ns/name", PreviousExpiry: past},
+			expected: fmt.Sprintf("ns/name (expired %s)", past.Format(time.RFC3339)),
+		},
+		{
+			name:     "Rotated before expiry",
+			rotated:  RotatedPullSecret{Secret: "ns/name", PreviousExpiry: future, Expiry: renewed},
+			expected: fmt.Sprintf("ns/name (expires %s, now expires %s)", future.Format(time.RFC3339), renewed.Format(time.RFC3339)),
+		},
+		{
+			name:     "Rotated after expiry",
+			rotated:  RotatedPullSecret{Secret: "ns/name", PreviousExpiry: past, Expiry: renewed},
+			expected: fmt.Sprintf("ns/name (expired %s, now expires %s)", past.Format(time.RFC3339), renewed.Format(time.RFC3339)),
+		},
+		{
+			name:     "Unknown previous expiry",
+			rotated:  RotatedPullSecret{Secret: "ns/name", Expiry: renewed},
+			expected: fmt.Sprintf("ns/name (expiry unknown, now expires %s)", renewed.Format(time.RFC3339)),
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, testCase.expected, testCase.rotated.String())
+		})
+	}
+}
+
+func hasUpdateAction(actions []clienttesting.Action) bool {
+	for _, action := range actions {
+		if action.Matches("update", "secrets") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,15 +2,16 @@ package utils
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
 	"time"
 
+	configv1client "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
+	routeclientset "github.com/openshift/client-go/route/clientset/versioned"
+	routev1client "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
 	authv1client "k8s.io/client-go/kubernetes/typed/authentication/v1"
-	"k8s.io/client-go/tools/clientcmd"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/klog"
 
 	corev1 "k8s.io/api/core/v1"
@@ -18,16 +19,44 @@ import (
 	authv1 "k8s.io/api/authentication/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
 	"k8s.io/client-go/rest"
 
 	"github.com/openshift/machine-config-operator/test/framework"
 )
 
+const (
+	// The name of the cluster-wide image config.
+	imageConfigName string = "cluster"
+	// The namespace that the cluster image registry and its Routes live in.
+	imageRegistryNamespace string = "openshift-image-registry"
+	// Used if the image config does not report an internal hostname.
+	defaultInternalRegistryHostname string = "image-registry.openshift-image-registry.svc:5000"
+	// The username that OpenShift uses in service account pull secrets.
+	registryUsername string = "serviceaccount"
+)
+
+const (
+	// Identifies the secrets created by CreateLongLivedPullSecret.
+	LongLivedPullSecretLabelKey string = "machineconfiguration.openshift.io/long-lived-pull-secret"
+	// When the token in the secret expires, in RFC 3339 format.
+	LongLivedPullSecretExpiryAnnotationKey string = "machineconfiguration.openshift.io/long-lived-pull-secret-expires-at"
+	// The namespace/name of the service account that the token is for.
+	longLivedPullSecretServiceAccountAnnotationKey string = "machineconfiguration.openshift.io/long-lived-pull-secret-service-account"
+	// The lifetime that the token was requested with.
+	longLivedPullSecretLifetimeAnnotationKey string = "machineconfiguration.openshift.io/long-lived-pull-secret-lifetime"
+	// Excludes the secret from RotateLongLivedPullSecrets.
+	longLivedPullSecretNoRotateLabelKey string = "machineconfiguration.openshift.io/long-lived-pull-secret-no-rotate"
+)
+
 // Creates a long-lived image pull secret for a service account token.
 func CreateLongLivedPullSecret(ctx context.Context, cs *framework.ClientSet, opts LongLivedSecretOpts) error {
-	creator, secret, err := createLongLivedPullSecret(ctx, cs, opts)
+	creator, err := newSecretCreator(cs, opts)
+	if err != nil {
+		return err
+	}
+
+	secret, err := creator.createSecretSpec(ctx)
 	if err != nil {
 		return err
 	}
@@ -35,38 +64,54 @@ func CreateLongLivedPullSecret(ctx context.Context, cs *framework.ClientSet, opt
 	return creator.createSecret(ctx, secret)
 }
 
-// Creates a long-lived image pull secret for a service account token.
-func createLongLivedPullSecret(ctx context.Context, cs *framework.ClientSet, opts LongLivedSecretOpts) (*secretCreator, *corev1.Secret, error) {
-	_, err := exec.LookPath("oc")
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not locate oc command: %w", err)
+// Creates the secret creator and the clients it needs from the provided
+// framework.ClientSet.
+func newSecretCreator(cs *framework.ClientSet, opts LongLivedSecretOpts) (*secretCreator, error) {
+	if err := opts.validateOpts(); err != nil {
+		return nil, fmt.Errorf("could not validate opts: %w", err)
 	}
 
-	if err := opts.validateOpts(); err != nil {
-		return nil, nil, fmt.Errorf("could not validate opts: %w", err)
+	rc, err := routeclientset.NewForConfig(cs.GetRestConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create route client: %w", err)
 	}
 
-	creator := &secretCreator{
+	return &secretCreator{
 		LongLivedSecretOpts: opts,
-		cs:                  cs,
-	}
+		core:                cs.CoreV1Interface,
+		images:              cs.ConfigV1Interface,
+		routes:              rc.RouteV1(),
+		restConfig:          cs.GetRestConfig(),
+		newAuthClient: func(cfg *rest.Config) (authv1client.SelfSubjectReviewsGetter, error) {
+			return authv1client.NewForConfig(cfg)
+		},
+	}, nil
+}
 
-	token, err := creator.createToken(ctx)
+// Creates a token for the service account, validates it, and builds the
+// image pull secret for every hostname that the cluster image registry is
+// reachable at.
+func (s *secretCreator) createSecretSpec(ctx context.Context) (*corev1.Secret, error) {
+	token, expires, err := s.createToken(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not create token: %w", err)
+		return nil, fmt.Errorf("could not create token: %w", err)
 	}
 
-	cfg, err := creator.getRESTConfigForToken(ctx, token)
+	if _, err := s.getRESTConfigForToken(ctx, token); err != nil {
+		return nil, fmt.Errorf("could not get RESTConfig for token: %w", err)
+	}
+
+	hostnames, err := s.getRegistryHostnames(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not get RESTConfig for token: %w", err)
+		return nil, fmt.Errorf("could not get image registry hostnames: %w", err)
 	}
 
-	pullSecretBytes, err := creator.getPullSecretForRESTConfig(ctx, cfg)
+	pullSecretBytes, err := buildDockerConfigJSONForToken(hostnames, token)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not get pull secret: %w", err)
+		return nil, fmt.Errorf("could not get pull secret: %w", err)
 	}
 
-	return creator, creator.createSecretSpecFromBytes(pullSecretBytes), nil
+	return s.createSecretSpecFromBytes(pullSecretBytes, expires), nil
 }
 
 // Options for a long-lived image pull secret attached to a service account
@@ -79,6 +124,9 @@ type LongLivedSecretOpts struct {
 	Lifetime string
 	// The secret metadata to use for creating the secret.
 	Secret metav1.ObjectMeta
+	// Exclude the secret from RotateLongLivedPullSecrets so that it expires
+	// with its token, e.g., because it only grants temporary access.
+	DisableRotation bool
 }
 
 // Validates a provided metav1.ObjectMeta object to ensure that the namespace
@@ -120,14 +168,21 @@ func (l *LongLivedSecretOpts) validateOpts() error {
 // basis; even if they were just created.
 type secretCreator struct {
 	LongLivedSecretOpts
-	cs *framework.ClientSet
+	core       corev1client.CoreV1Interface
+	images     configv1client.ImagesGetter
+	routes     routev1client.RoutesGetter
+	restConfig *rest.Config
+	// Creates the client used to validate the token. This is replaced in tests
+	// since the token cannot be validated without a real API server.
+	newAuthClient func(*rest.Config) (authv1client.SelfSubjectReviewsGetter, error)
 }
 
-// Creates an authentication token for a given service account in a given namespace.
-func (s *secretCreator) createToken(ctx context.Context) (string, error) {
+// Creates an authentication token for a given service account in a given
+// namespace. Returns the token and when it expires.
+func (s *secretCreator) createToken(ctx context.Context) (string, time.Time, error) {
 	parsed, err := time.ParseDuration(s.Lifetime)
 	if err != nil {
-		return "", fmt.Errorf("could not parse lifetime %q: %w", s.Lifetime, err)
+		return "", time.Time{}, fmt.Errorf("could not parse lifetime %q: %w", s.Lifetime, err)
 	}
 
 	// Note: parsed.Seconds() returns a float64 that we cast to an int64. It's
@@ -142,19 +197,28 @@ func (s *secretCreator) createToken(ctx context.Context) (string, error) {
 		},
 	}
 
-	resp, err := s.cs.CoreV1Interface.ServiceAccounts(s.ServiceAccount.Namespace).CreateToken(ctx, s.ServiceAccount.Name, req, metav1.CreateOptions{})
+	requested := time.Now()
+
+	resp, err := s.core.ServiceAccounts(s.ServiceAccount.Namespace).CreateToken(ctx, s.ServiceAccount.Name, req, metav1.CreateOptions{})
 	if err != nil {
-		return "", fmt.Errorf("could not create token for service account %q in namespace %q: %w", s.ServiceAccount.Name, s.ServiceAccount.Namespace, err)
+		return "", time.Time{}, fmt.Errorf("could not create token for service account %q in namespace %q: %w", s.ServiceAccount.Name, s.ServiceAccount.Namespace, err)
 	}
 
-	return resp.Status.Token, nil
+	// The API server may shorten the requested lifetime, so prefer the
+	// expiration it reports.
+	expires := resp.Status.ExpirationTimestamp.Time
+	if expires.IsZero() {
+		expires = requested.Add(parsed)
+	}
+
+	return resp.Status.Token, expires, nil
 }
 
 // Gets the REST Config from the provided framework.ClientSet instance and
 // configures it to use the newly created token and the provided service
 // account.
 func (s *secretCreator) getRESTConfigForToken(ctx context.Context, token string) (*rest.Config, error) {
-	defaultCfg := s.cs.GetRestConfig()
+	defaultCfg := s.restConfig
 
 	cfg := &rest.Config{
 		Host:            defaultCfg.Host,
@@ -183,7 +247,10 @@ func (s *secretCreator) getFullyQualifiedServiceAccountUsername() string {
 // correctly. This essentially performs the same thing as $ oc whoami except
 // that it verifies the returned data.
 func (s *secretCreator) testRESTConfig(ctx context.Context, cfg *rest.Config) error {
-	authclient := authv1client.NewForConfigOrDie(cfg)
+	authclient, err := s.newAuthClient(cfg)
+	if err != nil {
+		return fmt.Errorf("could not create authentication client: %w", err)
+	}
 
 	ssr := &authv1.SelfSubjectReview{}
 
@@ -200,140 +267,110 @@ func (s *secretCreator) testRESTConfig(ctx context.Context, cfg *rest.Config) er
 	return nil
 }
 
-// Writes the given REST Config to the given filename in a format that is
-// usable as a KUBECONFIG.
-func (s *secretCreator) writeRESTConfigToFile(cfg *rest.Config, filename string) error {
-	// Adapted from: https://github.com/kubernetes/client-go/issues/711#issuecomment-730112049
-	clusterName := "default-cluster"
-	contextName := "default-context"
-
-	clientConfig := clientcmdapi.Config{
-		Kind:       "Config",
-		APIVersion: "v1",
-		Clusters: map[string]*clientcmdapi.Cluster{
-			clusterName: {
-				Server:                   cfg.Host,
-				CertificateAuthorityData: cfg.CAData,
-			},
-		},
-		Contexts: map[string]*clientcmdapi.Context{
-			contextName: {
-				Cluster:   clusterName,
-				Namespace: s.ServiceAccount.Namespace,
-				AuthInfo:  s.ServiceAccount.Namespace,
-			},
-		},
-		CurrentContext: "default-context",
-		AuthInfos: map[string]*clientcmdapi.AuthInfo{
-			s.ServiceAccount.Namespace: {
-				Impersonate: cfg.Impersonate.UserName,
-				Token:       cfg.BearerToken,
-			},
-		},
-	}
-
-	err := clientcmd.WriteToFile(clientConfig, filename)
+// Gets every hostname that the cluster image registry is reachable at. The
+// internal hostname and any external hostnames come from the cluster image
+// config. The hosts of any Routes in the image registry namespace (e.g., the
+// default route or one created by ExposeClusterImageRegistry) are included as
+// well. The internal hostname is always first.
+func (s *secretCreator) getRegistryHostnames(ctx context.Context) ([]string, error) {
+	hostnames := []string{}
 
-	if err == nil {
-		klog.Infof("Wrote temp config to %q", filename)
+	imageConfig, err := s.images.Images().Get(ctx, imageConfigName, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, fmt.Errorf("could not get image config %q: %w", imageConfigName, err)
 	}
 
-	return err
-}
-
-// This takes the given REST Config for the service account and performs the
-// following actions with it to generate an internal image registry pull
-// secret:
-//
-// 1. Writes it to a temporary directory (this dir is cleaned up upon return).
-// 2. The oc login and oc registry login commands consume it via setting the
-// KUBECONFIG env var to point to it.
-// 3. After registry login, the generated pull secret is read and returned.
-//
-// We shell out to oc to perform these steps because it would be a nontrivial
-// amount of work to reproduce / reimplement the oc registry login command.
-func (s *secretCreator) getPullSecretForRESTConfig(ctx context.Context, cfg *rest.Config) ([]byte, error) {
-	tmpdir, err := os.MkdirTemp("", "")
-	if err != nil {
-		return nil, fmt.Errorf("could not create temp directory: %w", err)
+	internal := defaultInternalRegistryHostname
+	if err == nil && imageConfig.Status.InternalRegistryHostname != "" {
+		internal = imageConfig.Status.InternalRegistryHostname
 	}
 
-	defer os.RemoveAll(tmpdir)
-
-	kubeconfigPath := filepath.Join(tmpdir, "kubeconfig")
+	hostnames = append(hostnames, internal)
 
-	if err := s.writeRESTConfigToFile(cfg, kubeconfigPath); err != nil {
-		return nil, fmt.Errorf("could not write REST config to %q: %w", kubeconfigPath, err)
+	if err == nil {
+		hostnames = append(hostnames, imageConfig.Status.ExternalRegistryHostnames...)
 	}
 
-	// If we encounter an error, we should scrub the bearer token from any
-	// output.
-	redactSensitiveInfo := func(in string) string {
-		toReplace := []string{
-			cfg.BearerToken,
+	routes, err := s.routes.Routes(imageRegistryNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		// The Route API may not be available or we may not be allowed to list
+		// Routes. Neither prevents use of the internal hostname.
+		klog.Warningf("Could not list Routes in namespace %q, only using image config hostnames: %s", imageRegistryNamespace, err)
+	} else {
+		for _, route := range routes.Items {
+			if route.Spec.Host != "" {
+				hostnames = append(hostnames, route.Spec.Host)
+			}
 		}
+	}
 
-		for _, item := range toReplace {
-			in = strings.ReplaceAll(in, item, "---REDACTED---")
-		}
+	out := []string{}
+	seen := map[string]bool{}
 
-		return in
+	for _, hostname := range hostnames {
+		if !seen[hostname] {
+			seen[hostname] = true
+			out = append(out, hostname)
+		}
 	}
 
-	// Runs the given command and returns its combined output in the form of a string.
-	runCmdWithOutput := func(name string, args ...string) (string, error) {
-		cmd := exec.CommandContext(ctx, name, args...)
-		// Ensure that we use the KUBECONFIG we wrote to our temp dir instead of
-		// the value inherited by this process.
-		cmd.Env = append(cmd.Env, fmt.Sprintf("KUBECONFIG=%s", kubeconfigPath))
+	klog.Infof("Generating pull secret for image registry hostname(s): %v", out)
 
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return "", fmt.Errorf("could not run %q, got %q: %w", redactSensitiveInfo(cmd.String()), redactSensitiveInfo(string(output)), err)
-		}
+	return out, nil
+}
 
-		return string(output), nil
+// Builds a .dockerconfigjson with an entry for each of the given hostnames
+// using the service account token as the password. This is equivalent to what
+// "oc registry login" writes. The image registry ignores the username and only
+// validates the token, so the same "serviceaccount" username that OpenShift
+// uses for its own service account pull secrets is used.
+func buildDockerConfigJSONForToken(hostnames []string, token string) ([]byte, error) {
+	if len(hostnames) == 0 {
+		return nil, fmt.Errorf("no image registry hostnames given")
 	}
 
-	// Runs the given command but does not return any output.
-	runCmd := func(name string, args ...string) error {
-		_, err := runCmdWithOutput(name, args...)
-		return err
+	if token == "" {
+		return nil, fmt.Errorf("empty token")
 	}
 
-	// Run: "$ oc login --token=<token> --server=<hostname>"
-	if err := runCmd("oc", "login", "--token", cfg.BearerToken, "--server", cfg.Host); err != nil {
-		return nil, fmt.Errorf("could not log in: %w", err)
+	type dockerAuth struct {
+		Auth string `json:"auth"`
 	}
 
-	// Run: "$ oc whoami"
-	// Not strictly required, but provides a good sanity check.
-	whoami, err := runCmdWithOutput("oc", "whoami")
-	if err != nil {
-		return nil, fmt.Errorf("could not run oc whoami: %w", err)
+	type dockerConfigJSON struct {
+		Auths map[string]dockerAuth `json:"auths"`
 	}
 
-	// Validate that the fully qualified service account name is present in the output.
-	username := s.getFullyQualifiedServiceAccountUsername()
-	if !strings.Contains(whoami, username) {
-		return nil, fmt.Errorf("expected oc whoami to return %q, got %q", username, whoami)
-	}
+	auth := base64.StdEncoding.EncodeToString([]byte(registryUsername + ":" + token))
 
-	pullsecretPath := filepath.Join(tmpdir, "config.json")
+	out := dockerConfigJSON{
+		Auths: map[string]dockerAuth{},
+	}
 
-	// Run: "$ oc registry login --to=<path to target file in temp dir>"
-	if err := runCmd("oc", "registry", "login", "--to", pullsecretPath); err != nil {
-		return nil, fmt.Errorf("could not registry login: %w", err)
+	for _, hostname := range hostnames {
+		out.Auths[hostname] = dockerAuth{Auth: auth}
 	}
 
-	// Read the temp file containing the image pull secret bytes.
-	return os.ReadFile(pullsecretPath)
+	return json.Marshal(out)
 }
 
-// Instantiates the secret spec from the provided bytes.
-func (s *secretCreator) createSecretSpecFromBytes(secretBytes []byte) *corev1.Secret {
+// Instantiates the secret spec from the provided bytes. The secret is labeled
+// and annotated with everything RotateLongLivedPullSecrets needs to re-create
+// it before the token expires.
+func (s *secretCreator) createSecretSpecFromBytes(secretBytes []byte, expires time.Time) *corev1.Secret {
+	meta := *s.Secret.DeepCopy()
+
+	metav1.SetMetaDataLabel(&meta, LongLivedPullSecretLabelKey, "")
+	metav1.SetMetaDataAnnotation(&meta, LongLivedPullSecretExpiryAnnotationKey, expires.UTC().Format(time.RFC3339))
+	metav1.SetMetaDataAnnotation(&meta, longLivedPullSecretServiceAccountAnnotationKey, fmt.Sprintf("%s/%s", s.ServiceAccount.Namespace, s.ServiceAccount.Name))
+	metav1.SetMetaDataAnnotation(&meta, longLivedPullSecretLifetimeAnnotationKey, s.Lifetime)
+
+	if s.DisableRotation {
+		metav1.SetMetaDataLabel(&meta, longLivedPullSecretNoRotateLabelKey, "")
+	}
+
 	return &corev1.Secret{
-		ObjectMeta: s.Secret,
+		ObjectMeta: meta,
 		Type:       corev1.SecretTypeDockerConfigJson,
 		Data: map[string][]byte{
 			corev1.DockerConfigJsonKey: secretBytes,
@@ -344,10 +381,10 @@ func (s *secretCreator) createSecretSpecFromBytes(secretBytes []byte) *corev1.Se
 // Creates the secret in the Kube API server, deleting a preexisting one if it
 // exists and the option is set.
 func (s *secretCreator) createSecret(ctx context.Context, secret *corev1.Secret) error {
-	_, err := s.cs.CoreV1Interface.Secrets(s.Secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	_, err := s.core.Secrets(s.Secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
 
 	if k8serrors.IsAlreadyExists(err) && s.DeleteIfExists {
-		if err := s.cs.CoreV1Interface.Secrets(s.Secret.Namespace).Delete(ctx, s.Secret.Name, metav1.DeleteOptions{}); err != nil {
+		if err := s.core.Secrets(s.Secret.Namespace).Delete(ctx, s.Secret.Name, metav1.DeleteOptions{}); err != nil {
 			return err
 		}
 
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	configv1 "github.com/openshift/api/config/v1"
+	routev1 "github.com/openshift/api/route/v1"
+	fakeconfig "github.com/openshift/client-go/config/clientset/versioned/fake"
+	fakeroute "github.com/openshift/client-go/route/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	authv1client "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	"k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+const testToken string = "service-account-token"
+
+func TestCreateLongLivedPullSecret(t *testing.T) {
+	t.Parallel()
+
+	imageConfig := &configv1.Image{
+		ObjectMeta: metav1.ObjectMeta{Name: imageConfigName},
+		Status: configv1.ImageStatus{
+			InternalRegistryHostname:  "image-registry.openshift-image-registry.svc:5000",
+			ExternalRegistryHostnames: []string{"registry.example.com"},
+		},
+	}
+
+	defaultRoute := &routev1.Route{
+		ObjectMeta: metav1.ObjectMeta{Name: "default-route", Namespace: imageRegistryNamespace},
+		Spec:       routev1.RouteSpec{Host: "default-route-openshift-image-registry.apps.example.com"},
+	}
+
+	// Same host as the external hostname; should not be duplicated.
+	duplicateRoute := &routev1.Route{
+		ObjectMeta: metav1.ObjectMeta{Name: "duplicate", Namespace: imageRegistryNamespace},
+		Spec:       routev1.RouteSpec{Host: "registry.example.com"},
+	}
+
+	testCases := []struct {
+		name              string
+		configObjects     []runtime.Object
+		routeObjects      []runtime.Object
+		username          string
+		expectedHostnames []string
+		errExpected       bool
+	}{
+		{
+			name:          "Image config and Routes",
+			configObjects: []runtime.Object{imageConfig},
+			routeObjects:  []runtime.Object{defaultRoute, duplicateRoute},
+			username:      "system:serviceaccount:test-ns:builder",
+			expectedHostnames: []string{
+				"image-registry.openshift-image-registry.svc:5000",
+				"registry.example.com",
+				"default-route-openshift-image-registry.apps.example.com",
+			},
+		},
+		{
+			name:              "No image config or Routes",
+			username:          "system:serviceaccount:test-ns:builder",
+			expectedHostnames: []string{defaultInternalRegistryHostname},
+		},
+		{
+			name:        "Token for wrong user",
+			username:    "system:serviceaccount:other-ns:builder",
+			errExpected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+
+			kubeclient := newFakeKubeClientForToken(testCase.username)
+
+			s := &secretCreator{
+				LongLivedSecretOpts: LongLivedSecretOpts{
+					ServiceAccount: metav1.ObjectMeta{Name: "builder", Namespace: "test-ns"},
+					Secret:         metav1.ObjectMeta{Name: "long-lived", Namespace: "test-ns"},
+					Lifetime:       "24h",
+				},
+				core:       kubeclient.CoreV1(),
+				images:     fakeconfig.NewSimpleClientset(testCase.configObjects...).ConfigV1(),
+				routes:     fakeroute.NewSimpleClientset(testCase.routeObjects...).RouteV1(),
+				restConfig: &rest.Config{Host: "https://api.example.com:6443"},
+				newAuthClient: func(_ *rest.Config) (authv1client.SelfSubjectReviewsGetter, error) {
+					return kubeclient.AuthenticationV1(), nil
+				},
+			}
+
+			require.NoError(t, s.validateOpts())
+
+			secret, err := s.createSecretSpec(ctx)
+			if testCase.errExpected {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, s.createSecret(ctx, secret))
+
+			created, err := kubeclient.CoreV1().Secrets("test-ns").Get(ctx, "long-lived", metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, corev1.SecretTypeDockerConfigJson, created.Type)
+
+			decoded := struct {
+				Auths map[string]struct {
+					Auth string `json:"auth"`
+				} `json:"auths"`
+			}{}
+
+			require.NoError(t, json.Unmarshal(created.Data[corev1.DockerConfigJsonKey], &decoded))
+
+			hostnames := []string{}
+			for hostname, auth := range decoded.Auths {
+				hostnames = append(hostnames, hostname)
+
+				creds, err := base64.StdEncoding.DecodeString(auth.Auth)
+				require.NoError(t, err)
+				assert.Equal(t, registryUsername+":"+testToken, string(creds))
+			}
+
+			assert.ElementsMatch(t, testCase.expectedHostnames, hostnames)
+		})
+	}
+}
+
+func TestBuildDockerConfigJSONForToken(t *testing.T) {
+	t.Parallel()
+
+	out, err := buildDockerConfigJSONForToken([]string{"registry.example.com"}, "token")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths":{"registry.example.com":{"auth":"c2VydmljZWFjY291bnQ6dG9rZW4="}}}`, string(out))
+
+	_, err = buildDockerConfigJSONForToken(nil, "token")
+	assert.Error(t, err)
+
+	_, err = buildDockerConfigJSONForToken([]string{"registry.example.com"}, "")
+	assert.Error(t, err)
+}
+
+// Creates a fake Kubernetes client which issues testToken for service account
+// token requests and reports the given username for SelfSubjectReviews.
+func newFakeKubeClientForToken(username string) *fakekube.Clientset {
+	kubeclient := fakekube.NewSimpleClientset()
+
+	kubeclient.PrependReactor("create", "serviceaccounts", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+
+		return true, &authv1.TokenRequest{Status: authv1.TokenRequestStatus{Token: testToken}}, nil
+	})
+
+	kubeclient.PrependReactor("create", "selfsubjectreviews", func(_ clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &authv1.SelfSubjectReview{
+			Status: authv1.SelfSubjectReviewStatus{
+				UserInfo: authv1.UserInfo{Username: username},
+			},
+		}, nil
+	})
+
+	return kubeclient
+}
@@ -0,0 +1,381 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	mcfgclientset "github.com/openshift/client-go/machineconfiguration/clientset/versioned"
+	mcfgv1client "github.com/openshift/client-go/machineconfiguration/clientset/versioned/typed/machineconfiguration/v1"
+	mcfginformers "github.com/openshift/client-go/machineconfiguration/informers/externalversions"
+	mcfglistersv1 "github.com/openshift/client-go/machineconfiguration/listers/machineconfiguration/v1"
+	buildconstants "github.com/openshift/machine-config-operator/pkg/controller/build/constants"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/test/framework"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The names of the informer indexes used by the cached MachineOSBuildQuery.
+const (
+	moscByPoolIndex string = "byMachineConfigPool"
+	mosbByMOSCIndex string = "byMachineOSConfig"
+)
+
+// Provides the MachineOSConfigs and MachineOSBuilds that a
+// MachineOSBuildQuery operates on. This is either backed by the API server
+// directly or by an informer cache.
+type machineOSBuildSource interface {
+	getMachineOSConfigsForPool(ctx context.Context, poolName string) ([]*mcfgv1.MachineOSConfig, error)
+	getMachineOSBuildsForMachineOSConfig(ctx context.Context, moscName string) ([]*mcfgv1.MachineOSBuild, error)
+}
+
+// Answers questions about which MachineOSBuilds belong to a given
+// MachineConfigPool. MachineOSBuilds are associated with a pool through the
+// MachineOSConfig that owns them, which is determined by the MachineOSConfig
+// name label that the BuildController adds to each MachineOSBuild, falling
+// back to the MachineOSConfig reference in the MachineOSBuild spec.
+type MachineOSBuildQuery struct {
+	source machineOSBuildSource
+}
+
+// Creates a MachineOSBuildQuery which queries the API server on each call.
+// This is best for one-off lookups.
+func NewMachineOSBuildQuery(cs *framework.ClientSet) *MachineOSBuildQuery {
+	return newMachineOSBuildQueryForClient(cs.MachineconfigurationV1Interface)
+}
+
+func newMachineOSBuildQueryForClient(client mcfgv1client.MachineconfigurationV1Interface) *MachineOSBuildQuery {
+	return &MachineOSBuildQuery{
+		source: &apiMachineOSBuildSource{client: client},
+	}
+}
+
+// Creates a MachineOSBuildQuery which is backed by indexed informers. This is
+// best for callers which query repeatedly, such as when waiting for a build
+// to complete. The informers stop when the given context is canceled.
+func NewCachedMachineOSBuildQuery(ctx context.Context, cs *framework.ClientSet) (*MachineOSBuildQuery, error) {
+	mcfgclient := cs.GetMcfgclient()
+	if mcfgclient == nil {
+		return nil, fmt.Errorf("ClientSet is missing the MachineConfig clientset needed to start informers")
+	}
+
+	return newCachedMachineOSBuildQueryForClient(ctx, mcfgclient)
+}
+
+func newCachedMachineOSBuildQueryForClient(ctx context.Context, mcfgclient mcfgclientset.Interface) (*MachineOSBuildQuery, error) {
+	source, err := newCachedMachineOSBuildSource(ctx, mcfgclient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MachineOSBuildQuery{source: source}, nil
+}
+
+// Creates a MachineOSBuildQuery which is backed by the given listers. This is
+// for callers which already run MachineOSConfig and MachineOSBuild informers
+// for other purposes and should not start a second set.
+func NewMachineOSBuildQueryForListers(moscLister mcfglistersv1.MachineOSConfigLister, mosbLister mcfglistersv1.MachineOSBuildLister) *MachineOSBuildQuery {
+	return &MachineOSBuildQuery{
+		source: &listerMachineOSBuildSource{
+			moscLister: moscLister,
+			mosbLister: mosbLister,
+		},
+	}
+}
+
+// Gets the MachineOSConfig for the given MachineConfigPool name.
+func (q *MachineOSBuildQuery) GetMachineOSConfigForPool(ctx context.Context, poolName string) (*mcfgv1.MachineOSConfig, error) {
+	moscs, err := q.source.getMachineOSConfigsForPool(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(moscs) == 0 {
+		return nil, newNotFoundErr("machineosconfigs", poolName)
+	}
+
+	if len(moscs) > 1 {
+		return nil, fmt.Errorf("expected one MachineOSConfig for MachineConfigPool %s, found %d", poolName, len(moscs))
+	}
+
+	return moscs[0], nil
+}
+
+// Gets the MachineOSBuilds owned by the given MachineOSConfig, ordered from
+// oldest to newest.
+func (q *MachineOSBuildQuery) GetMachineOSBuildsForMachineOSConfig(ctx context.Context, moscName string) ([]*mcfgv1.MachineOSBuild, error) {
+	mosbs, err := q.source.getMachineOSBuildsForMachineOSConfig(ctx, moscName)
+	if err != nil {
+		return nil, err
+	}
+
+	sortMachineOSBuildsByCreation(mosbs)
+
+	return mosbs, nil
+}
+
+// Gets the MachineOSBuilds owned by the MachineOSConfig for the given
+// MachineConfigPool name, ordered from oldest to newest.
+func (q *MachineOSBuildQuery) GetMachineOSBuildsForPool(ctx context.Context, poolName string) ([]*mcfgv1.MachineOSBuild, error) {
+	mosc, err := q.GetMachineOSConfigForPool(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.GetMachineOSBuildsForMachineOSConfig(ctx, mosc.Name)
+}
+
+// Gets the MachineOSBuild for the pool's current rendered MachineConfig. If
+// the MachineOSConfig's current build annotation names a build for that
+// rendered MachineConfig, that build is returned. Otherwise, the newest build
+// for that rendered MachineConfig is returned so that a retried build is
+// preferred over the stale failed one it replaced.
+func (q *MachineOSBuildQuery) GetCurrentMachineOSBuildForPool(ctx context.Context, mcp *mcfgv1.MachineConfigPool) (*mcfgv1.MachineOSBuild, error) {
+	mosc, err := q.GetMachineOSConfigForPool(ctx, mcp.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	mosbs, err := q.GetMachineOSBuildsForMachineOSConfig(ctx, mosc.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	currentName := mosc.Annotations[buildconstants.CurrentMachineOSBuildAnnotationKey]
+
+	var newest *mcfgv1.MachineOSBuild
+
+	for _, mosb := range mosbs {
+		if mosb.Spec.MachineConfig.Name != mcp.Spec.Configuration.Name {
+			continue
+		}
+
+		if mosb.Name == currentName {
+			return mosb, nil
+		}
+
+		newest = mosb
+	}
+
+	if newest == nil {
+		return nil, newNotFoundErr("machineosbuilds", mcp.Name)
+	}
+
+	return newest, nil
+}
+
+// Gets the newest successful MachineOSBuild for the given MachineConfigPool
+// name, regardless of which rendered MachineConfig it was built for.
+func (q *MachineOSBuildQuery) GetLatestSuccessfulMachineOSBuildForPool(ctx context.Context, poolName string) (*mcfgv1.MachineOSBuild, error) {
+	mosbs, err := q.GetMachineOSBuildsForPool(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(mosbs) - 1; i >= 0; i-- {
+		if ctrlcommon.NewMachineOSBuildState(mosbs[i]).IsBuildSuccess() {
+			return mosbs[i], nil
+		}
+	}
+
+	return nil, newNotFoundErr("machineosbuilds", poolName)
+}
+
+// Gets the name of the MachineOSConfig which owns the given MachineOSBuild.
+// The label set by the BuildController takes precedence over the spec.
+func getMachineOSConfigNameForBuild(mosb *mcfgv1.MachineOSBuild) string {
+	if name, ok := mosb.Labels[buildconstants.MachineOSConfigNameLabelKey]; ok && name != "" {
+		return name
+	}
+
+	return mosb.Spec.MachineOSConfig.Name
+}
+
+// Sorts the given MachineOSBuilds from oldest to newest. Builds created in
+// the same second are ordered by name so that the order is stable.
+func sortMachineOSBuildsByCreation(mosbs []*mcfgv1.MachineOSBuild) {
+	sort.SliceStable(mosbs, func(i, j int) bool {
+		iTime := mosbs[i].CreationTimestamp
+		jTime := mosbs[j].CreationTimestamp
+
+		if !iTime.Equal(&jTime) {
+			return iTime.Before(&jTime)
+		}
+
+		return mosbs[i].Name < mosbs[j].Name
+	})
+}
+
+// Queries the API server directly.
+type apiMachineOSBuildSource struct {
+	client mcfgv1client.MachineconfigurationV1Interface
+}
+
+func (a *apiMachineOSBuildSource) getMachineOSConfigsForPool(ctx context.Context, poolName string) ([]*mcfgv1.MachineOSConfig, error) {
+	moscList, err := a.client.MachineOSConfigs().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineOSConfigs: %w", err)
+	}
+
+	out := []*mcfgv1.MachineOSConfig{}
+
+	for i := range moscList.Items {
+		if moscList.Items[i].Spec.MachineConfigPool.Name == poolName {
+			out = append(out, &moscList.Items[i])
+		}
+	}
+
+	return out, nil
+}
+
+func (a *apiMachineOSBuildSource) getMachineOSBuildsForMachineOSConfig(ctx context.Context, moscName string) ([]*mcfgv1.MachineOSBuild, error) {
+	mosbList, err := a.client.MachineOSBuilds().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineOSBuilds: %w", err)
+	}
+
+	out := []*mcfgv1.MachineOSBuild{}
+
+	for i := range mosbList.Items {
+		if getMachineOSConfigNameForBuild(&mosbList.Items[i]) == moscName {
+			out = append(out, &mosbList.Items[i])
+		}
+	}
+
+	return out, nil
+}
+
+// Queries indexed informer caches. Objects returned from the cache are
+// deep-copied so that callers may safely mutate them.
+type cachedMachineOSBuildSource struct {
+	moscIndexer cache.Indexer
+	mosbIndexer cache.Indexer
+}
+
+// Starts the MachineOSConfig and MachineOSBuild informers with their indexes
+// and waits for their caches to sync.
+func newCachedMachineOSBuildSource(ctx context.Context, mcfgclient mcfgclientset.Interface) (*cachedMachineOSBuildSource, error) {
+	factory := mcfginformers.NewSharedInformerFactory(mcfgclient, 0)
+
+	moscInformer := factory.Machineconfiguration().V1().MachineOSConfigs().Informer()
+	mosbInformer := factory.Machineconfiguration().V1().MachineOSBuilds().Informer()
+
+	err := moscInformer.AddIndexers(cache.Indexers{
+		moscByPoolIndex: func(obj interface{}) ([]string, error) {
+			mosc, ok := obj.(*mcfgv1.MachineOSConfig)
+			if !ok {
+				return nil, nil
+			}
+
+			return []string{mosc.Spec.MachineConfigPool.Name}, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not add MachineOSConfig indexers: %w", err)
+	}
+
+	err = mosbInformer.AddIndexers(cache.Indexers{
+		mosbByMOSCIndex: func(obj interface{}) ([]string, error) {
+			mosb, ok := obj.(*mcfgv1.MachineOSBuild)
+			if !ok {
+				return nil, nil
+			}
+
+			return []string{getMachineOSConfigNameForBuild(mosb)}, nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not add MachineOSBuild indexers: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("could not sync informer cache for %s: %w", informerType, ctx.Err())
+		}
+	}
+
+	return &cachedMachineOSBuildSource{
+		moscIndexer: moscInformer.GetIndexer(),
+		mosbIndexer: mosbInformer.GetIndexer(),
+	}, nil
+}
+
+func (c *cachedMachineOSBuildSource) getMachineOSConfigsForPool(_ context.Context, poolName string) ([]*mcfgv1.MachineOSConfig, error) {
+	objs, err := c.moscIndexer.ByIndex(moscByPoolIndex, poolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get MachineOSConfigs for MachineConfigPool %s from cache: %w", poolName, err)
+	}
+
+	out := []*mcfgv1.MachineOSConfig{}
+
+	for _, obj := range objs {
+		if mosc, ok := obj.(*mcfgv1.MachineOSConfig); ok {
+			out = append(out, mosc.DeepCopy())
+		}
+	}
+
+	return out, nil
+}
+
+func (c *cachedMachineOSBuildSource) getMachineOSBuildsForMachineOSConfig(_ context.Context, moscName string) ([]*mcfgv1.MachineOSBuild, error) {
+	objs, err := c.mosbIndexer.ByIndex(mosbByMOSCIndex, moscName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get MachineOSBuilds for MachineOSConfig %s from cache: %w", moscName, err)
+	}
+
+	out := []*mcfgv1.MachineOSBuild{}
+
+	for _, obj := range objs {
+		if mosb, ok := obj.(*mcfgv1.MachineOSBuild); ok {
+			out = append(out, mosb.DeepCopy())
+		}
+	}
+
+	return out, nil
+}
+
+// Queries caller-provided listers. Objects returned from the listers are
+// deep-copied so that callers may safely mutate them.
+type listerMachineOSBuildSource struct {
+	moscLister mcfglistersv1.MachineOSConfigLister
+	mosbLister mcfglistersv1.MachineOSBuildLister
+}
+
+func (l *listerMachineOSBuildSource) getMachineOSConfigsForPool(_ context.Context, poolName string) ([]*mcfgv1.MachineOSConfig, error) {
+	moscs, err := l.moscLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineOSConfigs: %w", err)
+	}
+
+	out := []*mcfgv1.MachineOSConfig{}
+
+	for _, mosc := range moscs {
+		if mosc.Spec.MachineConfigPool.Name == poolName {
+			out = append(out, mosc.DeepCopy())
+		}
+	}
+
+	return out, nil
+}
+
+func (l *listerMachineOSBuildSource) getMachineOSBuildsForMachineOSConfig(_ context.Context, moscName string) ([]*mcfgv1.MachineOSBuild, error) {
+	mosbs, err := l.mosbLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineOSBuilds: %w", err)
+	}
+
+	out := []*mcfgv1.MachineOSBuild{}
+
+	for _, mosb := range mosbs {
+		if getMachineOSConfigNameForBuild(mosb) == moscName {
+			out = append(out, mosb.DeepCopy())
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	fakemcfg "github.com/openshift/client-go/machineconfiguration/clientset/versioned/fake"
+	mcfginformers "github.com/openshift/client-go/machineconfiguration/informers/externalversions"
+	buildconstants "github.com/openshift/machine-config-operator/pkg/controller/build/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMachineOSBuildQuery(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	mosc := newMachineOSConfig("worker", "worker", "")
+	currentMOSC := newMachineOSConfig("worker", "worker", "worker-retried")
+
+	// The failed build is newer than the successful one for an older rendered
+	// config, but older than the retry for the same rendered config.
+	oldSuccess := newMachineOSBuild("worker-old", "worker", "rendered-worker-1", now.Add(-time.Hour), mcfgv1.MachineOSBuildSucceeded)
+	failed := newMachineOSBuild("worker-failed", "worker", "rendered-worker-2", now.Add(-time.Minute*30), mcfgv1.MachineOSBuildFailed)
+	retried := newMachineOSBuild("worker-retried", "worker", "rendered-worker-2", now.Add(-time.Minute*10), mcfgv1.MachineOSBuilding)
+
+	// Owned through the spec reference only, not the label.
+	specOnly := newMachineOSBuild("worker-spec-only", "worker", "rendered-worker-0", now.Add(-time.Hour*2), mcfgv1.MachineOSBuildSucceeded)
+	delete(specOnly.Labels, buildconstants.MachineOSConfigNameLabelKey)
+
+	// Belongs to a different MachineOSConfig even though it targets the same
+	// rendered config.
+	otherMOSC := newMachineOSConfig("infra", "infra", "")
+	otherPool := newMachineOSBuild("infra-build", "infra", "rendered-worker-2", now, mcfgv1.MachineOSBuildSucceeded)
+
+	mcp := &mcfgv1.MachineConfigPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker"},
+		Spec: mcfgv1.MachineConfigPoolSpec{
+			Configuration: mcfgv1.MachineConfigPoolStatusConfiguration{
+				ObjectReference: corev1.ObjectReference{Name: "rendered-worker-2"},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		objects         []runtime.Object
+		expectedCurrent string
+	}{
+		{
+			name:            "Newest build for the rendered config is preferred",
+			objects:         []runtime.Object{mosc, otherMOSC, oldSuccess, failed, retried, specOnly, otherPool},
+			expectedCurrent: "worker-retried",
+		},
+		{
+			name:            "Current build annotation is preferred",
+			objects:         []runtime.Object{newMachineOSConfig("worker", "worker", "worker-failed"), otherMOSC, oldSuccess, failed, retried, specOnly, otherPool},
+			expectedCurrent: "worker-failed",
+		},
+		{
+			name:            "Current build annotation for another rendered config is ignored",
+			objects:         []runtime.Object{newMachineOSConfig("worker", "worker", "worker-old"), otherMOSC, oldSuccess, failed, retried, specOnly, otherPool},
+			expectedCurrent: "worker-retried",
+		},
+		{
+			name:            "Current build annotation matches",
+			objects:         []runtime.Object{currentMOSC, otherMOSC, oldSuccess, failed, retried, specOnly, otherPool},
+			expectedCurrent: "worker-retried",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+
+			client := fakemcfg.NewSimpleClientset(testCase.objects...)
+
+			cached, err := newCachedMachineOSBuildQueryForClient(ctx, client)
+			require.NoError(t, err)
+
+			factory := mcfginformers.NewSharedInformerFactory(client, 0)
+			moscLister := factory.Machineconfiguration().V1().MachineOSConfigs().Lister()
+			mosbLister := factory.Machineconfiguration().V1().MachineOSBuilds().Lister()
+			factory.Start(ctx.Done())
+			factory.WaitForCacheSync(ctx.Done())
+
+			queries := map[string]*MachineOSBuildQuery{
+				"API":     newMachineOSBuildQueryForClient(client.MachineconfigurationV1()),
+				"Cached":  cached,
+				"Listers": NewMachineOSBuildQueryForListers(moscLister, mosbLister),
+			}
+
+			for name, query := range queries {
+				mosbs, err := query.GetMachineOSBuildsForPool(ctx, "worker")
+				require.NoError(t, err, name)
+				assert.Equal(t, []string{"worker-spec-only", "worker-old", "worker-failed", "worker-retried"}, getMachineOSBuildNames(mosbs), name)
+
+				current, err := query.GetCurrentMachineOSBuildForPool(ctx, mcp)
+				require.NoError(t, err, name)
+				assert.Equal(t, testCase.expectedCurrent, current.Name, name)
+
+				latest, err := query.GetLatestSuccessfulMachineOSBuildForPool(ctx, "worker")
+				require.NoError(t, err, name)
+				assert.Equal(t, "worker-old", latest.Name, name)
+
+				infraBuilds, err := query.GetMachineOSBuildsForMachineOSConfig(ctx, "infra")
+				require.NoError(t, err, name)
+				assert.Equal(t, []string{"infra-build"}, getMachineOSBuildNames(infraBuilds), name)
+			}
+		})
+	}
+}
+
+func TestMachineOSBuildQueryNotFound(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	mcp := &mcfgv1.MachineConfigPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker"},
+		Spec: mcfgv1.MachineConfigPoolSpec{
+			Configuration: mcfgv1.MachineConfigPoolStatusConfiguration{
+				ObjectReference: corev1.ObjectReference{Name: "rendered-worker-3"},
+			},
+		},
+	}
+
+	// No MachineOSConfig at all.
+	query := newMachineOSBuildQueryForClient(fakemcfg.NewSimpleClientset().MachineconfigurationV1())
+
+	_, err := query.GetMachineOSConfigForPool(ctx, "worker")
+	assert.True(t, IsNotFoundErr(err))
+
+	_, err = query.GetCurrentMachineOSBuildForPool(ctx, mcp)
+	assert.True(t, IsNotFoundErr(err))
+
+	// A MachineOSConfig with only a failed build for a different rendered
+	// config.
+	client := fakemcfg.NewSimpleClientset(
+		newMachineOSConfig("worker", "worker", ""),
+		newMachineOSBuild("worker-failed", "worker", "rendered-worker-2", time.Now(), mcfgv1.MachineOSBuildFailed),
+	)
+	query = newMachineOSBuildQueryForClient(client.MachineconfigurationV1())
+
+	_, err = query.GetCurrentMachineOSBuildForPool(ctx, mcp)
+	assert.True(t, IsNotFoundErr(err))
+
+	_, err = query.GetLatestSuccessfulMachineOSBuildForPool(ctx, "worker")
+	assert.True(t, IsNotFoundErr(err))
+
+	// Multiple MachineOSConfigs for the same pool is an error.
+	client = fakemcfg.NewSimpleClientset(
+		newMachineOSConfig("worker", "worker", ""),
+		newMachineOSConfig("worker-2", "worker", ""),
+	)
+	query = newMachineOSBuildQueryForClient(client.MachineconfigurationV1())
+
+	_, err = query.GetMachineOSConfigForPool(ctx, "worker")
+	assert.Error(t, err)
+	assert.False(t, IsNotFoundErr(err))
+}
+
+func newMachineOSConfig(name, poolName, currentBuild string) *mcfgv1.MachineOSConfig {
+	mosc := &mcfgv1.MachineOSConfig{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{},
+		},
+		Spec: mcfgv1.MachineOSConfigSpec{
+			MachineConfigPool: mcfgv1.MachineConfigPoolReference{
+				Name: poolName,
+			},
+		},
+	}
+
+	if currentBuild != "" {
+		mosc.Annotations[buildconstants.CurrentMachineOSBuildAnnotationKey] = currentBuild
+	}
+
+	return mosc
+}
+
+func newMachineOSBuild(name, moscName, renderedConfig string, created time.Time, condType mcfgv1.BuildProgress) *mcfgv1.MachineOSBuild {
+	return &mcfgv1.MachineOSBuild{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+			Labels: map[string]string{
+				buildconstants.MachineOSConfigNameLabelKey: moscName,
+			},
+		},
+		Spec: mcfgv1.MachineOSBuildSpec{
+			MachineConfig: mcfgv1.MachineConfigReference{
+				Name: renderedConfig,
+			},
+			MachineOSConfig: mcfgv1.MachineOSConfigReference{
+				Name: moscName,
+			},
+		},
+		Status: mcfgv1.MachineOSBuildStatus{
+			Conditions: []metav1.Condition{
+				{Type: string(condType), Status: metav1.ConditionTrue},
+			},
+		},
+	}
+}
+
+func getMachineOSBuildNames(mosbs []*mcfgv1.MachineOSBuild) []string {
+	out := []string{}
+
+	for _, mosb := range mosbs {
+		out = append(out, mosb.Name)
+	}
+
+	return out
+}
@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	"github.com/openshift/machine-config-operator/test/framework"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// Marks the MachineConfigPools that were paused by one of these helpers. The
+// value is a JSON-encoded PauseRecord, although pools paused by older
+// versions have an empty value.
+const mcpPausedByHelper string = "machineconfiguration.openshift.io/paused-by-zacks-openshift-helpers"
+
+// Records when and why one of these helpers paused a MachineConfigPool. This
+// is stored on the pool itself so that pools which were left paused by a
+// crashed or interrupted command can be found and unpaused later.
+type PauseRecord struct {
+	// The name of the paused pool. Not stored in the annotation.
+	PoolName string `json:"-"`
+	// Whether the pool is currently paused. Not stored in the annotation.
+	Paused bool `json:"-"`
+	// When the pool was paused. Zero for pools paused by older versions.
+	PausedAt time.Time `json:"pausedAt,omitempty"`
+	// The command which paused the pool (e.g., "mcp-rollout apply").
+	Command string `json:"command,omitempty"`
+	// Why the pool was paused.
+	Reason string `json:"reason,omitempty"`
+}
+
+func (p PauseRecord) String() string {
+	pausedAt := "unknown time"
+	if !p.PausedAt.IsZero() {
+		pausedAt = p.PausedAt.Format(time.RFC3339)
+	}
+
+	command := p.Command
+	if command == "" {
+		command = "unknown command"
+	}
+
+	out := fmt.Sprintf("%s: paused at %s by %s", p.PoolName, pausedAt, command)
+
+	if p.Reason != "" {
+		out = fmt.Sprintf("%s (%s)", out, p.Reason)
+	}
+
+	if !p.Paused {
+		out = fmt.Sprintf("%s, no longer paused", out)
+	}
+
+	return out
+}
+
+// Gets the PauseRecord for the given MachineConfigPool. Returns false if the
+// pool was not paused by one of these helpers.
+func GetPauseRecord(mcp *mcfgv1.MachineConfigPool) (*PauseRecord, bool) {
+	value, ok := mcp.Annotations[mcpPausedByHelper]
+	if !ok {
+		return nil, false
+	}
+
+	record := &PauseRecord{}
+
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), record); err != nil {
+			klog.Warningf("Could not parse annotation %q on MachineConfigPool %s: %s", mcpPausedByHelper, mcp.Name, err)
+			record = &PauseRecord{}
+		}
+	}
+
+	record.PoolName = mcp.Name
+	record.Paused = mcp.Spec.Paused
+
+	return record, true
+}
+
+// Gets the name of the currently running command and its subcommands, e.g.,
+// "mcp-rollout apply".
+func getInvokingCommand() string {
+	parts := []string{filepath.Base(os.Args[0])}
+
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		parts = append(parts, arg)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func PauseMachineConfigPool(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+	return PauseMachineConfigPoolWithReason(ctx, cs, poolName, "")
+}
+
+// Pauses the given MachineConfigPool and records when, why, and by which
+// command it was paused.
+func PauseMachineConfigPoolWithReason(ctx context.Context, cs *framework.ClientSet, poolName, reason string) error {
+	record := PauseRecord{
+		PausedAt: time.Now().UTC(),
+		Command:  getInvokingCommand(),
+		Reason:   reason,
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not encode pause record for MachineConfigPool %s: %w", poolName, err)
+	}
+
+	klog.Infof("Pausing MachineConfigPool %s", poolName)
+
+	return updateMachineConfigPoolPauseState(ctx, cs, poolName, func(mcp *mcfgv1.MachineConfigPool) bool {
+		metav1.SetMetaDataAnnotation(&mcp.ObjectMeta, mcpPausedByHelper, string(recordBytes))
+		mcp.Spec.Paused = true
+		return true
+	})
+}
+
+func UnpauseMachineConfigPool(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+	klog.Infof("Unpausing MachineConfigPool %s", poolName)
+
+	return updateMachineConfigPoolPauseState(ctx, cs, poolName, func(mcp *mcfgv1.MachineConfigPool) bool {
+		if metav1.HasAnnotation(mcp.ObjectMeta, mcpPausedByHelper) {
+			delete(mcp.Annotations, mcpPausedByHelper)
+		} else {
+			klog.Warningf("MachineConfigPool %q missing annotation %q", mcp.Name, mcpPausedByHelper)
+		}
+
+		mcp.Spec.Paused = false
+		return true
+	})
+}
+
+func UnpauseMachineConfigPoolOnlyIfWePausedIt(ctx context.Context, cs *framework.ClientSet, poolName string) error {
+	return updateMachineConfigPoolPauseState(ctx, cs, poolName, func(mcp *mcfgv1.MachineConfigPool) bool {
+		if !metav1.HasAnnotation(mcp.ObjectMeta, mcpPausedByHelper) {
+			klog.Infof("MachineConfigPool %q missing annotation %q, will not unpause", poolName, mcpPausedByHelper)
+			return false
+		}
+
+		klog.Infof("Unpausing MachineConfigPool %s", poolName)
+		delete(mcp.Annotations, mcpPausedByHelper)
+		mcp.Spec.Paused = false
+		return true
+	})
+}
+
+// Fetches the named MachineConfigPool, applies the given mutation, and
+// updates it, retrying on conflicts. If the mutation returns false, no update
+// is made.
+func updateMachineConfigPoolPauseState(ctx context.Context, cs *framework.ClientSet, poolName string, mutateFunc func(*mcfgv1.MachineConfigPool) bool) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		mcp, err := cs.MachineConfigPools().Get(ctx, poolName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get MachineConfigPool %s: %w", poolName, err)
+		}
+
+		if !mutateFunc(mcp) {
+			return nil
+		}
+
+		_, err = cs.MachineConfigPools().Update(ctx, mcp, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Lists the MachineConfigPools that were paused by one of these helpers,
+// ordered by pool name. Pools which have since been unpaused by something else
+// but still carry the annotation are included so that the annotation can be
+// cleaned up.
+func ListMachineConfigPoolsPausedByUs(ctx context.Context, cs *framework.ClientSet) ([]PauseRecord, error) {
+	mcpList, err := cs.MachineConfigPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list MachineConfigPools: %w", err)
+	}
+
+	out := []PauseRecord{}
+
+	for i := range mcpList.Items {
+		if record, ok := GetPauseRecord(&mcpList.Items[i]); ok {
+			out = append(out, *record)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].PoolName < out[j].PoolName
+	})
+
+	return out, nil
+}
+
+// Options for unpausing MachineConfigPools in bulk.
+type BulkUnpauseOpts struct {
+	// Only unpause these pools. Defaults to every pool paused by these helpers.
+	PoolNames []string
+	// Only unpause pools which were paused at least this long ago. Pools paused
+	// by older versions have no timestamp and are always considered old
+	// enough.
+	OlderThan time.Duration
+	// Report which pools would be unpaused without unpausing them.
+	DryRun bool
+}
+
+// Unpauses the MachineConfigPools which were paused by one of these helpers
+// and returns the records for those that were (or would be) unpaused. Pools
+// which were not paused by these helpers are never unpaused.
+func UnpauseMachineConfigPoolsPausedByUs(ctx context.Context, cs *framework.ClientSet, opts BulkUnpauseOpts) ([]PauseRecord, error) {
+	records, err := ListMachineConfigPoolsPausedByUs(ctx, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for _, poolName := range opts.PoolNames {
+		selected[poolName] = true
+	}
+
+	unpaused := []PauseRecord{}
+	errs := []error{}
+
+	for _, record := range records {
+		if len(selected) != 0 && !selected[record.PoolName] {
+			continue
+		}
+
+		if opts.OlderThan != 0 && !record.PausedAt.IsZero() && time.Since(record.PausedAt) < opts.OlderThan {
+			klog.Infof("Skipping MachineConfigPool %s, paused less than %s ago", record.PoolName, opts.OlderThan)
+			continue
+		}
+
+		if opts.DryRun {
+			klog.Infof("Would unpause MachineConfigPool %s", record.PoolName)
+			unpaused = append(unpaused, record)
+			continue
+		}
+
+		if err := UnpauseMachineConfigPoolOnlyIfWePausedIt(ctx, cs, record.PoolName); err != nil {
+			errs = append(errs, fmt.Errorf("could not unpause MachineConfigPool %s: %w", record.PoolName, err))
+			continue
+		}
+
+		unpaused = append(unpaused, record)
+	}
+
+	return unpaused, errors.Join(errs...)
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/api/machineconfiguration/v1"
+	fakemcfg "github.com/openshift/client-go/machineconfiguration/clientset/versioned/fake"
+	"github.com/openshift/machine-config-operator/test/framework"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestPauseAndUnpauseMachineConfigPool(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	client := fakemcfg.NewSimpleClientset(newPausablePool("worker", false, nil))
+	cs := &framework.ClientSet{MachineconfigurationV1Interface: client.MachineconfigurationV1()}
+
+	// Fail the first update with a conflict to ensure it is retried.
+	conflicts := 0
+	client.PrependReactor("update", "machineconfigpools", func(_ clienttesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			conflicts++
+			return true, nil, apierrs.NewConflict(schema.GroupResource{Resource: "machineconfigpools"}, "worker", nil)
+		}
+
+		return false, nil, nil
+	})
+
+	before := time.Now().UTC()
+	require.NoError(t, PauseMachineConfigPoolWithReason(ctx, cs, "worker", "testing"))
+	assert.Equal(t, 1, conflicts)
+
+	mcp, err := cs.MachineConfigPools().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, mcp.Spec.Paused)
+
+	record, ok := GetPauseRecord(mcp)
+	require.True(t, ok)
+	assert.Equal(t, "worker", record.PoolName)
+	assert.Equal(t, "testing", record.Reason)
+	assert.NotEmpty(t, record.Command)
+	assert.True(t, record.Paused)
+	assert.False(t, record.PausedAt.Before(before.Truncate(time.Second)))
+
+	require.NoError(t, UnpauseMachineConfigPoolOnlyIfWePausedIt(ctx, cs, "worker"))
+
+	mcp, err = cs.MachineConfigPools().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.False(t, mcp.Spec.Paused)
+
+	_, ok = GetPauseRecord(mcp)
+	assert.False(t, ok)
+}
+
+func TestUnpauseMachineConfigPoolsPausedByUs(t *testing.T) {
+	t.Parallel()
+
+	recent := &PauseRecord{PausedAt: time.Now().UTC(), Command: "mcp-rollout apply", Reason: "applying MachineConfigs"}
+	old := &PauseRecord{PausedAt: time.Now().UTC().Add(-2 * time.Hour), Command: "mcp-rollout canary", Reason: "canary rollout"}
+
+	pools := func() []runtime.Object {
+		return []runtime.Object{
+			newPausablePool("recent", true, recent),
+			newPausablePool("old", true, old),
+			// Paused by an older version with an empty annotation value.
+			newPausablePool("legacy", true, &PauseRecord{}),
+			// Paused by someone else.
+			newPausablePool("manual", true, nil),
+			newPausablePool("unpaused", false, nil),
+		}
+	}
+
+	testCases := []struct {
+		name             string
+		opts             BulkUnpauseOpts
+		expectedUnpaused []string
+		expectedPaused   []string
+	}{
+		{
+			name:             "All pools paused by us",
+			expectedUnpaused: []string{"legacy", "old", "recent"},
+			expectedPaused:   []string{"manual"},
+		},
+		{
+			name:             "Older than",
+			opts:             BulkUnpauseOpts{OlderThan: time.Hour},
+			expectedUnpaused: []string{"legacy", "old"},
+			expectedPaused:   []string{"manual", "recent"},
+		},
+		{
+			name:             "Selected pools",
+			opts:             BulkUnpauseOpts{PoolNames: []string{"recent", "manual"}},
+			expectedUnpaused: []string{"recent"},
+			expectedPaused:   []string{"legacy", "manual", "old"},
+		},
+		{
+			name:             "Dry run",
+			opts:             BulkUnpauseOpts{DryRun: true},
+			expectedUnpaused: []string{"legacy", "old", "recent"},
+			expectedPaused:   []string{"legacy", "manual", "old", "recent"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+
+			client := fakemcfg.NewSimpleClientset(pools()...)
+			cs := &framework.ClientSet{MachineconfigurationV1Interface: client.MachineconfigurationV1()}
+
+			records, err := ListMachineConfigPoolsPausedByUs(ctx, cs)
+			require.NoError(t, err)
+			require.Len(t, records, 3)
+			assert.Equal(t, "old: paused at "+old.PausedAt.Format(time.RFC3339)+" by mcp-rollout canary (canary rollout)", records[1].String())
+			assert.Equal(t, "legacy: paused at unknown time by unknown command", records[0].String())
+
+			unpaused, err := UnpauseMachineConfigPoolsPausedByUs(ctx, cs, testCase.opts)
+			require.NoError(t, err)
+
+			unpausedNames := []string{}
+			for _, record := range unpaused {
+				unpausedNames = append(unpausedNames, record.PoolName)
+			}
+
+			assert.Equal(t, testCase.expectedUnpaused, unpausedNames)
+
+			mcpList, err := cs.MachineConfigPools().List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+
+			paused := []string{}
+			for _, mcp := range mcpList.Items {
+				if mcp.Spec.Paused {
+					paused = append(paused, mcp.Name)
+				}
+			}
+
+			assert.ElementsMatch(t, testCase.expectedPaused, paused)
+		})
+	}
+}
+
+// Creates a MachineConfigPool with the given pause state. If record is not
+// nil, the pool is annotated as paused by these helpers. An empty record
+// produces the empty annotation value written by older versions.
+func newPausablePool(name string, paused bool, record *PauseRecord) *mcfgv1.MachineConfigPool {
+	mcp := &mcfgv1.MachineConfigPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: mcfgv1.MachineConfigPoolSpec{
+			Paused: paused,
+		},
+	}
+
+	if record == nil {
+		return mcp
+	}
+
+	value := ""
+	if *record != (PauseRecord{}) {
+		recordBytes, _ := json.Marshal(record)
+		value = string(recordBytes)
+	}
+
+	metav1.SetMetaDataAnnotation(&mcp.ObjectMeta, mcpPausedByHelper, value)
+
+	return mcp
+}